@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ferama/rospo/pkg/conf"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+	checkCmd.Flags().BoolP("print", "p", true, "print the effective configuration")
+	checkCmd.Flags().String("profile", "", "the config profile merged over the config values")
+}
+
+var checkCmd = &cobra.Command{
+	Use:   "check config_file_path.yaml",
+	Short: "Validates a config file without connecting",
+	Long: `Validates a config file without connecting.
+
+The config is parsed, the endpoints validated and the key files checked:
+they must exist and be readable, and the private keys must not be
+accessible by other users. The effective configuration is printed, with
+the templates and the port ranges expanded, the named ssh clients merged
+and the paths expanded. The command exits with a non zero status if
+errors are found.`,
+	Example: `
+  # checks the config and prints the effective one
+  $ rospo check config.yaml
+
+  # checks only
+  $ rospo check --print=false config.yaml
+
+  # checks the config with the staging profile values
+  $ rospo check --profile staging config.yaml
+	`,
+	Args: cobra.MinimumNArgs(1),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) != 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return []string{"yaml"}, cobra.ShellCompDirectiveFilterFileExt
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		profile, _ := cmd.Flags().GetString("profile")
+		cfg, err := conf.LoadConfigProfile(args[0], profile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR %s\n", err)
+			os.Exit(1)
+		}
+		problems := cfg.Check()
+
+		if doPrint, _ := cmd.Flags().GetBool("print"); doPrint {
+			data, err := effectiveConfig(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Print(string(data))
+		}
+
+		errors := 0
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, p)
+			if !p.Warning {
+				errors++
+			}
+		}
+		if errors > 0 {
+			fmt.Fprintf(os.Stderr, "%d errors found\n", errors)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "config ok")
+	},
+}
+
+// effectiveConfig marshals cfg without the unset options
+func effectiveConfig(cfg *conf.Config) ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(cfg); err != nil {
+		return nil, err
+	}
+	pruneEmpty(&node)
+	return yaml.Marshal(&node)
+}
+
+// pruneEmpty removes the mapping entries with a zero value, like "",
+// 0, false, null or an empty list. It returns true if node is empty
+func pruneEmpty(node *yaml.Node) bool {
+	switch node.Kind {
+	case yaml.MappingNode:
+		content := []*yaml.Node{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if !pruneEmpty(node.Content[i+1]) {
+				content = append(content, node.Content[i], node.Content[i+1])
+			}
+		}
+		node.Content = content
+		return len(content) == 0
+	case yaml.SequenceNode:
+		for _, n := range node.Content {
+			pruneEmpty(n)
+		}
+		return len(node.Content) == 0
+	case yaml.ScalarNode:
+		switch node.Value {
+		case "", "0", "false", "null":
+			return node.Style == 0 || node.Value == ""
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package cmnflags
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// AddOutputFlags adds the --json and --format flags of the commands
+// printing a status
+func AddOutputFlags(fs *pflag.FlagSet) {
+	fs.Bool("json", false, "print the output as json")
+	fs.String("format", "", "print the output with a go template, like '{{.Pid}}'")
+}
+
+// outputFuncs are the functions of the --format templates
+var outputFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// PrintOutput prints v as json or with the --format template, if one of
+// them is set, on the cmd output (stdout by default). It returns false
+// otherwise, for cmd to print v its own way.
+// The template fields are the go ones, like {{.Tunnels}}, and the json
+// function prints a value as json: {{json .Connections}}
+func PrintOutput(cmd *cobra.Command, v any) (bool, error) {
+	if format, _ := cmd.Flags().GetString("format"); format != "" {
+		tmpl, err := template.New("format").Funcs(outputFuncs).Parse(format)
+		if err != nil {
+			return true, fmt.Errorf("invalid format: %w", err)
+		}
+		if err := tmpl.Execute(cmd.OutOrStdout(), v); err != nil {
+			return true, err
+		}
+		fmt.Fprintln(cmd.OutOrStdout())
+		return true, nil
+	}
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		return true, enc.Encode(v)
+	}
+	return false, nil
+}
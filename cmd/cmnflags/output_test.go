@@ -0,0 +1,115 @@
+package cmnflags
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ferama/rospo/pkg/control"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/tun"
+	"github.com/spf13/cobra"
+)
+
+func TestPrintOutput(t *testing.T) {
+	tunnels := []control.TunnelStatus{
+		{
+			ID:       1,
+			Name:     "web",
+			Forward:  true,
+			Listener: "127.0.0.1:8080",
+			Endpoint: "127.0.0.1:80",
+			Stats: tun.Stats{
+				AcceptedConnections: 2,
+				BytesIn:             10,
+				BytesOut:            20,
+				Uptime:              time.Second,
+			},
+		},
+	}
+	status := &control.Status{
+		Pid:     42,
+		Version: "dev",
+		Uptime:  time.Minute,
+		Connections: []sshc.ConnectionStatus{
+			{Server: "user@server:22", Status: sshc.STATUS_CONNECTED},
+		},
+		Tunnels: tunnels,
+	}
+
+	cases := []struct {
+		name     string
+		args     []string
+		v        any
+		done     bool
+		expected string
+		err      bool
+	}{
+		{"no flags", nil, status, false, "", false},
+		{"template", []string{"--format", "{{.Pid}} {{.Version}}"}, status, true, "42 dev\n", false},
+		{"json func", []string{"--format", "{{json .Connections}}"}, status, true,
+			`[{"server":"user@server:22","status":"Connected","on_demand":false,"uptime":0}]` + "\n", false},
+		{"invalid template", []string{"--format", "{{.Pid"}, status, true, "", true},
+		{"missing field", []string{"--format", "{{.NoSuchField}}"}, status, true, "", true},
+		{"tun ls json", []string{"--json"}, tunnels, true, `[
+  {
+    "id": 1,
+    "name": "web",
+    "forward": true,
+    "dynamic": false,
+    "paused": false,
+    "listener": "127.0.0.1:8080",
+    "endpoint": "127.0.0.1:80",
+    "stats": {
+      "accepted_connections": 2,
+      "active_connections": 0,
+      "bytes_in": 10,
+      "bytes_out": 20,
+      "last_error": "",
+      "last_error_time": "0001-01-01T00:00:00Z",
+      "uptime": 1000000000
+    }
+  }
+]
+`, false},
+		{"status json", []string{"--json"}, &control.Status{Pid: 42, Version: "dev", Uptime: time.Minute, Connections: status.Connections, Tunnels: []control.TunnelStatus{}}, true, `{
+  "pid": 42,
+  "version": "dev",
+  "uptime": 60000000000,
+  "connections": [
+    {
+      "server": "user@server:22",
+      "status": "Connected",
+      "on_demand": false,
+      "uptime": 0
+    }
+  ],
+  "tunnels": []
+}
+`, false},
+	}
+	for _, c := range cases {
+		cmd := &cobra.Command{}
+		AddOutputFlags(cmd.Flags())
+		if err := cmd.Flags().Parse(c.args); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		cmd.SetOut(&out)
+
+		done, err := PrintOutput(cmd, c.v)
+		if done != c.done {
+			t.Fatalf("%s: expected done %v, got %v", c.name, c.done, done)
+		}
+		if (err != nil) != c.err {
+			t.Fatalf("%s: unexpected error %v", c.name, err)
+		}
+		if !c.err && out.String() != c.expected {
+			t.Fatalf("%s: expected %q, got %q", c.name, c.expected, out.String())
+		}
+		if c.name == "invalid template" && !strings.Contains(err.Error(), "invalid format") {
+			t.Fatalf("%s: unexpected error %s", c.name, err)
+		}
+	}
+}
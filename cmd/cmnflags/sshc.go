@@ -1,6 +1,8 @@
 package cmnflags
 
 import (
+	"fmt"
+	"os"
 	"os/user"
 	"path/filepath"
 
@@ -49,6 +51,11 @@ func GetSshClientConf(cmd *cobra.Command, serverURI string) *sshc.SshClientConf
 			Identity: identity,
 		})
 	}
+	// the ssh:// url options override the flags
+	if err := sshcConf.ApplyURI(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
 	return sshcConf
 }
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/utils"
+	"github.com/pkg/sftp"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(cpCmd)
+
+	cmnflags.AddSshClientFlags(cpCmd.Flags())
+	cpCmd.Flags().BoolP("recursive", "r", false, "if the copy should be recursive")
+}
+
+// copyPaths splits the cp command arguments into the server and the
+// source and target paths. It reports if the copy is an upload
+func copyPaths(args []string) (server string, sources []string, target string, upload bool, err error) {
+	target = args[len(args)-1]
+	targetServer, targetPath, upload := utils.ParseRemotePath(target)
+	if upload {
+		for _, src := range args[:len(args)-1] {
+			if _, _, remote := utils.ParseRemotePath(src); remote {
+				return "", nil, "", false, fmt.Errorf("copies between remote paths are not supported: %s", src)
+			}
+		}
+		return targetServer, args[:len(args)-1], targetPath, true, nil
+	}
+
+	for _, src := range args[:len(args)-1] {
+		srcServer, srcPath, remote := utils.ParseRemotePath(src)
+		if !remote {
+			return "", nil, "", false, fmt.Errorf("either the sources or the target must be remote: %s", src)
+		}
+		if server != "" && srcServer != server {
+			return "", nil, "", false, fmt.Errorf("all the sources must be on the same server: %s", src)
+		}
+		server = srcServer
+		sources = append(sources, srcPath)
+	}
+	return server, sources, target, false, nil
+}
+
+// copyPath copies src to target in the given direction. Directories are
+// only copied if recursive is set
+func copyPath(client *sftp.Client, src, target string, upload, recursive bool) error {
+	var isDir bool
+	if upload {
+		stat, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("cannot stat local path: %s", src)
+		}
+		isDir = stat.IsDir()
+	} else {
+		stat, err := client.Stat(src)
+		if err != nil {
+			return fmt.Errorf("cannot stat remote path: %s", src)
+		}
+		isDir = stat.IsDir()
+	}
+	if isDir && !recursive {
+		return fmt.Errorf("%s is a directory (use -r)", src)
+	}
+
+	switch {
+	case upload && isDir:
+		return putFileRecursive(client, target, src)
+	case upload:
+		return putFile(client, target, src)
+	case isDir:
+		return getFileRecursive(client, src, target)
+	default:
+		return getFile(client, src, target)
+	}
+}
+
+var cpCmd = &cobra.Command{
+	Use:   "cp source... target",
+	Short: "Copies files from and to remote",
+	Long: `Copies files from and to remote, like scp does.
+
+The remote paths are in the [user@]host[:port]:path form and either all
+the sources or the target must be remote. The files permissions are
+preserved.`,
+	Example: `
+  # downloads a file from the remote server to the current directory
+  $ rospo cp myserver:2222:file.txt .
+
+  # uploads some files to a remote directory through a jump host
+  $ rospo cp -j jumpuser@jumphost:22 a.txt b.txt user@myserver:2222:/tmp/
+
+  # downloads recursively a remote directory
+  $ rospo cp -r myserver:2222:/home/myuser/myremotefolder ~/mylocalfolder
+	`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		recursive, _ := cmd.Flags().GetBool("recursive")
+		server, sources, target, upload, err := copyPaths(args)
+		exitOnError(err)
+
+		sshcConf := cmnflags.GetSshClientConf(cmd, server)
+		sshcConf.Quiet = true
+		conn := sshc.NewSshConnection(sshcConf)
+		go conn.Start()
+		conn.ReadyWait()
+
+		client, err := sftp.NewClient(conn.Client)
+		exitOnError(err)
+
+		failed := false
+		for _, src := range sources {
+			if err := copyPath(client, src, target, upload, recursive); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR %s\n", err)
+				failed = true
+			}
+		}
+		client.Close()
+		conn.Stop()
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
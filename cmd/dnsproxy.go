@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"log"
+	"strings"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(dnsProxyCmd)
+	// sshc options
+	cmnflags.AddSshClientFlags(dnsProxyCmd.Flags())
+
+	dnsProxyCmd.Flags().StringP("listen-address", "l", "127.0.0.1:5353", "the dns proxy udp and tcp listener address")
+	dnsProxyCmd.Flags().String("server", "", "the remote dns server resolving the names not matched by a route, queried through the ssh connection")
+	dnsProxyCmd.Flags().StringArray("route", []string{}, "a domain1,domain2=server route, queried through the ssh connection. Can be repeated")
+	dnsProxyCmd.Flags().String("direct-server", "", "the dns server resolving the names not matched by a route, queried from the local machine. Overrides --server")
+}
+
+var dnsProxyCmd = &cobra.Command{
+	Use:   "dnsproxy [user@]host[:port]",
+	Short: "Starts a DNS forwarder resolving names through the ssh connection",
+	Long: `Starts a DNS forwarder resolving names through the ssh connection
+
+The queries are sent to the remote dns servers over tcp, through the
+ssh connection, so the names private to the remote network resolve on
+the local machine. The routes send the queries for some domains to
+specific servers: the route with the longest matching domain wins.
+	`,
+	Example: `
+  # resolves the corp.internal names with the remote 10.0.0.2 server, and
+  # the others with the local 1.1.1.1
+  $ rospo dnsproxy --route corp.internal=10.0.0.2 --direct-server 1.1.1.1 sshhost:sshport
+
+  # resolves all the names with the remote 10.0.0.2 server
+  $ rospo dnsproxy --server 10.0.0.2 sshhost:sshport
+	`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		listenAddress, _ := cmd.Flags().GetString("listen-address")
+		server, _ := cmd.Flags().GetString("server")
+		directServer, _ := cmd.Flags().GetString("direct-server")
+		routeSpecs, _ := cmd.Flags().GetStringArray("route")
+
+		routes := []*sshc.DnsRouteConf{}
+		for _, spec := range routeSpecs {
+			domains, server, ok := strings.Cut(spec, "=")
+			if !ok || domains == "" || server == "" {
+				log.Fatalf("invalid route '%s', expected domain1,domain2=server", spec)
+			}
+			routes = append(routes, &sshc.DnsRouteConf{
+				Domains: strings.Split(domains, ","),
+				Server:  server,
+			})
+		}
+		if directServer != "" {
+			routes = append(routes, &sshc.DnsRouteConf{Server: directServer, Direct: true})
+		} else if server != "" {
+			routes = append(routes, &sshc.DnsRouteConf{Server: server})
+		}
+
+		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
+		conn := sshc.NewSshConnection(sshcConf)
+		go conn.Start()
+
+		dnsProxy, err := sshc.NewDnsProxy(conn, routes)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := dnsProxy.Start(listenAddress); err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
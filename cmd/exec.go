@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+
+	cmnflags.AddSshClientFlags(execCmd.Flags())
+	execCmd.Flags().BoolP("no-stdin", "n", false, "don't forward the standard input to the remote command")
+	// everything after the host is the remote command
+	execCmd.Flags().SetInterspersed(false)
+}
+
+var execCmd = &cobra.Command{
+	Use:   "exec [user@]host[:port] [--] command [args...]",
+	Short: "Runs a command on the remote server",
+	Long: `Runs a command on the remote server, without a pty.
+
+The remote stdout and stderr are streamed to the local ones, the standard
+input is forwarded to the remote command and rospo exits with the remote
+exit status, or 255 if the session failed. A single command argument is
+run as a shell command line, while several arguments are quoted so they
+reach the remote command unchanged.`,
+	Example: `
+  # runs a command and exits with its status
+  $ rospo exec user@server:2222 -- ls -la /tmp
+
+  # runs a shell command line, feeding it the local stdin
+  $ cat dump.sql | rospo exec user@server:2222 "gzip > dump.sql.gz"
+	`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		noStdin, _ := cmd.Flags().GetBool("no-stdin")
+		if quiet, _ := cmd.Flags().GetBool("quiet"); !quiet {
+			// stdout is the remote command one: keep the logs off it
+			logger.SetOutput(os.Stderr)
+		}
+		if args[1] == "--" {
+			args = append(args[:1], args[2:]...)
+		}
+		if len(args) < 2 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
+		conn := sshc.NewSshConnection(sshcConf)
+		go conn.Start()
+
+		var stdin io.Reader = os.Stdin
+		if noStdin {
+			stdin = nil
+		}
+		err := sshc.Exec(conn, sshc.CommandLine(args[1:]), stdin, os.Stdout, os.Stderr)
+		var exitErr *ssh.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+		conn.Stop()
+		os.Exit(sshc.ExitCode(err))
+	},
+}
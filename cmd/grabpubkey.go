@@ -1,11 +1,18 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
 	"os/user"
 	"path/filepath"
+	"text/tabwriter"
 
+	"github.com/ferama/rospo/pkg/conf"
 	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/utils"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func init() {
@@ -14,24 +21,91 @@ func init() {
 	usr, _ := user.Current()
 	knownHostFile := filepath.Join(usr.HomeDir, ".ssh", "known_hosts")
 	grabpubkeyCmd.PersistentFlags().StringP("known-hosts", "k", knownHostFile, "the known_hosts file absolute path")
+	grabpubkeyCmd.Flags().StringP("print", "p", "", "print the keys of all the types instead: fingerprints, randomart, config or known_hosts")
+	grabpubkeyCmd.Flags().StringP("config", "c", "", "pin the keys fingerprints in the sshclients of this config file connecting to the host")
 }
 
 var grabpubkeyCmd = &cobra.Command{
 	Use:   "grabpubkey host:port",
 	Short: "Grab the host pubkey and put it into the known_hosts file",
-	Long:  `Grab the host pubkey and put it into the known_hosts file`,
+	Long: `Grab the host pubkey and put it into the known_hosts file.
+
+With --print or --config, the server keys of all the types are scanned
+and known_hosts is not changed. --print prints them as SHA256 and MD5
+fingerprints, as randomart images to compare them visually, as the
+host_key_fingerprints option of an sshclient config, or as known_hosts
+lines. --config pins the fingerprints in the
+sshclients of a config file connecting to the host.`,
 	Example: `
  # grabs the pubkey from the server at host:port and put it into ./known file
  $ rospo grabpubkey -k ./known host:port
+
+ # prints the randomart images of the server keys
+ $ rospo grabpubkey --print randomart host:port
+
+ # prints the host_key_fingerprints to paste into an sshclient config
+ $ rospo grabpubkey --print config host:port
+
+ # pins the server keys in the config file
+ $ rospo grabpubkey --config rospo.yaml host:port
 	`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		knownHosts, _ := cmd.Flags().GetString("known-hosts")
-		sshcConf := &sshc.SshClientConf{
-			KnownHosts: knownHosts,
-			ServerURI:  args[0],
+		format, _ := cmd.Flags().GetString("print")
+		configPath, _ := cmd.Flags().GetString("config")
+
+		if format == "" && configPath == "" {
+			sshcConf := &sshc.SshClientConf{
+				KnownHosts: knownHosts,
+				ServerURI:  args[0],
+			}
+			client := sshc.NewSshConnection(sshcConf)
+			client.GrabPubKey()
+			return
+		}
+
+		switch format {
+		case "", "fingerprints", "randomart", "config", "known_hosts":
+		default:
+			exitOnError(fmt.Errorf("invalid print format '%s', use fingerprints, randomart, config or known_hosts", format))
+		}
+		address, _, keys, err := sshc.ScanHostKeys(args[0], hostKeyScanTimeout)
+		exitOnError(err)
+		fingerprints := []string{}
+		for _, key := range keys {
+			fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+		}
+
+		switch format {
+		case "fingerprints":
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			for _, key := range keys {
+				md5, _ := utils.Fingerprint(key, utils.FINGERPRINT_MD5)
+				fmt.Fprintf(w, "%s\t%s\t%s\n", key.Type(), ssh.FingerprintSHA256(key), md5)
+			}
+			w.Flush()
+		case "randomart":
+			for _, key := range keys {
+				fmt.Printf("%s %s\n", key.Type(), ssh.FingerprintSHA256(key))
+				art, _ := utils.RandomArt(key, utils.FINGERPRINT_SHA256)
+				fmt.Println(art)
+			}
+		case "config":
+			fmt.Println("host_key_fingerprints:")
+			for _, key := range keys {
+				fmt.Printf("  - %s # %s\n", ssh.FingerprintSHA256(key), key.Type())
+			}
+		case "known_hosts":
+			for _, key := range keys {
+				fmt.Println(knownhosts.Line([]string{knownhosts.Normalize(address)}, key))
+			}
+		}
+
+		if configPath != "" {
+			n, err := conf.PinHostKeys(configPath, args[0], fingerprints)
+			exitOnError(err)
+			fmt.Fprintf(os.Stderr, "%d keys pinned in %d sshclients of %s\n", len(fingerprints), n, configPath)
 		}
-		client := sshc.NewSshConnection(sshcConf)
-		client.GrabPubKey()
 	},
 }
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/control"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(healthCmd)
+	healthCmd.Flags().StringP("socket", "s", control.DefaultSocketPath, "the control socket of the running instance")
+	cmnflags.AddOutputFlags(healthCmd.Flags())
+}
+
+var healthCmd = &cobra.Command{
+	Use:   "health",
+	Short: "Checks the health of a running instance",
+	Long: `Checks the health of a running instance.
+
+The instance must be started by the run command with a control socket.
+It is healthy if its ssh connections are up, the on demand ones
+excluded, and its tunnels are listening. The command exits with 1 if the
+instance is unhealthy or unreachable, for the container health checks
+and the liveness probes.`,
+	Example: `
+  # checks the instance started with "control_socket: /tmp/rospo.sock"
+  $ rospo health -s /tmp/rospo.sock
+
+  # as a Dockerfile health check
+  HEALTHCHECK --interval=30s CMD rospo health -s /tmp/rospo.sock
+	`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		socket, _ := cmd.Flags().GetString("socket")
+		health, err := control.QueryHealth(socket)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to get the health from %s: %s\n", socket, err)
+			os.Exit(1)
+		}
+
+		if !printOutput(cmd, health) {
+			if health.Healthy {
+				fmt.Println("healthy")
+			} else {
+				fmt.Println("unhealthy")
+				for _, p := range health.Problems {
+					fmt.Printf("  %s\n", p)
+				}
+			}
+		}
+		if !health.Healthy {
+			os.Exit(1)
+		}
+	},
+}
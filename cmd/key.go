@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+
+	"github.com/ferama/rospo/pkg/utils"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+func init() {
+	rootCmd.AddCommand(keyCmd)
+
+	keyCmd.AddCommand(keyConvertCmd)
+	keyConvertCmd.Flags().StringP("format", "f", utils.KEY_FORMAT_OPENSSH, "the output format: openssh, pem, pkcs8, or authorized_keys and rfc4716 for the public key")
+	keyConvertCmd.Flags().StringP("out", "o", "", "the output file. Default stdout")
+	keyConvertCmd.Flags().StringP("comment", "C", "", "the key comment, stored by the openssh and the public key formats")
+	keyConvertCmd.Flags().StringP("passphrase", "P", "", "the passphrase of the key. Asked if the key is encrypted and not set")
+	keyConvertCmd.Flags().StringP("new-passphrase", "N", "", "encrypt the converted key with this passphrase")
+	keyConvertCmd.Flags().BoolP("encrypt", "e", false, "ask the passphrase the converted key is encrypted with")
+}
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manages the ssh keys",
+	Long:  `Manages the ssh keys.`,
+	Args:  cobra.MinimumNArgs(1),
+	Run:   func(cmd *cobra.Command, args []string) {},
+}
+
+// readPassphrase asks a passphrase on the terminal
+func readPassphrase(prompt string) []byte {
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	exitOnError(err)
+	return p
+}
+
+var keyConvertCmd = &cobra.Command{
+	Use:   "convert keyfile",
+	Short: "Converts a key to another format",
+	Long: `Converts a private key to another format, or exports its public key.
+
+The private keys are read in the OpenSSH, PEM (PKCS#1 and SEC 1) and
+PKCS#8 formats, and written in the same ones: openssh, pem and pkcs8.
+The public key is exported with the authorized_keys and the rfc4716
+formats, from a private key or from an authorized_keys line.
+
+The passphrase of a key is added, changed or removed by converting it to
+the same file: the converted key is encrypted only with --new-passphrase
+or --encrypt.`,
+	Example: `
+  # converts a PEM rsa key to the OpenSSH format
+  $ rospo key convert -o id_rsa.new id_rsa
+
+  # exports the public key for a commercial ssh server
+  $ rospo key convert -f rfc4716 -C "me@laptop" id_ed25519
+
+  # adds a passphrase to a key
+  $ rospo key convert -e -o id_ed25519 id_ed25519
+
+  # removes the passphrase of a key
+  $ rospo key convert -o id_ed25519 id_ed25519
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		format, _ := cmd.Flags().GetString("format")
+		out, _ := cmd.Flags().GetString("out")
+		comment, _ := cmd.Flags().GetString("comment")
+		passphrase, _ := cmd.Flags().GetString("passphrase")
+		newPassphrase, _ := cmd.Flags().GetString("new-passphrase")
+		encrypt, _ := cmd.Flags().GetBool("encrypt")
+
+		path, _ := utils.ExpandUserHome(args[0])
+		data, err := os.ReadFile(path)
+		exitOnError(err)
+
+		var res []byte
+		switch format {
+		case utils.PUBKEY_FORMAT_AUTHORIZED_KEYS, utils.PUBKEY_FORMAT_RFC4716:
+			pub, keyComment, _, _, err := ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				// not a public key, export the one of the private key
+				pub, err = ssh.NewPublicKey(loadKey(data, passphrase).Public())
+				exitOnError(err)
+			}
+			if comment == "" {
+				comment = keyComment
+			}
+			res, err = utils.EncodePublicKey(pub, format, comment)
+			exitOnError(err)
+		default:
+			key := loadKey(data, passphrase)
+			if encrypt && newPassphrase == "" {
+				newPassphrase = string(readPassphrase("New passphrase: "))
+				if string(readPassphrase("Repeat the new passphrase: ")) != newPassphrase {
+					exitOnError(fmt.Errorf("the passphrases don't match"))
+				}
+				if newPassphrase == "" {
+					exitOnError(fmt.Errorf("empty passphrase"))
+				}
+			}
+			res, err = utils.EncodePrivateKey(key, format, comment, []byte(newPassphrase))
+			exitOnError(err)
+		}
+
+		if out == "" {
+			fmt.Print(string(res))
+			return
+		}
+		exitOnError(utils.WriteKeyToFile(res, out))
+	},
+}
+
+// loadKey parses a private key, asking its passphrase if it is encrypted
+// and not given
+func loadKey(data []byte, passphrase string) crypto.Signer {
+	if passphrase == "" && utils.IsEncryptedKey(data) {
+		passphrase = string(readPassphrase("Passphrase: "))
+	}
+	key, err := utils.ParsePrivateKey(data, []byte(passphrase))
+	exitOnError(err)
+	return key
+}
@@ -2,10 +2,13 @@ package cmd
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 
 	"github.com/ferama/rospo/pkg/utils"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
 )
 
 func init() {
@@ -16,10 +19,21 @@ func init() {
 	keygenCmd.Flags().StringP("name", "n", "identity", "output file name")
 }
 
+// printFingerprint prints the SHA256 fingerprint and the randomart image
+// of key, like ssh-keygen
+func printFingerprint(w io.Writer, key ssh.PublicKey) {
+	art, err := utils.RandomArt(key, utils.FINGERPRINT_SHA256)
+	exitOnError(err)
+	fmt.Fprintf(w, "The key fingerprint is:\n%s\nThe key's randomart image is:\n%s\n", ssh.FingerprintSHA256(key), art)
+}
+
 var keygenCmd = &cobra.Command{
 	Use:   "keygen",
 	Short: "Generates private/public key pairs",
-	Long:  `Generates private/public key pairs`,
+	Long: `Generates private/public key pairs.
+
+The key fingerprint and randomart image are printed too, on stderr if
+the keys are printed on stdout.`,
 	Example: `
   # generates a key pair an store it into identiy and identity.pub files
   $ rospo keygen -s
@@ -38,12 +52,17 @@ var keygenCmd = &cobra.Command{
 			panic(err)
 		}
 		encodedKey := utils.EncodePrivateKeyToPEM(key)
+		var out io.Writer = os.Stdout
 		if storeKeys {
 			utils.WriteKeyToFile(encodedKey, filepath.Join(path, name))
 			utils.WriteKeyToFile(publicKey, filepath.Join(path, name+".pub"))
 		} else {
 			fmt.Printf("%s", encodedKey)
 			fmt.Printf("%s", publicKey)
+			out = os.Stderr
 		}
+		pub, err := ssh.NewPublicKey(&key.PublicKey)
+		exitOnError(err)
+		printFingerprint(out, pub)
 	},
 }
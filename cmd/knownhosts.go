@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ferama/rospo/pkg/knownhosts"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// how long the host keys scan waits for the server
+const hostKeyScanTimeout = 10 * time.Second
+
+func init() {
+	rootCmd.AddCommand(knownHostsCmd)
+
+	usr, _ := user.Current()
+	knownHostFile := filepath.Join(usr.HomeDir, ".ssh", "known_hosts")
+	knownHostsCmd.PersistentFlags().StringP("known-hosts", "k", knownHostFile, "the known_hosts file absolute path")
+
+	knownHostsCmd.AddCommand(knownHostsLsCmd)
+	knownHostsCmd.AddCommand(knownHostsAddCmd)
+	knownHostsAddCmd.Flags().Bool("hash", false, "hash the host name of the added entries")
+	knownHostsCmd.AddCommand(knownHostsRmCmd)
+	knownHostsCmd.AddCommand(knownHostsHashCmd)
+	knownHostsCmd.AddCommand(knownHostsVerifyCmd)
+}
+
+var knownHostsCmd = &cobra.Command{
+	Use:   "knownhosts",
+	Short: "Manages the known_hosts file",
+	Long: `Manages the known_hosts file.
+
+The entries can be listed, added by scanning the host keys of a server,
+removed and hashed. The verify command checks the keys of a live server
+against the file.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  func(cmd *cobra.Command, args []string) {},
+}
+
+var knownHostsLsCmd = &cobra.Command{
+	Use:   "ls [host[:port]]",
+	Short: "Lists the known_hosts entries",
+	Long: `Lists the known_hosts entries, or the ones of a host.
+
+The hashed host names are shown as (hashed), but they are matched when
+a host is given.`,
+	Example: `
+  # lists the keys known for the server at host:2222
+  $ rospo knownhosts ls host:2222
+	`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		knownHosts, _ := cmd.Flags().GetString("known-hosts")
+		host := ""
+		if len(args) > 0 {
+			host = args[0]
+		}
+		kh, err := knownhosts.Load(knownHosts)
+		exitOnError(err)
+		entries := kh.Lookup(host)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "LINE\tHOSTS\tTYPE\tFINGERPRINT")
+		for _, e := range entries {
+			hosts := []string{}
+			for _, h := range e.Hosts {
+				if strings.HasPrefix(h, "|1|") {
+					h = "(hashed)"
+				}
+				hosts = append(hosts, h)
+			}
+			hostsCol := strings.Join(hosts, ",")
+			if e.Marker != "" {
+				hostsCol = e.Marker + " " + hostsCol
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", e.Line, hostsCol, e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+		}
+		w.Flush()
+	},
+}
+
+var knownHostsAddCmd = &cobra.Command{
+	Use:   "add host[:port]",
+	Short: "Scans the host keys of a server and adds them to known_hosts",
+	Long: `Scans the host keys of a server and adds them to known_hosts.
+
+The keys already known are skipped. If the server presents a key
+different from the known one, nothing is added: remove the old entry
+first if the key change is expected.`,
+	Example: `
+  # adds the keys of the server at host:2222
+  $ rospo knownhosts add host:2222
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		knownHosts, _ := cmd.Flags().GetString("known-hosts")
+		hash, _ := cmd.Flags().GetBool("hash")
+
+		address, remote, keys, err := sshc.ScanHostKeys(args[0], hostKeyScanTimeout)
+		exitOnError(err)
+
+		toAdd := []ssh.PublicKey{}
+		for _, key := range keys {
+			result, err := knownhosts.Verify(knownHosts, address, remote, key)
+			exitOnError(err)
+			switch result {
+			case knownhosts.KEY_OK:
+				fmt.Printf("%s %s already known\n", key.Type(), ssh.FingerprintSHA256(key))
+			case knownhosts.KEY_UNKNOWN:
+				toAdd = append(toAdd, key)
+			default:
+				exitOnError(fmt.Errorf("the %s key of %s is %s. Nothing added", key.Type(), address, result))
+			}
+		}
+		if len(toAdd) == 0 {
+			return
+		}
+		err = knownhosts.Update(knownHosts, func(f *knownhosts.File) error {
+			for _, key := range toAdd {
+				f.Add(address, key, hash)
+			}
+			return nil
+		})
+		exitOnError(err)
+		for _, key := range toAdd {
+			fmt.Printf("%s %s added\n", key.Type(), ssh.FingerprintSHA256(key))
+		}
+	},
+}
+
+var knownHostsRmCmd = &cobra.Command{
+	Use:   "rm host[:port]",
+	Short: "Removes a host from known_hosts",
+	Long: `Removes a host from known_hosts.
+
+The entries listing other hosts too are kept for them.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		knownHosts, _ := cmd.Flags().GetString("known-hosts")
+		n := 0
+		err := knownhosts.Update(knownHosts, func(f *knownhosts.File) error {
+			n = f.Remove(args[0])
+			return nil
+		})
+		exitOnError(err)
+		fmt.Printf("%d entries removed\n", n)
+	},
+}
+
+var knownHostsHashCmd = &cobra.Command{
+	Use:   "hash",
+	Short: "Hashes the host names of known_hosts",
+	Long: `Hashes the host names of known_hosts, like ssh-keygen -H.
+
+An entry listing many hosts is split in one line per host. The patterns
+with wildcards or negations can't be hashed and are kept as is.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		knownHosts, _ := cmd.Flags().GetString("known-hosts")
+		n := 0
+		err := knownhosts.Update(knownHosts, func(f *knownhosts.File) error {
+			n = f.Hash()
+			return nil
+		})
+		exitOnError(err)
+		fmt.Printf("%d hosts hashed\n", n)
+	},
+}
+
+var knownHostsVerifyCmd = &cobra.Command{
+	Use:   "verify host[:port]",
+	Short: "Checks the host keys of a server against known_hosts",
+	Long: `Checks the host keys of a server against known_hosts.
+
+Each key the server presents is printed with its state: ok, changed,
+unknown or revoked. The command exits with a non zero status if a key
+changed or was revoked, or if no key is known.`,
+	Example: `
+  # checks the server at host:2222
+  $ rospo knownhosts verify host:2222
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		knownHosts, _ := cmd.Flags().GetString("known-hosts")
+
+		address, remote, keys, err := sshc.ScanHostKeys(args[0], hostKeyScanTimeout)
+		exitOnError(err)
+
+		known := 0
+		failed := false
+		for _, key := range keys {
+			result, err := knownhosts.Verify(knownHosts, address, remote, key)
+			exitOnError(err)
+			fmt.Printf("%s %s %s\n", result, key.Type(), ssh.FingerprintSHA256(key))
+			switch result {
+			case knownhosts.KEY_OK:
+				known++
+			case knownhosts.KEY_CHANGED, knownhosts.KEY_REVOKED:
+				failed = true
+			}
+		}
+		if failed || known == 0 {
+			os.Exit(1)
+		}
+	},
+}
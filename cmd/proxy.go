@@ -1,15 +1,20 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/logger"
 	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/spf13/cobra"
 )
 
 func init() {
 	rootCmd.AddCommand(proxyCmd)
+	proxyCmd.AddCommand(proxyStdioCmd)
+	cmnflags.AddSshClientFlags(proxyStdioCmd.Flags())
 	// sshc options
 	cmnflags.AddSshClientFlags(proxyCmd.Flags())
 
@@ -47,3 +52,35 @@ the proxy configuration form.
 		}
 	},
 }
+
+var proxyStdioCmd = &cobra.Command{
+	Use:   "stdio [user@]host[:port] target_host:target_port",
+	Short: "Pipes the stdio to a target through the ssh server",
+	Long: `Connects to the target through the ssh server and pipes the standard
+input and output to it. Other ssh clients can use it as their ProxyCommand
+to reach hosts through rospo connections, jump hosts included.
+
+The logs are written to the standard error.`,
+	Example: `
+  # in the ~/.ssh/config file, reaches the internal hosts through the bastion
+  Host *.internal
+    ProxyCommand rospo proxy stdio -j jumpuser@jumphost:22 user@bastion:2222 %h:%p
+	`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if quiet, _ := cmd.Flags().GetBool("quiet"); !quiet {
+			// stdout is the proxied connection: keep the logs off it
+			logger.SetOutput(os.Stderr)
+		}
+		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
+		conn := sshc.NewSshConnection(sshcConf)
+		go conn.Start()
+
+		err := sshc.ProxyStdio(conn, args[1], os.Stdin, os.Stdout)
+		conn.Stop()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
@@ -106,6 +106,9 @@ func putFileRecursive(client *sftp.Client, remote, local string) error {
 			if err != nil {
 				return fmt.Errorf("cannot create directory %s: %s", remotePath, err)
 			}
+			if info, err := d.Info(); err == nil {
+				client.Chmod(targetPath, info.Mode().Perm())
+			}
 		} else {
 			err := putFile(client, targetPath, localPath)
 			if err != nil {
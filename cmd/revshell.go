@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"log"
+
 	"github.com/ferama/rospo/cmd/cmnflags"
 	"github.com/ferama/rospo/pkg/conf"
 	"github.com/ferama/rospo/pkg/sshc"
@@ -45,7 +47,11 @@ Preliminary checks:
 	Run: func(cmd *cobra.Command, args []string) {
 		sshdConf := cmnflags.GetSshDConf(cmd)
 		s := sshd.NewSshServer(sshdConf)
-		go s.Start()
+		go func() {
+			if err := s.Start(); err != nil {
+				log.Fatalf("sshd server failed: %s", err)
+			}
+		}()
 
 		remote, _ := cmd.Flags().GetString("remote")
 
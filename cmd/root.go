@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/ferama/rospo/pkg/failfast"
 	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/rio"
 	"github.com/spf13/cobra"
 )
 
@@ -12,8 +14,17 @@ import (
 // is set during the build process using -ldflags="-X 'github.com/ferama/rospo/cmd.Version=
 var Version = "development"
 
+// platformPreRun does the platform specific setup before every command,
+// like the windows event log one
+var platformPreRun = func(cmd *cobra.Command) {}
+
 func init() {
 	rootCmd.PersistentFlags().BoolP("quiet", "q", false, "if set disable all logs")
+	rootCmd.PersistentFlags().String("log-format", logger.FormatText, "the logs format: text or json")
+	rootCmd.PersistentFlags().String("log-level", "info", "the minimum logs level: debug, info, warn or error")
+	rootCmd.PersistentFlags().Int("buffer-size", rio.DefaultBufferSize, "the size in bytes of the buffers used to copy the connections data")
+	rootCmd.PersistentFlags().Int("max-retries", -1, "exit after this many failed connection or listen attempts in a row. Negative retries forever")
+	rootCmd.PersistentFlags().Bool("fail-fast", false, "exit at the first failed connection or listen attempt, like --max-retries 0")
 }
 
 var rootCmd = &cobra.Command{
@@ -22,9 +33,34 @@ var rootCmd = &cobra.Command{
 	Version: Version,
 	Args:    cobra.MinimumNArgs(1),
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		platformPreRun(cmd)
 		if quiet, _ := cmd.Flags().GetBool("quiet"); quiet {
 			logger.DisableLoggers()
 		}
+		format, _ := cmd.Flags().GetString("log-format")
+		if err := logger.SetFormat(format); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		levelName, _ := cmd.Flags().GetString("log-level")
+		level, err := logger.ParseLevel(levelName)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		logger.SetLevel(level)
+		if cmd.Flags().Changed("buffer-size") {
+			size, _ := cmd.Flags().GetInt("buffer-size")
+			if err := rio.SetBufferSize(size); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		maxRetries, _ := cmd.Flags().GetInt("max-retries")
+		if failFast, _ := cmd.Flags().GetBool("fail-fast"); failFast {
+			maxRetries = 0
+		}
+		failfast.SetMaxRetries(maxRetries)
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("invalid subcommand")
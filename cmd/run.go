@@ -2,13 +2,14 @@ package cmd
 
 import (
 	"log"
-	"os"
-	"os/signal"
 
+	"github.com/ferama/rospo/cmd/cmnflags"
 	"github.com/ferama/rospo/pkg/conf"
+	"github.com/ferama/rospo/pkg/control"
+	"github.com/ferama/rospo/pkg/rio"
 	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/sshd"
-	"github.com/ferama/rospo/pkg/tun"
+	"github.com/ferama/rospo/pkg/systemd"
 	"github.com/ferama/rospo/pkg/web"
 	rootapi "github.com/ferama/rospo/pkg/web/api/root"
 	"github.com/spf13/cobra"
@@ -16,13 +17,43 @@ import (
 
 func init() {
 	rootCmd.AddCommand(runCmd)
+	runCmd.Flags().BoolP("watch", "w", false, "reload the config file when it changes")
+	runCmd.Flags().String("profile", "", "the config profile merged over the config values")
+	runCmd.Flags().String("control-socket", "", "the control socket path queried by the status command")
+	runCmd.Flags().Bool("dry-run", false, "print the listeners, the dialed hosts and the keys of the config, then exit. See --json and --format")
+	cmnflags.AddOutputFlags(runCmd.Flags())
+	runCmd.Flags().Bool("pprof", false, "serve the go profiles under /debug/pprof/ on the control socket and the web api")
 }
 
 var runCmd = &cobra.Command{
 	Use:   "run config_file_path.yaml",
 	Short: "Run rospo using a config file.",
-	Long:  "Run rospo using a config file.",
-	Args:  cobra.MinimumNArgs(1),
+	Long: `Run rospo using a config file.
+
+A single config file can declare the sshd server, the ssh clients, any
+number of forward and reverse tunnels, the socks and dns proxies, the
+web and the grpc apis. Use the template command to generate a documented example.
+
+The config is reloaded on SIGHUP, or when the file changes if --watch
+is set. The tunnels and the sshd keys changes are applied live: the
+added and removed tunnels are started and stopped, and an ssh connection
+is recycled only if its client configuration changed. The other sections
+need a restart.`,
+	Example: `
+  # generates a config file and runs it
+  $ rospo template > config.yaml
+  $ rospo run config.yaml
+
+  # runs the config with the staging profile values
+  $ rospo run --profile staging config.yaml
+
+  # prints what the config would open, dial and read, without running it
+  $ rospo run --dry-run config.yaml
+
+  # applies the config changes without restarting
+  $ kill -HUP $(pidof rospo)
+	`,
+	Args: cobra.MinimumNArgs(1),
 	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		if len(args) != 0 {
 			return nil, cobra.ShellCompDirectiveNoFileComp
@@ -30,43 +61,77 @@ var runCmd = &cobra.Command{
 		return []string{"yaml"}, cobra.ShellCompDirectiveFilterFileExt
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		conf, err := conf.LoadConfig(args[0])
+		profile, _ := cmd.Flags().GetString("profile")
+		conf, err := conf.LoadConfigProfile(args[0], profile)
 		if err != nil {
 			log.Fatalln(err)
 		}
+		// the --control-socket flag wins over the config
+		if cmd.Flags().Changed("control-socket") {
+			conf.ControlSocket, _ = cmd.Flags().GetString("control-socket")
+		}
+		if dry, _ := cmd.Flags().GetBool("dry-run"); dry {
+			dryRun(cmd, conf)
+			return
+		}
+		// the --buffer-size flag wins over the config
+		if conf.BufferSize != 0 && !cmd.Flags().Changed("buffer-size") {
+			if err := rio.SetBufferSize(conf.BufferSize); err != nil {
+				log.Fatalln(err)
+			}
+		}
 		somethingRun := false
 
-		var sshConn *sshc.SshConnection
-
+		// sections with identical sshclient configurations share
+		// the same ssh connection
+		r := newRunner(args[0], profile)
+		r.cfg = conf
+		pool := r.pool
+		sshConn := r.globalConn(conf)
 		if conf.SshClient != nil {
-			sshConn = sshc.NewSshConnection(conf.SshClient)
-			go sshConn.Start()
 			somethingRun = true
 		}
 
 		failIfNoClient := func(item string) {
-			if sshConn == nil {
+			if conf.SshClient == nil {
 				log.Fatalf("you need to configure sshclient section to support %s", item)
 			}
 		}
 
+		var sshdStatus control.SshDStatus
 		if conf.SshD != nil {
 			sshServer := sshd.NewSshServer(conf.SshD)
-			go sshServer.Start()
+			r.sshServer = sshServer
+			sshdStatus = sshServer
+			r.hasSshD = true
+			go func() {
+				if err := sshServer.Start(); err != nil {
+					log.Fatalf("sshd server failed: %s", err)
+				}
+			}()
 			somethingRun = true
 		}
 
-		if conf.Tunnel != nil && len(conf.Tunnel) > 0 {
-			for _, c := range conf.Tunnel {
-				if c.SshClientConf != nil {
-					conn := sshc.NewSshConnection(c.SshClientConf)
-					go conn.Start()
-					go tun.NewTunnel(conn, c, false).Start()
-				} else {
-					failIfNoClient("tunnel")
-					go tun.NewTunnel(sshConn, c, false).Start()
-				}
+		for _, c := range conf.Tunnel {
+			if c.SshClientConf == nil {
+				failIfNoClient("tunnel")
+			}
+		}
+
+		// the management api, served by the control socket and by the
+		// web server
+		controlServer := control.NewServer(Version, pool, sshdStatus)
+		controlServer.SetTunnelManager(r)
+		if pprof, _ := cmd.Flags().GetBool("pprof"); pprof {
+			controlServer.EnablePprof()
+		}
+		defer controlServer.Close()
+
+		if conf.Grpc != nil {
+			if err := controlServer.StartGrpc(conf.Grpc); err != nil {
+				log.Fatalf("grpc server failed: %s", err)
 			}
+			somethingRun = true
 		}
 
 		if conf.Web != nil {
@@ -88,19 +153,19 @@ var runCmd = &cobra.Command{
 				}
 			}
 
-			go web.StartServer(dev, sshConn, conf.Web, info)
+			r.fixedConns[sshConn] = true
+			go web.StartServer(dev, sshConn, controlServer, conf.Web, info)
 		}
 
 		if conf.SocksProxy != nil {
-			var sockProxy *sshc.SocksProxy
+			socksConn := sshConn
 			if conf.SocksProxy.SshClientConf == nil {
 				failIfNoClient("socks proxy")
-				sockProxy = sshc.NewSocksProxy(sshConn)
 			} else {
-				proxySshConn := sshc.NewSshConnection(conf.SocksProxy.SshClientConf)
-				go proxySshConn.Start()
-				sockProxy = sshc.NewSocksProxy(proxySshConn)
+				socksConn = pool.Get(conf.SocksProxy.SshClientConf)
 			}
+			r.fixedConns[socksConn] = true
+			sockProxy := sshc.NewSocksProxy(socksConn)
 			somethingRun = true
 
 			go func() {
@@ -111,10 +176,57 @@ var runCmd = &cobra.Command{
 			}()
 		}
 
+		if conf.DnsProxy != nil {
+			dnsConn := sshConn
+			if conf.DnsProxy.SshClientConf == nil {
+				failIfNoClient("dns proxy")
+			} else {
+				dnsConn = pool.Get(conf.DnsProxy.SshClientConf)
+			}
+			r.fixedConns[dnsConn] = true
+			dnsProxy, err := sshc.NewDnsProxy(dnsConn, conf.DnsProxy.Routes)
+			if err != nil {
+				log.Fatal(err)
+			}
+			somethingRun = true
+
+			go func() {
+				err := dnsProxy.Start(conf.DnsProxy.ListenAddress)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}()
+		}
+
+		if len(conf.Tunnel) > 0 {
+			r.applyTunnels(conf)
+			somethingRun = true
+		}
+
 		if somethingRun {
-			c := make(chan os.Signal, 1)
-			signal.Notify(c, os.Interrupt)
-			<-c
+			controlSocket := conf.ControlSocket
+			if controlSocket != "" {
+				if err := controlServer.Start(controlSocket); err != nil {
+					log.Fatalf("control socket failed: %s", err)
+				}
+			}
+
+			watch, _ := cmd.Flags().GetBool("watch")
+			go r.watchReload(watch)
+			systemd.Ready()
+			systemd.StartWatchdog()
+
+			// without other services, the process exits once the
+			// tunnels stopped by themselves, see max_accepted. With
+			// a control socket new tunnels can be added, so it waits
+			var done <-chan struct{}
+			if controlSocket == "" && conf.SshD == nil && conf.Web == nil && conf.Grpc == nil && conf.SocksProxy == nil && conf.DnsProxy == nil {
+				done = r.tunnelsDone()
+			}
+			waitSignalOr(done)
+			systemd.Stopping()
+			// the tunnels connections are drained before exiting
+			shutdownTunnels(r.list())
 		} else {
 			log.Println("nothing to run")
 		}
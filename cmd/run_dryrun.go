@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ferama/rospo/pkg/conf"
+	"github.com/spf13/cobra"
+)
+
+// dryRun checks cfg and prints its listeners, dialed hosts and key files
+// without running it. It exits with 1 if the config has errors
+func dryRun(cmd *cobra.Command, cfg *conf.Config) {
+	errors := 0
+	for _, p := range cfg.Check() {
+		fmt.Fprintln(os.Stderr, p)
+		if !p.Warning {
+			errors++
+		}
+	}
+
+	steps := cfg.Plan()
+	if !printOutput(cmd, steps) {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ACTION\tTARGET\tSECTION\tNOTE")
+		for _, s := range steps {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Action, s.Target, s.Section, s.Note)
+		}
+		w.Flush()
+	}
+
+	if errors > 0 {
+		fmt.Fprintf(os.Stderr, "%d errors found\n", errors)
+		os.Exit(1)
+	}
+}
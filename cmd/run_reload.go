@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ferama/rospo/pkg/conf"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/systemd"
+	"github.com/ferama/rospo/pkg/tun"
+	"gopkg.in/yaml.v3"
+)
+
+// how often the config file is checked for changes with --watch
+const configWatchInterval = 2 * time.Second
+
+// keysReloader is implemented by the sshd server
+type keysReloader interface {
+	ReloadKeys(conf *sshd.SshDConf) error
+}
+
+// runningTunnel is a tunnel started by the run command, with the ssh
+// connection and the configuration it uses
+type runningTunnel struct {
+	tunnel *tun.Tunnel
+	conn   *sshc.SshConnection
+	conf   *tun.TunnelConf
+}
+
+// runner holds the services started by the run command. On reload the
+// tunnels are diffed by configuration: only the added and the removed
+// ones are started and stopped, and the ssh connections are recycled
+// only if no section uses their client configuration anymore
+type runner struct {
+	path    string
+	profile string
+	pool    *sshc.ConnectionPool
+	// the global ssh connection, nil if not configured or only used
+	// by lazy tunnels
+	sshConn *sshc.SshConnection
+	// the connections of the sections that are not reloaded, like the
+	// socks proxy
+	fixedConns map[*sshc.SshConnection]bool
+	sshServer  keysReloader
+	hasSshD    bool
+
+	// the last loaded config
+	cfg *conf.Config
+
+	tunnels map[string]*runningTunnel
+	// the tunnels added through the control socket. They are not part
+	// of the config, so the reloads keep them
+	added     map[*tun.Tunnel]*runningTunnel
+	tunnelsMU sync.Mutex
+	reloadMU  sync.Mutex
+}
+
+func newRunner(path string, profile string) *runner {
+	return &runner{
+		path:       path,
+		profile:    profile,
+		pool:       sshc.NewConnectionPool(),
+		fixedConns: make(map[*sshc.SshConnection]bool),
+		tunnels:    make(map[string]*runningTunnel),
+		added:      make(map[*tun.Tunnel]*runningTunnel),
+	}
+}
+
+// globalConn returns the global ssh connection of cfg. It is not started
+// if only lazy tunnels use it: they get an on demand one
+func (r *runner) globalConn(cfg *conf.Config) *sshc.SshConnection {
+	if cfg.SshClient == nil {
+		return nil
+	}
+	usedByLazy := false
+	usedByOthers := cfg.Web != nil ||
+		(cfg.SocksProxy != nil && cfg.SocksProxy.SshClientConf == nil) ||
+		(cfg.DnsProxy != nil && cfg.DnsProxy.SshClientConf == nil)
+	for _, c := range cfg.Tunnel {
+		if c.SshClientConf == nil {
+			usedByLazy = usedByLazy || c.Lazy
+			usedByOthers = usedByOthers || !c.Lazy
+		}
+	}
+	if usedByOthers || !usedByLazy {
+		return r.pool.Get(cfg.SshClient)
+	}
+	return nil
+}
+
+// tunnelKey identifies a tunnel by its configuration and by the one of
+// the ssh client it uses
+func tunnelKey(c *tun.TunnelConf, clientConf *sshc.SshClientConf) string {
+	data, _ := yaml.Marshal(struct {
+		Tunnel *tun.TunnelConf
+		Client *sshc.SshClientConf
+	}{c, clientConf})
+	return string(data)
+}
+
+// tunnelConn returns the ssh connection of the tunnel c, nil if neither
+// c nor cfg configure an ssh client
+func (r *runner) tunnelConn(cfg *conf.Config, c *tun.TunnelConf) *sshc.SshConnection {
+	clientConf := c.SshClientConf
+	if clientConf == nil {
+		clientConf = cfg.SshClient
+	}
+	if clientConf == nil {
+		return nil
+	}
+	if c.Lazy {
+		return r.pool.GetOnDemand(clientConf, c.GetLazyIdleTimeout())
+	}
+	return r.pool.Get(clientConf)
+}
+
+// applyTunnels starts the tunnels of cfg that are not running yet and
+// stops the running ones cfg doesn't have anymore. The ssh connections
+// left unused are stopped
+func (r *runner) applyTunnels(cfg *conf.Config) (int, int) {
+	r.sshConn = r.globalConn(cfg)
+
+	r.tunnelsMU.Lock()
+	r.cfg = cfg
+	next := make(map[string]*runningTunnel)
+	added := 0
+	for _, c := range cfg.Tunnel {
+		clientConf := c.SshClientConf
+		if clientConf == nil {
+			clientConf = cfg.SshClient
+		}
+		if clientConf == nil {
+			log.Printf("you need to configure sshclient section to support tunnel %s", c.Name)
+			continue
+		}
+		key := tunnelKey(c, clientConf)
+		if rt, ok := r.tunnels[key]; ok {
+			next[key] = rt
+			delete(r.tunnels, key)
+			continue
+		}
+		if _, ok := next[key]; ok {
+			log.Printf("duplicated tunnel %s ignored", c.Name)
+			continue
+		}
+		client := r.tunnelConn(cfg, c)
+		t := tun.NewTunnel(client, c, false)
+		go t.Start()
+		next[key] = &runningTunnel{tunnel: t, conn: client, conf: c}
+		added++
+	}
+	removed := []*tun.Tunnel{}
+	for _, rt := range r.tunnels {
+		removed = append(removed, rt.tunnel)
+	}
+	r.tunnels = next
+	r.tunnelsMU.Unlock()
+
+	if len(removed) > 0 {
+		shutdownTunnels(removed)
+	}
+	r.retainConns()
+	return added, len(removed)
+}
+
+// retainConns stops the ssh connections no tunnel or section uses
+func (r *runner) retainConns() {
+	used := map[*sshc.SshConnection]bool{}
+	r.tunnelsMU.Lock()
+	for _, rt := range r.tunnels {
+		used[rt.conn] = true
+	}
+	for t, rt := range r.added {
+		select {
+		case <-t.Done():
+			// stopped by itself, see max_accepted
+			delete(r.added, t)
+		default:
+			used[rt.conn] = true
+		}
+	}
+	r.tunnelsMU.Unlock()
+	for c := range r.fixedConns {
+		used[c] = true
+	}
+	if r.sshConn != nil {
+		used[r.sshConn] = true
+	}
+	if n := r.pool.Retain(used); n > 0 {
+		log.Printf("%d unused ssh connections stopped", n)
+	}
+}
+
+// AddTunnel starts the tunnel c, requested through the control socket.
+// It uses the ssh clients of the last loaded config
+func (r *runner) AddTunnel(c *tun.TunnelConf) (int, error) {
+	r.tunnelsMU.Lock()
+	defer r.tunnelsMU.Unlock()
+	confs, err := r.cfg.ExpandTunnel(c)
+	if err != nil {
+		return 0, err
+	}
+	for _, tc := range confs {
+		if err := tc.Validate(); err != nil {
+			return 0, err
+		}
+		if tc.SshClientConf == nil && r.cfg.SshClient == nil {
+			return 0, fmt.Errorf("no sshclient configured for tunnel %s", tc.Name)
+		}
+	}
+	for _, tc := range confs {
+		client := r.tunnelConn(r.cfg, tc)
+		t := tun.NewTunnel(client, tc, true)
+		go t.Start()
+		r.added[t] = &runningTunnel{tunnel: t, conn: client, conf: tc}
+	}
+	log.Printf("%d tunnels added through the control socket", len(confs))
+	return len(confs), nil
+}
+
+// RemoveTunnel stops t, requested through the control socket. A config
+// tunnel is started again by the next reload
+func (r *runner) RemoveTunnel(t *tun.Tunnel) int {
+	r.tunnelsMU.Lock()
+	delete(r.added, t)
+	for key, rt := range r.tunnels {
+		if rt.tunnel == t {
+			delete(r.tunnels, key)
+		}
+	}
+	r.tunnelsMU.Unlock()
+
+	cut := t.Shutdown()
+	r.retainConns()
+	return cut
+}
+
+// RestartTunnel stops t and starts it again with the same configuration
+// and ssh connection, requested through the control socket
+func (r *runner) RestartTunnel(t *tun.Tunnel) (int, error) {
+	// a reload can't replace the tunnel meanwhile
+	r.reloadMU.Lock()
+	defer r.reloadMU.Unlock()
+
+	r.tunnelsMU.Lock()
+	key := ""
+	rt, stoppable := r.added[t]
+	for k, v := range r.tunnels {
+		if v.tunnel == t {
+			key, rt = k, v
+		}
+	}
+	r.tunnelsMU.Unlock()
+	if rt == nil {
+		return 0, fmt.Errorf("the tunnel %s is not managed by this instance", t.GetName())
+	}
+
+	cut := t.Shutdown()
+	restarted := &runningTunnel{
+		tunnel: tun.NewTunnel(rt.conn, rt.conf, stoppable),
+		conn:   rt.conn,
+		conf:   rt.conf,
+	}
+	go restarted.tunnel.Start()
+
+	r.tunnelsMU.Lock()
+	if key != "" {
+		r.tunnels[key] = restarted
+	} else {
+		delete(r.added, t)
+		r.added[restarted.tunnel] = restarted
+	}
+	r.tunnelsMU.Unlock()
+	log.Printf("tunnel %s restarted through the control socket", t.GetName())
+	return cut, nil
+}
+
+// list returns the running tunnels
+func (r *runner) list() []*tun.Tunnel {
+	r.tunnelsMU.Lock()
+	defer r.tunnelsMU.Unlock()
+	res := []*tun.Tunnel{}
+	for _, rt := range r.tunnels {
+		res = append(res, rt.tunnel)
+	}
+	for t := range r.added {
+		res = append(res, t)
+	}
+	return res
+}
+
+// pendingTunnels returns the running tunnels that didn't stop by
+// themselves yet
+func (r *runner) pendingTunnels() []*tun.Tunnel {
+	res := []*tun.Tunnel{}
+	for _, t := range r.list() {
+		select {
+		case <-t.Done():
+		default:
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// tunnelsDone is like the tunnelsDone function, but follows the
+// tunnels added and removed by the reloads
+func (r *runner) tunnelsDone() <-chan struct{} {
+	if len(r.list()) == 0 {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			pending := r.pendingTunnels()
+			if len(pending) == 0 {
+				close(done)
+				return
+			}
+			for _, t := range pending {
+				<-t.Done()
+			}
+		}
+	}()
+	return done
+}
+
+// reload reads the config file again and applies the changes to the
+// tunnels and to the sshd keys. The other sections need a restart
+func (r *runner) reload() error {
+	r.reloadMU.Lock()
+	defer r.reloadMU.Unlock()
+	systemd.Reloading()
+	defer systemd.Ready()
+
+	cfg, err := conf.LoadConfigProfile(r.path, r.profile)
+	if err != nil {
+		return err
+	}
+	if r.sshServer != nil && cfg.SshD != nil {
+		if err := r.sshServer.ReloadKeys(cfg.SshD); err != nil {
+			return fmt.Errorf("sshd keys reload failed: %s", err)
+		}
+	} else if r.hasSshD != (cfg.SshD != nil) {
+		log.Println("adding or removing the sshd section needs a restart")
+	}
+	added, removed := r.applyTunnels(cfg)
+	log.Printf("config reloaded. %d tunnels added, %d removed", added, removed)
+	return nil
+}
+
+// watchReload reloads the config on SIGHUP and, if watch is set, when
+// the config file changes
+func (r *runner) watchReload(watch bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var modTime time.Time
+	if watch {
+		if info, err := os.Stat(r.path); err == nil {
+			modTime = info.ModTime()
+		}
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading the config")
+		case <-tick:
+			info, err := os.Stat(r.path)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = info.ModTime()
+			log.Println("config file changed, reloading")
+		}
+		if err := r.reload(); err != nil {
+			log.Printf("config reload failed, keeping the current one: %s", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/conf"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(secretCmd)
+
+	secretCmd.AddCommand(secretKeygenCmd)
+	secretCmd.AddCommand(secretEncryptCmd)
+	secretEncryptCmd.Flags().StringArrayP("recipient", "r", []string{}, "the age recipient, like age1... Repeat it for more recipients")
+	secretCmd.AddCommand(secretDecryptCmd)
+}
+
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Encrypts the config secrets",
+	Long: `Encrypts the config secrets.
+
+A config value like "password: ENC[age,...]" is decrypted at load time
+with the age key of the ROSPO_AGE_KEY environment variable, or of the
+file at ROSPO_AGE_KEY_FILE. The configs can be committed with their
+secrets encrypted, and only the hosts holding the key can run them.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  func(cmd *cobra.Command, args []string) {},
+}
+
+var secretKeygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generates an age key",
+	Long: `Generates an age key.
+
+The key is printed on stdout, its recipient, to encrypt the values with,
+on stderr.`,
+	Example: `
+  # generates a key file
+  $ rospo secret keygen > rospo.agekey
+	`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		key, recipient, err := conf.GenerateAgeKey()
+		exitOnError(err)
+		fmt.Fprintf(os.Stderr, "recipient: %s\n", recipient)
+		fmt.Println(key)
+	},
+}
+
+// secretArg returns the value argument, or the stdin content if not given
+func secretArg(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	data, err := io.ReadAll(os.Stdin)
+	exitOnError(err)
+	return strings.TrimSuffix(string(data), "\n")
+}
+
+var secretEncryptCmd = &cobra.Command{
+	Use:   "encrypt [value]",
+	Short: "Encrypts a config value",
+	Long: `Encrypts a config value for the age recipients.
+
+The value is read from stdin if not given, so that it is not left in the
+shell history. The output replaces the value in the config file.`,
+	Example: `
+  # encrypts the password read from stdin
+  $ rospo secret encrypt -r age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+	`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		recipients, _ := cmd.Flags().GetStringArray("recipient")
+		res, err := conf.Encrypt(secretArg(args), recipients)
+		exitOnError(err)
+		fmt.Println(res)
+	},
+}
+
+var secretDecryptCmd = &cobra.Command{
+	Use:   "decrypt [value]",
+	Short: "Decrypts a config value",
+	Long: `Decrypts a config value with the age key of the ROSPO_AGE_KEY or
+the ROSPO_AGE_KEY_FILE environment variables.
+
+The value is read from stdin if not given.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		res, err := conf.Decrypt(secretArg(args))
+		exitOnError(err)
+		fmt.Println(res)
+	},
+}
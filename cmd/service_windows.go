@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ferama/rospo/pkg/logger"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	defaultServiceName = "rospo"
+	// how long the start and stop commands wait for the service state
+	serviceStateTimeout = 30 * time.Second
+	// the failures counter is reset after a day without failures
+	serviceRecoveryReset = 24 * 60 * 60
+)
+
+// the service restart delays after the first, the second and the next
+// failures
+var serviceRestartDelays = []time.Duration{5 * time.Second, 30 * time.Second, 60 * time.Second}
+
+func init() {
+	rootCmd.AddCommand(serviceCmd)
+	serviceCmd.PersistentFlags().StringP("name", "n", defaultServiceName, "the windows service name")
+
+	serviceCmd.AddCommand(serviceInstallCmd)
+	serviceInstallCmd.Flags().String("display-name", "Rospo", "the service display name")
+	serviceInstallCmd.Flags().String("description", "rospo ssh tunnels", "the service description")
+	serviceInstallCmd.Flags().Bool("manual", false, "the service is started manually instead of on boot")
+	serviceInstallCmd.Flags().String("profile", "", "the config profile merged over the config values")
+
+	serviceCmd.AddCommand(serviceUninstallCmd)
+	serviceCmd.AddCommand(serviceStartCmd)
+	serviceCmd.AddCommand(serviceStopCmd)
+
+	rootCmd.PersistentFlags().String("eventlog", "", "write the logs to the windows event log with this source name")
+	rootCmd.PersistentFlags().MarkHidden("eventlog")
+	platformPreRun = openEventLog
+}
+
+// eventLogWriter writes the log lines to the windows event log
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	if err := w.elog.Info(1, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// openEventLog redirects the logs to the event log, if the eventlog
+// flag is set. The service command sets it in the service command line
+func openEventLog(cmd *cobra.Command) {
+	source, _ := cmd.Flags().GetString("eventlog")
+	if source == "" {
+		return
+	}
+	elog, err := eventlog.Open(source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to open the event log: %s\n", err)
+		return
+	}
+	logger.SetOutput(&eventLogWriter{elog: elog})
+}
+
+// openService connects to the service manager and opens the service
+// named by the name flag
+func openService(cmd *cobra.Command) (*mgr.Mgr, *mgr.Service) {
+	name, _ := cmd.Flags().GetString("name")
+	m, err := mgr.Connect()
+	exitOnError(err)
+	s, err := m.OpenService(name)
+	if err != nil {
+		m.Disconnect()
+		exitOnError(fmt.Errorf("service %s: %s", name, err))
+	}
+	return m, s
+}
+
+// waitServiceState waits for the service to reach state
+func waitServiceState(s *mgr.Service, state svc.State) error {
+	deadline := time.Now().Add(serviceStateTimeout)
+	for {
+		status, err := s.Query()
+		if err != nil {
+			return err
+		}
+		if status.State == state {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for the service state %d", state)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Manages the rospo windows service",
+	Long: `Manages the rospo windows service.
+
+The service runs a config file like the run command does. It starts on
+boot, is restarted by the service manager if it fails, and writes its
+logs to the windows event log. The commands need administrative rights.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  func(cmd *cobra.Command, args []string) {},
+}
+
+var serviceInstallCmd = &cobra.Command{
+	Use:   "install config_file_path.yaml",
+	Short: "Installs the windows service running the config file",
+	Example: `
+  # installs and starts the service
+  $ rospo service install C:\rospo\config.yaml
+  $ rospo service start
+
+  # installs a second instance with another name
+  $ rospo service install -n rospo-rdp C:\rospo\rdp.yaml
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, _ := cmd.Flags().GetString("name")
+		displayName, _ := cmd.Flags().GetString("display-name")
+		description, _ := cmd.Flags().GetString("description")
+		manual, _ := cmd.Flags().GetBool("manual")
+		profile, _ := cmd.Flags().GetString("profile")
+
+		exe, err := os.Executable()
+		exitOnError(err)
+		configPath, err := filepath.Abs(args[0])
+		exitOnError(err)
+		if _, err := os.Stat(configPath); err != nil {
+			exitOnError(err)
+		}
+
+		m, err := mgr.Connect()
+		exitOnError(err)
+		defer m.Disconnect()
+		if s, err := m.OpenService(name); err == nil {
+			s.Close()
+			exitOnError(fmt.Errorf("service %s already exists", name))
+		}
+
+		startType := uint32(mgr.StartAutomatic)
+		if manual {
+			startType = mgr.StartManual
+		}
+		serviceArgs := []string{"run", configPath, "--eventlog", name}
+		if profile != "" {
+			serviceArgs = append(serviceArgs, "--profile", profile)
+		}
+		s, err := m.CreateService(name, exe, mgr.Config{
+			DisplayName: displayName,
+			Description: description,
+			StartType:   startType,
+		}, serviceArgs...)
+		exitOnError(err)
+		defer s.Close()
+
+		actions := []mgr.RecoveryAction{}
+		for _, delay := range serviceRestartDelays {
+			actions = append(actions, mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: delay})
+		}
+		if err := s.SetRecoveryActions(actions, serviceRecoveryReset); err != nil {
+			s.Delete()
+			exitOnError(err)
+		}
+		if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			exitOnError(fmt.Errorf("event log source install failed: %s", err))
+		}
+		fmt.Printf("service %s installed\n", name)
+	},
+}
+
+var serviceUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Stops and removes the windows service",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		m, s := openService(cmd)
+		defer m.Disconnect()
+		defer s.Close()
+
+		if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+			if _, err := s.Control(svc.Stop); err == nil {
+				waitServiceState(s, svc.Stopped)
+			}
+		}
+		exitOnError(s.Delete())
+		eventlog.Remove(s.Name)
+		fmt.Printf("service %s uninstalled\n", s.Name)
+	},
+}
+
+var serviceStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Starts the windows service",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		m, s := openService(cmd)
+		defer m.Disconnect()
+		defer s.Close()
+
+		exitOnError(s.Start())
+		exitOnError(waitServiceState(s, svc.Running))
+		fmt.Printf("service %s started\n", s.Name)
+	},
+}
+
+var serviceStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stops the windows service",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		m, s := openService(cmd)
+		defer m.Disconnect()
+		defer s.Close()
+
+		_, err := s.Control(svc.Stop)
+		exitOnError(err)
+		exitOnError(waitServiceState(s, svc.Stopped))
+		fmt.Printf("service %s stopped\n", s.Name)
+	},
+}
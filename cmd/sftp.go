@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/pkg/sftp"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(sftpCmd)
+
+	cmnflags.AddSshClientFlags(sftpCmd.Flags())
+}
+
+const sftpHelp = `Available commands:
+  cd path                       change the remote directory
+  chmod mode path               change the remote path permissions
+  get [-r] remote [local]       download a file, or a directory with -r
+  help                          show this help
+  lcd path                      change the local directory
+  lls [path]                    list a local directory
+  lpwd                          print the local directory
+  ls [path]                     list a remote directory
+  mkdir path                    create a remote directory
+  put [-r] local [remote]       upload a file, or a directory with -r
+  pwd                           print the remote directory
+  rename old new                rename a remote path
+  rm path                       remove a remote file
+  rmdir path                    remove a remote empty directory
+  exit, quit                    exit the sftp session
+`
+
+// sftpSession holds the interactive sftp session state
+type sftpSession struct {
+	client *sftp.Client
+	out    io.Writer
+	// the remote working directory
+	cwd string
+}
+
+// remotePath resolves p against the remote working directory
+func (s *sftpSession) remotePath(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+	return path.Join(s.cwd, p)
+}
+
+// run runs a single command line. It returns false when the session
+// has to end
+func (s *sftpSession) run(line string) (bool, error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return true, nil
+	}
+	name, args := args[0], args[1:]
+	recursive := (name == "get" || name == "put") && len(args) > 0 && args[0] == "-r"
+	if recursive {
+		args = args[1:]
+	}
+
+	arity := map[string][2]int{
+		"cd": {1, 1}, "chmod": {2, 2}, "get": {1, 2}, "lcd": {1, 1},
+		"lls": {0, 1}, "ls": {0, 1}, "mkdir": {1, 1}, "put": {1, 2},
+		"rename": {2, 2}, "rm": {1, 1}, "rmdir": {1, 1},
+	}
+	if n, ok := arity[name]; ok && (len(args) < n[0] || len(args) > n[1]) {
+		return true, fmt.Errorf("wrong number of arguments for %s", name)
+	}
+
+	switch name {
+	case "exit", "quit", "bye":
+		return false, nil
+	case "help", "?":
+		fmt.Fprint(s.out, sftpHelp)
+	case "pwd":
+		fmt.Fprintln(s.out, s.cwd)
+	case "lpwd":
+		wd, err := os.Getwd()
+		if err != nil {
+			return true, err
+		}
+		fmt.Fprintln(s.out, wd)
+	case "cd":
+		dir := s.remotePath(args[0])
+		stat, err := s.client.Stat(dir)
+		if err != nil {
+			return true, fmt.Errorf("cannot stat remote path: %s", dir)
+		}
+		if !stat.IsDir() {
+			return true, fmt.Errorf("not a directory: %s", dir)
+		}
+		s.cwd = dir
+	case "lcd":
+		return true, os.Chdir(args[0])
+	case "ls":
+		dir := s.cwd
+		if len(args) > 0 {
+			dir = s.remotePath(args[0])
+		}
+		entries, err := s.client.ReadDir(dir)
+		if err != nil {
+			return true, err
+		}
+		s.list(entries)
+	case "lls":
+		dir := "."
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return true, err
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		s.list(infos)
+	case "get":
+		local := "."
+		if len(args) > 1 {
+			local = args[1]
+		}
+		return true, copyPath(s.client, s.remotePath(args[0]), local, false, recursive)
+	case "put":
+		remote := s.cwd
+		if len(args) > 1 {
+			remote = s.remotePath(args[1])
+		}
+		return true, copyPath(s.client, args[0], remote, true, recursive)
+	case "mkdir":
+		return true, s.client.Mkdir(s.remotePath(args[0]))
+	case "rmdir":
+		return true, s.client.RemoveDirectory(s.remotePath(args[0]))
+	case "rm":
+		return true, s.client.Remove(s.remotePath(args[0]))
+	case "rename":
+		return true, s.client.Rename(s.remotePath(args[0]), s.remotePath(args[1]))
+	case "chmod":
+		mode, err := strconv.ParseUint(args[0], 8, 32)
+		if err != nil {
+			return true, fmt.Errorf("invalid mode: %s", args[0])
+		}
+		return true, s.client.Chmod(s.remotePath(args[1]), os.FileMode(mode))
+	default:
+		return true, fmt.Errorf("unknown command %s, type help for the commands list", name)
+	}
+	return true, nil
+}
+
+func (s *sftpSession) list(infos []os.FileInfo) {
+	w := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%d\t %s\t %s\n",
+			info.Mode(),
+			info.Size(),
+			info.ModTime().Format("Jan _2 15:04"),
+			info.Name(),
+		)
+	}
+	w.Flush()
+}
+
+var sftpCmd = &cobra.Command{
+	Use:   "sftp [user@]host[:port]",
+	Short: "Starts an interactive sftp session",
+	Long: `Starts an interactive sftp session to browse the remote server and
+to download and upload files. Type help at the prompt for the commands list.`,
+	Example: `
+  # starts an sftp session through a jump host
+  $ rospo sftp -j jumpuser@jumphost:22 user@server:2222
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
+		sshcConf.Quiet = true
+		conn := sshc.NewSshConnection(sshcConf)
+		go conn.Start()
+		conn.ReadyWait()
+
+		client, err := sftp.NewClient(conn.Client)
+		exitOnError(err)
+		cwd, err := client.Getwd()
+		exitOnError(err)
+
+		session := &sftpSession{
+			client: client,
+			out:    os.Stdout,
+			cwd:    cwd,
+		}
+		scanner := bufio.NewScanner(os.Stdin)
+		for {
+			fmt.Print("sftp> ")
+			if !scanner.Scan() {
+				fmt.Println()
+				break
+			}
+			more, err := session.run(scanner.Text())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR %s\n", err)
+			}
+			if !more {
+				break
+			}
+		}
+		client.Close()
+		conn.Stop()
+	},
+}
@@ -1,30 +1,54 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"strings"
 
 	"github.com/ferama/rospo/cmd/cmnflags"
 	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
 )
 
 func init() {
 	rootCmd.AddCommand(shellCmd)
 
 	cmnflags.AddSshClientFlags(shellCmd.Flags())
+	shellCmd.Flags().BoolP("no-pty", "T", false, "don't request a pty, even if the standard input is a terminal")
 }
 
 var shellCmd = &cobra.Command{
 	Use:   "shell [user@]host[:port] [cmd_string]",
 	Short: "Starts a remote shell",
-	Long:  "Starts a remote shell",
-	Args:  cobra.MinimumNArgs(1),
+	Long: `Starts a remote shell, or runs a command, on the remote server.
+
+If the standard input is a terminal, a pty is requested and the local
+terminal is put in raw mode, with its size changes sent to the server.
+The command exits with the remote exit status, or 255 if the session
+failed, like ssh does.`,
+	Example: `
+  # opens a shell through a jump host
+  $ rospo shell -j jumpuser@jumphost:22 user@server:2222
+
+  # runs a command and exits with its status
+  $ rospo shell user@server:2222 "systemctl is-active nginx"
+	`,
+	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		noPty, _ := cmd.Flags().GetBool("no-pty")
 		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
 		conn := sshc.NewSshConnection(sshcConf)
 		go conn.Start()
 
 		remoteShell := sshc.NewRemoteShell(conn)
-		remoteShell.Start(strings.Join(args[1:], " "), true)
+		err := remoteShell.Start(strings.Join(args[1:], " "), !noPty)
+		var exitErr *ssh.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+		conn.Stop()
+		os.Exit(sshc.ExitCode(err))
 	},
 }
@@ -1,27 +1,75 @@
 package cmd
 
 import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/ferama/rospo/cmd/cmnflags"
 	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/systemd"
 
 	"github.com/spf13/cobra"
 )
 
+// how long the sshd server waits for sessions to drain
+// when stopping or restarting
+const sshdStopTimeout = 10 * time.Second
+
 func init() {
 	rootCmd.AddCommand(sshdCmd)
 
 	cmnflags.AddSshDFlags(sshdCmd.Flags())
 	sshdCmd.Flags().BoolP("disable-shell", "D", false, "if set disable shell/exec")
+	sshdCmd.Flags().Bool("tunnel-only", false, "if set reject sessions (shell/exec/sftp) and allow tunnels only")
 }
 
 var sshdCmd = &cobra.Command{
 	Use:   "sshd",
 	Short: "Starts the sshd server",
-	Long:  `Starts the sshd server`,
+	Long: `Starts the sshd server
+
+Send a SIGHUP to gracefully restart the server (server key and
+authorized keys are reloaded)`,
 	Run: func(cmd *cobra.Command, args []string) {
 		disableShell, _ := cmd.Flags().GetBool("disable-shell")
+		tunnelOnly, _ := cmd.Flags().GetBool("tunnel-only")
 		config := cmnflags.GetSshDConf(cmd)
 		config.DisableShell = disableShell
-		sshd.NewSshServer(config).Start()
+		config.DisableSession = tunnelOnly
+
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP, os.Interrupt)
+		systemd.StartWatchdog()
+		for {
+			server := sshd.NewSshServer(config)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- server.Start()
+			}()
+			systemd.Ready()
+
+			var sig os.Signal
+			select {
+			case sig = <-c:
+			case err := <-errCh:
+				log.Fatalf("sshd server failed: %s", err)
+			}
+			if sig == syscall.SIGHUP {
+				systemd.Reloading()
+			} else {
+				systemd.Stopping()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), sshdStopTimeout)
+			server.Stop(ctx)
+			cancel()
+			if sig != syscall.SIGHUP {
+				return
+			}
+			log.Println("restarting sshd server")
+		}
 	},
 }
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/control"
+	"github.com/ferama/rospo/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().StringP("socket", "s", control.DefaultSocketPath, "the control socket of the running instance")
+	cmnflags.AddOutputFlags(statusCmd.Flags())
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Prints the status of a running instance",
+	Long: `Prints the status of a running instance.
+
+The instance must be started by the run command with a control socket,
+set by the control_socket config option or the --control-socket flag.
+The ssh connections state, the tunnels with their stats and the sshd
+sessions are printed.`,
+	Example: `
+  # queries the instance started with "control_socket: /tmp/rospo.sock"
+  $ rospo status -s /tmp/rospo.sock
+
+  # prints the status as json, for scripts
+  $ rospo status --json | jq '.tunnels[].stats'
+
+  # prints the ssh connections uptime
+  $ rospo status --format '{{range .Connections}}{{.Server}} {{.Uptime}}{{"\n"}}{{end}}'
+	`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		socket, _ := cmd.Flags().GetString("socket")
+		status, err := control.QueryStatus(socket)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to get the status from %s: %s\n", socket, err)
+			os.Exit(1)
+		}
+
+		if printOutput(cmd, status) {
+			return
+		}
+		printStatus(status)
+	},
+}
+
+// printStatus prints the status as tables
+func printStatus(status *control.Status) {
+	fmt.Printf("rospo %s, pid %d, up %s\n", status.Version, status.Pid, status.Uptime.Round(time.Second))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nSSH CONNECTIONS")
+	fmt.Fprintln(w, "SERVER\tSTATUS\tON DEMAND")
+	for _, c := range status.Connections {
+		fmt.Fprintf(w, "%s\t%s\t%t\n", c.Server, c.Status, c.OnDemand)
+	}
+
+	fmt.Fprintln(w, "\nTUNNELS")
+	printTunnels(w, status.Tunnels)
+
+	if status.SshD != nil {
+		stats := status.SshD.Stats
+		fmt.Fprintf(w, "\nSSHD: %d connections, %d sessions, %d forwards, auth %d ok %d failed\n",
+			stats.ActiveConnections, stats.ActiveSessions, stats.OpenForwards,
+			stats.AuthSuccesses, stats.AuthFailures)
+		channels := []string{}
+		for name := range stats.Channels {
+			channels = append(channels, name)
+		}
+		sort.Strings(channels)
+		for _, name := range channels {
+			c := stats.Channels[name]
+			fmt.Fprintf(w, "  %s: %d open, %d total, in %s, out %s\n", name, c.Open, c.Total,
+				utils.ByteCountSI(c.BytesIn), utils.ByteCountSI(c.BytesOut))
+		}
+		fmt.Fprintln(w, "ID\tUSER\tREMOTE\tCLIENT\tSINCE\tFORWARDS")
+		for _, s := range status.SshD.Sessions {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\n", s.ID, s.User, s.RemoteAddr,
+				strings.TrimPrefix(s.ClientVersion, "SSH-2.0-"),
+				time.Since(s.Since).Round(time.Second), s.Forwards)
+		}
+	}
+	w.Flush()
+}
+
+// printTunnels prints the tunnels table rows to w
+func printTunnels(w io.Writer, tunnels []control.TunnelStatus) {
+	fmt.Fprintln(w, "ID\tNAME\tTYPE\tLISTENER\tENDPOINT\tUP\tACTIVE\tACCEPTED\tIN\tOUT\tLAST ERROR")
+	for _, t := range tunnels {
+		kind := "reverse"
+		if t.Forward {
+			kind = "forward"
+		}
+		if t.Dynamic {
+			kind += " dynamic"
+		}
+		up := "-"
+		if t.Paused {
+			up = "paused"
+		} else if t.Stats.Uptime > 0 {
+			up = t.Stats.Uptime.Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			t.ID, t.Name, kind, t.Listener, t.Endpoint, up,
+			t.Stats.ActiveConnections, t.Stats.AcceptedConnections,
+			utils.ByteCountSI(t.Stats.BytesIn), utils.ByteCountSI(t.Stats.BytesOut),
+			t.Stats.LastError)
+	}
+}
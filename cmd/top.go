@@ -0,0 +1,370 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ferama/rospo/pkg/control"
+	"github.com/ferama/rospo/pkg/utils"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func init() {
+	rootCmd.AddCommand(topCmd)
+	topCmd.Flags().StringP("socket", "s", control.DefaultSocketPath, "the control socket of the running instance")
+	topCmd.Flags().DurationP("interval", "n", time.Second, "the refresh interval")
+}
+
+// how many throughput samples the sparklines show
+const sparklineSamples = 20
+
+var sparklineBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws the samples as a line of blocks, scaled to the
+// highest one
+func sparkline(samples []int64) string {
+	var max int64
+	for _, s := range samples {
+		if s > max {
+			max = s
+		}
+	}
+	res := make([]rune, len(samples))
+	for i, s := range samples {
+		idx := 0
+		if max > 0 {
+			idx = int(s * int64(len(sparklineBlocks)-1) / max)
+		}
+		res[i] = sparklineBlocks[idx]
+	}
+	return string(res)
+}
+
+// topView is the state of the top command screen
+type topView struct {
+	socket   string
+	interval time.Duration
+
+	status *control.Status
+	err    error
+	// the id of the selected tunnel
+	selected int
+	// the throughput samples, in bytes per second, by tunnel id
+	history map[int][]int64
+	// the bytes transferred by the tunnels at the last update
+	lastBytes map[int]int64
+	lastTime  time.Time
+	// the outcome of the last action
+	message string
+}
+
+// update queries the status again and samples the tunnels throughput
+func (v *topView) update() {
+	status, err := control.QueryStatus(v.socket)
+	v.err = err
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	elapsed := now.Sub(v.lastTime).Seconds()
+	history := make(map[int][]int64)
+	lastBytes := make(map[int]int64)
+	for _, t := range status.Tunnels {
+		bytes := t.Stats.BytesIn + t.Stats.BytesOut
+		samples := v.history[t.ID]
+		if prev, ok := v.lastBytes[t.ID]; ok && elapsed > 0 {
+			samples = append(samples, int64(float64(bytes-prev)/elapsed))
+		}
+		if len(samples) > sparklineSamples {
+			samples = samples[len(samples)-sparklineSamples:]
+		}
+		history[t.ID] = samples
+		lastBytes[t.ID] = bytes
+	}
+	v.status = status
+	v.history = history
+	v.lastBytes = lastBytes
+	v.lastTime = now
+	v.selectTunnel(0)
+}
+
+// selectTunnel moves the selection by delta rows, keeping it on an
+// existing tunnel
+func (v *topView) selectTunnel(delta int) {
+	if v.status == nil || len(v.status.Tunnels) == 0 {
+		v.selected = -1
+		return
+	}
+	idx := 0
+	for i, t := range v.status.Tunnels {
+		if t.ID == v.selected {
+			idx = i
+		}
+	}
+	idx += delta
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(v.status.Tunnels) {
+		idx = len(v.status.Tunnels) - 1
+	}
+	v.selected = v.status.Tunnels[idx].ID
+}
+
+// selectedTunnel returns the selected tunnel, nil if none
+func (v *topView) selectedTunnel() *control.TunnelStatus {
+	if v.status == nil {
+		return nil
+	}
+	for i, t := range v.status.Tunnels {
+		if t.ID == v.selected {
+			return &v.status.Tunnels[i]
+		}
+	}
+	return nil
+}
+
+// action runs the action of key on the selected tunnel and returns its
+// outcome. It can block while the tunnel connections are drained
+func (v *topView) action(key string, t control.TunnelStatus) string {
+	var err error
+	res := ""
+	switch key {
+	case "p":
+		if t.Paused {
+			err = control.ResumeTunnel(v.socket, t.ID)
+			res = fmt.Sprintf("tunnel %d resumed", t.ID)
+		} else {
+			err = control.PauseTunnel(v.socket, t.ID)
+			res = fmt.Sprintf("tunnel %d paused", t.ID)
+		}
+	case "r":
+		var cut int
+		cut, err = control.RestartTunnel(v.socket, t.ID)
+		res = fmt.Sprintf("tunnel %d restarted, %d connections cut", t.ID, cut)
+	case "s":
+		var cut int
+		cut, err = control.RemoveTunnel(v.socket, t.ID)
+		res = fmt.Sprintf("tunnel %d stopped, %d connections cut", t.ID, cut)
+	}
+	if err != nil {
+		return fmt.Sprintf("tunnel %d: %s", t.ID, err)
+	}
+	return res
+}
+
+// render draws the screen, fitting it in width and height
+func (v *topView) render(width, height int) string {
+	var lines []string
+	table := func(rows func(w *tabwriter.Writer)) {
+		var buf bytes.Buffer
+		w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		rows(w)
+		w.Flush()
+		lines = append(lines, strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")...)
+	}
+
+	if v.status == nil {
+		lines = append(lines, fmt.Sprintf("connecting to %s...", v.socket))
+	} else {
+		s := v.status
+		lines = append(lines, fmt.Sprintf("rospo %s, pid %d, up %s, refresh %s",
+			s.Version, s.Pid, s.Uptime.Round(time.Second), v.interval))
+	}
+	if v.err != nil {
+		lines = append(lines, fmt.Sprintf("ERROR %s", v.err))
+	}
+	selectedLine := -1
+	if s := v.status; s != nil {
+		lines = append(lines, "", "SSH CONNECTIONS")
+		table(func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "SERVER\tSTATUS\tON DEMAND")
+			for _, c := range s.Connections {
+				fmt.Fprintf(w, "%s\t%s\t%t\n", c.Server, c.Status, c.OnDemand)
+			}
+		})
+
+		lines = append(lines, "", "TUNNELS")
+		first := len(lines) + 1
+		table(func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "ID\tNAME\tLISTENER\tENDPOINT\tUP\tACTIVE\tRATE\tTHROUGHPUT")
+			for i, t := range s.Tunnels {
+				up := "-"
+				if t.Paused {
+					up = "paused"
+				} else if t.Stats.Uptime > 0 {
+					up = t.Stats.Uptime.Round(time.Second).String()
+				}
+				samples := v.history[t.ID]
+				rate := int64(0)
+				if len(samples) > 0 {
+					rate = samples[len(samples)-1]
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s/s\t%s\n",
+					t.ID, t.Name, t.Listener, t.Endpoint, up,
+					t.Stats.ActiveConnections, utils.ByteCountSI(rate), sparkline(samples))
+				if t.ID == v.selected {
+					selectedLine = first + i
+				}
+			}
+		})
+
+		if t := v.selectedTunnel(); t != nil {
+			lines = append(lines, "", fmt.Sprintf("CONNECTIONS OF TUNNEL %d %s", t.ID, t.Name))
+			table(func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "ID\tPEER\tIN\tOUT\tDURATION")
+				for _, c := range t.Connections {
+					fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", c.ID, c.Peer,
+						utils.ByteCountSI(c.BytesIn), utils.ByteCountSI(c.BytesOut),
+						c.Duration.Round(time.Second))
+				}
+			})
+		}
+
+		if s.SshD != nil {
+			lines = append(lines, "", "SSHD SESSIONS")
+			table(func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "ID\tUSER\tREMOTE\tCLIENT\tSINCE\tFORWARDS")
+				for _, c := range s.SshD.Sessions {
+					fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\n", c.ID, c.User, c.RemoteAddr,
+						strings.TrimPrefix(c.ClientVersion, "SSH-2.0-"),
+						time.Since(c.Since).Round(time.Second), c.Forwards)
+				}
+			})
+		}
+	}
+
+	footer := []string{v.message, "up/down select, p pause/resume, r restart, s stop, q quit"}
+	room := height - len(footer)
+	if room < 0 {
+		room = 0
+	}
+	if len(lines) > room {
+		lines = lines[:room]
+	}
+	for len(lines) < room {
+		lines = append(lines, "")
+	}
+	lines = append(lines, footer...)
+
+	for i, line := range lines {
+		if runes := []rune(line); len(runes) > width {
+			line = string(runes[:width])
+		}
+		// clears the rest of the previous frame line
+		line += "\033[K"
+		if i == selectedLine {
+			line = "\033[7m" + line + "\033[0m"
+		}
+		lines[i] = line
+	}
+	return "\033[H" + strings.Join(lines, "\r\n")
+}
+
+// readKeys sends the keys read from the raw terminal. The arrows are
+// translated to "up" and "down"
+func readKeys(keys chan<- string) {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		switch in := string(buf[:n]); in {
+		case "\033[A", "\033OA", "k":
+			keys <- "up"
+		case "\033[B", "\033OB", "j":
+			keys <- "down"
+		case "\x03":
+			keys <- "q"
+		default:
+			keys <- in
+		}
+	}
+}
+
+var topCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Shows a live dashboard of a running instance",
+	Long: `Shows a live dashboard of a running instance, through its control socket.
+
+The ssh connections state, the tunnels with their throughput, the active
+connections of the selected tunnel and the sshd sessions are refreshed
+at every interval. The selected tunnel can be paused and resumed,
+restarted or stopped.`,
+	Example: `
+  # watches the instance started with "control_socket: /tmp/rospo.sock"
+  $ rospo top -s /tmp/rospo.sock
+	`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		socket, _ := cmd.Flags().GetString("socket")
+		interval, _ := cmd.Flags().GetDuration("interval")
+
+		stdin, stdout := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+		if !term.IsTerminal(stdin) || !term.IsTerminal(stdout) {
+			exitOnError(fmt.Errorf("the top command needs a terminal, use the status one instead"))
+		}
+		state, err := term.MakeRaw(stdin)
+		exitOnError(err)
+		// the alternate screen, without the cursor
+		fmt.Print("\033[?1049h\033[?25l")
+		defer func() {
+			fmt.Print("\033[?25h\033[?1049l")
+			term.Restore(stdin, state)
+		}()
+
+		view := &topView{
+			socket:   socket,
+			interval: interval,
+			selected: -1,
+		}
+		keys := make(chan string)
+		go readKeys(keys)
+		results := make(chan string)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		view.update()
+		for {
+			width, height, err := term.GetSize(stdout)
+			if err != nil {
+				width, height = 80, 24
+			}
+			fmt.Print(view.render(width, height))
+
+			select {
+			case <-ticker.C:
+				view.update()
+			case msg := <-results:
+				view.message = msg
+				view.update()
+			case key, ok := <-keys:
+				if !ok {
+					return
+				}
+				switch key {
+				case "q":
+					return
+				case "up":
+					view.selectTunnel(-1)
+				case "down":
+					view.selectTunnel(1)
+				case "p", "r", "s":
+					if t := view.selectedTunnel(); t != nil {
+						view.message = "working..."
+						go func(t control.TunnelStatus) {
+							results <- view.action(key, t)
+						}(*t)
+					}
+				}
+			}
+		}
+	},
+}
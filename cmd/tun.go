@@ -12,6 +12,14 @@ func init() {
 
 	tunCmd.PersistentFlags().StringP("local", "l", "127.0.0.1:2222", "the local tunnel endpoint")
 	tunCmd.PersistentFlags().StringP("remote", "r", "127.0.0.1:2222", "the remote tunnel endpoint")
+	tunCmd.PersistentFlags().String("bind-address", "", "the address the tunnel listener is bound to. Use 0.0.0.0 to listen on all the interfaces")
+	tunCmd.PersistentFlags().StringArray("allowed-source", []string{}, "a CIDR or ip allowed to connect to the tunnel listener. Can be repeated. Default any")
+	tunCmd.PersistentFlags().Bool("print-port", false, "print a json line with the listener address and port on stdout once listening")
+	tunCmd.PersistentFlags().String("port-file", "", "write the listener port to this file once listening")
+	tunCmd.PersistentFlags().Int("drain-timeout", 0, "the seconds the active connections can take to complete when the tunnel is stopped")
+	tunCmd.PersistentFlags().Int("max-accepted", 0, "stop the tunnel once it accepted this many connections and they completed. 0 means unlimited")
+	tunCmd.PersistentFlags().Int("lifetime", 0, "stop the tunnel after this many seconds. 0 means unlimited")
+	tunCmd.PersistentFlags().Int("idle-timeout", 0, "stop the tunnel after this many seconds without connections. 0 means unlimited")
 }
 
 var tunCmd = &cobra.Command{
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/control"
+	"github.com/ferama/rospo/pkg/tun"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	for _, c := range []*cobra.Command{tunLsCmd, tunAddCmd, tunPauseCmd, tunResumeCmd, tunRestartCmd, tunRmCmd} {
+		tunCmd.AddCommand(c)
+		c.Flags().StringP("control-socket", "c", control.DefaultSocketPath, "the control socket of the running instance")
+	}
+	for _, c := range []*cobra.Command{tunLsCmd, tunAddCmd, tunRestartCmd, tunRmCmd} {
+		cmnflags.AddOutputFlags(c.Flags())
+	}
+
+	tunAddCmd.Flags().String("name", "", "the tunnel name")
+	tunAddCmd.Flags().BoolP("forward", "f", false, "add a forward tunnel. Reverse if not set")
+	tunAddCmd.Flags().BoolP("dynamic", "d", false, "add a dynamic (SOCKS5) tunnel")
+	tunAddCmd.Flags().Bool("remote-dynamic", false, "add a dynamic (SOCKS5) tunnel listening on the remote endpoint")
+	tunAddCmd.Flags().BoolP("udp", "u", false, "forward udp datagrams instead of tcp connections")
+}
+
+// controlSocket returns the control socket flag of cmd
+func controlSocket(cmd *cobra.Command) string {
+	socket, _ := cmd.Flags().GetString("control-socket")
+	return socket
+}
+
+// tunnelID parses the tunnel id argument
+func tunnelID(arg string) int {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid tunnel id %s\n", arg)
+		os.Exit(1)
+	}
+	return id
+}
+
+// printOutput prints v as set by the --json and --format flags. It
+// returns false if none is set
+func printOutput(cmd *cobra.Command, v any) bool {
+	done, err := cmnflags.PrintOutput(cmd, v)
+	exitOnError(err)
+	return done
+}
+
+// exitOnError prints err and exits, if not nil
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR %s\n", err)
+		os.Exit(1)
+	}
+}
+
+var tunLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "Lists the tunnels of a running instance",
+	Long: `Lists the tunnels of a running instance.
+
+The instance must be started by the run command with a control socket.`,
+	Example: `
+  # lists the tunnels of the instance started with "control_socket: /tmp/rospo.sock"
+  $ rospo tun ls -c /tmp/rospo.sock
+
+  # prints the listener of the tunnel named web, like its assigned port
+  $ rospo tun ls --format '{{range .}}{{if eq .Name "web"}}{{.Listener}}{{end}}{{end}}'
+	`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		tunnels, err := control.ListTunnels(controlSocket(cmd))
+		exitOnError(err)
+		if printOutput(cmd, tunnels) {
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		printTunnels(w, tunnels)
+		w.Flush()
+	},
+}
+
+var tunAddCmd = &cobra.Command{
+	Use:   "add [[user@][server]:port]",
+	Short: "Adds a tunnel to a running instance",
+	Long: `Adds a tunnel to a running instance.
+
+The tunnel uses the sshclient of the instance config, or the server
+given as argument with the ssh client flags. The tunnels added at runtime
+are not saved to the config file: the config reloads keep them, a
+restart drops them.`,
+	Example: `
+  # forwards the local 8080 port to the remote 80 through the instance sshclient
+  $ rospo tun add -f -l :8080 -r :80
+
+  # exposes the local 3000 port on another server
+  $ rospo tun add -l :3000 -r :8000 user@server:port
+	`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, _ := cmd.Flags().GetString("name")
+		forward, _ := cmd.Flags().GetBool("forward")
+		dynamic, _ := cmd.Flags().GetBool("dynamic")
+		remoteDynamic, _ := cmd.Flags().GetBool("remote-dynamic")
+		udp, _ := cmd.Flags().GetBool("udp")
+		local, _ := cmd.Flags().GetString("local")
+		remote, _ := cmd.Flags().GetString("remote")
+		bindAddress, _ := cmd.Flags().GetString("bind-address")
+		allowedSources, _ := cmd.Flags().GetStringArray("allowed-source")
+		drainTimeout, _ := cmd.Flags().GetInt("drain-timeout")
+
+		c := &tun.TunnelConf{
+			Name:    name,
+			Local:   local,
+			Remote:  remote,
+			Forward: forward,
+			Dynamic: dynamic,
+			Udp:     udp,
+
+			RemoteDynamic: remoteDynamic,
+
+			BindAddress:    bindAddress,
+			AllowedSources: allowedSources,
+			DrainTimeout:   drainTimeout,
+		}
+		if len(args) > 0 {
+			c.SshClientConf = cmnflags.GetSshClientConf(cmd, args[0])
+		}
+		applyExpiryFlags(cmd, []*tun.TunnelConf{c})
+
+		added, err := control.AddTunnel(controlSocket(cmd), c)
+		exitOnError(err)
+		if printOutput(cmd, map[string]int{"added": added}) {
+			return
+		}
+		fmt.Printf("%d tunnels added\n", added)
+	},
+}
+
+var tunPauseCmd = &cobra.Command{
+	Use:   "pause tunnel_id",
+	Short: "Pauses a tunnel of a running instance",
+	Long: `Pauses a tunnel of a running instance.
+
+A paused tunnel keeps its listener but refuses the new clients. The
+active connections are not cut.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(control.PauseTunnel(controlSocket(cmd), tunnelID(args[0])))
+	},
+}
+
+var tunResumeCmd = &cobra.Command{
+	Use:   "resume tunnel_id",
+	Short: "Resumes a paused tunnel of a running instance",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(control.ResumeTunnel(controlSocket(cmd), tunnelID(args[0])))
+	},
+}
+
+var tunRestartCmd = &cobra.Command{
+	Use:   "restart tunnel_id",
+	Short: "Restarts a tunnel of a running instance",
+	Long: `Restarts a tunnel of a running instance, with the same configuration.
+
+The active connections get the tunnel drain timeout to complete, then the
+tunnel is started again with a new id.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cut, err := control.RestartTunnel(controlSocket(cmd), tunnelID(args[0]))
+		exitOnError(err)
+		if printOutput(cmd, map[string]int{"cut_connections": cut}) {
+			return
+		}
+		fmt.Printf("tunnel restarted, %d connections cut\n", cut)
+	},
+}
+
+var tunRmCmd = &cobra.Command{
+	Use:   "rm tunnel_id",
+	Short: "Removes a tunnel from a running instance",
+	Long: `Removes a tunnel from a running instance.
+
+The active connections get the tunnel drain timeout to complete. A
+tunnel of the config file is started again by the next config reload.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cut, err := control.RemoveTunnel(controlSocket(cmd), tunnelID(args[0]))
+		exitOnError(err)
+		if printOutput(cmd, map[string]int{"cut_connections": cut}) {
+			return
+		}
+		fmt.Printf("tunnel removed, %d connections cut\n", cut)
+	},
+}
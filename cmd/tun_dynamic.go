@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/conf"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/tun"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	tunCmd.AddCommand(tunDynamicCmd)
+
+	tunDynamicCmd.Flags().BoolP("reverse", "R", false, "listen on the remote endpoint and dial the destinations from the local machine")
+}
+
+var tunDynamicCmd = &cobra.Command{
+	Use:   "dynamic [user@][server]:port",
+	Short: "Creates a dynamic (SOCKS5) ssh tunnel",
+	Long: `Creates a dynamic (SOCKS5) ssh tunnel, like ssh -D
+
+A SOCKS5 proxy listens on the local endpoint. Each connection is forwarded
+to the requested destination through the ssh server, that resolves the 
+destination host names too.
+
+With the reverse flag, the SOCKS5 proxy listens on the remote endpoint
+instead, and the destinations are dialed from the local machine: the 
+remote network can reach the local one, like ssh -R with no destination.
+
+Preliminary checks:
+  1. Your remote server pubkey should be present into known_host file (disable this behaviour using the insecure flag)
+     You can explicitly grab it with the 'grabpubkey' command
+  2. Your identity should be authorized into the remote server (you can generate a new identity with the keygen comand)
+`,
+	Example: `
+  # Starts a SOCKS5 proxy on the local 1080 port
+  $ rospo tun dynamic -l 127.0.0.1:1080 user@server:port
+
+  # Starts a SOCKS5 proxy on the remote 1080 port, reaching the local network
+  $ rospo tun dynamic -R -r 127.0.0.1:1080 user@server:port
+	`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		local, _ := cmd.Flags().GetString("local")
+		remote, _ := cmd.Flags().GetString("remote")
+		bindAddress, _ := cmd.Flags().GetString("bind-address")
+		allowedSources, _ := cmd.Flags().GetStringArray("allowed-source")
+		printPort, _ := cmd.Flags().GetBool("print-port")
+		portFile, _ := cmd.Flags().GetString("port-file")
+		drainTimeout, _ := cmd.Flags().GetInt("drain-timeout")
+		reverse, _ := cmd.Flags().GetBool("reverse")
+
+		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
+		config := &conf.Config{
+			SshClient: sshcConf,
+			Tunnel: []*tun.TunnelConf{
+				{
+					Local:         local,
+					Remote:        remote,
+					Dynamic:       !reverse,
+					RemoteDynamic: reverse,
+
+					BindAddress:    bindAddress,
+					AllowedSources: allowedSources,
+					PrintPort:      printPort,
+					PortFile:       portFile,
+					DrainTimeout:   drainTimeout,
+				},
+			},
+		}
+
+		client := sshc.NewSshConnection(config.SshClient)
+		go client.Start()
+		applyExpiryFlags(cmd, config.Tunnel)
+		serveTunnels(client, config.Tunnel)
+	},
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"log"
+
 	"github.com/ferama/rospo/cmd/cmnflags"
 	"github.com/ferama/rospo/pkg/conf"
 	"github.com/ferama/rospo/pkg/sshc"
@@ -11,6 +13,8 @@ import (
 
 func init() {
 	tunCmd.AddCommand(tunForwardCmd)
+
+	tunForwardCmd.Flags().BoolP("udp", "u", false, "forward udp datagrams instead of tcp connections. Requires a rospo sshd server")
 }
 
 var tunForwardCmd = &cobra.Command{
@@ -26,11 +30,34 @@ Preliminary checks:
 	Example: `
   # Forwards the local 8080 port to the remote 8080 
   $ rospo tun forward -l :8080 -r :8080 user@server:port
+
+  # Forwards a free local port, chosen by the system and printed on stdout,
+  # to the remote 8080
+  $ rospo tun forward -l 127.0.0.1:0 -r :8080 --print-port user@server:port
+
+  # Forwards the local ports from 8000 to 8010 to the same remote ones
+  $ rospo tun forward -l :8000-8010 -r :8000-8010 user@server:port
+
+  # Forwards the local 8080 port to the remote 8080 for a single
+  # connection, exiting once it completes or after 10 minutes
+  $ rospo tun forward -l :8080 -r :8080 --max-accepted 1 --lifetime 600 user@server:port
+
+  # Forwards the local udp 5353 port to a remote dns server
+  $ rospo tun forward --udp -l :5353 -r 10.0.0.2:53 user@server:port
+
+  # Forwards the local 5432 port to the remote postgres unix socket
+  $ rospo tun forward -l :5432 -r /var/run/postgresql/.s.PGSQL.5432 user@server:port
 	`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		local, _ := cmd.Flags().GetString("local")
 		remote, _ := cmd.Flags().GetString("remote")
+		bindAddress, _ := cmd.Flags().GetString("bind-address")
+		allowedSources, _ := cmd.Flags().GetStringArray("allowed-source")
+		printPort, _ := cmd.Flags().GetBool("print-port")
+		portFile, _ := cmd.Flags().GetString("port-file")
+		drainTimeout, _ := cmd.Flags().GetInt("drain-timeout")
+		udp, _ := cmd.Flags().GetBool("udp")
 
 		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
 		config := &conf.Config{
@@ -40,12 +67,28 @@ Preliminary checks:
 					Remote:  remote,
 					Local:   local,
 					Forward: true,
+					Udp:     udp,
+
+					BindAddress:    bindAddress,
+					AllowedSources: allowedSources,
+					PrintPort:      printPort,
+					PortFile:       portFile,
+					DrainTimeout:   drainTimeout,
 				},
 			},
 		}
 
+		// a port range expands to one tunnel per port
+		tunnels, err := config.Tunnel[0].ExpandPorts()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
 		client := sshc.NewSshConnection(config.SshClient)
 		go client.Start()
-		tun.NewTunnel(client, config.Tunnel[0], false).Start()
+		applyExpiryFlags(cmd, tunnels)
+		// I can easily run multiple tunnels in their respective
+		// go routine here using the same client
+		serveTunnels(client, tunnels)
 	},
 }
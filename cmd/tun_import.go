@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"log"
+	"os/user"
+	"path/filepath"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/conf"
+	"github.com/ferama/rospo/pkg/sshc"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	tunCmd.AddCommand(tunImportCmd)
+
+	usr, _ := user.Current()
+	sshConfig := filepath.Join(usr.HomeDir, ".ssh", "config")
+	tunImportCmd.Flags().String("ssh-config", sshConfig, "the OpenSSH client config file")
+}
+
+var tunImportCmd = &cobra.Command{
+	Use:   "import host",
+	Short: "Creates the ssh tunnels of a host defined in an OpenSSH client config",
+	Long: `Creates the tunnels described by the LocalForward, RemoteForward and
+DynamicForward directives of a host in an OpenSSH client config file.
+
+The HostName, User, Port, IdentityFile, ProxyJump, UserKnownHostsFile and
+StrictHostKeyChecking settings of the host are used for the ssh connection.
+All the tunnels share the same ssh connection.
+`,
+	Example: `
+  # Starts the tunnels of the myserver host of ~/.ssh/config
+  $ rospo tun import myserver
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		sshConfig, _ := cmd.Flags().GetString("ssh-config")
+		bindAddress, _ := cmd.Flags().GetString("bind-address")
+		allowedSources, _ := cmd.Flags().GetStringArray("allowed-source")
+		printPort, _ := cmd.Flags().GetBool("print-port")
+		drainTimeout, _ := cmd.Flags().GetInt("drain-timeout")
+
+		host, err := conf.LoadSSHConfig(sshConfig, args[0])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		tunnels, err := host.Tunnels()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(tunnels) == 0 {
+			log.Fatalf("no forwards defined for host %s in %s", args[0], sshConfig)
+		}
+
+		sshcConf := host.SshClientConf(cmnflags.GetSshClientConf(cmd, args[0]))
+		client := sshc.NewSshConnection(sshcConf)
+		go client.Start()
+		for _, c := range tunnels {
+			c.BindAddress = bindAddress
+			c.AllowedSources = allowedSources
+			c.PrintPort = printPort
+			c.DrainTimeout = drainTimeout
+		}
+		applyExpiryFlags(cmd, tunnels)
+		serveTunnels(client, tunnels)
+	},
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/tun"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	tunCmd.AddCommand(tunMultiCmd)
+
+	tunMultiCmd.Flags().StringArrayP("forward", "L", []string{}, "a forward tunnel as local=remote. Can be repeated")
+	tunMultiCmd.Flags().StringArrayP("reverse", "R", []string{}, "a reverse tunnel as remote=local. Can be repeated")
+}
+
+// parseTunnelSpec parses a listen=destination tunnel spec
+func parseTunnelSpec(spec string, forward bool) (*tun.TunnelConf, error) {
+	listen, dest, ok := strings.Cut(spec, "=")
+	if !ok || listen == "" || dest == "" {
+		return nil, fmt.Errorf("invalid tunnel '%s', expected listen=destination", spec)
+	}
+	if forward {
+		return &tun.TunnelConf{Local: listen, Remote: dest, Forward: true}, nil
+	}
+	return &tun.TunnelConf{Remote: listen, Local: dest, Forward: false}, nil
+}
+
+var tunMultiCmd = &cobra.Command{
+	Use:   "multi [user@][server]:port",
+	Short: "Creates many ssh tunnels over a single ssh connection",
+	Long: `Creates many forward and reverse ssh tunnels, all of them
+multiplexed over a single ssh connection.
+
+Each tunnel is described as listen=destination: forward tunnels listen on
+the local endpoint (-L local=remote), reverse tunnels on the remote one
+(-R remote=local).
+`,
+	Example: `
+  # Forwards the local 8080 and 5432 ports and exposes the local 3000
+  # on the remote 3000, using one ssh connection
+  $ rospo tun multi -L :8080=:8080 -L :5432=db:5432 -R :3000=:3000 user@server:port
+	`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		forwards, _ := cmd.Flags().GetStringArray("forward")
+		reverses, _ := cmd.Flags().GetStringArray("reverse")
+		bindAddress, _ := cmd.Flags().GetString("bind-address")
+		allowedSources, _ := cmd.Flags().GetStringArray("allowed-source")
+		printPort, _ := cmd.Flags().GetBool("print-port")
+		portFile, _ := cmd.Flags().GetString("port-file")
+		drainTimeout, _ := cmd.Flags().GetInt("drain-timeout")
+
+		tunnels := []*tun.TunnelConf{}
+		for _, spec := range forwards {
+			c, err := parseTunnelSpec(spec, true)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			tunnels = append(tunnels, c)
+		}
+		for _, spec := range reverses {
+			c, err := parseTunnelSpec(spec, false)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			tunnels = append(tunnels, c)
+		}
+		expanded := []*tun.TunnelConf{}
+		for _, c := range tunnels {
+			res, err := c.ExpandPorts()
+			if err != nil {
+				log.Fatalln(err)
+			}
+			expanded = append(expanded, res...)
+		}
+		tunnels = expanded
+		if len(tunnels) == 0 {
+			log.Fatalln("no tunnels defined. Use the --forward and --reverse flags")
+		}
+		if portFile != "" {
+			log.Fatalln("the port-file flag is not supported with multiple tunnels, use print-port")
+		}
+		for _, c := range tunnels {
+			c.BindAddress = bindAddress
+			c.AllowedSources = allowedSources
+			c.PrintPort = printPort
+			c.DrainTimeout = drainTimeout
+		}
+
+		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
+		client := sshc.NewSshConnection(sshcConf)
+		go client.Start()
+		applyExpiryFlags(cmd, tunnels)
+		serveTunnels(client, tunnels)
+	},
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"log"
+
 	"github.com/ferama/rospo/cmd/cmnflags"
 	"github.com/ferama/rospo/pkg/conf"
 	"github.com/ferama/rospo/pkg/sshc"
@@ -32,6 +34,11 @@ Preliminary checks:
 	Run: func(cmd *cobra.Command, args []string) {
 		local, _ := cmd.Flags().GetString("local")
 		remote, _ := cmd.Flags().GetString("remote")
+		bindAddress, _ := cmd.Flags().GetString("bind-address")
+		allowedSources, _ := cmd.Flags().GetStringArray("allowed-source")
+		printPort, _ := cmd.Flags().GetBool("print-port")
+		portFile, _ := cmd.Flags().GetString("port-file")
+		drainTimeout, _ := cmd.Flags().GetInt("drain-timeout")
 
 		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
 		config := &conf.Config{
@@ -41,14 +48,27 @@ Preliminary checks:
 					Remote:  remote,
 					Local:   local,
 					Forward: false,
+
+					BindAddress:    bindAddress,
+					AllowedSources: allowedSources,
+					PrintPort:      printPort,
+					PortFile:       portFile,
+					DrainTimeout:   drainTimeout,
 				},
 			},
 		}
 
+		// a port range expands to one tunnel per port
+		tunnels, err := config.Tunnel[0].ExpandPorts()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
 		client := sshc.NewSshConnection(config.SshClient)
 		go client.Start()
+		applyExpiryFlags(cmd, tunnels)
 		// I can easily run multiple tunnels in their respective
 		// go routine here using the same client
-		tun.NewTunnel(client, config.Tunnel[0], false).Start()
+		serveTunnels(client, tunnels)
 	},
 }
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/tun"
+	"github.com/spf13/cobra"
+)
+
+// startTunnels starts a tunnel for each configuration
+func startTunnels(client *sshc.SshConnection, confs []*tun.TunnelConf) []*tun.Tunnel {
+	tunnels := []*tun.Tunnel{}
+	for _, c := range confs {
+		t := tun.NewTunnel(client, c, false)
+		go t.Start()
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+// shutdownTunnels stops the tunnels, draining their connections
+// concurrently, and logs how many connections were cut
+func shutdownTunnels(tunnels []*tun.Tunnel) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	cut := 0
+	for _, t := range tunnels {
+		wg.Add(1)
+		go func(t *tun.Tunnel) {
+			defer wg.Done()
+			n := t.Shutdown()
+			mu.Lock()
+			cut += n
+			mu.Unlock()
+		}(t)
+	}
+	wg.Wait()
+	log.Printf("%d tunnels stopped, %d connections cut", len(tunnels), cut)
+}
+
+// waitSignal blocks until the process is interrupted or terminated
+func waitSignal() {
+	waitSignalOr(nil)
+}
+
+// waitSignalOr blocks until the process is interrupted or terminated,
+// or done is closed
+func waitSignalOr(done <-chan struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-c:
+	case <-done:
+	}
+}
+
+// tunnelsDone returns a channel closed once all the tunnels stopped by
+// themselves, like the one-shot and time-limited ones do
+func tunnelsDone(tunnels []*tun.Tunnel) <-chan struct{} {
+	if len(tunnels) == 0 {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, t := range tunnels {
+			<-t.Done()
+		}
+		close(done)
+	}()
+	return done
+}
+
+// applyExpiryFlags sets the tunnels limits from the command flags, if
+// they are set
+func applyExpiryFlags(cmd *cobra.Command, confs []*tun.TunnelConf) {
+	maxAccepted, _ := cmd.Flags().GetInt("max-accepted")
+	lifetime, _ := cmd.Flags().GetInt("lifetime")
+	idleTimeout, _ := cmd.Flags().GetInt("idle-timeout")
+	for _, c := range confs {
+		if cmd.Flags().Changed("max-accepted") {
+			c.MaxAccepted = maxAccepted
+		}
+		if cmd.Flags().Changed("lifetime") {
+			c.Lifetime = lifetime
+		}
+		if cmd.Flags().Changed("idle-timeout") {
+			c.IdleTimeout = idleTimeout
+		}
+	}
+}
+
+// serveTunnels runs the tunnels until the process is interrupted or
+// they all stopped by themselves, then shuts them down gracefully
+func serveTunnels(client *sshc.SshConnection, confs []*tun.TunnelConf) {
+	tunnels := startTunnels(client, confs)
+	waitSignalOr(tunnelsDone(tunnels))
+	shutdownTunnels(tunnels)
+}
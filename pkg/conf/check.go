@@ -0,0 +1,284 @@
+package conf
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// Problem is an issue found checking the configuration
+type Problem struct {
+	// the config section, like "sshclient" or "tunnel[2]"
+	Section string
+	Message string
+	// warnings don't prevent rospo from running
+	Warning bool
+}
+
+func (p Problem) String() string {
+	level := "ERROR"
+	if p.Warning {
+		level = "WARNING"
+	}
+	return fmt.Sprintf("%s %s: %s", level, p.Section, p.Message)
+}
+
+// checker collects the problems found by Check
+type checker struct {
+	problems []Problem
+}
+
+func (c *checker) errorf(section string, format string, args ...any) {
+	c.problems = append(c.problems, Problem{Section: section, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) warnf(section string, format string, args ...any) {
+	c.problems = append(c.problems, Problem{Section: section, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// endpoint checks that addr is a valid endpoint
+func (c *checker) endpoint(section string, name string, addr string) {
+	if err := utils.ValidateEndpoint(addr); err != nil {
+		c.errorf(section, "%s: %s", name, err)
+	}
+}
+
+// expandPath returns path with the ~ prefix expanded
+func expandPath(path string) string {
+	res, err := utils.ExpandUserHome(path)
+	if err != nil {
+		return path
+	}
+	return res
+}
+
+// file checks that path exists and is readable. If private is set, the
+// file must not be accessible by the group and the others, like ssh
+// requires for the private keys
+func (c *checker) file(section string, name string, path string, private bool) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		c.errorf(section, "%s: %s", name, err)
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.errorf(section, "%s: %s", name, err)
+		return false
+	}
+	if info.IsDir() {
+		c.errorf(section, "%s: %s is a directory", name, path)
+		return false
+	}
+	// the windows permissions are not mapped to the unix mode
+	if private && runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		c.warnf(section, "%s: %s permissions %#o are too open, use 0600", name, path, info.Mode().Perm())
+	}
+	return true
+}
+
+// keySources checks the files of authorized keys sources. The http
+// sources are not fetched
+func (c *checker) keySources(section string, name string, sources []string) {
+	for i, s := range sources {
+		if u, err := url.ParseRequestURI(s); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			continue
+		}
+		sources[i] = expandPath(s)
+		if _, err := os.Stat(sources[i]); err != nil {
+			c.warnf(section, "%s: %s", name, err)
+			continue
+		}
+		c.file(section, name, sources[i], false)
+	}
+}
+
+// sshClient checks an ssh client configuration
+func (c *checker) sshClient(section string, conf *sshc.SshClientConf) {
+	home := ""
+	if usr, err := user.Current(); err == nil {
+		home = usr.HomeDir
+	}
+	if conf.ServerURI == "" {
+		c.errorf(section, "server is not set")
+	} else {
+		c.endpoint(section, "server", conf.ServerURI)
+	}
+
+	if conf.Identity == "" && conf.Password == "" {
+		conf.Identity = filepath.Join(home, ".ssh", "id_rsa")
+	}
+	if conf.Identity != "" {
+		conf.Identity = expandPath(conf.Identity)
+		if _, err := os.Stat(conf.Identity); err != nil && conf.Password != "" {
+			c.warnf(section, "identity: %s, the password is used", err)
+		} else {
+			c.file(section, "identity", conf.Identity, true)
+		}
+	}
+	for _, f := range conf.HostKeyFingerprints {
+		if !strings.HasPrefix(f, "SHA256:") {
+			c.errorf(section, "host_key_fingerprints: %s is not a SHA256 fingerprint", f)
+		}
+	}
+	if !conf.Insecure && len(conf.HostKeyFingerprints) == 0 {
+		if conf.KnownHosts == "" {
+			conf.KnownHosts = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		conf.KnownHosts = expandPath(conf.KnownHosts)
+		if _, err := os.Stat(conf.KnownHosts); err != nil {
+			c.warnf(section, "known_hosts: %s. The server keys are added on the first connection", err)
+		}
+	}
+	for i, jh := range conf.JumpHosts {
+		jhSection := fmt.Sprintf("%s.jump_hosts[%d]", section, i)
+		c.endpoint(jhSection, "uri", jh.URI)
+		if jh.Identity != "" {
+			jh.Identity = expandPath(jh.Identity)
+			c.file(jhSection, "identity", jh.Identity, true)
+		}
+	}
+}
+
+// Check validates the configuration without connecting: the endpoints
+// are parsed, the key files must exist and be readable, and the
+// sections must have an ssh client. The paths are expanded and the
+// defaults filled in place, so that the configuration shows the
+// effective values
+func (c *Config) Check() []Problem {
+	ch := &checker{}
+	if c.SshClient == nil && c.SshD == nil && len(c.Tunnel) == 0 &&
+		c.Web == nil && c.SocksProxy == nil && c.DnsProxy == nil {
+		ch.errorf("config", "nothing to run")
+	}
+
+	if c.SshClient != nil {
+		ch.sshClient("sshclient", c.SshClient)
+	}
+	for name, sc := range c.SshClients {
+		if sc != nil {
+			ch.sshClient(fmt.Sprintf("sshclients.%s", name), sc)
+		}
+	}
+	// checks the inline clients once
+	checked := map[*sshc.SshClientConf]bool{c.SshClient: true}
+	for _, sc := range c.SshClients {
+		checked[sc] = true
+	}
+	sectionClient := func(section string, sc *sshc.SshClientConf) {
+		if sc == nil {
+			if c.SshClient == nil {
+				ch.errorf(section, "no sshclient configured")
+			}
+			return
+		}
+		if !checked[sc] {
+			checked[sc] = true
+			ch.sshClient(section+".sshclient", sc)
+		}
+	}
+
+	for i, t := range c.Tunnel {
+		section := fmt.Sprintf("tunnel[%d]", i)
+		if t.Name != "" {
+			section = fmt.Sprintf("tunnel[%d] %s", i, t.Name)
+		}
+		if err := t.Validate(); err != nil {
+			ch.errorf(section, "%s", err)
+		}
+		sectionClient(section, t.SshClientConf)
+	}
+
+	if c.SshD != nil {
+		c.checkSshD(ch)
+	}
+	if c.Web != nil {
+		ch.endpoint("web", "listen_address", c.Web.GetListenAddress())
+		if c.Web.Password == "" && c.Web.Token == "" && !utils.IsLoopback(c.Web.GetListenAddress()) {
+			ch.warnf("web", "listen_address: %s is not a loopback address and no password or token is set", c.Web.GetListenAddress())
+		}
+		sectionClient("web", nil)
+	}
+	if c.Grpc != nil {
+		ch.endpoint("grpc", "listen_address", c.Grpc.GetListenAddress())
+		if c.Grpc.Token == "" && !utils.IsLoopback(c.Grpc.GetListenAddress()) {
+			ch.warnf("grpc", "listen_address: %s is not a loopback address and no token is set", c.Grpc.GetListenAddress())
+		}
+		if c.Grpc.TLSCert != "" || c.Grpc.TLSKey != "" {
+			ch.file("grpc", "tls_cert", expandPath(c.Grpc.TLSCert), false)
+			ch.file("grpc", "tls_key", expandPath(c.Grpc.TLSKey), true)
+		}
+	}
+	if c.SocksProxy != nil {
+		ch.endpoint("socksproxy", "listen_address", c.SocksProxy.ListenAddress)
+		sectionClient("socksproxy", c.SocksProxy.SshClientConf)
+	}
+	if c.DnsProxy != nil {
+		ch.endpoint("dnsproxy", "listen_address", c.DnsProxy.ListenAddress)
+		if len(c.DnsProxy.Routes) == 0 {
+			ch.errorf("dnsproxy", "the dns proxy needs at least a route")
+		}
+		for i, r := range c.DnsProxy.Routes {
+			if r.Server == "" {
+				ch.errorf(fmt.Sprintf("dnsproxy.routes[%d]", i), "server is not set")
+			}
+		}
+		sectionClient("dnsproxy", c.DnsProxy.SshClientConf)
+	}
+	return ch.problems
+}
+
+// checkSshD checks the sshd section
+func (c *Config) checkSshD(ch *checker) {
+	conf := c.SshD
+	if conf.ListenAddress == "" && len(conf.Listeners) == 0 {
+		ch.errorf("sshd", "listen_address is not set")
+	}
+	if conf.ListenAddress != "" {
+		ch.endpoint("sshd", "listen_address", conf.ListenAddress)
+	}
+	for i, l := range conf.Listeners {
+		section := fmt.Sprintf("sshd.listeners[%d]", i)
+		if l.SocketPath != "" {
+			l.SocketPath = expandPath(l.SocketPath)
+		} else {
+			ch.endpoint(section, "address", l.Address)
+		}
+	}
+
+	if conf.Key == "" && len(conf.Keys) == 0 {
+		ch.errorf("sshd", "server_key is not set")
+	}
+	hostKeys := func(name string, paths []string) {
+		for i, p := range paths {
+			paths[i] = expandPath(p)
+			if _, err := os.Stat(paths[i]); os.IsNotExist(err) {
+				ch.warnf("sshd", "%s: %s doesn't exist and will be generated", name, paths[i])
+				continue
+			}
+			ch.file("sshd", name, paths[i], true)
+		}
+	}
+	if conf.Key != "" {
+		keys := []string{conf.Key}
+		hostKeys("server_key", keys)
+		conf.Key = keys[0]
+	}
+	hostKeys("server_keys", conf.Keys)
+	hostKeys("next_server_keys", conf.NextKeys)
+
+	ch.keySources("sshd", "authorized_keys", conf.AuthorizedKeysURI)
+	ch.keySources("sshd", "trusted_user_ca_keys", conf.TrustedUserCAKeys)
+	if !conf.DisableAuth && len(conf.Users) == 0 && len(conf.AuthorizedKeysURI) == 0 &&
+		conf.AuthorizedPassword == "" && len(conf.TrustedUserCAKeys) == 0 {
+		ch.errorf("sshd", "no authorized_keys, authorized_password or trusted_user_ca_keys set")
+	}
+}
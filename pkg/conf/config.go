@@ -1,32 +1,61 @@
 package conf
 
 import (
-	"os"
+	"fmt"
 
+	"github.com/ferama/rospo/pkg/control"
 	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/sshd"
 	"github.com/ferama/rospo/pkg/tun"
 	"github.com/ferama/rospo/pkg/web"
-	"gopkg.in/yaml.v3"
 )
 
 // Config holds all the config values
 type Config struct {
-	SshClient  *sshc.SshClientConf  `yaml:"sshclient"`
-	Tunnel     []*tun.TunnelConf    `yaml:"tunnel"`
-	SshD       *sshd.SshDConf       `yaml:"sshd"`
-	Web        *web.WebConf         `yaml:"web"`
-	SocksProxy *sshc.SocksProxyConf `yaml:"socksproxy"`
+	SshClient *sshc.SshClientConf `yaml:"sshclient"`
+	// the named ssh clients. The tunnels and the proxies use them by
+	// name, with sshclient_name, to connect to many servers
+	SshClients map[string]*sshc.SshClientConf `yaml:"sshclients"`
+	Tunnel     []*tun.TunnelConf              `yaml:"tunnel"`
+	SshD       *sshd.SshDConf                 `yaml:"sshd"`
+	Web        *web.WebConf                   `yaml:"web"`
+	SocksProxy *sshc.SocksProxyConf           `yaml:"socksproxy"`
+	DnsProxy   *sshc.DnsProxyConf             `yaml:"dnsproxy"`
+	// the local control socket path. The status command queries the
+	// running instance through it
+	ControlSocket string `yaml:"control_socket"`
+	// the gRPC management api
+	Grpc *control.GrpcConf `yaml:"grpc"`
+	// the size in bytes of the buffers used to copy the tunnels and
+	// forwards data. Defaults to 32KB
+	BufferSize int `yaml:"buffer_size"`
 }
 
 // LoadConfig parses the [config].yaml file and loads its values
 // into the Config struct
 func LoadConfig(filePath string) (*Config, error) {
-	f, err := os.Open(filePath)
+	return LoadConfigProfile(filePath, "")
+}
+
+// LoadConfigProfile is like LoadConfig, but merges the values of the
+// named profile over the config ones. The files listed by the include
+// directives are merged too, before the including file. The ${VAR}
+// references of the values are expanded from the environment, and the
+// encrypted values decrypted, see AgeIdentities
+func LoadConfigProfile(filePath string, profile string) (*Config, error) {
+	root, err := readConfigNode(filePath, map[string]bool{})
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	if err := applyProfile(root, profile); err != nil {
+		return nil, err
+	}
+	if err := expandEnvNode(root); err != nil {
+		return nil, err
+	}
+	if err := decryptNode(root); err != nil {
+		return nil, err
+	}
 
 	cfg := Config{
 		nil,
@@ -34,13 +63,127 @@ func LoadConfig(filePath string) (*Config, error) {
 		nil,
 		nil,
 		nil,
+		nil,
+		nil,
+		"",
+		nil,
+		0,
 	}
 
-	decoder := yaml.NewDecoder(f)
-	err = decoder.Decode(&cfg)
+	err = root.Decode(&cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	tunnels := []*tun.TunnelConf{}
+	for _, c := range cfg.Tunnel {
+		expanded, err := cfg.ExpandTunnel(c)
+		if err != nil {
+			return nil, err
+		}
+		tunnels = append(tunnels, expanded...)
+	}
+	if cfg.Tunnel != nil {
+		cfg.Tunnel = tunnels
+	}
+	if err := cfg.resolveSshClients(); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyServerURIs(); err != nil {
+		return nil, err
+	}
+
 	return &cfg, nil
 }
+
+// ExpandTunnel expands the template of t to one tunnel per item, and
+// the port ranges to one tunnel per port. The sshclient_name references
+// are resolved with the named ssh clients of c
+func (c *Config) ExpandTunnel(t *tun.TunnelConf) ([]*tun.TunnelConf, error) {
+	templated, err := t.ExpandTemplate()
+	if err != nil {
+		return nil, err
+	}
+	res := []*tun.TunnelConf{}
+	for _, tt := range templated {
+		if tt.SshClientName != "" {
+			if tt.SshClientConf, err = c.namedSshClient(tt.SshClientName, tt.SshClientConf); err != nil {
+				return nil, err
+			}
+		}
+		expanded, err := tt.ExpandPorts()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, expanded...)
+	}
+	return res, nil
+}
+
+// namedSshClient returns the ssh client configuration named name
+func (c *Config) namedSshClient(name string, inline *sshc.SshClientConf) (*sshc.SshClientConf, error) {
+	if inline != nil {
+		return nil, fmt.Errorf("sshclient and sshclient_name '%s' can't be set together", name)
+	}
+	conf, ok := c.SshClients[name]
+	if !ok || conf == nil {
+		return nil, fmt.Errorf("unknown sshclient_name '%s'", name)
+	}
+	return conf, nil
+}
+
+// resolveSshClients replaces the proxies sshclient_name references with
+// the named ssh client configurations. The tunnels ones are resolved by
+// ExpandTunnel. The sections using the same name share the connection
+func (c *Config) resolveSshClients() error {
+	var err error
+	if c.SocksProxy != nil && c.SocksProxy.SshClientName != "" {
+		if c.SocksProxy.SshClientConf, err = c.namedSshClient(c.SocksProxy.SshClientName, c.SocksProxy.SshClientConf); err != nil {
+			return err
+		}
+	}
+	if c.DnsProxy != nil && c.DnsProxy.SshClientName != "" {
+		if c.DnsProxy.SshClientConf, err = c.namedSshClient(c.DnsProxy.SshClientName, c.DnsProxy.SshClientConf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyServerURIs applies the options of the ssh:// server urls of all
+// the ssh clients, see sshc.SshClientConf.ApplyURI
+func (c *Config) applyServerURIs() error {
+	apply := func(section string, sc *sshc.SshClientConf) error {
+		if sc == nil {
+			return nil
+		}
+		if err := sc.ApplyURI(); err != nil {
+			return fmt.Errorf("%s: server: %s", section, err)
+		}
+		return nil
+	}
+	if err := apply("sshclient", c.SshClient); err != nil {
+		return err
+	}
+	for name, sc := range c.SshClients {
+		if err := apply("sshclients."+name, sc); err != nil {
+			return err
+		}
+	}
+	for i, t := range c.Tunnel {
+		if err := apply(fmt.Sprintf("tunnel[%d].sshclient", i), t.SshClientConf); err != nil {
+			return err
+		}
+	}
+	if c.SocksProxy != nil {
+		if err := apply("socksproxy.sshclient", c.SocksProxy.SshClientConf); err != nil {
+			return err
+		}
+	}
+	if c.DnsProxy != nil {
+		if err := apply("dnsproxy.sshclient", c.DnsProxy.SshClientConf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
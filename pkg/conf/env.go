@@ -0,0 +1,75 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// matches the "$${" escape and the ${VAR} and ${VAR:-fallback} references
+var envRefRe = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces the ${VAR} references of s with the environment
+// values. ${VAR:-fallback} uses fallback if VAR is unset or empty, and
+// "$${" is kept as a literal "${". Unset variables without a fallback
+// are an error, so that a missing secret is not silently replaced
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var err error
+	res := envRefRe.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := envRefRe.FindStringSubmatch(ref)
+		value, ok := os.LookupEnv(m[1])
+		if m[2] != "" {
+			if value == "" {
+				return m[3]
+			}
+			return value
+		}
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", m[1])
+		}
+		return value
+	})
+	return res, err
+}
+
+// expandEnvNode expands the environment references of all the scalar
+// values of node. The keys are not expanded
+func expandEnvNode(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		value, err := expandEnv(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", node.Line, err)
+		}
+		if value != node.Value {
+			node.Value = value
+			// the plain values get their type from the expanded
+			// value, so that ${PORT} can fill a number
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := expandEnvNode(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, n := range node.Content {
+			if err := expandEnvNode(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	includeKey  = "include"
+	profilesKey = "profiles"
+	// the tunnel lists are appended instead of replaced, so that the
+	// included files and the profiles can add tunnels
+	tunnelKey = "tunnel"
+)
+
+// readConfigNode parses the yaml file at filePath, with its includes
+// merged. The included paths are relative to the including file. The
+// values of the including file win over the included ones
+func readConfigNode(filePath string, seen map[string]bool) (*yaml.Node, error) {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if seen[abs] {
+		return nil, fmt.Errorf("include cycle on %s", filePath)
+	}
+	seen[abs] = true
+	defer delete(seen, abs)
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var doc yaml.Node
+	if err := yaml.NewDecoder(f).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("%s: empty config", filePath)
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: the config must be a mapping", filePath)
+	}
+
+	includes, err := takeIncludes(root)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filePath, err)
+	}
+	if len(includes) == 0 {
+		return root, nil
+	}
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, inc := range includes {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(filePath), inc)
+		}
+		node, err := readConfigNode(inc, seen)
+		if err != nil {
+			return nil, err
+		}
+		mergeNodes(merged, node, true)
+	}
+	mergeNodes(merged, root, true)
+	return merged, nil
+}
+
+// takeIncludes removes the include key from root and returns its paths.
+// The include value is a path or a list of paths
+func takeIncludes(root *yaml.Node) ([]string, error) {
+	value := removeKey(root, includeKey)
+	if value == nil {
+		return nil, nil
+	}
+	res := []string{}
+	switch value.Kind {
+	case yaml.ScalarNode:
+		res = append(res, value.Value)
+	case yaml.SequenceNode:
+		if err := value.Decode(&res); err != nil {
+			return nil, errors.New("include must be a path or a list of paths")
+		}
+	default:
+		return nil, errors.New("include must be a path or a list of paths")
+	}
+	for i, path := range res {
+		expanded, err := expandEnv(path)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = expanded
+	}
+	return res, nil
+}
+
+// applyProfile removes the profiles from root and, if profile is set,
+// merges the one named profile over the root values
+func applyProfile(root *yaml.Node, profile string) error {
+	profiles := removeKey(root, profilesKey)
+	if profile == "" {
+		return nil
+	}
+	if profiles == nil || profiles.Kind != yaml.MappingNode {
+		return fmt.Errorf("unknown profile '%s'", profile)
+	}
+	overlay := lookupKey(profiles, profile)
+	if overlay == nil {
+		return fmt.Errorf("unknown profile '%s'", profile)
+	}
+	if overlay.Kind != yaml.MappingNode {
+		return fmt.Errorf("profile '%s' must be a mapping", profile)
+	}
+	mergeNodes(root, overlay, true)
+	return nil
+}
+
+// mergeNodes merges the src mapping into dst. The nested mappings are
+// merged, the other values of src replace the dst ones. At the top
+// level the tunnel lists are appended
+func mergeNodes(dst, src *yaml.Node, top bool) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		current := lookupKey(dst, key.Value)
+		switch {
+		case current == nil:
+			dst.Content = append(dst.Content, key, value)
+		case current.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			mergeNodes(current, value, false)
+		case top && key.Value == tunnelKey &&
+			current.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode:
+			current.Content = append(append([]*yaml.Node{}, current.Content...), value.Content...)
+		default:
+			*current = *value
+		}
+	}
+}
+
+// lookupKey returns the value of key in the mapping node, or nil
+func lookupKey(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// removeKey removes key from the mapping node and returns its value
+func removeKey(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			value := node.Content[i+1]
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return value
+		}
+	}
+	return nil
+}
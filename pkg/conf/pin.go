@@ -0,0 +1,121 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// serverAddress returns the host:port of an ssh server uri, or of an
+// ssh:// url, with the default port
+func serverAddress(uri string) string {
+	if strings.HasPrefix(uri, utils.SSHScheme) {
+		if u, err := url.Parse(uri); err == nil {
+			uri = u.Host
+		}
+	}
+	if i := strings.LastIndex(uri, "@"); i >= 0 {
+		uri = uri[i+1:]
+	}
+	host, port, err := net.SplitHostPort(uri)
+	if err != nil {
+		return net.JoinHostPort(uri, "22")
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// pinClients sets the host_key_fingerprints of the ssh client mappings of
+// node, the sshclient and the sshclients values, connecting to server.
+// It returns how many were set
+func pinClients(node *yaml.Node, server string, fingerprints *yaml.Node) int {
+	pin := func(client *yaml.Node) int {
+		if client.Kind != yaml.MappingNode {
+			return 0
+		}
+		matches := false
+		for i := 0; i+1 < len(client.Content); i += 2 {
+			if client.Content[i].Value == "server" && serverAddress(client.Content[i+1].Value) == server {
+				matches = true
+			}
+		}
+		if !matches {
+			return 0
+		}
+		for i := 0; i+1 < len(client.Content); i += 2 {
+			if client.Content[i].Value == "host_key_fingerprints" {
+				client.Content[i+1] = fingerprints
+				return 1
+			}
+		}
+		client.Content = append(client.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "host_key_fingerprints"},
+			fingerprints)
+		return 1
+	}
+
+	count := 0
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, n := range node.Content {
+			count += pinClients(n, server, fingerprints)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			switch key {
+			case "sshclient":
+				count += pin(value)
+			case "sshclients":
+				if value.Kind == yaml.MappingNode {
+					for j := 1; j < len(value.Content); j += 2 {
+						count += pin(value.Content[j])
+					}
+				}
+			default:
+				count += pinClients(value, server, fingerprints)
+			}
+		}
+	}
+	return count
+}
+
+// PinHostKeys sets the host_key_fingerprints of the ssh clients of the
+// config file at path connecting to server. The comments are kept, but
+// the file is formatted again. It returns how many clients were updated
+func PinHostKeys(path string, server string, fingerprints []string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return 0, err
+	}
+
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, f := range fingerprints {
+		seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: f})
+	}
+	count := pinClients(&root, serverAddress(server), seq)
+	if count == 0 {
+		return 0, fmt.Errorf("no sshclient of %s connects to %s", path, server)
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return count, os.WriteFile(path, buf.Bytes(), info.Mode().Perm())
+}
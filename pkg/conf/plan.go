@@ -0,0 +1,218 @@
+package conf
+
+import (
+	"fmt"
+
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+// the Step actions
+const (
+	ActionListen = "listen"
+	ActionDial   = "dial"
+	ActionKey    = "key"
+)
+
+// Step is something rospo would do running the configuration: open a
+// listener, dial a host or use a key file
+type Step struct {
+	Action  string `json:"action"`
+	Section string `json:"section"`
+	// the address, socket path or file
+	Target string `json:"target"`
+	// where and what for, like "on user@server"
+	Note string `json:"note,omitempty"`
+}
+
+// plan collects the steps of Plan
+type plan struct {
+	steps []Step
+}
+
+func (p *plan) add(action string, section string, target string, format string, args ...any) {
+	p.steps = append(p.steps, Step{
+		Action:  action,
+		Section: section,
+		Target:  target,
+		Note:    fmt.Sprintf(format, args...),
+	})
+}
+
+// sshClient adds the dials and the keys of an ssh client
+func (p *plan) sshClient(section string, conf *sshc.SshClientConf) {
+	for i, jh := range conf.JumpHosts {
+		p.add(ActionDial, section, jh.URI, "jump host %d", i+1)
+		if jh.Identity != "" {
+			p.add(ActionKey, section, jh.Identity, "jump host %d identity", i+1)
+		}
+	}
+	note := "ssh server"
+	if len(conf.JumpHosts) != 0 {
+		note = "ssh server, through the jump hosts"
+	}
+	if len(conf.HostKeyFingerprints) != 0 {
+		note += ", host key pinned"
+	} else if conf.Insecure {
+		note += ", host key not verified"
+	}
+	p.add(ActionDial, section, conf.ServerURI, "%s", note)
+	if conf.Identity != "" {
+		p.add(ActionKey, section, conf.Identity, "identity")
+	}
+	if !conf.Insecure && len(conf.HostKeyFingerprints) == 0 {
+		p.add(ActionKey, section, conf.KnownHosts, "known hosts")
+	}
+}
+
+// tunnel adds the listener and the dials of a tunnel using the client
+// of server
+func (p *plan) tunnel(section string, t *tun.TunnelConf, server string) {
+	proto := "tcp"
+	if t.IsUdp() {
+		proto = "udp"
+	}
+	if t.Dynamic {
+		p.add(ActionListen, section, t.Local, "on this host, socks5 proxy dialing from %s", server)
+		return
+	}
+	if t.RemoteDynamic {
+		p.add(ActionListen, section, t.Remote, "on %s, socks5 proxy dialing from this host", server)
+		return
+	}
+	if t.Forward {
+		p.add(ActionListen, section, t.Local, "%s, on this host", proto)
+		for _, r := range append([]string{t.Remote}, t.Remotes...) {
+			if r != "" {
+				p.add(ActionDial, section, r, "%s, from %s", proto, server)
+			}
+		}
+		for _, r := range t.Backups {
+			p.add(ActionDial, section, r, "%s backup, from %s", proto, server)
+		}
+		return
+	}
+	p.add(ActionListen, section, t.Remote, "%s, on %s", proto, server)
+	p.add(ActionDial, section, t.Local, "%s, from this host", proto)
+	for _, l := range t.Backups {
+		p.add(ActionDial, section, l, "%s backup, from this host", proto)
+	}
+}
+
+// Plan returns what rospo would do running the configuration, without
+// doing it. Call it after Check, for the effective paths and defaults
+func (c *Config) Plan() []Step {
+	p := &plan{}
+	if c.SshClient != nil {
+		p.sshClient("sshclient", c.SshClient)
+	}
+	for name, sc := range c.SshClients {
+		if sc != nil {
+			p.sshClient(fmt.Sprintf("sshclients.%s", name), sc)
+		}
+	}
+	// the inline clients are listed once, the named and the global ones
+	// are above
+	listed := map[*sshc.SshClientConf]bool{c.SshClient: true}
+	for _, sc := range c.SshClients {
+		listed[sc] = true
+	}
+	sectionServer := func(section string, sc *sshc.SshClientConf) string {
+		if sc == nil {
+			sc = c.SshClient
+		}
+		if sc == nil {
+			return "no server"
+		}
+		if !listed[sc] {
+			listed[sc] = true
+			p.sshClient(section+".sshclient", sc)
+		}
+		return sc.ServerURI
+	}
+
+	for i, t := range c.Tunnel {
+		section := fmt.Sprintf("tunnel[%d]", i)
+		if t.Name != "" {
+			section = fmt.Sprintf("tunnel[%d] %s", i, t.Name)
+		}
+		p.tunnel(section, t, sectionServer(section, t.SshClientConf))
+	}
+
+	if c.SshD != nil {
+		c.planSshD(p)
+	}
+	if c.Web != nil {
+		p.add(ActionListen, "web", c.Web.GetListenAddress(), "web dashboard and api")
+	}
+	if c.Grpc != nil {
+		p.add(ActionListen, "grpc", c.Grpc.GetListenAddress(), "grpc api")
+		if c.Grpc.TLSCert != "" {
+			p.add(ActionKey, "grpc", c.Grpc.TLSCert, "tls certificate")
+			p.add(ActionKey, "grpc", c.Grpc.TLSKey, "tls key")
+		}
+	}
+	if c.ControlSocket != "" {
+		p.add(ActionListen, "control_socket", expandPath(c.ControlSocket), "control socket")
+	}
+	if c.SocksProxy != nil {
+		server := sectionServer("socksproxy", c.SocksProxy.SshClientConf)
+		p.add(ActionListen, "socksproxy", c.SocksProxy.ListenAddress, "on this host, socks5 proxy dialing from %s", server)
+	}
+	if c.DnsProxy != nil {
+		server := sectionServer("dnsproxy", c.DnsProxy.SshClientConf)
+		p.add(ActionListen, "dnsproxy", c.DnsProxy.ListenAddress, "udp, on this host")
+		for _, r := range c.DnsProxy.Routes {
+			p.add(ActionDial, "dnsproxy", r.Server, "dns server, from %s", server)
+		}
+	}
+	return p.steps
+}
+
+// planSshD adds the sshd listeners and keys
+func (c *Config) planSshD(p *plan) {
+	conf := c.SshD
+	if conf.ListenAddress != "" {
+		p.add(ActionListen, "sshd", conf.ListenAddress, "ssh server")
+	}
+	for _, l := range conf.Listeners {
+		if l.SocketPath != "" {
+			p.add(ActionListen, "sshd", l.SocketPath, "ssh server, unix socket")
+		} else {
+			p.add(ActionListen, "sshd", l.Address, "ssh server")
+		}
+	}
+	if v := conf.HTTPVhosts; v != nil {
+		if v.ListenAddress != "" {
+			p.add(ActionListen, "sshd.http_vhosts", v.ListenAddress, "http front-end")
+		}
+		if v.TLSListenAddress != "" {
+			p.add(ActionListen, "sshd.http_vhosts", v.TLSListenAddress, "https front-end")
+		}
+		if v.TLSCert != "" {
+			p.add(ActionKey, "sshd.http_vhosts", v.TLSCert, "tls certificate")
+			p.add(ActionKey, "sshd.http_vhosts", v.TLSKey, "tls key")
+		}
+	}
+
+	if conf.Key != "" {
+		p.add(ActionKey, "sshd", conf.Key, "host key")
+	}
+	for _, k := range conf.Keys {
+		p.add(ActionKey, "sshd", k, "host key")
+	}
+	for _, k := range conf.NextKeys {
+		p.add(ActionKey, "sshd", k, "next host key")
+	}
+	for _, s := range conf.AuthorizedKeysURI {
+		p.add(ActionKey, "sshd", s, "authorized keys")
+	}
+	for _, s := range conf.TrustedUserCAKeys {
+		p.add(ActionKey, "sshd", s, "trusted user ca keys")
+	}
+	for _, u := range conf.Users {
+		for _, s := range u.AuthorizedKeysURI {
+			p.add(ActionKey, "sshd", s, "authorized keys of %s", u.Name)
+		}
+	}
+}
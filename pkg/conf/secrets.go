@@ -0,0 +1,158 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v3"
+)
+
+// the environment variables holding the age identities decrypting the
+// encrypted config values: the key itself, or the path of a key file
+const (
+	AgeKeyEnv     = "ROSPO_AGE_KEY"
+	AgeKeyFileEnv = "ROSPO_AGE_KEY_FILE"
+)
+
+// matches an encrypted value: ENC[age,<base64 age ciphertext>]
+var encryptedRe = regexp.MustCompile(`^ENC\[age,([A-Za-z0-9+/=]+)\]$`)
+
+// IsEncrypted tells if value is an encrypted config value
+func IsEncrypted(value string) bool {
+	return encryptedRe.MatchString(strings.TrimSpace(value))
+}
+
+// Encrypt encrypts value for the age recipients, like "age1...", as an
+// encrypted config value
+func Encrypt(value string, recipients []string) (string, error) {
+	if len(recipients) == 0 {
+		return "", fmt.Errorf("no recipient given")
+	}
+	ageRecipients := []age.Recipient{}
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return "", err
+		}
+		ageRecipients = append(ageRecipients, recipient)
+	}
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, ageRecipients...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(w, value); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return "ENC[age," + base64.StdEncoding.EncodeToString(buf.Bytes()) + "]", nil
+}
+
+// AgeIdentities loads the age identities from the ROSPO_AGE_KEY or the
+// ROSPO_AGE_KEY_FILE environment variables
+func AgeIdentities() ([]age.Identity, error) {
+	if key := os.Getenv(AgeKeyEnv); key != "" {
+		return age.ParseIdentities(strings.NewReader(key))
+	}
+	path := os.Getenv(AgeKeyFileEnv)
+	if path == "" {
+		return nil, fmt.Errorf("no age key, set %s or %s", AgeKeyEnv, AgeKeyFileEnv)
+	}
+	path = expandPath(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return age.ParseIdentities(f)
+}
+
+// GenerateAgeKey generates an age key. It returns the key, to keep
+// secret, and its recipient, to encrypt the values with
+func GenerateAgeKey() (string, string, error) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", "", err
+	}
+	return identity.String(), identity.Recipient().String(), nil
+}
+
+// Decrypt decrypts an encrypted config value with the AgeIdentities
+func Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return "", fmt.Errorf("not an encrypted value")
+	}
+	identities, err := AgeIdentities()
+	if err != nil {
+		return "", err
+	}
+	return decrypt(value, identities)
+}
+
+// decrypt decrypts an encrypted config value
+func decrypt(value string, identities []age.Identity) (string, error) {
+	m := encryptedRe.FindStringSubmatch(strings.TrimSpace(value))
+	data, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		return "", err
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), identities...)
+	if err != nil {
+		return "", err
+	}
+	res, err := io.ReadAll(r)
+	return string(res), err
+}
+
+// decryptNode decrypts the encrypted scalar values of node. The
+// identities are loaded by AgeIdentities at the first encrypted value
+func decryptNode(node *yaml.Node) error {
+	var identities []age.Identity
+	var walk func(node *yaml.Node) error
+	walk = func(node *yaml.Node) error {
+		switch node.Kind {
+		case yaml.ScalarNode:
+			if !IsEncrypted(node.Value) {
+				return nil
+			}
+			if identities == nil {
+				var err error
+				if identities, err = AgeIdentities(); err != nil {
+					return fmt.Errorf("line %d: the value is encrypted: %s", node.Line, err)
+				}
+			}
+			value, err := decrypt(node.Value, identities)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", node.Line, err)
+			}
+			node.Value = value
+			// like the environment references, the plain values
+			// get their type from the decrypted value
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		case yaml.MappingNode:
+			for i := 1; i < len(node.Content); i += 2 {
+				if err := walk(node.Content[i]); err != nil {
+					return err
+				}
+			}
+		case yaml.DocumentNode, yaml.SequenceNode:
+			for _, n := range node.Content {
+				if err := walk(n); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(node)
+}
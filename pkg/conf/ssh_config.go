@@ -0,0 +1,264 @@
+package conf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+// SSHConfigHost holds the settings of a host read from an OpenSSH client
+// config file (~/.ssh/config). Only the settings rospo can use are kept
+type SSHConfigHost struct {
+	Host                  string
+	HostName              string
+	User                  string
+	Port                  string
+	IdentityFiles         []string
+	ProxyJump             string
+	StrictHostKeyChecking string
+	UserKnownHostsFile    string
+
+	LocalForwards   []string
+	RemoteForwards  []string
+	DynamicForwards []string
+}
+
+// LoadSSHConfig reads the settings of host from an OpenSSH client config file
+func LoadSSHConfig(filePath string, host string) (*SSHConfigHost, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseSSHConfig(f, host)
+}
+
+// ParseSSHConfig reads the settings of host from an OpenSSH client config.
+// Like ssh, the first value found for each setting wins, while the
+// forwards accumulate. Match blocks and Include directives are not
+// supported and are skipped
+func ParseSSHConfig(r io.Reader, host string) (*SSHConfigHost, error) {
+	res := &SSHConfigHost{Host: host}
+	matching := true
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := splitSSHConfigLine(line)
+		if value == "" {
+			return nil, fmt.Errorf("ssh config line %d: missing value for %s", lineNo, key)
+		}
+		switch key {
+		case "host":
+			matching = matchHostPatterns(strings.Fields(value), host)
+			continue
+		case "match":
+			matching = false
+			continue
+		}
+		if !matching {
+			continue
+		}
+		setFirst := func(field *string) {
+			if *field == "" {
+				*field = value
+			}
+		}
+		switch key {
+		case "hostname":
+			setFirst(&res.HostName)
+		case "user":
+			setFirst(&res.User)
+		case "port":
+			setFirst(&res.Port)
+		case "identityfile":
+			res.IdentityFiles = append(res.IdentityFiles, value)
+		case "proxyjump":
+			setFirst(&res.ProxyJump)
+		case "stricthostkeychecking":
+			setFirst(&res.StrictHostKeyChecking)
+		case "userknownhostsfile":
+			setFirst(&res.UserKnownHostsFile)
+		case "localforward":
+			res.LocalForwards = append(res.LocalForwards, value)
+		case "remoteforward":
+			res.RemoteForwards = append(res.RemoteForwards, value)
+		case "dynamicforward":
+			res.DynamicForwards = append(res.DynamicForwards, value)
+		}
+	}
+	return res, scanner.Err()
+}
+
+// splitSSHConfigLine splits a "Key value" or "Key=value" line. The key
+// is lower cased and the quotes around the value removed
+func splitSSHConfigLine(line string) (string, string) {
+	idx := strings.IndexAny(line, " \t=")
+	if idx < 0 {
+		return strings.ToLower(line), ""
+	}
+	key := strings.ToLower(line[:idx])
+	value := strings.TrimSpace(line[idx:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return key, value
+}
+
+// matchHostPatterns returns true if host matches at least one of the
+// patterns and none of the negated (!) ones
+func matchHostPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if ok, _ := filepath.Match(p[1:], host); ok {
+				return false
+			}
+			continue
+		}
+		if ok, _ := filepath.Match(p, host); ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// expandTokens expands the ~ prefix and the %h, %r, %u, %d and %%
+// tokens of a path
+func (h *SSHConfigHost) expandTokens(s string) string {
+	home, localUser := "", ""
+	if usr, err := user.Current(); err == nil {
+		home, localUser = usr.HomeDir, usr.Username
+	}
+	if strings.HasPrefix(s, "~/") {
+		s = filepath.Join(home, s[2:])
+	}
+	r := strings.NewReplacer(
+		"%%", "%",
+		"%h", h.hostName(),
+		"%r", h.User,
+		"%u", localUser,
+		"%d", home,
+	)
+	return r.Replace(s)
+}
+
+func (h *SSHConfigHost) hostName() string {
+	if h.HostName == "" {
+		return h.Host
+	}
+	return strings.ReplaceAll(h.HostName, "%h", h.Host)
+}
+
+// SshClientConf returns a copy of base updated with the host settings
+func (h *SSHConfigHost) SshClientConf(base *sshc.SshClientConf) *sshc.SshClientConf {
+	conf := *base
+	port := h.Port
+	if port == "" {
+		port = "22"
+	}
+	conf.ServerURI = net.JoinHostPort(h.hostName(), port)
+	if h.User != "" {
+		conf.ServerURI = h.User + "@" + conf.ServerURI
+	}
+
+	if len(h.IdentityFiles) > 0 {
+		conf.Identity = h.expandTokens(h.IdentityFiles[0])
+	}
+	if h.UserKnownHostsFile != "" {
+		conf.KnownHosts = h.expandTokens(strings.Fields(h.UserKnownHostsFile)[0])
+	}
+	if strings.EqualFold(h.StrictHostKeyChecking, "no") {
+		conf.Insecure = true
+	}
+	if h.ProxyJump != "" && !strings.EqualFold(h.ProxyJump, "none") {
+		conf.JumpHosts = []*sshc.JumpHostConf{}
+		for _, jh := range strings.Split(h.ProxyJump, ",") {
+			conf.JumpHosts = append(conf.JumpHosts, &sshc.JumpHostConf{
+				URI:      strings.TrimPrefix(strings.TrimSpace(jh), "ssh://"),
+				Identity: conf.Identity,
+			})
+		}
+	}
+	return &conf
+}
+
+// forwardAddress converts an ssh forward address, like "8080",
+// "*:8080", "host/8080" or a socket path, to a rospo endpoint
+func forwardAddress(s string) string {
+	if strings.HasPrefix(s, "/") {
+		return s
+	}
+	if !strings.Contains(s, ":") || strings.HasPrefix(s, "[") {
+		if idx := strings.LastIndex(s, "/"); idx >= 0 {
+			s = s[:idx] + ":" + s[idx+1:]
+		}
+	}
+	if !strings.Contains(s, ":") {
+		return ":" + s
+	}
+	if strings.HasPrefix(s, "*:") {
+		return "0.0.0.0" + s[1:]
+	}
+	return s
+}
+
+// Tunnels returns the rospo tunnels equivalent to the host LocalForward,
+// RemoteForward and DynamicForward directives
+func (h *SSHConfigHost) Tunnels() ([]*tun.TunnelConf, error) {
+	res := []*tun.TunnelConf{}
+	for _, f := range h.LocalForwards {
+		args := strings.Fields(f)
+		if len(args) != 2 {
+			return nil, fmt.Errorf("invalid LocalForward '%s'", f)
+		}
+		res = append(res, &tun.TunnelConf{
+			Local:   forwardAddress(args[0]),
+			Remote:  forwardAddress(args[1]),
+			Forward: true,
+		})
+	}
+	for _, f := range h.RemoteForwards {
+		args := strings.Fields(f)
+		switch len(args) {
+		case 1:
+			// like ssh, a remote forward without destination is a SOCKS proxy
+			res = append(res, &tun.TunnelConf{
+				Remote:        forwardAddress(args[0]),
+				RemoteDynamic: true,
+			})
+		case 2:
+			res = append(res, &tun.TunnelConf{
+				Remote: forwardAddress(args[0]),
+				Local:  forwardAddress(args[1]),
+			})
+		default:
+			return nil, fmt.Errorf("invalid RemoteForward '%s'", f)
+		}
+	}
+	for _, f := range h.DynamicForwards {
+		args := strings.Fields(f)
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid DynamicForward '%s'", f)
+		}
+		res = append(res, &tun.TunnelConf{
+			Local:   forwardAddress(args[0]),
+			Forward: true,
+			Dynamic: true,
+		})
+	}
+	return res, nil
+}
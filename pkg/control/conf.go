@@ -0,0 +1,26 @@
+package control
+
+// DefaultGrpcListenAddress is the gRPC server address when none is set,
+// bound to the loopback interface
+const DefaultGrpcListenAddress = "127.0.0.1:8091"
+
+// GrpcConf holds the gRPC management api configuration
+type GrpcConf struct {
+	ListenAddress string `yaml:"listen_address"`
+	// if the token is set, the requests need the
+	// "authorization: Bearer <token>" metadata
+	Token string `yaml:"token"`
+	// the server certificate and key files. Without them the
+	// connections are not encrypted
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+}
+
+// GetListenAddress returns the listen address, DefaultGrpcListenAddress
+// if not set
+func (c *GrpcConf) GetListenAddress() string {
+	if c.ListenAddress == "" {
+		return DefaultGrpcListenAddress
+	}
+	return c.ListenAddress
+}
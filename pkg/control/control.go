@@ -0,0 +1,298 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/tun"
+	"github.com/ferama/rospo/pkg/utils"
+	"google.golang.org/grpc"
+)
+
+var log = logger.NewLogger("[CTRL] ", logger.Cyan)
+
+// DefaultSocketPath is the control socket path used by the status
+// command when none is given
+var DefaultSocketPath = filepath.Join(os.TempDir(), "rospo.sock")
+
+// the requests timeout of the status client
+const queryTimeout = 5 * time.Second
+
+// SshDStatus is implemented by the sshd server
+type SshDStatus interface {
+	Stats() sshd.Stats
+	Sessions() []sshd.SessionInfo
+}
+
+// TunnelStatus describes a running tunnel
+type TunnelStatus struct {
+	ID       int               `json:"id"`
+	Name     string            `json:"name"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Forward  bool              `json:"forward"`
+	Dynamic  bool              `json:"dynamic"`
+	Paused   bool              `json:"paused"`
+	Listener string            `json:"listener"`
+	Endpoint string            `json:"endpoint"`
+	Stats    tun.Stats         `json:"stats"`
+	// the active client connections
+	Connections []tun.ConnStats `json:"connections,omitempty"`
+}
+
+// SshDInfo holds the sshd server state
+type SshDInfo struct {
+	Stats    sshd.Stats         `json:"stats"`
+	Sessions []sshd.SessionInfo `json:"sessions"`
+}
+
+// Status is the state of a running rospo instance
+type Status struct {
+	Pid         int                     `json:"pid"`
+	Version     string                  `json:"version"`
+	Uptime      time.Duration           `json:"uptime"`
+	Connections []sshc.ConnectionStatus `json:"connections"`
+	Tunnels     []TunnelStatus          `json:"tunnels"`
+	// nil if the sshd server is not running
+	SshD *SshDInfo `json:"sshd,omitempty"`
+}
+
+// Server serves the management api of the running instance on a local
+// control socket. The web server serves it too, under /api/v1:
+//
+//	GET /status       the whole instance state
+//	GET /healthz      the instance health, 503 if unhealthy
+//	GET /connections  the ssh connections state
+//	GET /sessions     the sshd sessions
+//	GET /metrics      the instance counters
+//	GET /logs         the last log lines
+//
+// and the tunnels requests, see tunnelsHandler. The go profiles are
+// served under /debug/pprof/ if enabled, see EnablePprof.
+//
+// Example:
+//
+//	curl --unix-socket /tmp/rospo.sock http://localhost/status
+type Server struct {
+	version   string
+	startTime time.Time
+	pool      *sshc.ConnectionPool
+	sshServer SshDStatus
+	// nil if the tunnels can't be added and removed
+	tunnels TunnelManager
+	// serves the go profiles, see EnablePprof
+	pprof bool
+
+	listener net.Listener
+	// the gRPC server, see StartGrpc
+	grpcServer   *grpc.Server
+	grpcListener net.Listener
+}
+
+// NewServer builds a control server. pool and sshServer may be nil
+func NewServer(version string, pool *sshc.ConnectionPool, sshServer SshDStatus) *Server {
+	return &Server{
+		version:   version,
+		startTime: time.Now(),
+		pool:      pool,
+		sshServer: sshServer,
+	}
+}
+
+// Start listens on the unix socket at path and serves the requests in
+// the background. On windows the socket is an AF_UNIX socket too
+func (s *Server) Start(path string) error {
+	path, err := utils.ExpandUserHome(path)
+	if err != nil {
+		return err
+	}
+	listener, err := utils.ListenUnix(path, utils.DefaultSocketPermissions)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	log.Printf("control socket listening on %s", path)
+
+	go http.Serve(listener, s.Handler())
+	return nil
+}
+
+// Handler returns the handler of the management api requests
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.statusHandler)
+	mux.HandleFunc("/healthz", s.healthHandler)
+	mux.HandleFunc("/connections", s.connectionsHandler)
+	mux.HandleFunc("/sessions", s.sessionsHandler)
+	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.HandleFunc("/logs", logsHandler)
+	mux.HandleFunc("/tunnels", s.tunnelsHandler)
+	mux.HandleFunc("/tunnels/", s.tunnelsHandler)
+	if s.pprof {
+		handlePprof(mux)
+	}
+	return mux
+}
+
+// Close stops the control listener and the gRPC server
+func (s *Server) Close() error {
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Status returns the current state of the instance
+func (s *Server) Status() *Status {
+	res := &Status{
+		Pid:         os.Getpid(),
+		Version:     s.version,
+		Uptime:      time.Since(s.startTime),
+		Connections: s.connections(),
+		Tunnels:     tunnels(),
+	}
+	if s.sshServer != nil {
+		res.SshD = &SshDInfo{
+			Stats:    s.sshServer.Stats(),
+			Sessions: s.sshServer.Sessions(),
+		}
+	}
+	return res
+}
+
+// connections returns the ssh connections state
+func (s *Server) connections() []sshc.ConnectionStatus {
+	if s.pool == nil {
+		return []sshc.ConnectionStatus{}
+	}
+	return s.pool.Status()
+}
+
+// sessions returns the sshd sessions, empty if the sshd is not running
+func (s *Server) sessions() []sshd.SessionInfo {
+	if s.sshServer == nil {
+		return []sshd.SessionInfo{}
+	}
+	return s.sshServer.Sessions()
+}
+
+// getOnly serves the GET requests with the value returned by get
+func getOnly(w http.ResponseWriter, r *http.Request, get func() any) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, get())
+}
+
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	getOnly(w, r, func() any { return s.Status() })
+}
+
+func (s *Server) connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	getOnly(w, r, func() any { return s.connections() })
+}
+
+func (s *Server) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	getOnly(w, r, func() any { return s.sessions() })
+}
+
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	getOnly(w, r, func() any { return s.Metrics() })
+}
+
+// logsHandler serves the last log lines. The lines query parameter
+// limits how many
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	lines := logger.Recent()
+	if param := r.URL.Query().Get("lines"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid lines parameter")
+			return
+		}
+		if n < len(lines) {
+			lines = lines[len(lines)-n:]
+		}
+	}
+	getOnly(w, r, func() any { return lines })
+}
+
+// QueryStatus gets the status of the instance listening on the control
+// socket at path
+func QueryStatus(path string) (*Status, error) {
+	var status Status
+	if err := request(path, http.MethodGet, "/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// request sends a request to the control socket at path, with body json
+// encoded if not nil, and decodes the response into out if not nil
+func request(path string, method string, uri string, body any, out any) error {
+	res, err := send(path, method, uri, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(res.Body).Decode(&e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// send sends a request to the control socket at path, with body json
+// encoded if not nil. The GET requests time out, the others may wait for
+// the tunnels to drain
+func send(path string, method string, uri string, body any) (*http.Response, error) {
+	path, err := utils.ExpandUserHome(path)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	if method == http.MethodGet {
+		client.Timeout = queryTimeout
+	}
+	var data []byte
+	if body != nil {
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, "http://localhost"+uri, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
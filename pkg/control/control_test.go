@@ -0,0 +1,217 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+type fakeSshD struct{}
+
+func (f fakeSshD) Stats() sshd.Stats {
+	return sshd.Stats{ActiveConnections: 1}
+}
+
+func (f fakeSshD) Sessions() []sshd.SessionInfo {
+	return []sshd.SessionInfo{{ID: 1, User: "test"}}
+}
+
+func TestStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rospo.sock")
+	server := NewServer("test", nil, fakeSshD{})
+	if err := server.Start(path); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if err := NewServer("test", nil, nil).Start(path); err == nil {
+		t.Fatal("the socket should be in use")
+	}
+
+	status, err := QueryStatus(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Pid != os.Getpid() || status.Version != "test" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if status.SshD == nil || status.SshD.Stats.ActiveConnections != 1 || len(status.SshD.Sessions) != 1 {
+		t.Fatalf("unexpected sshd status %+v", status.SshD)
+	}
+
+	server.Close()
+	if _, err := QueryStatus(path); err == nil {
+		t.Fatal("the query should fail once the server is closed")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	handler := NewServer("test", nil, fakeSshD{}).Handler()
+	get := func(path string, out any) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if out != nil && w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+
+	var sessions []sshd.SessionInfo
+	if code := get("/sessions", &sessions); code != http.StatusOK || len(sessions) != 1 {
+		t.Fatalf("unexpected sessions %d %+v", code, sessions)
+	}
+	var metrics Metrics
+	if code := get("/metrics", &metrics); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if metrics.Goroutines == 0 || metrics.SshD == nil || metrics.SshD.ActiveConnections != 1 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+	log.Println("control test line")
+	var lines []string
+	if code := get("/logs?lines=1", &lines); code != http.StatusOK ||
+		len(lines) != 1 || !strings.Contains(lines[0], "control test line") {
+		t.Fatalf("unexpected logs %d %v", code, lines)
+	}
+	if code := get("/logs?lines=x", nil); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", code)
+	}
+	var connections []any
+	if code := get("/connections", &connections); code != http.StatusOK || len(connections) != 0 {
+		t.Fatalf("unexpected connections %d %v", code, connections)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	get := func(handler http.Handler, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	server := NewServer("test", nil, nil)
+	if w := get(server.Handler(), "/debug/pprof/"); w.Code != http.StatusNotFound {
+		t.Fatalf("pprof should be disabled, got %d", w.Code)
+	}
+	server.EnablePprof()
+	w := get(server.Handler(), "/debug/pprof/goroutine?debug=1")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Fatalf("unexpected goroutine profile %d %q", w.Code, w.Body.String())
+	}
+}
+
+type fakeTunnelManager struct {
+	added     []*tun.TunnelConf
+	removed   []*tun.Tunnel
+	restarted []*tun.Tunnel
+}
+
+func (f *fakeTunnelManager) AddTunnel(c *tun.TunnelConf) (int, error) {
+	f.added = append(f.added, c)
+	return 1, nil
+}
+
+func (f *fakeTunnelManager) RemoveTunnel(t *tun.Tunnel) int {
+	f.removed = append(f.removed, t)
+	return 2
+}
+
+func (f *fakeTunnelManager) RestartTunnel(t *tun.Tunnel) (int, error) {
+	f.restarted = append(f.restarted, t)
+	return 1, nil
+}
+
+func TestTunnels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rospo.sock")
+	server := NewServer("test", nil, nil)
+	if err := server.Start(path); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if _, err := AddTunnel(path, &tun.TunnelConf{Local: ":8080", Remote: ":80"}); err == nil {
+		t.Fatal("adding a tunnel without a manager should fail")
+	}
+	manager := &fakeTunnelManager{}
+	server.SetTunnelManager(manager)
+	added, err := AddTunnel(path, &tun.TunnelConf{Name: "web", Local: ":8080", Remote: ":80"})
+	if err != nil || added != 1 {
+		t.Fatalf("unexpected add result %d %v", added, err)
+	}
+	if len(manager.added) != 1 || manager.added[0].Name != "web" {
+		t.Fatalf("unexpected added tunnels %+v", manager.added)
+	}
+
+	tunnel := tun.NewTunnel(nil, &tun.TunnelConf{Name: "test", Local: ":8080", Remote: ":80"}, true)
+	id := tun.TunRegistry().Add(tunnel)
+	defer tun.TunRegistry().Delete(id)
+
+	if err := PauseTunnel(path, id); err != nil {
+		t.Fatal(err)
+	}
+	tunnels, err := ListTunnels(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range tunnels {
+		if s.ID == id {
+			found = s.Paused && s.Name == "test"
+		}
+	}
+	if !found || !tunnel.IsPaused() {
+		t.Fatalf("the tunnel should be listed as paused: %+v", tunnels)
+	}
+	if err := ResumeTunnel(path, id); err != nil || tunnel.IsPaused() {
+		t.Fatalf("the tunnel should be resumed: %v", err)
+	}
+	cut, err := RestartTunnel(path, id)
+	if err != nil || cut != 1 || len(manager.restarted) != 1 || manager.restarted[0] != tunnel {
+		t.Fatalf("unexpected restart result %d %v", cut, err)
+	}
+
+	cut, err = RemoveTunnel(path, id)
+	if err != nil || cut != 2 || len(manager.removed) != 1 || manager.removed[0] != tunnel {
+		t.Fatalf("unexpected remove result %d %v", cut, err)
+	}
+	if err := PauseTunnel(path, -1); err == nil {
+		t.Fatal("pausing an unknown tunnel should fail")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rospo.sock")
+	server := NewServer("test", nil, nil)
+	if err := server.Start(path); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	health, err := QueryHealth(path)
+	if err != nil || !health.Healthy {
+		t.Fatalf("unexpected health %+v %v", health, err)
+	}
+
+	// a tunnel not started is not listening
+	tunnel := tun.NewTunnel(nil, &tun.TunnelConf{Name: "down", Local: ":8080", Remote: ":80"}, true)
+	id := tun.TunRegistry().Add(tunnel)
+	defer tun.TunRegistry().Delete(id)
+
+	health, err = QueryHealth(path)
+	if err != nil || health.Healthy || len(health.Problems) != 1 || !strings.Contains(health.Problems[0], "down") {
+		t.Fatalf("unexpected health %+v %v", health, err)
+	}
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+}
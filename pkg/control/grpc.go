@@ -0,0 +1,266 @@
+package control
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/tun"
+	"github.com/ferama/rospo/pkg/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// GrpcServiceName is the gRPC management service, defined in rospo.proto
+const GrpcServiceName = "rospo.control.v1.Control"
+
+// the events buffered for each Events stream. The events exceeding it
+// while the client is slow are lost
+const grpcEventsBufferSize = 256
+
+// toStruct converts v to the protobuf struct of its json object
+func toStruct(v any) (*structpb.Struct, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	res := &structpb.Struct{}
+	if err := protojson.Unmarshal(data, res); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return res, nil
+}
+
+// grpcTunnel returns the tunnel of the id request
+func grpcTunnel(in proto.Message) (*tun.Tunnel, error) {
+	t, err := tunnelByID(int(in.(*wrapperspb.Int64Value).GetValue()))
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return t, nil
+}
+
+// grpcMethod builds the descriptor of the unary rpc name. newIn returns
+// an empty request, call serves it
+func grpcMethod(name string, newIn func() proto.Message,
+	call func(s *Server, in proto.Message) (proto.Message, error)) grpc.MethodDesc {
+
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			in := newIn()
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req any) (any, error) {
+				return call(srv.(*Server), req.(proto.Message))
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/" + GrpcServiceName + "/" + name,
+			}
+			return interceptor(ctx, in, info, handler)
+		},
+	}
+}
+
+func newEmpty() proto.Message  { return &emptypb.Empty{} }
+func newID() proto.Message     { return &wrapperspb.Int64Value{} }
+func newStruct() proto.Message { return &structpb.Struct{} }
+
+// grpcServiceDesc describes the service of rospo.proto. It is written by
+// hand: the messages are the well known types, there is nothing to
+// generate
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: GrpcServiceName,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		grpcMethod("Status", newEmpty, func(s *Server, in proto.Message) (proto.Message, error) {
+			return toStruct(s.Status())
+		}),
+		grpcMethod("Connections", newEmpty, func(s *Server, in proto.Message) (proto.Message, error) {
+			return toStruct(map[string]any{"connections": s.connections()})
+		}),
+		grpcMethod("Sessions", newEmpty, func(s *Server, in proto.Message) (proto.Message, error) {
+			return toStruct(map[string]any{"sessions": s.sessions()})
+		}),
+		grpcMethod("Metrics", newEmpty, func(s *Server, in proto.Message) (proto.Message, error) {
+			return toStruct(s.Metrics())
+		}),
+		grpcMethod("ListTunnels", newEmpty, func(s *Server, in proto.Message) (proto.Message, error) {
+			return toStruct(map[string]any{"tunnels": tunnels()})
+		}),
+		grpcMethod("AddTunnel", newStruct, func(s *Server, in proto.Message) (proto.Message, error) {
+			if s.tunnels == nil {
+				return nil, status.Error(codes.Unimplemented, "this instance can't add tunnels")
+			}
+			data, err := protojson.Marshal(in)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			var c tun.TunnelConf
+			if err := json.Unmarshal(data, &c); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			added, err := s.tunnels.AddTunnel(&c)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			return toStruct(map[string]int{"added": added})
+		}),
+		grpcMethod("PauseTunnel", newID, func(s *Server, in proto.Message) (proto.Message, error) {
+			t, err := grpcTunnel(in)
+			if err != nil {
+				return nil, err
+			}
+			t.Pause()
+			return &emptypb.Empty{}, nil
+		}),
+		grpcMethod("ResumeTunnel", newID, func(s *Server, in proto.Message) (proto.Message, error) {
+			t, err := grpcTunnel(in)
+			if err != nil {
+				return nil, err
+			}
+			t.Resume()
+			return &emptypb.Empty{}, nil
+		}),
+		grpcMethod("RestartTunnel", newID, func(s *Server, in proto.Message) (proto.Message, error) {
+			t, err := grpcTunnel(in)
+			if err != nil {
+				return nil, err
+			}
+			if s.tunnels == nil {
+				return nil, status.Error(codes.Unimplemented, "this instance can't restart tunnels")
+			}
+			cut, err := s.tunnels.RestartTunnel(t)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			return toStruct(map[string]int{"cut_connections": cut})
+		}),
+		grpcMethod("RemoveTunnel", newID, func(s *Server, in proto.Message) (proto.Message, error) {
+			t, err := grpcTunnel(in)
+			if err != nil {
+				return nil, err
+			}
+			return toStruct(map[string]int{"cut_connections": s.removeTunnel(t)})
+		}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Events",
+			Handler:       grpcEvents,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rospo.proto",
+}
+
+// grpcEvents streams the tunnel events until the client goes away
+func grpcEvents(srv any, stream grpc.ServerStream) error {
+	in := &wrapperspb.Int64Value{}
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	tunnelID := int(in.GetValue())
+
+	events, unsubscribe := tun.Events().Subscribe(grpcEventsBufferSize)
+	defer unsubscribe()
+	// the headers tell the client that no event is lost from now on
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case e := <-events:
+			if tunnelID != 0 && e.TunnelID != tunnelID {
+				continue
+			}
+			msg, err := toStruct(e)
+			if err != nil {
+				return err
+			}
+			if err := stream.SendMsg(msg); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// grpcAuthorize checks the bearer token of the request metadata
+func grpcAuthorize(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, val := range md.Get("authorization") {
+		got, ok := strings.CutPrefix(val, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid or missing token")
+}
+
+// StartGrpc listens on the conf address and serves the gRPC management
+// api in the background
+func (s *Server) StartGrpc(conf *GrpcConf) error {
+	var opts []grpc.ServerOption
+	if conf.TLSCert != "" {
+		cert, err := utils.ExpandUserHome(conf.TLSCert)
+		if err != nil {
+			return err
+		}
+		key, err := utils.ExpandUserHome(conf.TLSKey)
+		if err != nil {
+			return err
+		}
+		creds, err := credentials.NewServerTLSFromFile(cert, key)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	if conf.Token != "" {
+		opts = append(opts,
+			grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				if err := grpcAuthorize(ctx, conf.Token); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := grpcAuthorize(ss.Context(), conf.Token); err != nil {
+					return err
+				}
+				return handler(srv, ss)
+			}),
+		)
+	} else if !utils.IsLoopback(conf.GetListenAddress()) {
+		log.Warnf("the grpc server listens on %s without authentication", conf.GetListenAddress())
+	}
+
+	listener, err := net.Listen("tcp", conf.GetListenAddress())
+	if err != nil {
+		return err
+	}
+	s.grpcListener = listener
+	s.grpcServer = grpc.NewServer(opts...)
+	s.grpcServer.RegisterService(&grpcServiceDesc, s)
+	log.Printf("grpc server listening on %s", listener.Addr())
+
+	go s.grpcServer.Serve(listener)
+	return nil
+}
@@ -0,0 +1,96 @@
+package control
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ferama/rospo/pkg/tun"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestGrpc(t *testing.T) {
+	server := NewServer("test", nil, fakeSshD{})
+	if err := server.StartGrpc(&GrpcConf{ListenAddress: "127.0.0.1:0", Token: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := grpc.Dial(server.grpcListener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	method := func(name string) string {
+		return "/" + GrpcServiceName + "/" + name
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res := &structpb.Struct{}
+	err = conn.Invoke(ctx, method("Status"), &emptypb.Empty{}, res)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	if err := conn.Invoke(ctx, method("Status"), &emptypb.Empty{}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Fields["version"].GetStringValue() != "test" {
+		t.Fatalf("unexpected status %v", res)
+	}
+	if err := conn.Invoke(ctx, method("Sessions"), &emptypb.Empty{}, res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Fields["sessions"].GetListValue().GetValues()) != 1 {
+		t.Fatalf("unexpected sessions %v", res)
+	}
+	tunnelConf, _ := structpb.NewStruct(map[string]any{"local": ":8080", "remote": ":80"})
+	err = conn.Invoke(ctx, method("AddTunnel"), tunnelConf, res)
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = conn.Invoke(ctx, method("PauseTunnel"), wrapperspb.Int64(-1), &emptypb.Empty{})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tunnel := tun.NewTunnel(nil, &tun.TunnelConf{Name: "grpc", Local: ":8080", Remote: ":80"}, true)
+	id := tun.TunRegistry().Add(tunnel)
+	defer tun.TunRegistry().Delete(id)
+
+	stream, err := conn.NewStream(ctx, &grpcServiceDesc.Streams[0], method("Events"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(wrapperspb.Int64(0)); err != nil {
+		t.Fatal(err)
+	}
+	stream.CloseSend()
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Invoke(ctx, method("RemoveTunnel"), wrapperspb.Int64(int64(id)), res); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		event := &structpb.Struct{}
+		if err := stream.RecvMsg(event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Fields["type"].GetStringValue() == tun.EVENT_TUNNEL_STOPPED &&
+			event.Fields["tunnel_name"].GetStringValue() == "grpc" {
+			break
+		}
+	}
+}
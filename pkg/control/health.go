@@ -0,0 +1,77 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ferama/rospo/pkg/sshc"
+)
+
+// Health tells whether the instance is healthy: its ssh connections are
+// up and its tunnels are listening
+type Health struct {
+	Healthy bool `json:"healthy"`
+	// what is wrong with an unhealthy instance
+	Problems []string `json:"problems,omitempty"`
+}
+
+// Health checks the instance. The on demand connections are not checked,
+// they are down while idle
+func (s *Server) Health() *Health {
+	res := &Health{}
+	for _, c := range s.connections() {
+		if !c.OnDemand && c.Status != sshc.STATUS_CONNECTED {
+			res.Problems = append(res.Problems,
+				fmt.Sprintf("ssh connection to %s: %s", c.Server, c.Status))
+		}
+	}
+	for _, t := range tunnels() {
+		if t.Stats.Uptime != 0 {
+			continue
+		}
+		problem := fmt.Sprintf("tunnel %d: not listening", t.ID)
+		if t.Name != "" {
+			problem = fmt.Sprintf("tunnel %d (%s): not listening", t.ID, t.Name)
+		}
+		if t.Stats.LastError != "" {
+			problem += ", " + t.Stats.LastError
+		}
+		res.Problems = append(res.Problems, problem)
+	}
+	res.Healthy = len(res.Problems) == 0
+	return res
+}
+
+// healthHandler serves the health, with the 503 status if unhealthy for
+// the http probes
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	health := s.Health()
+	code := http.StatusOK
+	if !health.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, health)
+}
+
+// QueryHealth gets the health of the instance listening on the control
+// socket at path
+func QueryHealth(path string) (*Health, error) {
+	res, err := send(path, http.MethodGet, "/healthz", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusServiceUnavailable {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	var health Health
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
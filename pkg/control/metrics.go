@@ -0,0 +1,65 @@
+package control
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+// Metrics are the counters of the running instance, for the monitoring
+// systems. The bytes are the data received from the tunnels clients and
+// sent to them
+type Metrics struct {
+	Uptime               time.Duration `json:"uptime"`
+	Connections          int           `json:"connections"`
+	ConnectedConnections int           `json:"connected_connections"`
+	Tunnels              int           `json:"tunnels"`
+	ActiveConnections    int           `json:"active_connections"`
+	AcceptedConnections  int64         `json:"accepted_connections"`
+	BytesIn              int64         `json:"bytes_in"`
+	BytesOut             int64         `json:"bytes_out"`
+	// the current tunnels throughput, in bytes per second
+	Throughput int64 `json:"throughput"`
+	Goroutines int   `json:"goroutines"`
+	// the memory in use, in bytes
+	Memory uint64 `json:"memory"`
+	// nil if the sshd server is not running
+	SshD *sshd.Stats `json:"sshd,omitempty"`
+}
+
+// Metrics returns the current counters of the instance
+func (s *Server) Metrics() *Metrics {
+	res := &Metrics{
+		Uptime:     time.Since(s.startTime),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	for _, c := range s.connections() {
+		res.Connections++
+		if c.Status == sshc.STATUS_CONNECTED {
+			res.ConnectedConnections++
+		}
+	}
+	for _, val := range tun.TunRegistry().GetAll() {
+		t := val.(*tun.Tunnel)
+		stats := t.Stats()
+		res.Tunnels++
+		res.ActiveConnections += stats.ActiveConnections
+		res.AcceptedConnections += stats.AcceptedConnections
+		res.BytesIn += stats.BytesIn
+		res.BytesOut += stats.BytesOut
+		res.Throughput += t.GetCurrentBytesPerSecond()
+	}
+
+	memStats := new(runtime.MemStats)
+	runtime.ReadMemStats(memStats)
+	res.Memory = memStats.HeapInuse + memStats.StackInuse + memStats.MSpanInuse + memStats.MCacheInuse
+
+	if s.sshServer != nil {
+		stats := s.sshServer.Stats()
+		res.SshD = &stats
+	}
+	return res
+}
@@ -0,0 +1,26 @@
+package control
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// EnablePprof serves the go runtime profiles under /debug/pprof/, to
+// look for the memory and goroutines leaks of a long running instance:
+//
+//	curl --unix-socket /tmp/rospo.sock http://localhost/debug/pprof/goroutine?debug=1
+//	go tool pprof http://127.0.0.1:8090/api/v1/debug/pprof/heap
+//
+// It must be called before Start and Handler
+func (s *Server) EnablePprof() {
+	s.pprof = true
+}
+
+// handlePprof registers the pprof handlers on mux
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
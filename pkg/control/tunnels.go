@@ -0,0 +1,214 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+// TunnelManager is implemented by the run command, to change its
+// tunnels at runtime
+type TunnelManager interface {
+	// AddTunnel starts the tunnels of c and returns how many. Templates
+	// and port ranges expand to many tunnels
+	AddTunnel(c *tun.TunnelConf) (int, error)
+	// RemoveTunnel stops t and returns the number of connections cut
+	RemoveTunnel(t *tun.Tunnel) int
+	// RestartTunnel stops t and starts it again with the same
+	// configuration. It returns the number of connections cut
+	RestartTunnel(t *tun.Tunnel) (int, error)
+}
+
+// SetTunnelManager enables the tunnels add, remove and restart requests
+func (s *Server) SetTunnelManager(m TunnelManager) {
+	s.tunnels = m
+}
+
+// tunnels returns the status of the running tunnels, sorted by id
+func tunnels() []TunnelStatus {
+	res := []TunnelStatus{}
+	for id, val := range tun.TunRegistry().GetAll() {
+		t := val.(*tun.Tunnel)
+		listener := ""
+		if addr := t.GetListenerAddr(); addr != nil {
+			listener = addr.String()
+		}
+		endpoint := t.GetEndpoint()
+		res = append(res, TunnelStatus{
+			ID:       id,
+			Name:     t.GetName(),
+			Labels:   t.GetLabels(),
+			Forward:  t.GetIsListenerLocal(),
+			Dynamic:  t.GetIsDynamic(),
+			Paused:   t.IsPaused(),
+			Listener: listener,
+			Endpoint: endpoint.String(),
+			Stats:    t.Stats(),
+
+			Connections: t.Connections(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// writeJSON writes v as the response body, with the code status
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err string) {
+	writeJSON(w, code, map[string]string{"error": err})
+}
+
+// tunnelsHandler serves:
+//
+//	GET    /tunnels             lists the tunnels
+//	POST   /tunnels             adds the tunnel of the json TunnelConf body
+//	POST   /tunnels/{id}/pause  refuses the new clients
+//	POST   /tunnels/{id}/resume accepts the new clients again
+//	POST   /tunnels/{id}/restart stops and starts the tunnel again
+//	DELETE /tunnels/{id}        stops the tunnel
+func (s *Server) tunnelsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/tunnels"), "/"), "/")
+	if parts[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, tunnels())
+		case http.MethodPost:
+			s.addTunnel(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	t, err := tunnelByID(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		writeJSON(w, http.StatusOK, map[string]int{"cut_connections": s.removeTunnel(t)})
+	case action == "pause" && r.Method == http.MethodPost:
+		t.Pause()
+		writeJSON(w, http.StatusOK, map[string]string{})
+	case action == "resume" && r.Method == http.MethodPost:
+		t.Resume()
+		writeJSON(w, http.StatusOK, map[string]string{})
+	case action == "restart" && r.Method == http.MethodPost:
+		if s.tunnels == nil {
+			writeError(w, http.StatusNotImplemented, "this instance can't restart tunnels")
+			return
+		}
+		cut, err := s.tunnels.RestartTunnel(t)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"cut_connections": cut})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// tunnelByID returns the running tunnel id
+func tunnelByID(id int) (*tun.Tunnel, error) {
+	val, err := tun.TunRegistry().GetByID(id)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel %d not found", id)
+	}
+	return val.(*tun.Tunnel), nil
+}
+
+// removeTunnel stops t through the tunnel manager, if any, and returns
+// the number of connections cut
+func (s *Server) removeTunnel(t *tun.Tunnel) int {
+	if s.tunnels != nil {
+		return s.tunnels.RemoveTunnel(t)
+	}
+	return t.Shutdown()
+}
+
+func (s *Server) addTunnel(w http.ResponseWriter, r *http.Request) {
+	if s.tunnels == nil {
+		writeError(w, http.StatusNotImplemented, "this instance can't add tunnels")
+		return
+	}
+	var c tun.TunnelConf
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	added, err := s.tunnels.AddTunnel(&c)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"added": added})
+}
+
+// ListTunnels gets the tunnels of the instance listening on the control
+// socket at path
+func ListTunnels(path string) ([]TunnelStatus, error) {
+	var res []TunnelStatus
+	err := request(path, http.MethodGet, "/tunnels", nil, &res)
+	return res, err
+}
+
+// AddTunnel starts the tunnel c on the instance listening on the control
+// socket at path. It returns the number of tunnels started
+func AddTunnel(path string, c *tun.TunnelConf) (int, error) {
+	var res struct {
+		Added int `json:"added"`
+	}
+	err := request(path, http.MethodPost, "/tunnels", c, &res)
+	return res.Added, err
+}
+
+// PauseTunnel makes the tunnel id refuse the new clients
+func PauseTunnel(path string, id int) error {
+	return request(path, http.MethodPost, fmt.Sprintf("/tunnels/%d/pause", id), nil, nil)
+}
+
+// ResumeTunnel makes the paused tunnel id accept the new clients again
+func ResumeTunnel(path string, id int) error {
+	return request(path, http.MethodPost, fmt.Sprintf("/tunnels/%d/resume", id), nil, nil)
+}
+
+// RemoveTunnel stops the tunnel id. It returns the number of connections
+// cut once the drain timeout expired
+func RemoveTunnel(path string, id int) (int, error) {
+	var res struct {
+		CutConnections int `json:"cut_connections"`
+	}
+	err := request(path, http.MethodDelete, fmt.Sprintf("/tunnels/%d", id), nil, &res)
+	return res.CutConnections, err
+}
+
+// RestartTunnel stops the tunnel id and starts it again, with a new id.
+// It returns the number of connections cut
+func RestartTunnel(path string, id int) (int, error) {
+	var res struct {
+		CutConnections int `json:"cut_connections"`
+	}
+	err := request(path, http.MethodPost, fmt.Sprintf("/tunnels/%d/restart", id), nil, &res)
+	return res.CutConnections, err
+}
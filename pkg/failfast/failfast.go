@@ -0,0 +1,53 @@
+// Package failfast makes rospo exit with a meaningful code when an ssh
+// connection or a tunnel listener keeps failing, instead of retrying
+// forever. It is disabled by default
+package failfast
+
+import (
+	"os"
+	"sync/atomic"
+
+	"github.com/ferama/rospo/pkg/logger"
+)
+
+var log = logger.NewLogger("[FAIL] ", logger.Red)
+
+// the exit codes, by failure cause
+const (
+	// the ssh server refused the credentials
+	ExitAuthFailure = 3
+	// the ssh server key is not the known or the pinned one
+	ExitHostKeyMismatch = 4
+	// the ssh server can't be reached
+	ExitUnreachable = 5
+	// a tunnel listener can't be opened
+	ExitBindFailure = 6
+)
+
+// the failed attempts retried in a row, negative for no limit
+var maxRetries atomic.Int64
+
+func init() {
+	maxRetries.Store(-1)
+}
+
+// exit is os.Exit, replaced by the tests
+var exit = os.Exit
+
+// SetMaxRetries sets how many times in a row a failed connection or
+// listener is retried before exiting. Negative values retry forever, the
+// default, and 0 exits at the first failure
+func SetMaxRetries(n int) {
+	maxRetries.Store(int64(n))
+}
+
+// Check exits with code once failures, the failed attempts in a row,
+// exceed the max retries. err is the last failure
+func Check(failures int, code int, err error) {
+	max := maxRetries.Load()
+	if max < 0 || int64(failures) <= max {
+		return
+	}
+	log.Errorf("giving up after %d failed attempts: %s", failures, err)
+	exit(code)
+}
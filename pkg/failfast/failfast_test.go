@@ -0,0 +1,39 @@
+package failfast
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	code := -1
+	exit = func(c int) { code = c }
+	defer func() {
+		exit = os.Exit
+		SetMaxRetries(-1)
+	}()
+
+	err := errors.New("connection refused")
+	Check(100, ExitUnreachable, err)
+	if code != -1 {
+		t.Fatalf("the default should retry forever, exited with %d", code)
+	}
+
+	SetMaxRetries(2)
+	Check(2, ExitUnreachable, err)
+	if code != -1 {
+		t.Fatalf("exited with %d before the max retries", code)
+	}
+	Check(3, ExitAuthFailure, err)
+	if code != ExitAuthFailure {
+		t.Fatalf("expected the exit code %d, got %d", ExitAuthFailure, code)
+	}
+
+	code = -1
+	SetMaxRetries(0)
+	Check(1, ExitBindFailure, err)
+	if code != ExitBindFailure {
+		t.Fatalf("expected the exit code %d, got %d", ExitBindFailure, code)
+	}
+}
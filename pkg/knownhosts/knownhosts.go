@@ -0,0 +1,380 @@
+package knownhosts
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	xknownhosts "golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Entry is a host key line of a known_hosts file
+type Entry struct {
+	// the line number, starting from 1
+	Line int
+	// @cert-authority or @revoked. Empty for the plain host keys
+	Marker string
+	// the host patterns. The hashed ones are kept as is
+	Hosts []string
+	Key   ssh.PublicKey
+}
+
+// File holds the lines of a known_hosts file. The lines that are not
+// host keys, like the comments, are kept as is on Save
+type File struct {
+	path  string
+	lines []string
+	// the parsed entries, by line index. nil for the other lines
+	entries []*Entry
+	// true if the lines were changed after Load
+	modified bool
+}
+
+// Load reads the known_hosts file at path. A missing file is loaded
+// empty, and created by Save
+func Load(path string) (*File, error) {
+	path, err := expandUserHome(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	f.setLines(lines)
+	f.modified = false
+	return f, nil
+}
+
+// setLines replaces the file lines and parses their entries
+func (f *File) setLines(lines []string) {
+	f.modified = true
+	f.lines = lines
+	f.entries = make([]*Entry, len(lines))
+	for i, line := range lines {
+		f.entries[i] = parseLine(line, i+1)
+	}
+}
+
+// parseLine parses a host key line. nil for the comments, the empty
+// lines and the invalid ones
+func parseLine(line string, number int) *Entry {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return nil
+	}
+	marker, hosts, key, _, _, err := ssh.ParseKnownHosts([]byte(trimmed))
+	if err != nil {
+		return nil
+	}
+	if marker != "" {
+		marker = "@" + marker
+	}
+	return &Entry{Line: number, Marker: marker, Hosts: hosts, Key: key}
+}
+
+// Path returns the file path, with the ~ prefix expanded
+func (f *File) Path() string {
+	return f.path
+}
+
+// Entries returns the host key entries of the file
+func (f *File) Entries() []*Entry {
+	return f.Lookup("")
+}
+
+// Lookup returns the entries matching host. All of them if host is empty
+func (f *File) Lookup(host string) []*Entry {
+	res := []*Entry{}
+	for _, e := range f.entries {
+		if e != nil && (host == "" || e.Matches(host)) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Add appends key for host, with the host name hashed if hash is set.
+// It returns false if the key is already known for host
+func (f *File) Add(host string, key ssh.PublicKey, hash bool) bool {
+	for _, e := range f.Lookup(host) {
+		if e.Marker == "" && bytes.Equal(e.Key.Marshal(), key.Marshal()) {
+			return false
+		}
+	}
+	pattern := xknownhosts.Normalize(host)
+	if hash {
+		pattern = xknownhosts.HashHostname(pattern)
+	}
+	f.setLines(append(f.lines, Line("", []string{pattern}, key)))
+	return true
+}
+
+// Remove removes host from the file. The entries listing other hosts too
+// keep them. It returns the number of entries changed or removed
+func (f *File) Remove(host string) int {
+	normalized := xknownhosts.Normalize(host)
+	changed := 0
+	lines := []string{}
+	for i, e := range f.entries {
+		if e == nil || !e.Matches(host) {
+			lines = append(lines, f.lines[i])
+			continue
+		}
+		changed++
+		hosts := []string{}
+		for _, pattern := range e.Hosts {
+			if !patternMatches(pattern, normalized) {
+				hosts = append(hosts, pattern)
+			}
+		}
+		if len(hosts) > 0 {
+			lines = append(lines, Line(e.Marker, hosts, e.Key))
+		}
+	}
+	if changed > 0 {
+		f.setLines(lines)
+	}
+	return changed
+}
+
+// Hash replaces the host names with their hashes, like ssh-keygen -H. An
+// entry listing many hosts is split in one line per host. The patterns
+// with wildcards or negations can't be hashed and are kept as is. It
+// returns the number of hosts hashed
+func (f *File) Hash() int {
+	hashed := 0
+	lines := []string{}
+	for i, e := range f.entries {
+		if e == nil {
+			lines = append(lines, f.lines[i])
+			continue
+		}
+		kept := []string{}
+		for _, pattern := range e.Hosts {
+			if strings.HasPrefix(pattern, "|1|") || strings.ContainsAny(pattern, "*?!") {
+				kept = append(kept, pattern)
+				continue
+			}
+			lines = append(lines, Line(e.Marker, []string{xknownhosts.HashHostname(pattern)}, e.Key))
+			hashed++
+		}
+		if len(kept) > 0 {
+			lines = append(lines, Line(e.Marker, kept, e.Key))
+		}
+	}
+	if hashed > 0 {
+		f.setLines(lines)
+	}
+	return hashed
+}
+
+// Save replaces the file atomically, keeping its permissions. A new file
+// is created with the 0600 ones. Use Update to serialize the concurrent
+// changes
+func (f *File) Save() error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(f.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".known_hosts")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, line := range f.lines {
+		fmt.Fprintln(w, line)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Update loads the file at path, applies fn and saves the result, holding
+// an exclusive lock on path.lock, so that the concurrent updates of the
+// rospo processes are not lost. Nothing is saved if fn returns an error
+// or doesn't change the file
+func Update(path string, fn func(f *File) error) error {
+	path, err := expandUserHome(path)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := Load(path)
+	if err != nil {
+		return err
+	}
+	if err := fn(f); err != nil || !f.modified {
+		return err
+	}
+	return f.Save()
+}
+
+// Add appends key for host to the file at path, see File.Add
+func Add(path string, host string, key ssh.PublicKey, hash bool) error {
+	return Update(path, func(f *File) error {
+		f.Add(host, key, hash)
+		return nil
+	})
+}
+
+// Matches returns true if one of the entry patterns is host. host is an
+// address like host or host:port, the port 22 is the default
+func (e *Entry) Matches(host string) bool {
+	normalized := xknownhosts.Normalize(host)
+	for _, pattern := range e.Hosts {
+		if patternMatches(pattern, normalized) {
+			return true
+		}
+	}
+	return false
+}
+
+// patternMatches returns true if the known_hosts pattern is the
+// normalized host. The wildcards and the negations are not supported
+func patternMatches(pattern string, normalized string) bool {
+	if !strings.HasPrefix(pattern, "|1|") {
+		return pattern == normalized
+	}
+	parts := strings.Split(pattern[len("|1|"):], "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(normalized))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// Line formats a known_hosts line
+func Line(marker string, hosts []string, key ssh.PublicKey) string {
+	line := xknownhosts.Line(hosts, key)
+	if marker != "" {
+		line = marker + " " + line
+	}
+	return line
+}
+
+// The Verify results
+const (
+	KEY_OK      = "ok"
+	KEY_CHANGED = "changed"
+	KEY_UNKNOWN = "unknown"
+	KEY_REVOKED = "revoked"
+)
+
+// Callback returns an ssh.HostKeyCallback checking the host keys against
+// the file at path, created empty if missing. Unlike File.Lookup, it
+// supports the wildcards and the @cert-authority entries
+func Callback(path string) (ssh.HostKeyCallback, error) {
+	path, err := expandUserHome(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	return xknownhosts.New(path)
+}
+
+// Verify checks key, presented by host at the remote address, against
+// the file at path. It returns one of the KEY values, KEY_UNKNOWN if the
+// file is missing
+func Verify(path string, host string, remote net.Addr, key ssh.PublicKey) (string, error) {
+	path, err := expandUserHome(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return KEY_UNKNOWN, nil
+	}
+	callback, err := xknownhosts.New(path)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	return Result(callback(host, remote, key))
+}
+
+// Result converts the error of a Callback to one of the KEY values. The
+// errors not about the key are returned as is
+func Result(err error) (string, error) {
+	if err == nil {
+		return KEY_OK, nil
+	}
+	var keyErr *xknownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		if len(keyErr.Want) == 0 {
+			return KEY_UNKNOWN, nil
+		}
+		return KEY_CHANGED, nil
+	}
+	var revokedErr *xknownhosts.RevokedError
+	if errors.As(err, &revokedErr) {
+		return KEY_REVOKED, nil
+	}
+	return "", err
+}
+
+// expandUserHome expands the ~/ prefix of path, like utils.ExpandUserHome.
+// The utils package can't be imported, as it wraps this one
+func expandUserHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, path[2:]), nil
+}
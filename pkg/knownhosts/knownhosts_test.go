@@ -0,0 +1,134 @@
+package knownhosts
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKnownHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	key1 := newTestHostKey(t)
+	key2 := newTestHostKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2222}
+
+	if res, err := Verify(path, "server:2222", remote, key1); err != nil || res != KEY_UNKNOWN {
+		t.Fatalf("unexpected result %s %v for a missing file", res, err)
+	}
+	if err := Add(path, "server:2222", key1, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Add(path, "hashed", key2, true); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString("# a comment\nalpha,beta " + string(ssh.MarshalAuthorizedKey(key2)))
+	f.Close()
+
+	kh, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := kh.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	if entries[0].Hosts[0] != "[server]:2222" || entries[2].Line != 4 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if len(kh.Lookup("hashed:22")) != 1 {
+		t.Fatal("the hashed host should match")
+	}
+	if kh.Add("server:2222", key1, false) {
+		t.Fatal("the known key should not be added again")
+	}
+
+	if res, _ := Verify(path, "server:2222", remote, key1); res != KEY_OK {
+		t.Fatalf("unexpected result %s", res)
+	}
+	if res, _ := Verify(path, "server:2222", remote, key2); res != KEY_CHANGED {
+		t.Fatalf("unexpected result %s", res)
+	}
+	if res, err := Verify(path, "other", remote, key1); res != KEY_UNKNOWN {
+		t.Fatalf("unexpected result %s %v", res, err)
+	}
+
+	if n := kh.Remove("alpha"); n != 1 {
+		t.Fatalf("unexpected remove result %d", n)
+	}
+	if entries := kh.Lookup("beta"); len(entries) != 1 || len(entries[0].Hosts) != 1 {
+		t.Fatalf("beta should be kept: %+v", entries)
+	}
+	if n := kh.Hash(); n != 2 {
+		t.Fatalf("unexpected hash result %d", n)
+	}
+	if err := kh.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "server") || !strings.Contains(string(data), "# a comment") {
+		t.Fatalf("unexpected hashed file:\n%s", data)
+	}
+	if res, _ := Verify(path, "server:2222", remote, key1); res != KEY_OK {
+		t.Fatalf("the hashed entry should verify: %s", res)
+	}
+
+	err = Update(path, func(f *File) error {
+		if n := f.Remove("server:2222"); n != 1 {
+			return fmt.Errorf("the hashed host should be removed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kh, _ = Load(path); len(kh.Entries()) != 2 {
+		t.Fatalf("unexpected entries left %+v", kh.Entries())
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		key := newTestHostKey(t)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := Add(path, fmt.Sprintf("host%d", i), key, false); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	kh, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kh.Entries()) != 20 {
+		t.Fatalf("expected 20 entries, got %d", len(kh.Entries()))
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected permissions %o", info.Mode().Perm())
+	}
+}
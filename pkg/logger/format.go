@@ -0,0 +1,145 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log line
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named s: debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("invalid log level '%s', use debug, info, warn or error", s)
+}
+
+// the lines below the minimum level are dropped, see SetLevel
+var minLevel atomic.Int32
+
+func init() {
+	minLevel.Store(int32(LevelInfo))
+}
+
+// SetLevel drops the log lines below level
+func SetLevel(level Level) {
+	minLevel.Store(int32(level))
+}
+
+// the log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// set by SetFormat
+var jsonFormat atomic.Bool
+
+// SetFormat sets the log lines format: text, the default, or json. The
+// json lines hold the time, level, subsystem and msg keys, and the
+// logger fields
+func SetFormat(format string) error {
+	switch format {
+	case FormatText:
+		jsonFormat.Store(false)
+	case FormatJSON:
+		jsonFormat.Store(true)
+	default:
+		return fmt.Errorf("invalid log format '%s', use text or json", format)
+	}
+	setupStdLogger()
+	return nil
+}
+
+// the text tags of the levels, before the message
+var levelTags = map[Level]string{
+	LevelDebug: "DEBUG: ",
+	LevelWarn:  "WARNING: ",
+	LevelError: "ERROR: ",
+}
+
+// entry is a log line
+type entry struct {
+	time      time.Time
+	level     Level
+	subsystem string
+	prefix    string
+	msg       string
+	fields    []field
+}
+
+// format renders the line as json or as text, with the prefix colored
+// by color if set
+func (e *entry) format(asJSON bool, color string) []byte {
+	var buf bytes.Buffer
+	if !asJSON {
+		if color != "" {
+			buf.WriteString(color + e.prefix + reset)
+		} else {
+			buf.WriteString(e.prefix)
+		}
+		buf.WriteString(e.time.Format("2006/01/02 15:04:05 "))
+		buf.WriteString(levelTags[e.level])
+		buf.WriteString(e.msg)
+		buf.WriteByte('\n')
+		return buf.Bytes()
+	}
+
+	add := func(key string, value any) {
+		data, err := json.Marshal(value)
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(value))
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte(',')
+		} else {
+			buf.WriteByte('{')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(data)
+	}
+	add("time", e.time.Format(time.RFC3339Nano))
+	add("level", e.level.String())
+	add("subsystem", e.subsystem)
+	add("msg", e.msg)
+	for _, f := range e.fields {
+		if err, ok := f.value.(error); ok {
+			add(f.key, err.Error())
+			continue
+		}
+		add(f.key, f.value)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,51 @@
+package logger
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// how many log lines Recent returns at most
+const historySize = 500
+
+// set by DisableLoggers
+var disabled atomic.Bool
+
+// the writer of all the loggers
+var sink = &recorder{}
+
+// recorder keeps the last log lines, as text, and writes them to the
+// output, unless the loggers are disabled
+type recorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *recorder) write(e *entry, color string) {
+	line := strings.TrimSuffix(string(e.format(false, "")), "\n")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, line)
+	if len(r.lines) > historySize {
+		r.lines = r.lines[len(r.lines)-historySize:]
+	}
+
+	if disabled.Load() {
+		return
+	}
+	if !colored {
+		color = ""
+	}
+	output.Write(e.format(jsonFormat.Load(), color))
+}
+
+// Recent returns the last log lines of the loggers, the oldest first and
+// without colors
+func Recent() []string {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	res := make([]string, len(sink.lines))
+	copy(res, sink.lines)
+	return res
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	"golang.org/x/term"
 )
@@ -21,30 +23,206 @@ const (
 	reset   = "\033[0m"
 )
 
-var instances []*log.Logger
+// the loggers output, see SetOutput
+var output io.Writer = os.Stdout
 
-// DisableLoggers prevents any log output to be printed on console
+// the standard logger output, see SetOutput
+var stdOutput io.Writer = os.Stderr
+
+// the text prefixes are colored on terminals
+var colored = term.IsTerminal(int(os.Stdout.Fd())) && runtime.GOOS != "windows"
+
+// DisableLoggers prevents any log output to be printed on console. The
+// log lines are still kept for Recent
 func DisableLoggers() {
-	for _, v := range instances {
-		v.SetOutput(io.Discard)
-	}
+	disabled.Store(true)
 }
 
 // EnableLoggers enables any disabled logger
 func EnableLoggers() {
-	for _, v := range instances {
-		v.SetOutput(os.Stdout)
+	disabled.Store(false)
+}
+
+// SetOutput redirects the output of all the loggers, and of the
+// standard one, to w
+func SetOutput(w io.Writer) {
+	output = w
+	stdOutput = w
+	setupStdLogger()
+}
+
+// field is a key value pair of the json log lines
+type field struct {
+	key   string
+	value any
+}
+
+// Logger is a leveled logger. The Print functions log at the info level
+// and the Fatal ones at the error level, like the standard logger
+// ones. Its fields are added to the json log lines
+type Logger struct {
+	// the subsystem, like "tun" for the "[TUN]  " prefix
+	subsystem string
+	prefix    string
+	color     string
+	fields    []field
+	// if set, the lines are written there instead of the output
+	out io.Writer
+}
+
+// NewLogger builds up and return a new logger. The prefix names the
+// subsystem of the log lines
+func NewLogger(prefix string, color string) *Logger {
+	return &Logger{
+		subsystem: strings.ToLower(strings.Trim(prefix, "[] ")),
+		prefix:    prefix,
+		color:     color,
+	}
+}
+
+// New builds a logger writing to w, outside of the shared output and of
+// the recent lines
+func New(w io.Writer, prefix string) *Logger {
+	l := NewLogger(prefix, "")
+	l.out = w
+	return l
+}
+
+// With returns a copy of the logger adding the key value field to the
+// json log lines
+func (l *Logger) With(key string, value any) *Logger {
+	res := *l
+	res.fields = append(append([]field{}, l.fields...), field{key, value})
+	return &res
+}
+
+// WithPrefix returns a copy of the logger adding prefix to the text log
+// lines prefix
+func (l *Logger) WithPrefix(prefix string) *Logger {
+	res := *l
+	res.prefix += prefix
+	return &res
+}
+
+// SetOutput makes the logger write its lines to w, outside of the shared
+// output and of the recent lines
+func (l *Logger) SetOutput(w io.Writer) {
+	l.out = w
+}
+
+// StdLogger returns a standard logger writing its lines through l, at the
+// info level, for the libraries needing one
+func (l *Logger) StdLogger() *log.Logger {
+	return log.New(lineWriter{l}, "", 0)
+}
+
+// lineWriter logs the lines written to it
+type lineWriter struct {
+	l *Logger
+}
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w.l.output(LevelInfo, string(p))
+	return len(p), nil
+}
+
+// Prefix returns the text log lines prefix
+func (l *Logger) Prefix() string {
+	return l.prefix
+}
+
+// output writes the message at level, if enabled
+func (l *Logger) output(level Level, msg string) {
+	if level < Level(minLevel.Load()) {
+		return
+	}
+	e := &entry{
+		time:      time.Now(),
+		level:     level,
+		subsystem: l.subsystem,
+		prefix:    l.prefix,
+		msg:       strings.TrimSuffix(msg, "\n"),
+		fields:    l.fields,
+	}
+	if l.out != nil {
+		l.out.Write(e.format(jsonFormat.Load(), ""))
+		return
+	}
+	sink.write(e, l.color)
+}
+
+// Debugf logs at the debug level, in the manner of fmt.Printf
+func (l *Logger) Debugf(format string, v ...any) {
+	l.output(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+// Printf logs at the info level, in the manner of fmt.Printf
+func (l *Logger) Printf(format string, v ...any) {
+	l.output(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Print logs at the info level, in the manner of fmt.Print
+func (l *Logger) Print(v ...any) {
+	l.output(LevelInfo, fmt.Sprint(v...))
+}
+
+// Println logs at the info level, in the manner of fmt.Println
+func (l *Logger) Println(v ...any) {
+	l.output(LevelInfo, fmt.Sprintln(v...))
+}
+
+// Warnf logs at the warning level, in the manner of fmt.Printf
+func (l *Logger) Warnf(format string, v ...any) {
+	l.output(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs at the error level, in the manner of fmt.Printf
+func (l *Logger) Errorf(format string, v ...any) {
+	l.output(LevelError, fmt.Sprintf(format, v...))
+}
+
+// Fatalf is like Errorf followed by os.Exit(1)
+func (l *Logger) Fatalf(format string, v ...any) {
+	l.output(LevelError, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+// Fatal is like Print at the error level, followed by os.Exit(1)
+func (l *Logger) Fatal(v ...any) {
+	l.output(LevelError, fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+// Fatalln is like Println at the error level, followed by os.Exit(1)
+func (l *Logger) Fatalln(v ...any) {
+	l.output(LevelError, fmt.Sprintln(v...))
+	os.Exit(1)
+}
+
+// stdWriter formats the standard logger lines as json ones
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	e := &entry{
+		time:      time.Now(),
+		level:     LevelInfo,
+		subsystem: "main",
+		msg:       strings.TrimSuffix(string(p), "\n"),
+	}
+	if _, err := stdOutput.Write(e.format(true, "")); err != nil {
+		return 0, err
 	}
+	return len(p), nil
 }
 
-// NewLogger builds up and return a new logger
-func NewLogger(prefix string, color string) *log.Logger {
-	var logger *log.Logger
-	if term.IsTerminal(int(os.Stdout.Fd())) && runtime.GOOS != "windows" {
-		logger = log.New(os.Stdout, fmt.Sprintf("%s%s%s", color, prefix, reset), log.LstdFlags)
+// setupStdLogger makes the standard logger follow the format and the
+// output of the loggers
+func setupStdLogger() {
+	if jsonFormat.Load() {
+		log.SetFlags(0)
+		log.SetOutput(stdWriter{})
 	} else {
-		logger = log.New(os.Stdout, prefix, log.LstdFlags)
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(stdOutput)
 	}
-	instances = append(instances, logger)
-	return logger
 }
@@ -0,0 +1,87 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRecent(t *testing.T) {
+	var out bytes.Buffer
+	SetOutput(&out)
+	l := NewLogger("[TEST] ", Red)
+
+	l.Println("first")
+	DisableLoggers()
+	l.Println("second")
+	EnableLoggers()
+
+	if !strings.Contains(out.String(), "first") || strings.Contains(out.String(), "second") {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+	recent := Recent()
+	if len(recent) < 2 {
+		t.Fatalf("unexpected recent lines %q", recent)
+	}
+	last := recent[len(recent)-2:]
+	if !strings.HasPrefix(last[0], "[TEST] ") || !strings.HasSuffix(last[0], "first") ||
+		!strings.HasSuffix(last[1], "second") {
+		t.Fatalf("unexpected recent lines %q", last)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	var out bytes.Buffer
+	SetOutput(&out)
+	if err := SetFormat(FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	defer SetFormat(FormatText)
+
+	l := NewLogger("[TUN] ", Blue).With("tunnel", "web").With("conn_id", 3)
+	l.Warnf("connection from %s refused", "1.2.3.4")
+
+	var line map[string]any
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("invalid json line %q: %s", out.String(), err)
+	}
+	if line["level"] != "warn" || line["subsystem"] != "tun" || line["tunnel"] != "web" ||
+		line["conn_id"] != float64(3) || line["msg"] != "connection from 1.2.3.4 refused" {
+		t.Fatalf("unexpected json line %q", out.String())
+	}
+	// the recent lines are always text ones
+	recent := Recent()
+	if last := recent[len(recent)-1]; !strings.HasPrefix(last, "[TUN] ") ||
+		!strings.Contains(last, "WARNING: connection") {
+		t.Fatalf("unexpected recent line %q", last)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var out bytes.Buffer
+	SetOutput(&out)
+	defer SetLevel(LevelInfo)
+
+	l := NewLogger("[TEST] ", Red)
+	l.Debugf("hidden")
+	l.Printf("shown")
+	SetLevel(LevelError)
+	l.Warnf("hidden")
+	l.Errorf("shown")
+	SetLevel(LevelDebug)
+	l.Debugf("shown")
+
+	if strings.Contains(out.String(), "hidden") || strings.Count(out.String(), "shown") != 3 {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	for name, want := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "warning": LevelWarn, "error": LevelError} {
+		if got, err := ParseLevel(name); err != nil || got != want {
+			t.Fatalf("ParseLevel(%s) = %s, %v", name, got, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("expected an error for an invalid level")
+	}
+}
@@ -32,13 +32,24 @@ func (r *Registry) Add(t interface{}) int {
 	return r.latestID
 }
 
-// GetAll returns all registry contents
+// GetAll returns all registry contents. The returned map is a copy,
+// safe to range over while the registry changes
 func (r *Registry) GetAll() map[int]interface{} {
-	return r.data
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := make(map[int]interface{}, len(r.data))
+	for k, v := range r.data {
+		res[k] = v
+	}
+	return res
 }
 
 // GetByID returns an item give its registry ID
 func (r *Registry) GetByID(id int) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if val, ok := r.data[id]; ok {
 		return val, nil
 	}
@@ -47,12 +58,12 @@ func (r *Registry) GetByID(id int) (interface{}, error) {
 
 // Delete removes an item from registry
 func (r *Registry) Delete(id int) error {
-	if _, err := r.GetByID(id); err != nil {
-		return err
-	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if _, ok := r.data[id]; !ok {
+		return errors.New("item not found")
+	}
 	delete(r.data, id)
 	return nil
 }
@@ -0,0 +1,63 @@
+package rio
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultBufferSize is the default size of the copy buffers
+	DefaultBufferSize = 32 * 1024
+	// the allowed buffer sizes range
+	minBufferSize = 1024
+	maxBufferSize = 16 * 1024 * 1024
+)
+
+var bufferSize atomic.Int64
+
+// the copy buffers pools, by buffer size
+var bufferPools sync.Map
+
+func init() {
+	bufferSize.Store(DefaultBufferSize)
+}
+
+// SetBufferSize sets the size of the buffers used to copy the data of
+// the connections. It applies to the copies started after the call
+func SetBufferSize(size int) error {
+	if size < minBufferSize || size > maxBufferSize {
+		return fmt.Errorf("invalid buffer size %d, it must be between %d and %d", size, minBufferSize, maxBufferSize)
+	}
+	bufferSize.Store(int64(size))
+	return nil
+}
+
+// BufferSize returns the size of the copy buffers
+func BufferSize() int {
+	return int(bufferSize.Load())
+}
+
+func bufferPool(size int) *sync.Pool {
+	if p, ok := bufferPools.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := bufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		},
+	})
+	return p.(*sync.Pool)
+}
+
+// GetBuffer returns a buffer of size bytes from the pool. It must be
+// given back with PutBuffer once done
+func GetBuffer(size int) *[]byte {
+	return bufferPool(size).Get().(*[]byte)
+}
+
+// PutBuffer gives back a buffer obtained with GetBuffer
+func PutBuffer(buf *[]byte) {
+	bufferPool(len(*buf)).Put(buf)
+}
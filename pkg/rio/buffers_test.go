@@ -0,0 +1,32 @@
+package rio
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	defer SetBufferSize(DefaultBufferSize)
+
+	if err := SetBufferSize(10); err == nil {
+		t.Fatal("too small buffer sizes should be refused")
+	}
+	if err := SetBufferSize(4096); err != nil {
+		t.Fatal(err)
+	}
+	buf := GetBuffer(BufferSize())
+	if len(*buf) != 4096 {
+		t.Fatalf("expected a 4096 bytes buffer, got %d", len(*buf))
+	}
+	PutBuffer(buf)
+
+	// the data is copied whatever the buffer size
+	data := bytes.Repeat([]byte("rospo"), 10000)
+	var dst bytes.Buffer
+	if err := CopyBuffer(&dst, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Bytes(), data) {
+		t.Fatal("copied data mismatch")
+	}
+}
@@ -0,0 +1,50 @@
+package rio
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MaxDatagramSize is the biggest datagram that can be carried by
+// WriteDatagram and ReadDatagram
+const MaxDatagramSize = 65535
+
+// ErrDatagramTooBig is returned if the datagram doesn't fit in the buffer
+// or exceeds MaxDatagramSize
+var ErrDatagramTooBig = errors.New("datagram too big")
+
+// WriteDatagram writes p to w as a single length prefixed frame. Stream
+// oriented writers (like ssh channels) can carry datagrams this way
+// preserving their boundaries
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return ErrDatagramTooBig
+	}
+	// write header and payload in one call, so concurrent writers
+	// can't interleave them
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads a single frame written by WriteDatagram into buf
+// and returns the datagram size
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(buf) {
+		// discard the datagram to keep the stream in sync
+		io.CopyN(io.Discard, r, int64(size))
+		return 0, ErrDatagramTooBig
+	}
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
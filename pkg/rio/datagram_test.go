@@ -0,0 +1,41 @@
+package rio
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDatagram(t *testing.T) {
+	var stream bytes.Buffer
+	datagrams := []string{"first", "", "third datagram"}
+	for _, d := range datagrams {
+		if err := WriteDatagram(&stream, []byte(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 64)
+	for _, d := range datagrams {
+		n, err := ReadDatagram(&stream, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != d {
+			t.Fatalf("expected '%s', got '%s'", d, buf[:n])
+		}
+	}
+
+	WriteDatagram(&stream, []byte("too big"))
+	WriteDatagram(&stream, []byte("ok"))
+	if _, err := ReadDatagram(&stream, make([]byte, 2)); err != ErrDatagramTooBig {
+		t.Fatalf("expected ErrDatagramTooBig, got %v", err)
+	}
+	n, err := ReadDatagram(&stream, buf)
+	if err != nil || string(buf[:n]) != "ok" {
+		t.Fatal("stream should be in sync after a too big datagram")
+	}
+
+	if err := WriteDatagram(&stream, make([]byte, MaxDatagramSize+1)); err != ErrDatagramTooBig {
+		t.Fatalf("expected ErrDatagramTooBig, got %v", err)
+	}
+}
@@ -10,15 +10,19 @@ import (
 // throughput metrics
 func CopyBuffer(dst io.Writer, src io.Reader, wch chan int64) (err error) {
 	var buf []byte
-	size := 32 * 1024
-	if l, ok := src.(*io.LimitedReader); ok && int64(size) > l.N {
-		if l.N < 1 {
-			size = 1
-		} else {
+	if l, ok := src.(*io.LimitedReader); ok && int64(BufferSize()) > l.N {
+		size := 1
+		if l.N >= 1 {
 			size = int(l.N)
 		}
+		buf = make([]byte, size)
+	} else {
+		// the buffers are pooled, to spare the allocations and the gc
+		// work when many connections are copied
+		pooled := GetBuffer(BufferSize())
+		defer PutBuffer(pooled)
+		buf = *pooled
 	}
-	buf = make([]byte, size)
 	for {
 		nr, er := src.Read(buf)
 		if nr > 0 {
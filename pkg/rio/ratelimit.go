@@ -0,0 +1,48 @@
+package rio
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the throughput of one or more streams to a
+// number of bytes per second. It is a token bucket holding at most one
+// second of traffic, so short bursts are allowed
+type RateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// NewRateLimiter builds a RateLimiter allowing bytesPerSecond
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// WaitN blocks until n bytes can be transferred without exceeding the rate
+func (l *RateLimiter) WaitN(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	// the tokens can go negative: the debt is paid by the next callers
+	// too, so concurrent streams share the rate fairly
+	l.tokens -= float64(n)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,19 @@
+package rio
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(1000)
+	start := time.Now()
+	// the first second of traffic is allowed as burst
+	for i := 0; i < 30; i++ {
+		l.WaitN(100)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 1900*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("3000 bytes at 1000 B/s took %s", elapsed)
+	}
+}
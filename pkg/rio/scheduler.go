@@ -0,0 +1,164 @@
+package rio
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// The priority classes of the WriteScheduler, and their weights
+const (
+	PRIORITY_HIGH   = "high"
+	PRIORITY_NORMAL = "normal"
+	PRIORITY_LOW    = "low"
+)
+
+var priorityWeights = map[string]float64{
+	PRIORITY_HIGH:   8,
+	PRIORITY_NORMAL: 4,
+	PRIORITY_LOW:    1,
+}
+
+const (
+	// a class is active while it has waiting writers or it wrote in
+	// the last activeWindow. The idle classes don't slow down the others
+	activeWindow = 100 * time.Millisecond
+	// how far, in weighted bytes, a class can get ahead of the others
+	schedulerQuantum = 64 * 1024
+	// the max bytes a single write is admitted with
+	maxScheduledWrite = 16 * 1024
+)
+
+// IsValidPriority returns true if name is a priority class. The empty
+// name is the normal class
+func IsValidPriority(name string) bool {
+	_, ok := priorityWeights[name]
+	return name == "" || ok
+}
+
+type schedClass struct {
+	weight float64
+	// the weighted bytes written, the class virtual time
+	vtime      float64
+	waiting    int
+	lastActive time.Time
+}
+
+func (c *schedClass) active(now time.Time) bool {
+	return c.waiting > 0 || now.Sub(c.lastActive) < activeWindow
+}
+
+// WriteScheduler shares the bandwidth of a connection between the
+// streams multiplexed over it, by weighted fair queuing: when streams of
+// different priority classes are writing, each class gets a share of
+// the writes proportional to its weight. A class alone writes freely
+type WriteScheduler struct {
+	mu      sync.Mutex
+	classes map[string]*schedClass
+	// closed and replaced when a write is admitted or completed
+	changed chan struct{}
+}
+
+// NewWriteScheduler builds a WriteScheduler
+func NewWriteScheduler() *WriteScheduler {
+	s := &WriteScheduler{
+		classes: make(map[string]*schedClass),
+		changed: make(chan struct{}),
+	}
+	for name, w := range priorityWeights {
+		s.classes[name] = &schedClass{weight: w}
+	}
+	return s
+}
+
+func (s *WriteScheduler) class(name string) *schedClass {
+	if c, ok := s.classes[name]; ok {
+		return c
+	}
+	return s.classes[PRIORITY_NORMAL]
+}
+
+// minOtherVtime returns the lowest virtual time of the active classes
+// other than c, and false if there are none
+func (s *WriteScheduler) minOtherVtime(c *schedClass, now time.Time) (float64, bool) {
+	min, found := 0.0, false
+	for _, other := range s.classes {
+		if other == c || !other.active(now) {
+			continue
+		}
+		if !found || other.vtime < min {
+			min, found = other.vtime, true
+		}
+	}
+	return min, found
+}
+
+func (s *WriteScheduler) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// WaitN blocks until the priority class can write n bytes
+func (s *WriteScheduler) WaitN(priority string, n int) {
+	s.mu.Lock()
+	c := s.class(priority)
+	now := time.Now()
+	if !c.active(now) {
+		// an idle class doesn't accumulate credit, nor the debt of the
+		// writes it made alone
+		if min, ok := s.minOtherVtime(c, now); ok {
+			c.vtime = min
+		}
+	}
+	c.waiting++
+	for {
+		now = time.Now()
+		min, ok := s.minOtherVtime(c, now)
+		if !ok || c.vtime <= min+schedulerQuantum {
+			break
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(activeWindow):
+		}
+		s.mu.Lock()
+	}
+	c.waiting--
+	c.vtime += float64(n) / c.weight
+	c.lastActive = now
+	s.notify()
+	s.mu.Unlock()
+}
+
+// scheduledWriter writes through a WriteScheduler
+type scheduledWriter struct {
+	io.Writer
+	scheduler *WriteScheduler
+	priority  string
+}
+
+// NewScheduledWriter returns a writer admitting the writes to w through
+// the scheduler, with the priority class. The large writes are split,
+// so that they don't delay the other classes
+func NewScheduledWriter(w io.Writer, s *WriteScheduler, priority string) io.Writer {
+	return &scheduledWriter{Writer: w, scheduler: s, priority: priority}
+}
+
+func (w *scheduledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > maxScheduledWrite {
+			chunk = chunk[:maxScheduledWrite]
+		}
+		w.scheduler.WaitN(w.priority, len(chunk))
+		n, err := w.Writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,59 @@
+package rio
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteScheduler(t *testing.T) {
+	s := NewWriteScheduler()
+
+	// a class alone is not delayed
+	start := time.Now()
+	w := NewScheduledWriter(io.Discard, s, PRIORITY_LOW)
+	buf := make([]byte, 64*1024)
+	for i := 0; i < 160; i++ {
+		w.Write(buf)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("10MB by a single class took %s", elapsed)
+	}
+	time.Sleep(2 * activeWindow)
+
+	// busy classes share the writes by weight
+	var high, low atomic.Int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	writer := func(priority string, counter *atomic.Int64) {
+		defer wg.Done()
+		w := NewScheduledWriter(io.Discard, s, priority)
+		buf := make([]byte, 1024)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			n, _ := w.Write(buf)
+			counter.Add(int64(n))
+		}
+	}
+	wg.Add(2)
+	go writer(PRIORITY_HIGH, &high)
+	go writer(PRIORITY_LOW, &low)
+	time.Sleep(time.Second)
+	close(stop)
+	wg.Wait()
+
+	ratio := float64(high.Load()) / float64(low.Load())
+	if ratio < 4 || ratio > 16 {
+		t.Fatalf("expected a high/low ratio near 8, got %.2f (%d/%d)", ratio, high.Load(), low.Load())
+	}
+
+	if !IsValidPriority("") || IsValidPriority("urgent") {
+		t.Fatal("unexpected priority validation")
+	}
+}
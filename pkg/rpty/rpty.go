@@ -10,6 +10,10 @@ type Pty interface {
 	Resize(cols uint16, rows uint16) error
 	Close() error
 	Run(c *exec.Cmd) error
+	// waits for the started command to exit and returns its exit code
+	Wait() int
+	// the tty device path. Empty if the platform has none
+	Name() string
 
 	// reads from pty and writes to io.Writeer
 	WriteTo(io.Writer) (int64, error)
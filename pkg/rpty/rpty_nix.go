@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
 
 	"github.com/creack/pty"
@@ -27,6 +28,9 @@ func newPty() (Pty, error) {
 type nixPty struct {
 	pty, tty *os.File
 	cmd      *exec.Cmd
+
+	waitOnce sync.Once
+	exitCode int
 }
 
 func (p *nixPty) Resize(cols uint16, rows uint16) error {
@@ -40,10 +44,26 @@ func (p *nixPty) Close() error {
 	p.pty.Close()
 	p.tty.Close()
 	p.cmd.Process.Kill()
-	p.cmd.Process.Wait()
+	p.Wait()
 	return nil
 }
 
+func (p *nixPty) Wait() int {
+	p.waitOnce.Do(func() {
+		p.exitCode = 255
+		p.cmd.Wait()
+		// a negative exit code means terminated by a signal
+		if p.cmd.ProcessState != nil && p.cmd.ProcessState.ExitCode() >= 0 {
+			p.exitCode = p.cmd.ProcessState.ExitCode()
+		}
+	})
+	return p.exitCode
+}
+
+func (p *nixPty) Name() string {
+	return p.tty.Name()
+}
+
 func (p *nixPty) Run(c *exec.Cmd) error {
 	defer p.tty.Close()
 
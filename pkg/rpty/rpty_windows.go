@@ -5,6 +5,8 @@ import (
 	"log"
 	"os/exec"
 	"sync"
+
+	"golang.org/x/sys/windows"
 )
 
 func newPty() (Pty, error) {
@@ -48,6 +50,19 @@ func (c *rconPty) Close() error {
 	return nil
 }
 
+func (c *rconPty) Wait() int {
+	c.ready.Wait()
+	c.cpty.Wait()
+	var exitCode uint32 = 255
+	windows.GetExitCodeProcess(c.cpty.pi.Process, &exitCode)
+	return int(exitCode)
+}
+
+func (c *rconPty) Name() string {
+	// conpty has no tty device
+	return ""
+}
+
 func (c *rconPty) Run(cm *exec.Cmd) error {
 	// The Pty on windows is handled from
 	// the conpty library. The subprocess is not
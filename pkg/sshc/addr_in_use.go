@@ -0,0 +1,56 @@
+package sshc
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AddrInUseRequestType is the rospo specific global request asking the
+// server if a remote forward address is busy. The ssh servers don't tell
+// why a tcpip-forward request is denied: the rospo sshd answers this one
+const AddrInUseRequestType = "addr-in-use@rospo"
+
+// how long to wait for the addr-in-use answer
+const addrInUseTimeout = 5 * time.Second
+
+// RemoteAddrInUse returns true if the server reports the remote forward
+// address addr (host:port) as already in use. False if it is not, or if
+// the server can't tell, like the non rospo ones
+func (s *SshConnection) RemoteAddrInUse(addr string) bool {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	var payload = struct {
+		Addr string
+		Port uint32
+	}{host, uint32(port)}
+
+	type reply struct {
+		ok   bool
+		data []byte
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		ok, data, err := s.Client.SendRequest(AddrInUseRequestType, true, ssh.Marshal(&payload))
+		replies <- reply{ok: ok && err == nil, data: data}
+	}()
+	select {
+	case r := <-replies:
+		var res struct{ InUse bool }
+		if !r.ok || ssh.Unmarshal(r.data, &res) != nil {
+			return false
+		}
+		return res.InUse
+	case <-time.After(addrInUseTimeout):
+		// the servers ignoring the unknown requests don't reply
+		return false
+	}
+}
@@ -0,0 +1,355 @@
+package sshc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTimeout = 5 * time.Second
+	// the max size of a dns message over tcp
+	dnsMaxMessageSize = 65535
+	// the max size of a dns message over udp, if the query doesn't
+	// advertise a bigger one with edns
+	dnsMaxUdpSize = 512
+	dnsTypeOPT    = 41
+
+	dnsRcodeServFail = 2
+	dnsRcodeRefused  = 5
+)
+
+var errDnsMessage = errors.New("malformed dns message")
+
+// DnsRouteConf sends the queries for some domains to a dns server
+type DnsRouteConf struct {
+	// the domains routed to the server, subdomains included. Empty
+	// means any name: the route is used when no other one matches
+	Domains []string `yaml:"domains"`
+	// the dns server, host:port. The port defaults to 53
+	Server string `yaml:"server"`
+	// if true the server is queried from the local machine. Otherwise
+	// it is queried through the ssh connection, over tcp
+	Direct bool `yaml:"direct"`
+}
+
+// DnsProxyConf holds the dns forwarder configuration
+type DnsProxyConf struct {
+	// the udp and tcp listener address, like 127.0.0.1:53
+	ListenAddress string `yaml:"listen_address"`
+	// the routing rules. A query is sent to the route with the
+	// longest matching domain. The names not matched by any route
+	// are refused
+	Routes []*DnsRouteConf `yaml:"routes"`
+	// use a dedicated ssh client. if nil use the global one
+	SshClientConf *SshClientConf `yaml:"sshclient"`
+	// use one of the named ssh clients of the config file
+	SshClientName string `yaml:"sshclient_name"`
+}
+
+// DnsProxy is a local dns forwarder. It resolves the names through
+// the dns servers of the remote network, reached through the ssh
+// connection, following per-domain routes
+type DnsProxy struct {
+	sshConn *SshConnection
+	routes  []*DnsRouteConf
+}
+
+// NewDnsProxy builds a dns forwarder with the given routes
+func NewDnsProxy(sshConn *SshConnection, routes []*DnsRouteConf) (*DnsProxy, error) {
+	if len(routes) == 0 {
+		return nil, errors.New("the dns proxy needs at least a route")
+	}
+	res := []*DnsRouteConf{}
+	for _, r := range routes {
+		if r.Server == "" {
+			return nil, errors.New("dns route server is not set")
+		}
+		route := *r
+		if _, _, err := net.SplitHostPort(route.Server); err != nil {
+			route.Server = net.JoinHostPort(route.Server, "53")
+		}
+		route.Domains = []string{}
+		for _, d := range r.Domains {
+			route.Domains = append(route.Domains, normalizeDomain(d))
+		}
+		res = append(res, &route)
+	}
+	return &DnsProxy{sshConn: sshConn, routes: res}, nil
+}
+
+func normalizeDomain(name string) string {
+	return strings.Trim(strings.ToLower(name), ".")
+}
+
+// route returns the route of name, or nil if none matches
+func (p *DnsProxy) route(name string) *DnsRouteConf {
+	name = normalizeDomain(name)
+	var fallback, res *DnsRouteConf
+	best := -1
+	for _, r := range p.routes {
+		if len(r.Domains) == 0 {
+			if fallback == nil {
+				fallback = r
+			}
+			continue
+		}
+		for _, d := range r.Domains {
+			matches := d == "" || name == d || strings.HasSuffix(name, "."+d)
+			if matches && len(d) > best {
+				res = r
+				best = len(d)
+			}
+		}
+	}
+	if res == nil {
+		return fallback
+	}
+	return res
+}
+
+// Start serves the dns queries on the udp and tcp listeners
+func (p *DnsProxy) Start(listenAddress string) error {
+	pconn, err := net.ListenPacket("udp", listenAddress)
+	if err != nil {
+		return err
+	}
+	defer pconn.Close()
+	listener, err := net.Listen("tcp", pconn.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	p.sshConn.ReadyWait()
+	log.Printf("local dns proxy listening at '%s'", pconn.LocalAddr())
+	for _, r := range p.routes {
+		log.Printf("dns route %s", r)
+	}
+	go p.serveTCP(listener)
+	return p.serveUDP(pconn)
+}
+
+func (p *DnsProxy) serveUDP(pconn net.PacketConn) error {
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, addr, err := pconn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			res := p.resolve(query)
+			if len(res) > dnsUdpSize(query) {
+				// the client retries over tcp
+				res = dnsTruncate(res)
+			}
+			if res != nil {
+				pconn.WriteTo(res, addr)
+			}
+		}()
+	}
+}
+
+func (p *DnsProxy) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetReadDeadline(time.Now().Add(dnsTimeout))
+				query, err := readDnsMessage(conn)
+				if err != nil {
+					return
+				}
+				res := p.resolve(query)
+				if res == nil || writeDnsMessage(conn, res) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// resolve answers query. It returns nil if the query is malformed
+func (p *DnsProxy) resolve(query []byte) []byte {
+	name, err := dnsQuestionName(query)
+	if err != nil {
+		return nil
+	}
+	route := p.route(name)
+	if route == nil {
+		return dnsErrorResponse(query, dnsRcodeRefused)
+	}
+	res, err := p.exchange(route, query)
+	if err != nil {
+		log.Errorf("dns query for %s to %s failed: %s", name, route.Server, err)
+		return dnsErrorResponse(query, dnsRcodeServFail)
+	}
+	return res
+}
+
+// exchange sends query to the route server, over tcp
+func (p *DnsProxy) exchange(route *DnsRouteConf, query []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if route.Direct {
+		conn, err = net.DialTimeout("tcp", route.Server, dnsTimeout)
+	} else {
+		conn, err = p.sshConn.Client.Dial("tcp", route.Server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// the ssh channels don't support deadlines
+	timer := time.AfterFunc(dnsTimeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	if err := writeDnsMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readDnsMessage(conn)
+}
+
+// readDnsMessage reads a length prefixed dns message, as sent over tcp
+func readDnsMessage(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeDnsMessage writes a length prefixed dns message, as sent over tcp
+func writeDnsMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// dnsQuestionEnd returns the name of the first question of msg, and the
+// offset the question ends at
+func dnsQuestionEnd(msg []byte) (string, int, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return "", 0, errDnsMessage
+	}
+	labels := []string{}
+	off := 12
+	for {
+		if off >= len(msg) {
+			return "", 0, errDnsMessage
+		}
+		size := int(msg[off])
+		off++
+		if size == 0 {
+			break
+		}
+		// compression pointers are not expected in questions
+		if size > 63 || off+size > len(msg) {
+			return "", 0, errDnsMessage
+		}
+		labels = append(labels, string(msg[off:off+size]))
+		off += size
+	}
+	// qtype and qclass
+	off += 4
+	if off > len(msg) {
+		return "", 0, errDnsMessage
+	}
+	return strings.Join(labels, "."), off, nil
+}
+
+// dnsQuestionName returns the name of the first question of msg
+func dnsQuestionName(msg []byte) (string, error) {
+	name, _, err := dnsQuestionEnd(msg)
+	return name, err
+}
+
+// dnsErrorResponse builds a response to query with the rcode error
+func dnsErrorResponse(query []byte, rcode byte) []byte {
+	_, end, err := dnsQuestionEnd(query)
+	if err != nil {
+		return nil
+	}
+	res := make([]byte, end)
+	copy(res, query[:end])
+	// QR and the query opcode and RD flags
+	res[2] = 0x80 | (query[2] & 0x79)
+	// RA and the rcode
+	res[3] = 0x80 | rcode
+	// one question, no records
+	binary.BigEndian.PutUint16(res[4:6], 1)
+	for i := 6; i < 12; i++ {
+		res[i] = 0
+	}
+	return res
+}
+
+// dnsUdpSize returns the max size of the udp response to query: the
+// size advertised by its edns OPT record, or the dns default
+func dnsUdpSize(query []byte) int {
+	_, off, err := dnsQuestionEnd(query)
+	if err != nil {
+		return dnsMaxUdpSize
+	}
+	// the OPT record is expected as the only additional one
+	if binary.BigEndian.Uint16(query[6:8]) != 0 || binary.BigEndian.Uint16(query[8:10]) != 0 ||
+		binary.BigEndian.Uint16(query[10:12]) == 0 {
+		return dnsMaxUdpSize
+	}
+	// root name, type and class
+	if off+5 > len(query) || query[off] != 0 || binary.BigEndian.Uint16(query[off+1:off+3]) != dnsTypeOPT {
+		return dnsMaxUdpSize
+	}
+	size := int(binary.BigEndian.Uint16(query[off+3 : off+5]))
+	if size < dnsMaxUdpSize {
+		return dnsMaxUdpSize
+	}
+	return size
+}
+
+// dnsTruncate returns the header and question of res with the TC flag
+// set, for the responses exceeding the udp size. nil if res is malformed
+func dnsTruncate(res []byte) []byte {
+	_, end, err := dnsQuestionEnd(res)
+	if err != nil {
+		return nil
+	}
+	truncated := make([]byte, end)
+	copy(truncated, res[:end])
+	truncated[2] |= 0x02
+	// one question, no records
+	binary.BigEndian.PutUint16(truncated[4:6], 1)
+	for i := 6; i < 12; i++ {
+		truncated[i] = 0
+	}
+	return truncated
+}
+
+// String returns a description of the route, for the logs
+func (r *DnsRouteConf) String() string {
+	via := "ssh"
+	if r.Direct {
+		via = "direct"
+	}
+	domains := "*"
+	if len(r.Domains) > 0 {
+		domains = strings.Join(r.Domains, ",")
+	}
+	return fmt.Sprintf("%s -> %s (%s)", domains, r.Server, via)
+}
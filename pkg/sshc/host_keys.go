@@ -0,0 +1,77 @@
+package sshc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ferama/rospo/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// the host key algorithms asked by ScanHostKeys, one per key type
+var scanKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512,
+}
+
+// HostKeyPinned tells if the SHA256 fingerprint of key is one of
+// fingerprints. Their SHA256: prefix is optional
+func HostKeyPinned(key ssh.PublicKey, fingerprints []string) bool {
+	fingerprint := strings.TrimPrefix(ssh.FingerprintSHA256(key), "SHA256:")
+	for _, f := range fingerprints {
+		if strings.TrimPrefix(strings.TrimSpace(f), "SHA256:") == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// errKeyScanned aborts the handshake once the host key is received
+var errKeyScanned = errors.New("host key scanned")
+
+// ScanHostKeys gets the host keys of the ssh server at serverURI, like
+// ssh-keyscan: a handshake is started for each key type, and aborted
+// once the server presented its key. It returns the server address and
+// its keys
+func ScanHostKeys(serverURI string, timeout time.Duration) (string, net.Addr, []ssh.PublicKey, error) {
+	parsed := utils.ParseSSHUrl(serverURI)
+	address := net.JoinHostPort(parsed.Host, strconv.Itoa(parsed.Port))
+
+	var remote net.Addr
+	keys := []ssh.PublicKey{}
+	var lastErr error
+	for _, algo := range scanKeyAlgorithms {
+		var key ssh.PublicKey
+		config := &ssh.ClientConfig{
+			HostKeyAlgorithms: []string{algo},
+			Timeout:           timeout,
+			HostKeyCallback: func(hostname string, addr net.Addr, k ssh.PublicKey) error {
+				remote = addr
+				key = k
+				return errKeyScanned
+			},
+		}
+		_, err := ssh.Dial("tcp", address, config)
+		if key != nil {
+			keys = append(keys, key)
+			continue
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) {
+			// the server is unreachable, no need to try the other types
+			return address, nil, nil, err
+		}
+		lastErr = err
+	}
+	if len(keys) == 0 {
+		return address, nil, nil, fmt.Errorf("no host key received: %v", lastErr)
+	}
+	return address, remote, keys, nil
+}
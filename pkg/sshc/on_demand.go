@@ -0,0 +1,78 @@
+package sshc
+
+import "time"
+
+// SetOnDemand makes the connection lazy: it is established only when a
+// user acquires it, and closed once it has been unused for idleTimeout.
+// It must be called before Start
+func (s *SshConnection) SetOnDemand(idleTimeout time.Duration) {
+	s.onDemand = true
+	s.idleTimeout = idleTimeout
+	s.demand = make(chan struct{}, 1)
+}
+
+// IsOnDemand returns true if the connection is established on demand
+func (s *SshConnection) IsOnDemand() bool {
+	return s.onDemand
+}
+
+// Acquire marks the connection as in use, so that an on demand
+// connection is established and kept open. Each call must be paired
+// with a Release one
+func (s *SshConnection) Acquire() {
+	if !s.onDemand {
+		return
+	}
+	s.usersMU.Lock()
+	s.users++
+	s.lastUsed = time.Now()
+	s.usersMU.Unlock()
+	s.wakeUp()
+}
+
+// Release ends a use of the connection started with Acquire
+func (s *SshConnection) Release() {
+	if !s.onDemand {
+		return
+	}
+	s.usersMU.Lock()
+	s.users--
+	s.lastUsed = time.Now()
+	s.usersMU.Unlock()
+}
+
+// wakeUp signals the connection loop waiting for a demand
+func (s *SshConnection) wakeUp() {
+	select {
+	case s.demand <- struct{}{}:
+	default:
+	}
+}
+
+// waitDemand blocks until the connection is acquired. It returns false
+// if the connection is stopped in the meantime
+func (s *SshConnection) waitDemand() bool {
+	for {
+		if s.isStopped.Load() {
+			return false
+		}
+		s.usersMU.Lock()
+		users := s.users
+		s.usersMU.Unlock()
+		if users > 0 {
+			return true
+		}
+		<-s.demand
+	}
+}
+
+// idleExpired returns true if an on demand connection has been unused
+// for the idle timeout
+func (s *SshConnection) idleExpired() bool {
+	if !s.onDemand {
+		return false
+	}
+	s.usersMU.Lock()
+	defer s.usersMU.Unlock()
+	return s.users == 0 && time.Since(s.lastUsed) >= s.idleTimeout
+}
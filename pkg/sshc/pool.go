@@ -0,0 +1,113 @@
+package sshc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConnectionPool shares a single SshConnection between all the users
+// (tunnels, socks proxies...) of an identical client configuration, so
+// that they are multiplexed over one ssh handshake
+type ConnectionPool struct {
+	mu    sync.Mutex
+	conns map[string]*SshConnection
+}
+
+// ConnectionStatus describes a connection of the pool
+type ConnectionStatus struct {
+	// user@host:port
+	Server   string `json:"server"`
+	Status   string `json:"status"`
+	OnDemand bool   `json:"on_demand"`
+	// how long the connection has been up. Zero if it is down
+	Uptime time.Duration `json:"uptime"`
+}
+
+// NewConnectionPool creates an empty pool
+func NewConnectionPool() *ConnectionPool {
+	return &ConnectionPool{
+		conns: make(map[string]*SshConnection),
+	}
+}
+
+// Get returns the connection for conf. A new connection is created and
+// started only if no other configuration with the same values was seen
+func (p *ConnectionPool) Get(conf *SshClientConf) *SshConnection {
+	return p.get(conf, 0)
+}
+
+// GetOnDemand is like Get, but the connection is established on demand
+// and closed after idleTimeout without users. See SetOnDemand. The on
+// demand connections are not shared with the permanent ones
+func (p *ConnectionPool) GetOnDemand(conf *SshClientConf, idleTimeout time.Duration) *SshConnection {
+	return p.get(conf, idleTimeout)
+}
+
+func (p *ConnectionPool) get(conf *SshClientConf, idleTimeout time.Duration) *SshConnection {
+	// the configurations are compared by value
+	data, _ := yaml.Marshal(conf)
+	key := string(data)
+	if idleTimeout > 0 {
+		key = fmt.Sprintf("on demand %s\n%s", idleTimeout, key)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn, ok := p.conns[key]; ok {
+		return conn
+	}
+	conn := NewSshConnection(conf)
+	if idleTimeout > 0 {
+		conn.SetOnDemand(idleTimeout)
+	}
+	go conn.Start()
+	p.conns[key] = conn
+	return conn
+}
+
+// Stop stops all the pool connections
+func (p *ConnectionPool) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Stop()
+	}
+}
+
+// Retain stops and forgets the pool connections not in used. It is
+// called on configuration reloads, to release the connections of the
+// removed sections. It returns the number of stopped connections
+func (p *ConnectionPool) Retain(used map[*SshConnection]bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stopped := 0
+	for key, conn := range p.conns {
+		if !used[conn] {
+			conn.Stop()
+			delete(p.conns, key)
+			stopped++
+		}
+	}
+	return stopped
+}
+
+// Status returns the state of the pool connections, sorted by server
+func (p *ConnectionPool) Status() []ConnectionStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := []ConnectionStatus{}
+	for _, conn := range p.conns {
+		res = append(res, ConnectionStatus{
+			Server:   fmt.Sprintf("%s@%s", conn.username, conn.serverEndpoint),
+			Status:   conn.GetConnectionStatus(),
+			OnDemand: conn.IsOnDemand(),
+			Uptime:   conn.Uptime(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Server < res[j].Server })
+	return res
+}
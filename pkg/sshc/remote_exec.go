@@ -0,0 +1,40 @@
+package sshc
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Exec runs cmd on the remote server, without a pty, and waits for it to
+// complete. The remote stdout and stderr are streamed to the given writers
+// and stdin, if not nil, is forwarded to the remote command. The returned
+// error is an *ssh.ExitError if the remote command failed, see ExitCode
+func Exec(sshConn *SshConnection, cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
+	sshConn.ReadyWait()
+
+	session, err := sshConn.Client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %s", err)
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	return session.Run(cmd)
+}
+
+// CommandLine builds the remote command line from args. A single arg is
+// used as is, so it can hold a whole shell command line, while several
+// args are single quoted so they reach the remote command unchanged
+func CommandLine(args []string) string {
+	if len(args) == 1 {
+		return args[0]
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
@@ -1,14 +1,19 @@
 package sshc
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"sync"
-	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
 
+// ExitCodeUnknown is the exit code used when the remote command status
+// is unknown, like ssh does
+const ExitCodeUnknown = 255
+
 // RemoteShell handles remote shell connections. It uses an ssh connection object
 // and requests a shell inside a pty to the remote server
 type RemoteShell struct {
@@ -28,14 +33,17 @@ func NewRemoteShell(sshConn *SshConnection) *RemoteShell {
 	return rs
 }
 
-// Start starts the remote shell
+// Start starts the remote shell, or runs cmd if not empty, and waits for
+// it to complete. A pty is requested if requestPty is set and the
+// standard input is a terminal, which is put in raw mode meanwhile. The
+// returned error is an *ssh.ExitError if the remote command failed, see
+// ExitCode
 func (rs *RemoteShell) Start(cmd string, requestPty bool) error {
 	rs.sshConn.ReadyWait()
 
 	session, err := rs.sshConn.Client.NewSession()
 	if err != nil {
-		log.Fatalf("Failed to create session: " + err.Error())
-		return err
+		return fmt.Errorf("failed to create session: %s", err)
 	}
 
 	rs.sessMU.Lock()
@@ -49,25 +57,6 @@ func (rs *RemoteShell) Start(cmd string, requestPty bool) error {
 
 	fd := int(os.Stdin.Fd())
 	if term.IsTerminal(fd) && requestPty {
-		state, err := term.MakeRaw(fd)
-		if err != nil {
-			log.Printf("terminal make raw: %s", err)
-		}
-		defer term.Restore(fd, state)
-
-		// terminal size poller
-		go func() {
-			for {
-				select {
-				case <-time.After(100 * time.Millisecond):
-					w, h, _ := term.GetSize(fd)
-					session.WindowChange(h, w)
-				case <-rs.stopCh:
-					return
-				}
-			}
-		}()
-
 		w, h, err := term.GetSize(fd)
 		if err != nil {
 			log.Printf("terminal get size: %s", err)
@@ -86,26 +75,48 @@ func (rs *RemoteShell) Start(cmd string, requestPty bool) error {
 		}
 		// Request pseudo terminal
 		if err := session.RequestPty(terminal, h, w, modes); err != nil {
-			log.Fatalf("request for pseudo terminal failed: %s", err)
-			return err
+			return fmt.Errorf("request for pseudo terminal failed: %s", err)
+		}
+
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			log.Printf("terminal make raw: %s", err)
+		} else {
+			defer term.Restore(fd, state)
 		}
+
+		go watchWindowSize(fd, w, h, session, rs.stopCh)
+		defer rs.Stop()
 	}
 	if cmd == "" {
 		// Start remote shell
 		if err := session.Shell(); err != nil {
-			log.Fatalf("failed to start shell: %s", err)
-			return err
+			return fmt.Errorf("failed to start shell: %s", err)
 		}
-		session.Wait()
-
-	} else {
-		// run the cmd
-		return session.Run(cmd)
+		return session.Wait()
 	}
-	return nil
+	// run the cmd
+	return session.Run(cmd)
 }
 
-// Stop stops the remote shell
+// Stop stops the remote shell window size updates
 func (rs *RemoteShell) Stop() {
-	rs.stopCh <- true
+	select {
+	case rs.stopCh <- true:
+	default:
+	}
+}
+
+// ExitCode returns the process exit code matching the Start result: the
+// remote exit status, 128 plus the signal number if the remote command
+// was killed, or ExitCodeUnknown if the session failed
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+	return ExitCodeUnknown
 }
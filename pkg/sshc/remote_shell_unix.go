@@ -0,0 +1,33 @@
+//go:build !windows
+
+package sshc
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// watchWindowSize sends the terminal size to the session when it
+// changes, on SIGWINCH. w and h are the initial size
+func watchWindowSize(fd int, w, h int, session *ssh.Session, stop <-chan bool) {
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	for {
+		select {
+		case <-winch:
+			nw, nh, err := term.GetSize(fd)
+			if err != nil || (nw == w && nh == h) {
+				continue
+			}
+			w, h = nw, nh
+			session.WindowChange(h, w)
+		case <-stop:
+			return
+		}
+	}
+}
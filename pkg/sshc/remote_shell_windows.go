@@ -0,0 +1,31 @@
+package sshc
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// how often the console size is checked, windows has no SIGWINCH
+const windowSizePollInterval = 250 * time.Millisecond
+
+// watchWindowSize sends the terminal size to the session when it
+// changes. w and h are the initial size
+func watchWindowSize(fd int, w, h int, session *ssh.Session, stop <-chan bool) {
+	ticker := time.NewTicker(windowSizePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			nw, nh, err := term.GetSize(fd)
+			if err != nil || (nw == w && nh == h) {
+				continue
+			}
+			w, h = nw, nh
+			session.WindowChange(h, w)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -24,7 +24,7 @@ func (p *SocksProxy) Start(socksAddress string) error {
 	p.sshConn.ReadyWait()
 
 	server, _ := socks.New(&socks.Config{
-		Logger: log,
+		Logger: log.StdLogger(),
 		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			return p.sshConn.Client.Dial(network, addr)
 		},
@@ -8,14 +8,17 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/ferama/rospo/pkg/failfast"
+	"github.com/ferama/rospo/pkg/knownhosts"
 	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/rio"
 	"github.com/ferama/rospo/pkg/utils"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/knownhosts"
 	"golang.org/x/term"
 )
 
@@ -40,6 +43,10 @@ type SshConnection struct {
 	insecure  bool
 	quiet     bool
 	jumpHosts []*JumpHostConf
+	// the pinned server keys, see SshClientConf
+	hostKeyFingerprints []string
+	// set when the last connection attempt rejected the server key
+	hostKeyRejected atomic.Bool
 
 	reconnectionInterval time.Duration
 	keepAliveInterval    time.Duration
@@ -49,16 +56,39 @@ type SshConnection struct {
 	// is connected. Tunnels will wait on this waitGroup to
 	// know if the ssh client is connected or not
 	connected sync.WaitGroup
+	// closed while the client is connected, replaced on disconnection.
+	// Unlike the wait group, the waits on it can be abandoned
+	ready   chan struct{}
+	readyMU sync.Mutex
 
 	connectionStatus   string
+	connectedSince     time.Time
 	connectionStatusMU sync.Mutex
 	clientMU           sync.Mutex
 	// indicates the connection status request
 	isStopped atomic.Bool
+
+	// on demand connections are established when acquired by a user
+	// and closed after idleTimeout without users
+	onDemand    bool
+	idleTimeout time.Duration
+	demand      chan struct{}
+	users       int
+	lastUsed    time.Time
+	usersMU     sync.Mutex
+
+	// shares the connection bandwidth between the channels by priority
+	scheduler *rio.WriteScheduler
+
+	log *logger.Logger
 }
 
 // NewSshConnection creates a new SshConnection instance
 func NewSshConnection(conf *SshClientConf) *SshConnection {
+	// the configs are applied at load time, the api ones may be not
+	if err := conf.ApplyURI(); err != nil {
+		log.Errorf("%s", err)
+	}
 
 	parsed := utils.ParseSSHUrl(conf.ServerURI)
 	var knownHostsPath string
@@ -79,10 +109,14 @@ func NewSshConnection(conf *SshClientConf) *SshConnection {
 		quiet:          conf.Quiet,
 		jumpHosts:      conf.JumpHosts,
 
+		hostKeyFingerprints: conf.HostKeyFingerprints,
+
 		keepAliveInterval:    5 * time.Second,
 		reconnectionInterval: 5 * time.Second,
 		connectionStatus:     STATUS_CONNECTING,
 		isStopped:            atomic.Bool{},
+		scheduler:            rio.NewWriteScheduler(),
+		ready:                make(chan struct{}),
 	}
 
 	c.isStopped.Store(true)
@@ -91,6 +125,7 @@ func NewSshConnection(conf *SshClientConf) *SshConnection {
 	if c.quiet {
 		log.SetOutput(io.Discard)
 	}
+	c.log = log.With("server", conf.ServerURI)
 
 	return c
 }
@@ -100,9 +135,50 @@ func (s *SshConnection) ReadyWait() {
 	s.connected.Wait()
 }
 
+// ReadyWaitTimeout waits until the connection is estabilished with the
+// server, for at most timeout. It returns false if the timeout expired
+func (s *SshConnection) ReadyWaitTimeout(timeout time.Duration) bool {
+	s.readyMU.Lock()
+	ready := s.ready
+	s.readyMU.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// setReady marks the connection as established or lost
+func (s *SshConnection) setReady(ready bool) {
+	s.readyMU.Lock()
+	defer s.readyMU.Unlock()
+	if ready {
+		close(s.ready)
+	} else {
+		s.ready = make(chan struct{})
+	}
+}
+
+// WriteScheduler returns the scheduler of the writes to the connection
+// channels. The channels users write through it with their priority
+func (s *SshConnection) WriteScheduler() *rio.WriteScheduler {
+	return s.scheduler
+}
+
+// IsConnected returns true if the connection with the server is up
+func (s *SshConnection) IsConnected() bool {
+	return s.GetConnectionStatus() == STATUS_CONNECTED
+}
+
 // Stop closes the ssh conn instance client connection
 func (s *SshConnection) Stop() {
 	s.isStopped.Store(true)
+	if s.onDemand {
+		s.wakeUp()
+	}
 	s.resetConn()
 }
 
@@ -116,6 +192,7 @@ func (s *SshConnection) resetConn() {
 
 	s.connectionStatusMU.Lock()
 	s.connectionStatus = STATUS_CLOSED
+	s.connectedSince = time.Time{}
 	s.connectionStatusMU.Unlock()
 }
 
@@ -124,35 +201,66 @@ func (s *SshConnection) resetConn() {
 // and reconnecting in the event of network failures
 func (s *SshConnection) Start() {
 	s.isStopped.Store(false)
+	// the consecutive failed connection attempts
+	failures := 0
 	for {
 		// this becomes true if Stop() was called in the meantime
 		if s.isStopped.Load() {
 			break
 		}
+		if s.onDemand {
+			s.connectionStatusMU.Lock()
+			s.connectionStatus = STATUS_CLOSED
+			s.connectionStatusMU.Unlock()
+			if !s.waitDemand() {
+				break
+			}
+		}
 		s.connectionStatusMU.Lock()
 		s.connectionStatus = STATUS_CONNECTING
 		s.connectionStatusMU.Unlock()
 
 		if err := s.connect(); err != nil {
-			log.Printf("error while connecting %s", err)
+			s.log.Errorf("error while connecting %s", err)
+			failures++
+			failfast.Check(failures, s.exitCode(err), err)
 			time.Sleep(s.reconnectionInterval)
 			continue
 		}
+		failures = 0
 		// client connected. Free the wait group
 		s.connected.Done()
+		s.setReady(true)
 
 		s.connectionStatusMU.Lock()
 		s.connectionStatus = STATUS_CONNECTED
+		s.connectedSince = time.Now()
 		s.connectionStatusMU.Unlock()
 
 		// this call will block until the connection fails
 		s.keepAlive()
 
 		s.resetConn()
+		s.setReady(false)
 		s.connected.Add(1)
 	}
 }
 
+// exitCode returns the fail fast exit code of a connection error
+func (s *SshConnection) exitCode(err error) int {
+	switch {
+	case s.hostKeyRejected.Load():
+		return failfast.ExitHostKeyMismatch
+	// the client gave up, or the server disconnected it after too many
+	// attempts
+	case strings.Contains(err.Error(), "unable to authenticate"),
+		strings.Contains(err.Error(), "authentication failures"):
+		return failfast.ExitAuthFailure
+	default:
+		return failfast.ExitUnreachable
+	}
+}
+
 // GetConnectionStatus returns the current connection status as a string
 func (s *SshConnection) GetConnectionStatus() string {
 	s.connectionStatusMU.Lock()
@@ -160,6 +268,16 @@ func (s *SshConnection) GetConnectionStatus() string {
 	return s.connectionStatus
 }
 
+// Uptime returns how long the connection has been up. Zero if it is down
+func (s *SshConnection) Uptime() time.Duration {
+	s.connectionStatusMU.Lock()
+	defer s.connectionStatusMU.Unlock()
+	if s.connectedSince.IsZero() {
+		return 0
+	}
+	return time.Since(s.connectedSince)
+}
+
 // GrabPubKey is an helper function that gets server pubkey
 func (s *SshConnection) GrabPubKey() {
 	sshConfig := &ssh.ClientConfig{
@@ -171,12 +289,16 @@ func (s *SshConnection) GrabPubKey() {
 }
 
 func (s *SshConnection) keepAlive() {
-	log.Println("starting client keep alive")
+	s.log.Debugf("starting client keep alive")
 	for {
-		// log.Println("keep alive")
+		if s.idleExpired() {
+			s.log.Println("closing the idle on demand connection")
+			return
+		}
+		// s.log.Println("keep alive")
 		_, _, err := s.Client.SendRequest("keepalive@rospo", true, nil)
 		if err != nil {
-			log.Printf("error while sending keep alive %s", err)
+			s.log.Errorf("error while sending keep alive %s", err)
 			return
 		}
 		time.Sleep(s.keepAliveInterval)
@@ -187,15 +309,16 @@ func (s *SshConnection) connect() error {
 		// SSH connection username
 		User:            s.username,
 		Auth:            s.getAuthMethods(),
-		HostKeyCallback: s.verifyHostCallback(true),
+		HostKeyCallback: s.verifyServerCallback(),
 		BannerCallback: func(message string) error {
 			if !s.quiet {
-				fmt.Print(message)
+				fmt.Fprint(os.Stderr, message)
 			}
 			return nil
 		},
 	}
-	log.Println("trying to connect to remote server...")
+	s.log.Println("trying to connect to remote server...")
+	s.hostKeyRejected.Store(false)
 
 	identityPath := s.identity
 	if s.identity == "" {
@@ -203,7 +326,7 @@ func (s *SshConnection) connect() error {
 		identityPath = filepath.Join(usr.HomeDir, ".ssh", "id_rsa")
 	}
 
-	log.Printf("using identity at %s", identityPath)
+	s.log.Printf("using identity at %s", identityPath)
 
 	if len(s.jumpHosts) != 0 {
 		client, err := s.jumpHostConnect(s.serverEndpoint, sshConfig)
@@ -227,6 +350,22 @@ func (s *SshConnection) connect() error {
 	return nil
 }
 
+// verifyServerCallback checks the server key against the pinned
+// fingerprints if set, against the known_hosts file otherwise
+func (s *SshConnection) verifyServerCallback() ssh.HostKeyCallback {
+	if len(s.hostKeyFingerprints) == 0 {
+		return s.verifyHostCallback(true)
+	}
+	return func(host string, remote net.Addr, key ssh.PublicKey) error {
+		if HostKeyPinned(key, s.hostKeyFingerprints) {
+			return nil
+		}
+		s.log.Errorf("%s is not a pinned key of %s, either a man in the middle attack or %s host pub key was changed.", ssh.FingerprintSHA256(key), host, host)
+		s.hostKeyRejected.Store(true)
+		return fmt.Errorf("the %s host key of %s is not pinned", ssh.FingerprintSHA256(key), host)
+	}
+}
+
 func (s *SshConnection) verifyHostCallback(fail bool) ssh.HostKeyCallback {
 
 	if s.insecure {
@@ -237,34 +376,27 @@ func (s *SshConnection) verifyHostCallback(fail bool) ssh.HostKeyCallback {
 	return func(host string, remote net.Addr, key ssh.PublicKey) error {
 		var err error
 
-		log.Printf("using known_hosts file at %s", s.knownHosts)
+		s.log.Printf("using known_hosts file at %s", s.knownHosts)
 
-		clb, err := knownhosts.New(s.knownHosts)
+		clb, err := knownhosts.Callback(s.knownHosts)
 		if err != nil {
-			log.Printf("error while parsing 'known_hosts' file: %s: %v", s.knownHosts, err)
-			f, fErr := os.OpenFile(s.knownHosts, os.O_CREATE, 0600)
-			if fErr != nil {
-				log.Fatalf("%s", fErr)
-			}
-			f.Close()
-			clb, err = knownhosts.New(s.knownHosts)
-			if err != nil {
-				log.Fatalf("%s", err)
-			}
+			s.log.Fatalf("error while parsing 'known_hosts' file: %s: %v", s.knownHosts, err)
 		}
-		var keyErr *knownhosts.KeyError
 		e := clb(host, remote, key)
-		if errors.As(e, &keyErr) && len(keyErr.Want) > 0 {
-			log.Printf("ERROR: %s is not a key of %s, either a man in the middle attack or %s host pub key was changed.", ssh.FingerprintSHA256(key), host, host)
+		switch result, _ := knownhosts.Result(e); result {
+		case knownhosts.KEY_CHANGED:
+			s.log.Errorf("%s is not a key of %s, either a man in the middle attack or %s host pub key was changed.", ssh.FingerprintSHA256(key), host, host)
+			s.hostKeyRejected.Store(true)
 			return e
-		} else if errors.As(e, &keyErr) && len(keyErr.Want) == 0 {
+		case knownhosts.KEY_UNKNOWN:
 			if fail {
-				log.Fatalf(`ERROR: the host '%s' is not trusted. If it is trusted instead, 
+				s.log.Fatalf(`the host '%s' is not trusted. If it is trusted instead, 
 				  please grab its pub key using the 'rospo grabpubkey' command`, host)
 				return errors.New("")
 			}
-			log.Printf("WARNING: %s is not trusted, adding this key: \n\n%s\n\nto known_hosts file.", host, utils.SerializePublicKey(key))
-			return utils.AddHostKeyToKnownHosts(host, key, s.knownHosts)
+			art, _ := utils.RandomArt(key, utils.FINGERPRINT_SHA256)
+			s.log.Warnf("%s is not trusted, adding this key: \n\n%s\n%s\n%s\n\nto known_hosts file.", host, utils.SerializePublicKey(key), ssh.FingerprintSHA256(key), art)
+			return knownhosts.Add(s.knownHosts, host, key, false)
 		}
 		return e
 	}
@@ -315,13 +447,13 @@ func (s *SshConnection) jumpHostConnect(
 			Auth:            s.getAuthMethods(),
 			HostKeyCallback: s.verifyHostCallback(true),
 		}
-		log.Printf("connecting to hop %s@%s", parsed.Username, hop.String())
+		s.log.Printf("connecting to hop %s@%s", parsed.Username, hop.String())
 
 		// if it is the first hop, use ssh Dial to create the first client
 		if idx == 0 {
 			jhClient, err = ssh.Dial("tcp", hop.String(), config)
 			if err != nil {
-				log.Printf("dial INTO remote server error. %s", err)
+				s.log.Errorf("dial INTO remote server error. %s", err)
 				return nil, err
 			}
 		} else {
@@ -335,11 +467,11 @@ func (s *SshConnection) jumpHostConnect(
 			}
 			jhClient = ssh.NewClient(ncc, chans, reqs)
 		}
-		log.Printf("reached the jump host %s@%s", parsed.Username, hop.String())
+		s.log.Printf("reached the jump host %s@%s", parsed.Username, hop.String())
 	}
 
 	// now I'm ready to reach the final hop, the server
-	log.Printf("connecting to %s@%s", sshConfig.User, server.String())
+	s.log.Printf("connecting to %s@%s", sshConfig.User, server.String())
 	jhConn, err = jhClient.Dial("tcp", server.String())
 	if err != nil {
 		return nil, err
@@ -358,12 +490,12 @@ func (s *SshConnection) directConnect(
 	sshConfig *ssh.ClientConfig,
 ) (*ssh.Client, error) {
 
-	log.Printf("connecting to %s", server.String())
+	s.log.Printf("connecting to %s", server.String())
 	client, err := ssh.Dial("tcp", server.String(), sshConfig)
 	if err != nil {
-		log.Printf("dial INTO remote server error. %s", err)
+		s.log.Errorf("dial INTO remote server error. %s", err)
 		return nil, err
 	}
-	log.Printf("connected to remote server at %s\n", server.String())
+	s.log.Printf("connected to remote server at %s\n", server.String())
 	return client, nil
 }
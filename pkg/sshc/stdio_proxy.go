@@ -0,0 +1,41 @@
+package sshc
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// closeWriter is implemented by the connections that can be half closed
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// ProxyStdio connects to target through the ssh connection and pipes in
+// and out to it, like an ssh ProxyCommand does with the process stdio.
+// The target is a "host:port" or a unix socket path. It returns when the
+// target closes the connection
+func ProxyStdio(sshConn *SshConnection, target string, in io.Reader, out io.Writer) error {
+	sshConn.ReadyWait()
+
+	endpoint := utils.NewEndpoint(target)
+	conn, err := sshConn.Client.Dial(endpoint.Network(), endpoint.String())
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %s", target, err)
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, in)
+		// let the target know there is nothing more to read
+		if cw, ok := conn.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}()
+
+	if _, err := io.Copy(out, conn); err != nil {
+		return fmt.Errorf("error while reading from %s: %s", target, err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package sshc
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/ferama/rospo/pkg/rio"
+	"golang.org/x/crypto/ssh"
+)
+
+// UdpChannelType is the rospo specific channel type used to carry
+// udp datagrams. The rospo sshd on the other side, sends the datagrams
+// to the requested address and carries the replies back
+const UdpChannelType = "udp-forward@rospo"
+
+// UdpConn carries udp datagrams through the ssh connection. Every
+// Write sends a datagram and every Read returns one
+type UdpConn struct {
+	channel ssh.Channel
+}
+
+// DialUDP opens a udp forward channel toward addr (host:port). The
+// address is resolved and dialed by the remote server
+func (s *SshConnection) DialUDP(addr string) (*UdpConn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	var payload = struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{
+		host, uint32(port), "127.0.0.1", 0,
+	}
+
+	s.clientMU.Lock()
+	client := s.Client
+	s.clientMU.Unlock()
+
+	channel, reqs, err := client.OpenChannel(UdpChannelType, ssh.Marshal(payload))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return &UdpConn{channel: channel}, nil
+}
+
+// Read reads a single datagram into b
+func (c *UdpConn) Read(b []byte) (int, error) {
+	return rio.ReadDatagram(c.channel, b)
+}
+
+// Write sends b as a single datagram
+func (c *UdpConn) Write(b []byte) (int, error) {
+	if err := rio.WriteDatagram(c.channel, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the udp forward channel
+func (c *UdpConn) Close() error {
+	return c.channel.Close()
+}
@@ -0,0 +1,79 @@
+package sshd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/ferama/rospo/pkg/rio"
+	"golang.org/x/crypto/ssh"
+)
+
+// agentForward exposes the client ssh agent to a session through
+// a unix socket. Every connection to the socket is carried back to the
+// client using an auth-agent@openssh.com channel
+type agentForward struct {
+	sshConn  *ssh.ServerConn
+	meter    *trafficMeter
+	listener net.Listener
+	dir      string
+}
+
+func newAgentForward(sshConn *ssh.ServerConn, meter *trafficMeter) (*agentForward, error) {
+	// MkdirTemp creates the dir with 0700 permissions, so only
+	// the server user can reach the socket
+	dir, err := os.MkdirTemp("", "rospo-agent-")
+	if err != nil {
+		return nil, err
+	}
+	socketPath := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	a := &agentForward{
+		sshConn:  sshConn,
+		meter:    meter,
+		listener: listener,
+		dir:      dir,
+	}
+	go a.serve()
+	return a, nil
+}
+
+// SocketPath returns the path to be exported as SSH_AUTH_SOCK
+func (a *agentForward) SocketPath() string {
+	return a.listener.Addr().String()
+}
+
+func (a *agentForward) serve() {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			channel, reqs, err := a.sshConn.OpenChannel("auth-agent@openssh.com", nil)
+			if err != nil {
+				sessionLogger(a.sshConn).Errorf("unable to open agent channel: %s", err)
+				conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			rio.CopyConn(a.meter.channel(channel), conn)
+		}()
+	}
+}
+
+// Close stops the agent listener and removes the socket
+func (a *agentForward) Close() {
+	a.listener.Close()
+	os.RemoveAll(a.dir)
+}
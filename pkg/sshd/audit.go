@@ -0,0 +1,139 @@
+package sshd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// audit events
+const (
+	auditAuth         = "auth"
+	auditSessionOpen  = "session_open"
+	auditSessionClose = "session_close"
+	auditShell        = "shell"
+	auditExec         = "exec"
+	auditSubsystem    = "subsystem"
+	auditForward      = "forward"
+)
+
+// auditRecord is a single audit log entry. Records are written
+// as JSON lines
+type auditRecord struct {
+	Time           time.Time `json:"time"`
+	Event          string    `json:"event"`
+	User           string    `json:"user,omitempty"`
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"`
+	RemoteAddr     string    `json:"remote_addr,omitempty"`
+	// the ssh session id. Correlates the records of the same connection
+	SessionID string `json:"session_id,omitempty"`
+	Success   bool   `json:"success"`
+	// the auth method for auth events
+	Method string `json:"method,omitempty"`
+	// the executed command for exec events, the subsystem name for
+	// subsystem events and the request type for forward events
+	Command string `json:"command,omitempty"`
+	// the forward address for forward events
+	Address string `json:"address,omitempty"`
+	// the connection duration for session_close events
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// how long a stopping server waits for the forcibly closed sessions
+// to write their last audit records
+const auditCloseTimeout = time.Second
+
+// auditLogger appends audit records to a file
+type auditLogger struct {
+	path string
+	file *os.File
+	enc  *json.Encoder
+	mu   sync.Mutex
+}
+
+func newAuditLogger(path string) (*auditLogger, error) {
+	a := &auditLogger{path: path}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLogger) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	a.file = f
+	a.enc = json.NewEncoder(f)
+	return nil
+}
+
+// reopen opens the file again, if closed by a server stop
+func (a *auditLogger) reopen() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file != nil {
+		return nil
+	}
+	return a.open()
+}
+
+func (a *auditLogger) write(rec *auditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// the file is closed when the server stops: the records of the
+	// connections outliving it are dropped
+	if a.file == nil {
+		return
+	}
+	if err := a.enc.Encode(rec); err != nil {
+		log.Errorf("failed to write audit log: %s", err)
+	}
+}
+
+func (a *auditLogger) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// audit writes rec to the audit log and sends it to the webhooks,
+// if enabled, filling in the connection details from conn
+func (s *sshServer) audit(conn ssh.ConnMetadata, rec *auditRecord) {
+	if s.auditLog == nil && len(s.webhooks) == 0 {
+		return
+	}
+	rec.Time = time.Now()
+	rec.User = conn.User()
+	rec.RemoteAddr = conn.RemoteAddr().String()
+	rec.SessionID = hex.EncodeToString(conn.SessionID())
+	if sc, ok := conn.(*ssh.ServerConn); ok && rec.KeyFingerprint == "" && sc.Permissions != nil {
+		rec.KeyFingerprint = sc.Permissions.Extensions["pubkey-fp"]
+	}
+	if s.auditLog != nil {
+		s.auditLog.write(rec)
+	}
+	for _, w := range s.webhooks {
+		w.notify(rec)
+	}
+}
+
+// errString returns the err message or an empty string if err is nil
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
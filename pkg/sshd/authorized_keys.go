@@ -0,0 +1,151 @@
+package sshd
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrAuthorizedKeyNotFound is returned when removing an unknown key
+var ErrAuthorizedKeyNotFound = errors.New("authorized key not found")
+
+// AuthorizedKey describes a public key allowed to log in
+type AuthorizedKey struct {
+	Fingerprint string `json:"fingerprint"`
+	Type        string `json:"type"`
+	// the key in authorized_keys format, without comment
+	Key     string `json:"key"`
+	Comment string `json:"comment,omitempty"`
+	// true if the key was added at runtime, false if it comes
+	// from the authorized_keys sources
+	Runtime bool `json:"runtime"`
+}
+
+func newAuthorizedKey(pubKey ssh.PublicKey, comment string, runtime bool) *AuthorizedKey {
+	return &AuthorizedKey{
+		Fingerprint: ssh.FingerprintSHA256(pubKey),
+		Type:        pubKey.Type(),
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubKey))),
+		Comment:     comment,
+		Runtime:     runtime,
+	}
+}
+
+// AddAuthorizedKey authorizes the key, given in authorized_keys format,
+// on the running server. Runtime keys are kept in memory only: they are
+// lost when the process exits
+func (s *sshServer) AddAuthorizedKey(line string) (*AuthorizedKey, error) {
+	pubKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+	key := newAuthorizedKey(pubKey, comment, true)
+
+	s.runtimeKeysMu.Lock()
+	defer s.runtimeKeysMu.Unlock()
+
+	s.runtimeKeys[string(pubKey.Marshal())] = key
+	delete(s.revokedKeys, key.Fingerprint)
+	log.Printf("authorized key %s added", key.Fingerprint)
+	return key, nil
+}
+
+// RemoveAuthorizedKey revokes the key with the given SHA256 fingerprint.
+// Keys coming from the authorized_keys sources are denied until the
+// process exits, without touching the sources
+func (s *sshServer) RemoveAuthorizedKey(fingerprint string) error {
+	found := false
+	for _, key := range s.ListAuthorizedKeys() {
+		if key.Fingerprint == fingerprint {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrAuthorizedKeyNotFound
+	}
+
+	s.runtimeKeysMu.Lock()
+	defer s.runtimeKeysMu.Unlock()
+
+	for k, key := range s.runtimeKeys {
+		if key.Fingerprint == fingerprint {
+			delete(s.runtimeKeys, k)
+		}
+	}
+	s.revokedKeys[fingerprint] = true
+	log.Printf("authorized key %s removed", fingerprint)
+	return nil
+}
+
+// ListAuthorizedKeys returns the keys currently allowed to log in
+func (s *sshServer) ListAuthorizedKeys() []*AuthorizedKey {
+	sourceKeys := s.sourceAuthorizedKeys()
+
+	s.runtimeKeysMu.Lock()
+	defer s.runtimeKeysMu.Unlock()
+
+	res := []*AuthorizedKey{}
+	for k := range sourceKeys {
+		if _, ok := s.runtimeKeys[k]; ok {
+			continue
+		}
+		pubKey, err := ssh.ParsePublicKey([]byte(k))
+		if err != nil {
+			continue
+		}
+		key := newAuthorizedKey(pubKey, "", false)
+		if s.revokedKeys[key.Fingerprint] {
+			continue
+		}
+		res = append(res, key)
+	}
+	for _, key := range s.runtimeKeys {
+		res = append(res, key)
+	}
+	return res
+}
+
+// sourceAuthorizedKeys returns the keys of the authorized_keys sources.
+// In virtual users mode, the ones of all the users
+func (s *sshServer) sourceAuthorizedKeys() map[string]bool {
+	if !s.hasVirtualUsers() {
+		return s.loadAuthorizedKeys()
+	}
+	res := map[string]bool{}
+	for name := range s.users {
+		for k, v := range s.virtualUserKeys(name) {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// isKeyAuthorized returns true if pubKey is allowed to log in as user.
+// The runtime keys are allowed for any user, but the unknown virtual
+// ones, and the revoked keys for none
+func (s *sshServer) isKeyAuthorized(user string, pubKey ssh.PublicKey) bool {
+	k := string(pubKey.Marshal())
+
+	s.runtimeKeysMu.Lock()
+	_, isRuntime := s.runtimeKeys[k]
+	isRevoked := s.revokedKeys[ssh.FingerprintSHA256(pubKey)]
+	s.runtimeKeysMu.Unlock()
+
+	if s.hasVirtualUsers() {
+		if _, ok := s.users[user]; !ok {
+			return false
+		}
+	}
+	if isRuntime {
+		return true
+	}
+	if isRevoked {
+		return false
+	}
+	if s.hasVirtualUsers() {
+		return s.virtualUserKeys(user)[k]
+	}
+	return s.loadAuthorizedKeys()[k]
+}
@@ -0,0 +1,140 @@
+package sshd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hasCertAuth returns true if user certificates signed by the
+// trusted CAs are accepted
+func (s *sshServer) hasCertAuth() bool {
+	cas, _ := s.trustedCAKeys()
+	return len(cas) > 0
+}
+
+// principalConn overrides the user of a connection with the
+// certificate principal it is authorized by
+type principalConn struct {
+	ssh.ConnMetadata
+	principal string
+}
+
+func (c *principalConn) User() string {
+	return c.principal
+}
+
+// principalsFile returns the authorized principals file of user, with
+// the %u token expanded. Empty if not configured
+func (s *sshServer) principalsFile(user string) string {
+	_, file := s.trustedCAKeys()
+	if vu, ok := s.users[user]; ok && vu.AuthorizedPrincipalsFile != "" {
+		file = vu.AuthorizedPrincipalsFile
+	}
+	return strings.ReplaceAll(file, "%u", user)
+}
+
+// loadPrincipals reads an authorized principals file: one principal per
+// line, the key options before it are ignored. Comments and empty lines
+// are skipped
+func loadPrincipals(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		res = append(res, fields[len(fields)-1])
+	}
+	return res, scanner.Err()
+}
+
+// authorizedPrincipals returns the certificate principals allowed to log
+// in as user. Like OpenSSH, if no principals file is found for the user,
+// the principal must be the user name itself
+func (s *sshServer) authorizedPrincipals(user string) []string {
+	path := s.principalsFile(user)
+	if path == "" {
+		return []string{user}
+	}
+	principals, err := loadPrincipals(path)
+	if os.IsNotExist(err) {
+		return []string{user}
+	}
+	if err != nil {
+		log.Errorf("failed to load authorized principals from %s: %s", path, err)
+		return nil
+	}
+	return principals
+}
+
+// certAuth checks a user certificate: it must be signed by one of the
+// trusted CAs and carry one of the user authorized principals
+func (s *sshServer) certAuth(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if !s.hasCertAuth() {
+		return nil, fmt.Errorf("certificates not accepted")
+	}
+	if s.hasVirtualUsers() {
+		if _, ok := s.users[conn.User()]; !ok {
+			return nil, fmt.Errorf("unknown user %q", conn.User())
+		}
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate has no principals")
+	}
+
+	sources, _ := s.trustedCAKeys()
+	cas := s.loadAuthorizedKeysFrom(sources)
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return cas[string(auth.Marshal())]
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			s.runtimeKeysMu.Lock()
+			defer s.runtimeKeysMu.Unlock()
+			return s.revokedKeys[ssh.FingerprintSHA256(cert.Key)]
+		},
+	}
+
+	principals := s.authorizedPrincipals(conn.User())
+	var lastErr error = fmt.Errorf("no authorized principal for %q", conn.User())
+	for _, p := range cert.ValidPrincipals {
+		found := false
+		for _, ap := range principals {
+			if p == ap {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		perms, err := checker.Authenticate(&principalConn{conn, p}, cert)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// the source-address critical option is enforced by the ssh
+		// library on the returned permissions
+		res := &ssh.Permissions{
+			CriticalOptions: perms.CriticalOptions,
+			Extensions: map[string]string{
+				"pubkey-fp": ssh.FingerprintSHA256(cert.Key),
+				"principal": p,
+			},
+		}
+		return res, nil
+	}
+	return nil, lastErr
+}
@@ -2,6 +2,7 @@ package sshd
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -10,7 +11,10 @@ import (
 	"os/user"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ferama/rospo/pkg/logger"
 	"github.com/ferama/rospo/pkg/rio"
 	"github.com/ferama/rospo/pkg/rpty"
 	"github.com/ferama/rospo/pkg/utils"
@@ -18,6 +22,10 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// how long a udp forward is kept open without receiving
+// any reply from the udp endpoint
+const udpIdleTimeout = 2 * time.Minute
+
 // parseDims extracts two uint32s from the provided buffer.
 func parseDims(b []byte) (uint32, uint32) {
 	w := binary.BigEndian.Uint32(b)
@@ -28,20 +36,40 @@ func parseDims(b []byte) (uint32, uint32) {
 type channelHandler struct {
 	server  *sshServer
 	sshConn *ssh.ServerConn
+	policy  *policy
 
 	chans <-chan ssh.NewChannel
+
+	// the rendered message of the day, displayed on interactive sessions
+	motd string
+	// nil if the traffic is not limited
+	meter *trafficMeter
+
+	// open channels counters used to enforce the server limits
+	openChannels int
+	openSessions int
+	countersMu   sync.Mutex
+	// the open session channels, to notify the user. Guarded by countersMu
+	sessionChannels map[ssh.Channel]struct{}
+
+	log *logger.Logger
 }
 
 func newChannelHandler(
 	server *sshServer,
 	sshConn *ssh.ServerConn,
+	policy *policy,
 	chans <-chan ssh.NewChannel,
 ) *channelHandler {
 
 	return &channelHandler{
 		server:  server,
 		sshConn: sshConn,
+		policy:  policy,
 		chans:   chans,
+		log:     sessionLogger(sshConn),
+
+		sessionChannels: make(map[ssh.Channel]struct{}),
 	}
 
 }
@@ -49,49 +77,118 @@ func newChannelHandler(
 func (s *channelHandler) handleShellExectRequest(
 	pty rpty.Pty,
 	env map[string]string,
+	fwdEnv map[string]string,
 	channel ssh.Channel,
 	req *ssh.Request) bool {
 
-	var shell string
-
-	if s.server.shellExecutable == "" {
+	// the session user. Virtual users are never mapped to OS accounts,
+	// their sessions run as the current process user
+	var username, homeDir, workDir string
+	// the OS account the default shell is looked up for
+	shellUser := ""
+	if vu, ok := s.server.users[s.sshConn.User()]; ok {
+		username = vu.Name
+		homeDir = vu.Home
+		workDir = vu.Home
+	} else {
 		usr, err := user.Current()
 		if err != nil {
-			panic(err)
+			s.log.Warnf("declining %s request: %s", req.Type, err)
+			req.Reply(false, nil)
+			return false
 		}
-		shell = utils.GetUserDefaultShell(usr.Username)
+		username = usr.Username
+		homeDir = usr.HomeDir
+		shellUser = usr.Username
+	}
+
+	var shell string
+
+	if s.policy.loginShell != "" {
+		shell = s.policy.loginShell
+	} else if s.server.shellExecutable == "" {
+		shell = utils.GetUserDefaultShell(shellUser)
 	} else {
 		shell = s.server.shellExecutable
 	}
 
-	if s.server.disableShell {
-		log.Printf("declining %s request... ", req.Type)
+	rec := &auditRecord{Event: auditShell}
+	if req.Type == "exec" {
+		var payload = struct{ Value string }{}
+		ssh.Unmarshal(req.Payload, &payload)
+		rec.Event = auditExec
+		rec.Command = payload.Value
+	}
+
+	if !s.policy.shell {
+		s.log.Warnf("declining %s request... ", req.Type)
+		rec.Error = "shell disabled"
+		s.server.audit(s.sshConn, rec)
+		req.Reply(false, nil)
+		return false
+	}
+	command, err := s.policy.command(rec.Command)
+	// the restricted commands are run without a shell, confined
+	// in the user home
+	var restrictedArgv []string
+	if err == nil && s.policy.forceCommand == "" && len(s.policy.restrictedCommands) > 0 {
+		if homeDir == "" {
+			homeDir, _ = os.Getwd()
+		}
+		workDir = homeDir
+		if command == "" {
+			err = errCommandNotAllowed
+		} else {
+			restrictedArgv, err = restrictedCommand(s.policy.restrictedCommands, homeDir, command)
+		}
+	} else if err == nil && s.policy.forceCommand == "" && len(s.policy.allowedCommands) > 0 {
+		// the allowed commands are run without a shell too, so its
+		// syntax (like ; or $()) can't run what the patterns don't match
+		restrictedArgv, err = splitCommand(command)
+		if err == nil && len(restrictedArgv) == 0 {
+			err = errCommandNotAllowed
+		}
+	}
+	if err != nil {
+		s.log.Warnf("declining %s request '%s': %s", req.Type, rec.Command, err)
+		rec.Error = err.Error()
+		s.server.audit(s.sshConn, rec)
 		req.Reply(false, nil)
 		return false
 	}
+	rec.Success = true
+	s.server.audit(s.sshConn, rec)
+
 	var cmd *exec.Cmd
 
-	if req.Type == "shell" {
-		if s.server.shellExecutable != "" {
+	if s.policy.forceCommand != "" {
+		cmd = exec.Command(shell, []string{"-c", command}...)
+	} else if restrictedArgv != nil {
+		cmd = exec.Command(restrictedArgv[0], restrictedArgv[1:]...)
+	} else if req.Type == "shell" {
+		if s.policy.loginShell == "" && s.server.shellExecutable != "" {
 			parts := strings.Split(s.server.shellExecutable, " ")
 			cmd = exec.Command(parts[0], parts[1:]...)
 		} else {
 			cmd = exec.Command(shell)
 		}
 	} else {
-		var payload = struct{ Value string }{}
-		ssh.Unmarshal(req.Payload, &payload)
-		command := payload.Value
 		cmd = exec.Command(shell, []string{"-c", command}...)
 	}
 
+	// under a command restriction the client can't set variables
+	// like BASH_ENV, LD_PRELOAD or GIT_CONFIG_PARAMETERS, that would
+	// run arbitrary code
+	restricted := s.policy.forceCommand != "" || len(s.policy.allowedCommands) > 0 || restrictedArgv != nil
 	envVal := make([]string, 0, len(env))
 	for k, v := range env {
+		if restricted && !acceptRestrictedEnv(k) {
+			s.log.Debugf("dropping env %s", k)
+			continue
+		}
 		envVal = append(envVal, fmt.Sprintf("%s=%s", k, v))
 	}
 
-	usr, _ := user.Current()
-
 	// export TERM
 	term := os.Getenv("TERM")
 	if term == "" {
@@ -100,43 +197,89 @@ func (s *channelHandler) handleShellExectRequest(
 	envVal = append(envVal, fmt.Sprintf("TERM=%s", term))
 
 	// export HOME
-	envVal = append(envVal, fmt.Sprintf("HOME=%s", usr.HomeDir))
+	envVal = append(envVal, fmt.Sprintf("HOME=%s", homeDir))
 
 	// export USER
-	envVal = append(envVal, fmt.Sprintf("USER=%s", usr.Username))
-	envVal = append(envVal, fmt.Sprintf("LOGNAME=%s", usr.Username))
+	envVal = append(envVal, fmt.Sprintf("USER=%s", username))
+	envVal = append(envVal, fmt.Sprintf("LOGNAME=%s", username))
+
+	// the forwardings variables, the configured ones, then the
+	// standard ssh ones. All of them take precedence over the
+	// variables sent by the client
+	for k, v := range fwdEnv {
+		envVal = append(envVal, fmt.Sprintf("%s=%s", k, v))
+	}
+	for k, v := range s.policy.env {
+		envVal = append(envVal, fmt.Sprintf("%s=%s", k, v))
+	}
+	envVal = append(envVal, s.sshEnv(pty)...)
+	if s.policy.forceCommand != "" {
+		envVal = append(envVal, fmt.Sprintf("SSH_ORIGINAL_COMMAND=%s", rec.Command))
+	}
 
 	cmd.Env = envVal
+	cmd.Dir = workDir
+
+	if req.Type == "shell" && s.motd != "" {
+		motd := s.motd
+		if pty != nil {
+			// the client terminal is in raw mode
+			motd = strings.ReplaceAll(motd, "\n", "\r\n")
+		}
+		io.WriteString(channel, motd)
+	}
 
 	if pty != nil {
 		if err := pty.Run(cmd); err != nil {
-			log.Fatalf("%s", err)
+			s.log.Errorf("could not start %s: %s", req.Type, err)
+			req.Reply(false, nil)
+			return false
 		}
 		s.ptySessionClientServe(channel, pty)
 
-		s.sendStatus(channel, 0)
-		s.sendSignal(channel, "TERM")
-
 	} else {
 		cmd.Stdout = channel
-		cmd.Stderr = channel
-		cmd.Stdin = channel
-		err := cmd.Start()
+		// stderr goes to the ssh extended data stream, so clients
+		// can tell it apart from stdout
+		cmd.Stderr = channel.Stderr()
+		// not using the channel as cmd.Stdin directly: cmd.Wait would
+		// wait for the client to close its input
+		stdin, err := cmd.StdinPipe()
 		if err != nil {
-			log.Printf("%s", err)
+			s.log.Errorf("could not start %s: %s", req.Type, err)
+			req.Reply(false, nil)
+			return false
+		}
+		err = cmd.Start()
+		if err != nil {
+			s.log.Errorf("could not start %s: %s", req.Type, err)
+			req.Reply(false, nil)
+			return false
 		}
 
 		go func() {
-			status, err := cmd.Process.Wait()
-			if err != nil {
-				log.Printf("failed to exit (%s)", err)
-				cmd.Process.Kill()
-			} else {
-				log.Printf("command executed with exit status %s", status)
+			io.Copy(stdin, channel)
+			stdin.Close()
+		}()
+
+		go func() {
+			// returns when the command exited and all its output
+			// was sent to the client
+			err := cmd.Wait()
+			var exitErr *exec.ExitError
+			if err != nil && !errors.As(err, &exitErr) {
+				s.log.Errorf("failed to exit (%s)", err)
+			}
+			exitCode := 255
+			// a negative exit code means terminated by a signal
+			if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() >= 0 {
+				exitCode = cmd.ProcessState.ExitCode()
 			}
-			s.sendStatus(channel, uint32(status.ExitCode()))
+			s.log.Printf("command executed with exit status %d", exitCode)
+			channel.CloseWrite()
+			s.sendStatus(channel, uint32(exitCode))
 			channel.Close()
-			log.Printf("session closed")
+			s.log.Printf("session closed")
 		}()
 	}
 
@@ -145,14 +288,14 @@ func (s *channelHandler) handleShellExectRequest(
 }
 
 func (s *channelHandler) handlePtyRequest(req *ssh.Request) (rpty.Pty, error) {
-	if s.server.disableShell {
-		log.Printf("declining %s request... ", req.Type)
+	if !s.policy.shell {
+		s.log.Warnf("declining %s request... ", req.Type)
 		req.Reply(false, nil)
 		return nil, nil
 	}
 
 	// allocate a terminal for this channel
-	// log.Print("creating pty...")
+	// s.log.Print("creating pty...")
 	// Create new pty
 	pty, err := rpty.New()
 	if err != nil {
@@ -168,30 +311,52 @@ func (s *channelHandler) handlePtyRequest(req *ssh.Request) (rpty.Pty, error) {
 	w, h := parseDims(req.Payload[termLen+4:])
 	pty.Resize(uint16(w), uint16(h))
 
-	log.Printf("pty-req '%s'", termEnv)
+	s.log.Debugf("pty-req '%s'", termEnv)
 	return pty, nil
 }
 
 func (s *channelHandler) serveChannelSession(c ssh.NewChannel) {
 	channel, requests, err := c.Accept()
 	if err != nil {
-		log.Printf("could not accept channel (%s)", err)
+		s.log.Errorf("could not accept channel (%s)", err)
 		return
 	}
+	s.countersMu.Lock()
+	s.sessionChannels[channel] = struct{}{}
+	s.countersMu.Unlock()
+	defer func() {
+		s.countersMu.Lock()
+		delete(s.sessionChannels, channel)
+		s.countersMu.Unlock()
+	}()
 
 	var pty rpty.Pty
+	var agent *agentForward
+	var x11 *x11Forward
+	// the variables sent by the client and the ones set by the
+	// agent and x11 forwardings
 	env := map[string]string{}
+	fwdEnv := map[string]string{}
+
+	defer func() {
+		if agent != nil {
+			agent.Close()
+		}
+		if x11 != nil {
+			x11.Close()
+		}
+	}()
 
 	for req := range requests {
 		ok := false
 		switch req.Type {
 		case "shell", "exec":
-			ok = s.handleShellExectRequest(pty, env, channel, req)
+			ok = s.handleShellExectRequest(pty, env, fwdEnv, channel, req)
 
 		case "pty-req":
 			pty, err = s.handlePtyRequest(req)
 			if err != nil {
-				log.Printf("could not start pty (%s)", err)
+				s.log.Errorf("could not start pty (%s)", err)
 				return
 			}
 			if pty != nil {
@@ -207,32 +372,81 @@ func (s *channelHandler) serveChannelSession(c ssh.NewChannel) {
 			var payload = struct{ Name, Value string }{}
 
 			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
-				log.Printf("invalid env payload: %s", req.Payload)
+				s.log.Printf("invalid env payload: %s", req.Payload)
 			}
-			log.Printf("setenv: %s=%s", payload.Name, payload.Value)
+			s.log.Debugf("setenv: %s=%s", payload.Name, payload.Value)
 
 			env[payload.Name] = payload.Value
 			ok = true
 
+		case "auth-agent-req@openssh.com":
+			if s.server.disableAgentForwarding || agent != nil {
+				break
+			}
+			agent, err = newAgentForward(s.sshConn, s.meter)
+			if err != nil {
+				s.log.Errorf("could not start agent forwarding (%s)", err)
+				agent = nil
+				break
+			}
+			fwdEnv["SSH_AUTH_SOCK"] = agent.SocketPath()
+			ok = true
+
+		case "x11-req":
+			if s.server.disableX11Forwarding || x11 != nil {
+				break
+			}
+			x11, err = newX11Forward(s.sshConn, s.meter, req.Payload)
+			if err != nil {
+				s.log.Errorf("could not start x11 forwarding (%s)", err)
+				x11 = nil
+				break
+			}
+			fwdEnv["DISPLAY"] = x11.Display()
+			ok = true
+
 		case "subsystem":
 			var payload = struct{ Name string }{}
 			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
-				log.Printf("invalid payload: %s", req.Payload)
+				s.log.Printf("invalid payload: %s", req.Payload)
 			}
-			if payload.Name == "sftp" && !s.server.disableSftpSubsystem {
+			// a forced command replaces the subsystems too
+			if payload.Name == "sftp" && s.policy.sftp && s.policy.forceCommand == "" {
 				go s.handleSftpRequest(channel)
 				ok = true
 			}
+			s.server.audit(s.sshConn, &auditRecord{
+				Event:   auditSubsystem,
+				Command: payload.Name,
+				Success: ok,
+			})
 		}
 
 		if !ok {
-			log.Printf("declining %s request... ", req.Type)
+			s.log.Warnf("declining %s request... ", req.Type)
 		}
 
 		req.Reply(ok, nil)
 	}
 }
 
+// notify writes msg on the stderr of the open session channels. The
+// standard clients show it to the user, unlike the rospo global requests
+func (s *channelHandler) notify(msg string) {
+	// not writing under countersMu: the writes block while the
+	// client window is full
+	s.countersMu.Lock()
+	channels := make([]ssh.Channel, 0, len(s.sessionChannels))
+	for channel := range s.sessionChannels {
+		channels = append(channels, channel)
+	}
+	s.countersMu.Unlock()
+	for _, channel := range channels {
+		// the client terminal may be in raw mode
+		fmt.Fprintf(channel.Stderr(), "\r\n%s\r\n", msg)
+	}
+}
+
 func (s *channelHandler) sendStatus(channel ssh.Channel, status uint32) {
 	msg := struct {
 		Status uint32
@@ -240,7 +454,7 @@ func (s *channelHandler) sendStatus(channel ssh.Channel, status uint32) {
 		Status: status,
 	}
 	if _, err := channel.SendRequest("exit-status", false, ssh.Marshal(&msg)); err != nil {
-		log.Printf("failed to send exit-status: %s", err)
+		s.log.Errorf("failed to send exit-status: %s", err)
 	}
 }
 
@@ -255,7 +469,12 @@ func (s *channelHandler) ptySessionClientServe(channel ssh.Channel, pty rpty.Pty
 	// Pipe session to shell and vice-versa
 	go func() {
 		pty.WriteTo(channel)
-		once.Do(close)
+		// the output ends when the command exits: report its
+		// exit status before tearing down the session
+		once.Do(func() {
+			s.sendStatus(channel, uint32(pty.Wait()))
+			close()
+		})
 	}()
 
 	go func() {
@@ -265,91 +484,266 @@ func (s *channelHandler) ptySessionClientServe(channel ssh.Channel, pty rpty.Pty
 }
 
 func (s *channelHandler) handleSftpRequest(channel ssh.Channel) {
+	if len(s.policy.sftpAllowedPaths) > 0 {
+		s.handleRestrictedSftpRequest(channel)
+		return
+	}
 	debugStream := os.Stderr
 	serverOptions := []sftp.ServerOption{
 		sftp.WithDebug(debugStream),
 	}
+	if s.policy.sftpReadOnly {
+		serverOptions = append(serverOptions, sftp.ReadOnly())
+	}
 	server, err := sftp.NewServer(
 		channel,
 		serverOptions...,
 	)
 	if err != nil {
-		log.Fatal(err)
+		s.log.Errorf("could not start sftp server: %s", err)
+		channel.Close()
+		return
 	}
 	if err := server.Serve(); err == io.EOF {
 		server.Close()
-		log.Print("sftp client exited session.")
+		s.log.Print("sftp client exited session.")
 	} else if err != nil {
-		log.Printf("sftp server completed with error: %s", err)
+		s.log.Errorf("sftp server completed with error: %s", err)
 	}
 }
 
-func (s *channelHandler) sendSignal(channel ssh.Channel, signal string) {
-	sig := struct {
-		Signal     string
-		CoreDumped bool
-		Errsmg     string
-		Lang       string
-	}{
-		Signal:     signal,
-		CoreDumped: false,
-		Errsmg:     "Process terminated",
-		Lang:       "en-GB",
+// handleRestrictedSftpRequest serves the sftp subsystem confining the
+// client in the policy allowed paths
+func (s *channelHandler) handleRestrictedSftpRequest(channel ssh.Channel) {
+	handler := newSftpHandler(s.policy.sftpAllowedPaths, s.policy.sftpReadOnly)
+
+	startDir := ""
+	if vu, ok := s.server.users[s.sshConn.User()]; ok {
+		startDir = vu.Home
+	} else if usr, err := user.Current(); err == nil {
+		startDir = usr.HomeDir
 	}
-	if _, err := channel.SendRequest("exit-signal", false, ssh.Marshal(&sig)); err != nil {
-		log.Printf("unable to send signal: %v", err)
+	server := sftp.NewRequestServer(
+		channel,
+		handler.handlers(),
+		sftp.WithStartDirectory(handler.startDirectory(startDir)),
+	)
+	if err := server.Serve(); err == io.EOF {
+		server.Close()
+		s.log.Print("sftp client exited session.")
+	} else if err != nil {
+		s.log.Errorf("sftp server completed with error: %s", err)
 	}
 }
 
-func (s *channelHandler) handleChannelDirect(c ssh.NewChannel) {
+// directDestination returns the network and address a direct-tcpip
+// or direct-streamlocal channel has to be connected to
+func directDestination(c ssh.NewChannel) (string, string, error) {
+	if c.ChannelType() == "direct-streamlocal@openssh.com" {
+		var payload = struct {
+			SocketPath string
+			Reserved0  string
+			Reserved1  uint32
+		}{}
+		if err := ssh.Unmarshal(c.ExtraData(), &payload); err != nil {
+			return "", "", err
+		}
+		return "unix", payload.SocketPath, nil
+	}
+
 	var payload = struct {
 		Addr       string
 		Port       uint32
 		OriginAddr string
 		OriginPort uint32
 	}{}
-
 	if err := ssh.Unmarshal(c.ExtraData(), &payload); err != nil {
-		log.Printf("Could not unmarshal extra data: %s\n", err)
+		return "", "", err
+	}
+	return "tcp", fmt.Sprintf("[%s]:%d", payload.Addr, payload.Port), nil
+}
+
+func (s *channelHandler) handleChannelDirect(c ssh.NewChannel) {
+	network, addr, err := directDestination(c)
+	if err != nil {
+		s.log.Errorf("Could not unmarshal extra data: %s\n", err)
 
 		c.Reject(ssh.Prohibited, "Bad payload")
 		return
 	}
 	connection, requests, err := c.Accept()
 	if err != nil {
-		log.Printf("Could not accept channel (%s)\n", err)
+		s.log.Errorf("Could not accept channel (%s)\n", err)
 		return
 	}
 	go ssh.DiscardRequests(requests)
-	addr := fmt.Sprintf("[%s]:%d", payload.Addr, payload.Port)
 
-	rconn, err := net.Dial("tcp", addr)
+	rconn, err := net.Dial(network, addr)
+	s.server.audit(s.sshConn, &auditRecord{
+		Event:   auditForward,
+		Command: c.ChannelType(),
+		Address: addr,
+		Success: err == nil,
+		Error:   errString(err),
+	})
 	if err != nil {
-		log.Printf("Could not dial remote (%s)", err)
+		s.log.Errorf("Could not dial remote (%s)", err)
 		connection.Close()
 		return
 	}
 
-	rio.CopyConn(connection, rconn)
+	// blocks until the forwarded connection is closed
+	done := make(chan struct{})
+	rio.CopyConnWithOnClose(connection, rconn, false, func() {
+		close(done)
+	})
+	<-done
+}
+
+func (s *channelHandler) handleChannelUdp(c ssh.NewChannel) {
+	var payload = struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{}
+
+	if err := ssh.Unmarshal(c.ExtraData(), &payload); err != nil {
+		s.log.Errorf("Could not unmarshal extra data: %s\n", err)
+
+		c.Reject(ssh.Prohibited, "Bad payload")
+		return
+	}
+	addr := fmt.Sprintf("[%s]:%d", payload.Addr, payload.Port)
+	uconn, err := net.Dial("udp", addr)
+	s.server.audit(s.sshConn, &auditRecord{
+		Event:   auditForward,
+		Command: c.ChannelType(),
+		Address: addr,
+		Success: err == nil,
+		Error:   errString(err),
+	})
+	if err != nil {
+		s.log.Errorf("Could not dial remote (%s)", err)
+		c.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	connection, requests, err := c.Accept()
+	if err != nil {
+		s.log.Errorf("Could not accept channel (%s)\n", err)
+		uconn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	var once sync.Once
+	closeForward := func() {
+		connection.Close()
+		uconn.Close()
+	}
+	// unix nano time of the latest datagram from the client
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+
+	// datagrams from the client to the udp endpoint
+	go func() {
+		defer once.Do(closeForward)
+		pooled := rio.GetBuffer(rio.MaxDatagramSize)
+		defer rio.PutBuffer(pooled)
+		buf := *pooled
+		for {
+			n, err := rio.ReadDatagram(connection, buf)
+			if err == rio.ErrDatagramTooBig {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			lastActivity.Store(time.Now().UnixNano())
+			uconn.Write(buf[:n])
+		}
+	}()
+
+	// replies from the udp endpoint back to the client. The
+	// forward is closed if there is no traffic for too long.
+	// Blocks until the forward is closed
+	func() {
+		defer once.Do(closeForward)
+		pooled := rio.GetBuffer(rio.MaxDatagramSize)
+		defer rio.PutBuffer(pooled)
+		buf := *pooled
+		for {
+			uconn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+			n, err := uconn.Read(buf)
+			if err != nil {
+				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+					last := time.Unix(0, lastActivity.Load())
+					if time.Since(last) < udpIdleTimeout {
+						continue
+					}
+					s.log.Printf("udp forward to %s idle. Closing", addr)
+				}
+				return
+			}
+			if err := rio.WriteDatagram(connection, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
 }
 
 func (s *channelHandler) handleChannels() {
 	// Service the incoming Channel channel.
 	for newChannel := range s.chans {
 		t := newChannel.ChannelType()
+		var handler func(ssh.NewChannel)
 		switch t {
 		case "session":
+			if !s.policy.session {
+				newChannel.Reject(ssh.Prohibited, "sessions are disabled")
+				continue
+			}
 			// shell, exec and sft subsystem
-			go s.serveChannelSession(newChannel)
-		case "direct-tcpip":
-			if s.server.disableTunnelling {
+			handler = s.serveChannelSession
+		case "direct-tcpip", "direct-streamlocal@openssh.com":
+			if !s.policy.localForwarding {
+				s.server.audit(s.sshConn, &auditRecord{
+					Event:   auditForward,
+					Command: t,
+					Error:   errForwardingDisabled.Error(),
+				})
 				newChannel.Reject(ssh.Prohibited, "tunnelling is disabled")
 				continue
 			}
 			// used by forward requests
-			go s.handleChannelDirect(newChannel)
+			handler = s.handleChannelDirect
+		case "udp-forward@rospo":
+			if !s.policy.localForwarding {
+				s.server.audit(s.sshConn, &auditRecord{
+					Event:   auditForward,
+					Command: t,
+					Error:   errForwardingDisabled.Error(),
+				})
+				newChannel.Reject(ssh.Prohibited, "tunnelling is disabled")
+				continue
+			}
+			// used by udp forward requests
+			handler = s.handleChannelUdp
 		default:
 			newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
+			continue
+		}
+
+		if msg, ok := s.acquireChannel(t); !ok {
+			s.log.Warnf("rejecting %s channel: %s", t, msg)
+			newChannel.Reject(ssh.ResourceShortage, msg)
+			continue
 		}
+		go func(t string, newChannel *countedNewChannel) {
+			defer s.releaseChannel(t)
+			defer newChannel.done()
+			// handlers return when the channel is closed
+			handler(newChannel)
+		}(t, &countedNewChannel{NewChannel: newChannel, metrics: s.server.metrics, meter: s.meter})
 	}
 }
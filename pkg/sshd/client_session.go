@@ -0,0 +1,125 @@
+package sshd
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// clientSession holds the state of a single client connection: its own
+// ssh connection, policy, request and channel handlers. Every client
+// gets a dedicated session, so concurrent clients never share state
+type clientSession struct {
+	id      int
+	server  *sshServer
+	sshConn *ssh.ServerConn
+	policy  *policy
+
+	requestHandler *requestHandler
+	channelHandler *channelHandler
+
+	startTime time.Time
+
+	closeOnce sync.Once
+}
+
+func newClientSession(
+	server *sshServer,
+	sshConn *ssh.ServerConn,
+	lc *ListenerConf,
+	chans <-chan ssh.NewChannel,
+	reqs <-chan *ssh.Request,
+	meter *trafficMeter) *clientSession {
+
+	policy := server.getPolicy(sshConn, lc)
+
+	channelHandler := newChannelHandler(server, sshConn, policy, chans)
+	channelHandler.motd = server.motd(sshConn, server.recordLogin(sshConn))
+	channelHandler.meter = meter
+
+	requestHandler := newRequestHandler(server, sshConn, policy, reqs)
+	requestHandler.meter = meter
+
+	return &clientSession{
+		server:         server,
+		sshConn:        sshConn,
+		policy:         policy,
+		requestHandler: requestHandler,
+		channelHandler: channelHandler,
+		startTime:      time.Now(),
+	}
+}
+
+// serve handles the session requests and channels. It blocks until
+// the client connection terminates and all the session forwards
+// are released
+func (cs *clientSession) serve() {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cs.requestHandler.handleRequests()
+	}()
+
+	done := make(chan struct{})
+	go cs.keepAlive(done)
+
+	// blocks until chans is closed (session terminates)
+	cs.channelHandler.handleChannels()
+	wg.Wait()
+	close(done)
+}
+
+// RemoteAddr returns the client network address
+func (cs *clientSession) RemoteAddr() net.Addr {
+	return cs.sshConn.RemoteAddr()
+}
+
+// User returns the user the client authenticated as
+func (cs *clientSession) User() string {
+	return cs.sshConn.User()
+}
+
+// how long a stopping server waits for the clients to take the shutdown
+// notifications, before closing their connections
+const shutdownNotifyTimeout = time.Second
+
+// notifySessions runs notify for every session in parallel, waiting for
+// them up to shutdownNotifyTimeout: the writes to a client not reading
+// its data block until its connection is closed
+func notifySessions(sessions []*clientSession, notify func(cs *clientSession)) {
+	var wg sync.WaitGroup
+	for _, cs := range sessions {
+		wg.Add(1)
+		go func(cs *clientSession) {
+			defer wg.Done()
+			notify(cs)
+		}(cs)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownNotifyTimeout):
+	}
+}
+
+// notifyShutdown tells the client the server is stopping, with the
+// shutdown@rospo global request for the rospo clients and with a message
+// on its open sessions for the others
+func (cs *clientSession) notifyShutdown(msg string) {
+	cs.sshConn.SendRequest("shutdown@rospo", false, nil)
+	cs.channelHandler.notify(msg)
+}
+
+// Close terminates the client connection
+func (cs *clientSession) Close() {
+	cs.closeOnce.Do(func() {
+		cs.sshConn.Close()
+	})
+}
@@ -2,26 +2,296 @@ package sshd
 
 // SshDConf holds the sshd configuration
 type SshDConf struct {
-	Key               string   `yaml:"server_key"`
+	Key string `yaml:"server_key"`
+	// additional server keys. Useful to serve host keys of different
+	// types (ed25519, ecdsa, rsa) to old and new clients
+	Keys []string `yaml:"server_keys"`
+	// the keys that will replace the current ones. They are not used
+	// to authenticate the server but are announced to the clients (through
+	// the OpenSSH hostkeys extension), so that they can learn them before
+	// the rotation takes place
+	NextKeys []string `yaml:"next_server_keys"`
+
 	AuthorizedKeysURI []string `yaml:"authorized_keys"`
 
 	AuthorizedPassword string `yaml:"authorized_password"`
+	// the sources (files or http urls, in authorized_keys format) of the
+	// trusted CA keys. If set, user certificates signed by these CAs are
+	// accepted
+	TrustedUserCAKeys []string `yaml:"trusted_user_ca_keys"`
+	// the file listing the certificate principals allowed to log in as a
+	// user, one per line. The %u token is replaced by the user name. If
+	// not set or missing, the certificate must list the user name itself
+	AuthorizedPrincipalsFile string `yaml:"authorized_principals_file"`
+	// if set, only the users matching one of these patterns can log in.
+	// A pattern is a user name, optionally followed by @ and the client
+	// address or CIDR (ex. alice@10.0.0.0/8). * and ? wildcards are allowed
+	AllowUsers []string `yaml:"allow_users"`
+	// the users matching one of these patterns can't log in. Checked
+	// before allow_users
+	DenyUsers []string `yaml:"deny_users"`
 	// The address the sshd server will listen too
 	ListenAddress string `yaml:"listen_address"`
+	// Additional listeners. Each one can restrict the server
+	// features for the clients connected through it
+	Listeners []*ListenerConf `yaml:"listeners"`
 	// if true the exec,shell requests will be ignored
 	DisableShell bool `yaml:"disable_shell"`
+	// if true session channels are rejected entirely (no shell, exec,
+	// sftp) while tunnelling is still allowed. The server works as
+	// a pure tunnels relay
+	DisableSession bool `yaml:"disable_session"`
 	// if true no banner will be displayed while interacting
 	// with the sshd server
 	DisableBanner bool `yaml:"disable_banner"`
+	// the ssh identification string sent to the clients, ex.
+	// SSH-2.0-OpenSSH_9.3. The SSH-2.0- prefix is added if missing.
+	// Leave empty for the default one
+	ServerVersion string `yaml:"server_version"`
+	// the text displayed to clients before the authentication.
+	// Leave empty for the default rospo banner
+	BannerText string `yaml:"banner_text"`
+	// if set, the banner is read from this file. Takes precedence
+	// over BannerText
+	BannerFile string `yaml:"banner_file"`
+	// the message of the day displayed after the login on interactive
+	// sessions. It is a go template: available variables are
+	// .Hostname, .User, .RemoteAddr, .Time, .LastLogin and .LastLoginFrom
+	Motd string `yaml:"motd"`
+	// if set, the motd template is read from this file. Takes
+	// precedence over Motd
+	MotdFile string `yaml:"motd_file"`
 	// if true all auth mechanism will be disabled
 	// use with caution
 	DisableAuth bool `yaml:"disable_auth"`
 	// If true the sftp subsystem will be disabled and no file transfer
 	// will be allowed
 	DisableSftpSubsystem bool `yaml:"disable_sftp_subsystem"`
+	// if true, the sftp clients can't modify the filesystem
+	SftpReadOnly bool `yaml:"sftp_read_only"`
+	// if set, sftp clients can access only these directories
+	// (absolute paths) and their content
+	SftpAllowedPaths []string `yaml:"sftp_allowed_paths"`
 	// if disabled, forward and reverse tunnelling will be not allowed
 	// on this server
 	DisableTunnelling bool `yaml:"disable_tunnelling"`
+	// if true, clients will not be allowed to forward their ssh agent
+	// into the sessions
+	DisableAgentForwarding bool `yaml:"disable_agent_forwarding"`
+	// if true, X11 forwarding requests will be declined
+	DisableX11Forwarding bool `yaml:"disable_x11_forwarding"`
+	// the directory the reverse unix socket forwards (streamlocal-forward)
+	// are confined in, even through symlinks. Relative socket paths start
+	// from it. Empty means the user home. The sockets are accessible
+	// by the server user only (mode 0600)
+	StreamLocalForwardDir string `yaml:"stream_local_forward_dir"`
+	// if set, this command is executed for every shell and exec request,
+	// in place of the requested one. The requested command is exported
+	// as SSH_ORIGINAL_COMMAND. Only the LANG and LC_* variables sent by
+	// the client are set
+	ForceCommand string `yaml:"force_command"`
+	// if set, only the exec requests whose command fully matches one of
+	// these regular expressions are allowed. They are run by rospo
+	// without a shell. Shell requests are declined and, like for
+	// ForceCommand, only the client locale variables are set
+	AllowedCommands []string `yaml:"allowed_commands"`
+	// if set, exec requests are allowed only if they are git or rsync
+	// server invocations, run by rospo without a shell and confined in
+	// the user home. Allowed values are git, git-ro, rsync and rsync-ro.
+	// Shell requests are declined and only the client locale variables
+	// are set
+	RestrictedCommands []string `yaml:"restricted_commands"`
+	// additional environment variables set in the sessions
+	Env map[string]string `yaml:"env"`
 	// shell executable. Leave empty for default behaviour
 	ShellExecutable string `yaml:"shell_executable"`
+	// controls the address reverse tunnels (tcpip-forward) listeners
+	// are bound to. Allowed values are:
+	//   no: listeners are bound to the loopback interface only
+	//   yes: listeners are bound to all interfaces
+	//   clientspecified: the client chooses the bind address
+	// Empty means clientspecified
+	GatewayPorts string `yaml:"gateway_ports"`
+	// the maximum number of concurrent client connections. 0 means unlimited
+	MaxConnections int `yaml:"max_connections"`
+	// the maximum number of concurrent connections per user. 0 means unlimited
+	MaxConnectionsPerUser int `yaml:"max_connections_per_user"`
+	// the seconds a client has to complete the handshake and authenticate
+	// before being disconnected. Defaults to 120. A negative value
+	// disables it
+	LoginGraceTime int `yaml:"login_grace_time"`
+	// the maximum number of concurrent sessions (shell, exec, sftp) for each
+	// connection. 0 means unlimited
+	MaxSessions int `yaml:"max_sessions"`
+	// the maximum number of concurrent channels (sessions and forwards)
+	// for each connection. 0 means unlimited
+	MaxChannels int `yaml:"max_channels"`
+	// the maximum throughput of each client connection, in bytes per
+	// second. It applies to each direction. 0 means unlimited
+	SessionRateLimit int64 `yaml:"session_rate_limit"`
+	// the maximum bytes a client connection can transfer, both directions
+	// included. The connection is closed when exceeded. 0 means unlimited
+	SessionQuota int64 `yaml:"session_quota"`
+	// the maximum throughput of all the connections of a user, in bytes
+	// per second. It applies to each direction. 0 means unlimited
+	UserRateLimit int64 `yaml:"user_rate_limit"`
+	// the maximum bytes all the connections of a user can transfer since
+	// the server start. 0 means unlimited
+	UserQuota int64 `yaml:"user_quota"`
+	// the interval in seconds between the keepalive requests sent to
+	// the clients. Defaults to 15. A negative value disables keepalives
+	ClientAliveInterval int `yaml:"client_alive_interval"`
+	// the number of consecutive unanswered keepalives after which a client
+	// is considered dead and disconnected, releasing its reverse tunnels.
+	// Defaults to 3
+	ClientAliveCountMax int `yaml:"client_alive_count_max"`
+	// if set, JSON audit records of the server activity (auth attempts,
+	// sessions, commands and forwards) are appended to this file
+	AuditLogFile string `yaml:"audit_log_file"`
+	// the audit records are POSTed as JSON to these endpoints too
+	Webhooks []*WebhookConf `yaml:"webhooks"`
+	// if set, the control api is served on this unix socket. It allows
+	// to manage the authorized keys of the running server
+	ControlSocket string `yaml:"control_socket"`
+	// virtual users. If set, the server accepts these users only, each one
+	// with its own keys, password and features. Virtual users are never
+	// mapped to OS accounts: sessions run as the rospo process user, so the
+	// server can run unprivileged. The global authorized_keys and
+	// authorized_password are not used in this mode
+	Users []*UserConf `yaml:"users"`
+	// per user and per key restrictions. All the policies matching
+	// a connection are applied
+	Policies []*PolicyConf `yaml:"policies"`
+	// if set, the server runs an http(s) front-end routing the requests
+	// to the reverse forwards by host name
+	HTTPVhosts *HTTPVhostsConf `yaml:"http_vhosts"`
 }
+
+// ListenerConf holds the configuration of an sshd listener
+type ListenerConf struct {
+	// the address (host:port) the listener is bound to
+	Address string `yaml:"address"`
+	// if set, the listener is bound to a unix domain socket
+	// at this path instead of Address
+	SocketPath string `yaml:"socket_path"`
+	// the socket file permissions in octal notation. Defaults to 0600
+	SocketPermissions string `yaml:"socket_permissions"`
+
+	// if true the exec,shell requests will be ignored
+	// for clients connected through this listener
+	DisableShell bool `yaml:"disable_shell"`
+	// if true forward and reverse tunnelling will not be allowed
+	// for clients connected through this listener
+	DisableTunnelling bool `yaml:"disable_tunnelling"`
+}
+
+// UserConf holds the configuration of a virtual user
+type UserConf struct {
+	// the login name
+	Name string `yaml:"name"`
+	// the user authorized_keys sources. Files and http urls are supported
+	AuthorizedKeysURI []string `yaml:"authorized_keys"`
+	// if set the user can log in with this password
+	Password string `yaml:"password"`
+	// the authorized principals file of this user. Overrides the
+	// server one
+	AuthorizedPrincipalsFile string `yaml:"authorized_principals_file"`
+	// the working directory and HOME of the user sessions. It is
+	// created if missing
+	Home string `yaml:"home"`
+	// if true the exec,shell requests will be ignored for this user
+	DisableShell bool `yaml:"disable_shell"`
+	// if true forward and reverse tunnelling will not be allowed
+	// for this user
+	DisableTunnelling bool `yaml:"disable_tunnelling"`
+	// if true the sftp subsystem will be disabled for this user
+	DisableSftpSubsystem bool `yaml:"disable_sftp_subsystem"`
+	// if true, the user can't modify the filesystem through sftp
+	SftpReadOnly bool `yaml:"sftp_read_only"`
+	// the sftp allowed paths for this user. Overrides the server ones
+	SftpAllowedPaths []string `yaml:"sftp_allowed_paths"`
+	// the forced command for this user. Overrides the server one
+	ForceCommand string `yaml:"force_command"`
+	// the exec commands allowlist for this user. Overrides the server one
+	AllowedCommands []string `yaml:"allowed_commands"`
+	// the restricted commands for this user. Overrides the server one
+	RestrictedCommands []string `yaml:"restricted_commands"`
+	// the login shell of this user, for example /usr/bin/git-shell.
+	// Exec requests are run as "shell -c command"
+	Shell string `yaml:"shell"`
+	// additional environment variables set in the user sessions
+	Env map[string]string `yaml:"env"`
+}
+
+// PolicyConf restricts the features available to a user or to
+// an authorized key
+type PolicyConf struct {
+	// the user the policy applies to. Empty matches any user
+	User string `yaml:"user"`
+	// the SHA256 fingerprint (as in SHA256:...) of the authorized key
+	// the policy applies to. Empty matches any key
+	KeyFingerprint string `yaml:"key_fingerprint"`
+	// if true, direct-tcpip (forward tunnels) channels are rejected
+	DisableLocalForwarding bool `yaml:"disable_local_forwarding"`
+	// if true, tcpip-forward (reverse tunnels) requests are rejected
+	DisableRemoteForwarding bool `yaml:"disable_remote_forwarding"`
+	// if true, session channels (shell, exec, sftp) are rejected
+	DisableSession bool `yaml:"disable_session"`
+	// if true, the sftp clients can't modify the filesystem
+	SftpReadOnly bool `yaml:"sftp_read_only"`
+	// the sftp allowed paths for the matching connections.
+	// Overrides the server ones
+	SftpAllowedPaths []string `yaml:"sftp_allowed_paths"`
+	// the forced command for the matching connections. Overrides
+	// the server one
+	ForceCommand string `yaml:"force_command"`
+	// the exec commands allowlist for the matching connections.
+	// Overrides the server one
+	AllowedCommands []string `yaml:"allowed_commands"`
+	// the restricted commands for the matching connections.
+	// Overrides the server one
+	RestrictedCommands []string `yaml:"restricted_commands"`
+	// the login shell for the matching connections
+	Shell string `yaml:"shell"`
+	// additional environment variables set in the sessions of
+	// the matching connections
+	Env map[string]string `yaml:"env"`
+}
+
+// WebhookConf configures an http endpoint notified of the server events
+type WebhookConf struct {
+	// the url the events are POSTed to, as JSON audit records
+	URL string `yaml:"url"`
+	// the notified events: auth, session_open, session_close, shell, exec,
+	// subsystem and forward. Empty means all of them
+	Events []string `yaml:"events"`
+	// additional http headers, like an authorization token
+	Headers map[string]string `yaml:"headers"`
+}
+
+// HTTPVhostsConf configures the http front-end. A reverse forward named
+// "app1" (ssh -R app1:0:localhost:3000) is served at app1.<domain>
+type HTTPVhostsConf struct {
+	// the domain of the virtual hosts, like relay.example.com
+	Domain string `yaml:"domain"`
+	// the plain http listener address, like ":80"
+	ListenAddress string `yaml:"listen_address"`
+	// the https listener address, like ":443"
+	TLSListenAddress string `yaml:"tls_listen_address"`
+	// the https certificate, usually a wildcard one. If not set, the
+	// certificates are obtained automatically through ACME (Let's Encrypt)
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	// the contact email of the ACME account
+	AutocertEmail string `yaml:"autocert_email"`
+	// the directory the automatic certificates are stored in. If not
+	// set, they are requested again at each start
+	AutocertCacheDir string `yaml:"autocert_cache_dir"`
+}
+
+// The GatewayPorts allowed values
+const (
+	GATEWAY_PORTS_NO              = "no"
+	GATEWAY_PORTS_YES             = "yes"
+	GATEWAY_PORTS_CLIENTSPECIFIED = "clientspecified"
+)
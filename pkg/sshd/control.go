@@ -0,0 +1,100 @@
+package sshd
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// startControl serves the control api on the control socket. The api
+// exposes the server metrics and manages the authorized keys of the
+// running server:
+//
+//	GET    /stats
+//	GET    /forwards[?name=...]
+//	GET    /sessions
+//	GET    /authorized_keys
+//	POST   /authorized_keys                 {"key": "ssh-ed25519 AAAA... comment"}
+//	DELETE /authorized_keys?fingerprint=SHA256:...
+//
+// Example:
+//
+//	curl --unix-socket /run/rospo/control.sock http://localhost/authorized_keys
+func (s *sshServer) startControl() (net.Listener, error) {
+	lc := &ListenerConf{SocketPath: s.controlSocket}
+	listener, err := lc.listen()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("control api listening on %s", s.controlSocket)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", s.statsHandler)
+	mux.HandleFunc("/forwards", s.forwardsHandler)
+	mux.HandleFunc("/sessions", s.sessionsHandler)
+	mux.HandleFunc("/authorized_keys", s.authorizedKeysHandler)
+	go newHTTPServer(mux).Serve(listener)
+	return listener, nil
+}
+
+func (s *sshServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Stats())
+}
+
+func (s *sshServer) forwardsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Forwards(r.URL.Query().Get("name")))
+}
+
+func (s *sshServer) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Sessions())
+}
+
+func (s *sshServer) authorizedKeysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.ListAuthorizedKeys())
+
+	case http.MethodPost:
+		var body struct {
+			Key string `json:"key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		key, err := s.AddAuthorizedKey(body.Key)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, key)
+
+	case http.MethodDelete:
+		if err := s.RemoveAuthorizedKey(r.URL.Query().Get("fingerprint")); err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{})
+
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
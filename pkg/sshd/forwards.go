@@ -0,0 +1,44 @@
+package sshd
+
+import (
+	"sort"
+	"time"
+)
+
+// ForwardInfo describes an active reverse forward (tcpip-forward or
+// streamlocal-forward) of a connected client
+type ForwardInfo struct {
+	ID int `json:"id"`
+	// the address requested by the client. When gateway_ports is "yes" or
+	// "no" the requested host is not used to bind the listener, so clients
+	// can use it to name their forwards (ex. ssh -R myapp:0:localhost:3000)
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// the listener address on the server
+	BindAddr string `json:"bind_addr"`
+	// the port allocated on the server. 0 for unix sockets
+	Port           uint32    `json:"port"`
+	User           string    `json:"user"`
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"`
+	ClientAddr     string    `json:"client_addr"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Forwards returns the active reverse forwards of all the clients, sorted
+// by creation. If name is not empty, only the forwards with that name
+// are returned
+func (s *sshServer) Forwards(name string) []ForwardInfo {
+	res := []ForwardInfo{}
+	for id, val := range s.forwardsRegistry.GetAll() {
+		info := *val.(*ForwardInfo)
+		if name != "" && info.Name != name {
+			continue
+		}
+		info.ID = id
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
@@ -0,0 +1,94 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// loadHostKey reads the host private key at keyPath. If the file doesn't
+// exist, a new key is generated and stored at keyPath (the public
+// one at keyPath.pub), so the server can start with zero configuration.
+// The generated key type is inferred from the file name (like in
+// ssh_host_rsa_key), defaulting to ed25519
+func loadHostKey(keyPath string) (ssh.Signer, error) {
+	hostPrivateKey, err := os.ReadFile(keyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		keyType := hostKeyTypeFromPath(keyPath)
+		log.Printf("server identity do not exists. Generating a %s one...", keyType)
+		hostPrivateKey, err = generateHostKey(keyPath, keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(hostPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse server key %s: %s", keyPath, err)
+	}
+	return signer, nil
+}
+
+// loadHostKeys loads all the host keys at paths. Only one key per
+// algorithm can be used by the server, so duplicates are rejected
+func loadHostKeys(paths []string) ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+	types := map[string]string{}
+	for _, p := range paths {
+		keyPath, _ := utils.ExpandUserHome(p)
+		log.Printf("loading server key at: '%s'", keyPath)
+		signer, err := loadHostKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		keyType := signer.PublicKey().Type()
+		if other, ok := types[keyType]; ok {
+			return nil, fmt.Errorf("server keys %s and %s have the same type %s", other, keyPath, keyType)
+		}
+		types[keyType] = keyPath
+		signers = append(signers, signer)
+		art, _ := utils.RandomArt(signer.PublicKey(), utils.FINGERPRINT_SHA256)
+		log.Printf("server key %s %s\n%s", keyType, ssh.FingerprintSHA256(signer.PublicKey()), art)
+	}
+	return signers, nil
+}
+
+func hostKeyTypeFromPath(keyPath string) string {
+	name := filepath.Base(keyPath)
+	for _, t := range []string{utils.KEY_TYPE_ECDSA, utils.KEY_TYPE_RSA} {
+		if strings.Contains(name, t) {
+			return t
+		}
+	}
+	return utils.KEY_TYPE_ED25519
+}
+
+func generateHostKey(keyPath string, keyType string) ([]byte, error) {
+	key, err := utils.GenerateKeyOfType(keyType)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := utils.EncodePrivateKeyToPKCS8PEM(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.WriteKeyToFile(encoded, keyPath); err != nil {
+		return nil, err
+	}
+
+	// this is the one to use in the known_hosts file
+	publicKey, err := utils.MarshalPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.WriteKeyToFile(publicKey, keyPath+".pub"); err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
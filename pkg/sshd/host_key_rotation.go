@@ -0,0 +1,135 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH host key rotation extension. After authentication the server
+// announces all its host keys (current and next ones), the client asks the
+// server to prove it owns the keys it didn't know yet and then
+// updates its known_hosts
+const (
+	hostKeysRequestType      = "hostkeys-00@openssh.com"
+	hostKeysProveRequestType = "hostkeys-prove-00@openssh.com"
+)
+
+// marshalStrings encodes a list of byte slices as a sequence of ssh strings
+func marshalStrings(list [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, item := range list {
+		binary.Write(&buf, binary.BigEndian, uint32(len(item)))
+		buf.Write(item)
+	}
+	return buf.Bytes()
+}
+
+// parseStrings decodes a sequence of ssh strings
+func parseStrings(in []byte) ([][]byte, error) {
+	list := [][]byte{}
+	for len(in) > 0 {
+		if len(in) < 4 {
+			return nil, fmt.Errorf("short string header")
+		}
+		size := binary.BigEndian.Uint32(in)
+		in = in[4:]
+		if uint32(len(in)) < size {
+			return nil, fmt.Errorf("short string")
+		}
+		list = append(list, in[:size])
+		in = in[size:]
+	}
+	return list, nil
+}
+
+// allHostKeys returns the current and next server host keys
+func (s *sshServer) allHostKeys() []ssh.Signer {
+	hostKeys, nextHostKeys := s.currentHostKeys()
+	keys := []ssh.Signer{}
+	keys = append(keys, hostKeys...)
+	keys = append(keys, nextHostKeys...)
+	return keys
+}
+
+// announceHostKeys sends the hostkeys-00 request to the client. It
+// is a no-op if no next keys are configured
+func (cs *clientSession) announceHostKeys() {
+	if _, next := cs.server.currentHostKeys(); len(next) == 0 {
+		return
+	}
+	blobs := [][]byte{}
+	for _, k := range cs.server.allHostKeys() {
+		blobs = append(blobs, k.PublicKey().Marshal())
+	}
+	if _, _, err := cs.sshConn.SendRequest(hostKeysRequestType, false, marshalStrings(blobs)); err != nil {
+		sessionLogger(cs.sshConn).Errorf("unable to announce host keys: %s", err)
+	}
+}
+
+// signatureAlgorithm returns the algorithm to sign with key. It is the
+// key default one, but for the RSA keys, certificates included, where the
+// SHA1 based ssh-rsa is replaced by rsa-sha2-512
+func signatureAlgorithm(key ssh.PublicKey) string {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	if key.Type() == ssh.KeyAlgoRSA {
+		return ssh.KeyAlgoRSASHA512
+	}
+	return key.Type()
+}
+
+// signHostKeyProof signs data with the signer algorithm. The signers not
+// supporting the algorithm choice use their default one
+func signHostKeyProof(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if as, ok := signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand.Reader, data, signatureAlgorithm(signer.PublicKey()))
+	}
+	return signer.Sign(rand.Reader, data)
+}
+
+// hostKeysProveHandler replies to the client hostkeys-prove-00 request with
+// a signature for every requested key
+func (r *requestHandler) hostKeysProveHandler(req *ssh.Request) {
+	blobs, err := parseStrings(req.Payload)
+	if err != nil {
+		r.log.Printf("invalid %s payload: %s", hostKeysProveRequestType, err)
+		req.Reply(false, nil)
+		return
+	}
+
+	signers := map[string]ssh.Signer{}
+	for _, k := range r.server.allHostKeys() {
+		signers[string(k.PublicKey().Marshal())] = k
+	}
+
+	signatures := [][]byte{}
+	for _, blob := range blobs {
+		signer, ok := signers[string(blob)]
+		if !ok {
+			r.log.Printf("%s: unknown host key requested", hostKeysProveRequestType)
+			req.Reply(false, nil)
+			return
+		}
+		data := ssh.Marshal(struct {
+			RequestType string
+			SessionID   []byte
+			HostKey     []byte
+		}{
+			hostKeysProveRequestType, r.sshConn.SessionID(), blob,
+		})
+
+		sig, err := signHostKeyProof(signer, data)
+		if err != nil {
+			r.log.Errorf("%s: unable to sign: %s", hostKeysProveRequestType, err)
+			req.Reply(false, nil)
+			return
+		}
+		signatures = append(signatures, ssh.Marshal(sig))
+	}
+	req.Reply(true, marshalStrings(signatures))
+}
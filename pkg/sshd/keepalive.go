@@ -0,0 +1,59 @@
+package sshd
+
+import "time"
+
+const (
+	keepAliveRequestType = "keepalive@openssh.com"
+
+	// defaults for the client_alive_interval (seconds) and
+	// client_alive_count_max options
+	defaultClientAliveInterval = 15
+	defaultClientAliveCountMax = 3
+)
+
+// keepAlive periodically sends keepalive requests to the client. If the client
+// misses clientAliveCountMax consecutive replies it is considered dead and the
+// connection is closed, so that its reverse tunnels listeners are released.
+// It returns when done is closed or the connection fails
+func (cs *clientSession) keepAlive(done <-chan struct{}) {
+	interval := cs.server.clientAliveInterval
+	if interval <= 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+
+		// any reply, even a failure one, means the client is alive
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := cs.sshConn.SendRequest(keepAliveRequestType, true, nil)
+			reply <- err
+		}()
+
+		missed := 0
+	wait:
+		for {
+			select {
+			case <-done:
+				return
+			case err := <-reply:
+				if err != nil {
+					return
+				}
+				break wait
+			case <-time.After(interval):
+				missed++
+				if missed >= cs.server.clientAliveCountMax {
+					sessionLogger(cs.sshConn).Warnf("client %s is not responding, closing connection", cs.RemoteAddr())
+					cs.Close()
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// how long a rejected client has to read the rejection reason
+	rejectTimeout = 10 * time.Second
+	// max concurrent rejections. The connections exceeding it are
+	// closed without a reason
+	maxRejections = 16
+	// the default login_grace_time, in seconds
+	defaultLoginGraceTime = 120
+)
+
+// acquireChannel accounts for a new channel of type t. It returns false
+// and the reason if the channel would exceed the server limits
+func (s *channelHandler) acquireChannel(t string) (string, bool) {
+	s.countersMu.Lock()
+	defer s.countersMu.Unlock()
+
+	if s.server.maxChannels > 0 && s.openChannels >= s.server.maxChannels {
+		return fmt.Sprintf("too many open channels (max %d)", s.server.maxChannels), false
+	}
+	if t == "session" {
+		if s.server.maxSessions > 0 && s.openSessions >= s.server.maxSessions {
+			return fmt.Sprintf("too many open sessions (max %d)", s.server.maxSessions), false
+		}
+		s.openSessions++
+	}
+	s.openChannels++
+	return "", true
+}
+
+// releaseChannel accounts for a closed channel of type t
+func (s *channelHandler) releaseChannel(t string) {
+	s.countersMu.Lock()
+	defer s.countersMu.Unlock()
+
+	if t == "session" {
+		s.openSessions--
+	}
+	s.openChannels--
+}
+
+// reserveConnection accounts for an accepted connection, before its
+// handshake, so that the concurrent connections can't exceed the server
+// limit. It returns an error if the limit is reached
+func (s *sshServer) reserveConnection() error {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if s.maxConnections > 0 && s.connections >= s.maxConnections {
+		return fmt.Errorf("too many connections (max %d)", s.maxConnections)
+	}
+	s.connections++
+	return nil
+}
+
+// releaseConnection accounts for a closed connection
+func (s *sshServer) releaseConnection() {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	s.connections--
+}
+
+// reserveUserConnection accounts for an authenticated connection of user.
+// It returns an error if the per user connections limit is reached
+func (s *sshServer) reserveUserConnection(user string) error {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if s.maxConnectionsPerUser > 0 && s.userConnections[user] >= s.maxConnectionsPerUser {
+		return fmt.Errorf("too many connections for user %s (max %d)", user, s.maxConnectionsPerUser)
+	}
+	s.userConnections[user]++
+	return nil
+}
+
+// releaseUserConnection accounts for a closed connection of user
+func (s *sshServer) releaseUserConnection(user string) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	s.userConnections[user]--
+	if s.userConnections[user] <= 0 {
+		delete(s.userConnections, user)
+	}
+}
+
+// rejectConnection refuses conn telling the client why. The x/crypto ssh
+// server can only send a disconnect message on the authentication
+// failures: the reason is sent as the authentication banner, shown by
+// the clients, and the only authentication try fails
+func (s *sshServer) rejectConnection(conn net.Conn, reason string) {
+	defer s.connectionsWG.Done()
+	defer conn.Close()
+
+	// the rejections are bounded, as the handshakes are expensive
+	select {
+	case s.rejections <- struct{}{}:
+		defer func() { <-s.rejections }()
+	default:
+		return
+	}
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+
+	config := &ssh.ServerConfig{
+		ServerVersion: s.serverVersion,
+		MaxAuthTries:  1,
+		BannerCallback: func(conn ssh.ConnMetadata) string {
+			return fmt.Sprintf("rospo: %s\n", reason)
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, errors.New(reason)
+		},
+	}
+	hostKeys, _ := s.currentHostKeys()
+	for _, key := range hostKeys {
+		config.AddHostKey(key)
+	}
+	ssh.NewServerConn(conn, config)
+}
@@ -0,0 +1,37 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/ferama/rospo/pkg/systemd"
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// listen creates the network listener described by the conf. A socket
+// passed by systemd, named sshd or listening on the same address, is
+// used in place of a new one. The address can have the tcp:// or the
+// unix:// scheme, like "unix:///run/rospo.sock"
+func (lc *ListenerConf) listen() (net.Listener, error) {
+	scheme, addr := utils.SplitScheme(lc.Address)
+	if lc.SocketPath != "" {
+		scheme, addr = utils.SCHEME_UNIX, lc.SocketPath
+	}
+	switch scheme {
+	case "", utils.SCHEME_TCP, utils.SCHEME_UNIX:
+	default:
+		return nil, fmt.Errorf("the sshd can't listen on the %s address %s", scheme, lc.Address)
+	}
+	if l, err := systemd.Listener("sshd", addr); l != nil || err != nil {
+		return l, err
+	}
+	if scheme != utils.SCHEME_UNIX {
+		return net.Listen("tcp", addr)
+	}
+
+	perm, err := utils.ParseSocketPermissions(lc.SocketPermissions)
+	if err != nil {
+		return nil, err
+	}
+	return utils.ListenUnix(addr, perm)
+}
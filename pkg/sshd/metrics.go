@@ -0,0 +1,210 @@
+package sshd
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Stats is a snapshot of the server runtime metrics
+type Stats struct {
+	// connected clients
+	ActiveConnections int `json:"active_connections"`
+	// open session channels (shell, exec, sftp)
+	ActiveSessions int64 `json:"active_sessions"`
+	// active reverse forwards (tcpip-forward and streamlocal-forward)
+	OpenForwards  int   `json:"open_forwards"`
+	AuthSuccesses int64 `json:"auth_successes"`
+	AuthFailures  int64 `json:"auth_failures"`
+	// channels metrics by channel type
+	Channels map[string]ChannelStats `json:"channels"`
+}
+
+// SessionInfo describes a connected client
+type SessionInfo struct {
+	ID            int       `json:"id"`
+	User          string    `json:"user"`
+	RemoteAddr    string    `json:"remote_addr"`
+	ClientVersion string    `json:"client_version"`
+	Since         time.Time `json:"since"`
+	// active reverse forwards of the client
+	Forwards int `json:"forwards"`
+}
+
+// ChannelStats holds the metrics of the channels of a type. BytesIn is the
+// data received from the clients, BytesOut the data sent to them
+type ChannelStats struct {
+	Open     int64 `json:"open"`
+	Total    int64 `json:"total"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+type channelMetrics struct {
+	open     atomic.Int64
+	total    atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// serverMetrics collects the server counters
+type serverMetrics struct {
+	authSuccesses atomic.Int64
+	authFailures  atomic.Int64
+
+	channels   map[string]*channelMetrics
+	channelsMu sync.Mutex
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		channels: make(map[string]*channelMetrics),
+	}
+}
+
+func (m *serverMetrics) channel(t string) *channelMetrics {
+	m.channelsMu.Lock()
+	defer m.channelsMu.Unlock()
+
+	cm, ok := m.channels[t]
+	if !ok {
+		cm = &channelMetrics{}
+		m.channels[t] = cm
+	}
+	return cm
+}
+
+// countAuth accounts for an authentication attempt
+func (m *serverMetrics) countAuth(success bool) {
+	if success {
+		m.authSuccesses.Add(1)
+	} else {
+		m.authFailures.Add(1)
+	}
+}
+
+// countedChannel is an ssh.Channel counting the transferred bytes
+type countedChannel struct {
+	ssh.Channel
+	metrics *channelMetrics
+}
+
+func (c *countedChannel) Read(b []byte) (int, error) {
+	n, err := c.Channel.Read(b)
+	c.metrics.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *countedChannel) Write(b []byte) (int, error) {
+	n, err := c.Channel.Write(b)
+	c.metrics.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (c *countedChannel) Stderr() io.ReadWriter {
+	return &countedStderr{c.Channel.Stderr(), c.metrics}
+}
+
+type countedStderr struct {
+	io.ReadWriter
+	metrics *channelMetrics
+}
+
+func (c *countedStderr) Write(b []byte) (int, error) {
+	n, err := c.ReadWriter.Write(b)
+	c.metrics.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// openChannel wraps ch, opened or accepted channel of type t, and
+// accounts it as open. The returned func must be called when the
+// channel is closed
+func (m *serverMetrics) openChannel(t string, ch ssh.Channel) (ssh.Channel, func()) {
+	cm := m.channel(t)
+	cm.open.Add(1)
+	cm.total.Add(1)
+	var once sync.Once
+	return &countedChannel{ch, cm}, func() {
+		once.Do(func() {
+			cm.open.Add(-1)
+		})
+	}
+}
+
+// countedNewChannel wraps an incoming channel request, so that the
+// channel is accounted and metered once accepted
+type countedNewChannel struct {
+	ssh.NewChannel
+	metrics *serverMetrics
+	meter   *trafficMeter
+	closed  func()
+}
+
+func (c *countedNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		return ch, reqs, err
+	}
+	ch, c.closed = c.metrics.openChannel(c.ChannelType(), ch)
+	return c.meter.channel(ch), reqs, nil
+}
+
+// done must be called when the channel handler returns
+func (c *countedNewChannel) done() {
+	if c.closed != nil {
+		c.closed()
+	}
+}
+
+// Stats returns a snapshot of the server runtime metrics
+func (s *sshServer) Stats() Stats {
+	stats := Stats{
+		AuthSuccesses: s.metrics.authSuccesses.Load(),
+		AuthFailures:  s.metrics.authFailures.Load(),
+		Channels:      make(map[string]ChannelStats),
+	}
+
+	s.sessionsMu.Lock()
+	stats.ActiveConnections = len(s.sessions)
+	for _, cs := range s.sessions {
+		stats.OpenForwards += cs.requestHandler.forwardsCount()
+	}
+	s.sessionsMu.Unlock()
+
+	s.metrics.channelsMu.Lock()
+	for t, cm := range s.metrics.channels {
+		stats.Channels[t] = ChannelStats{
+			Open:     cm.open.Load(),
+			Total:    cm.total.Load(),
+			BytesIn:  cm.bytesIn.Load(),
+			BytesOut: cm.bytesOut.Load(),
+		}
+	}
+	s.metrics.channelsMu.Unlock()
+	stats.ActiveSessions = stats.Channels["session"].Open
+
+	return stats
+}
+
+// Sessions returns the connected clients, sorted by id
+func (s *sshServer) Sessions() []SessionInfo {
+	s.sessionsMu.Lock()
+	res := []SessionInfo{}
+	for _, cs := range s.sessions {
+		res = append(res, SessionInfo{
+			ID:            cs.id,
+			User:          cs.sshConn.User(),
+			RemoteAddr:    cs.sshConn.RemoteAddr().String(),
+			ClientVersion: string(cs.sshConn.ClientVersion()),
+			Since:         cs.startTime,
+			Forwards:      cs.requestHandler.forwardsCount(),
+		})
+	}
+	s.sessionsMu.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
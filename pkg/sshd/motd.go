@@ -0,0 +1,105 @@
+package sshd
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultBanner = `
+ .---------------.
+ | 🐸 rospo sshd |
+ .---------------.
+
+`
+
+// lastLogin holds the details of a user previous login
+type lastLogin struct {
+	Time       time.Time
+	RemoteAddr string
+}
+
+// motdData holds the variables available to the motd template
+type motdData struct {
+	Hostname   string
+	User       string
+	RemoteAddr string
+	Time       time.Time
+	// empty if this is the user first login since the server start
+	LastLogin     string
+	LastLoginFrom string
+}
+
+// banner returns the text displayed to clients before the authentication
+func (s *sshServer) banner() string {
+	if s.bannerFile != "" {
+		data, err := os.ReadFile(s.bannerFile)
+		if err != nil {
+			log.Errorf("failed to read banner_file: %s", err)
+			return ""
+		}
+		return string(data)
+	}
+	return s.bannerText
+}
+
+// recordLogin stores the user login and returns its previous one, if any
+func (s *sshServer) recordLogin(sshConn *ssh.ServerConn) *lastLogin {
+	s.lastLoginsMu.Lock()
+	defer s.lastLoginsMu.Unlock()
+
+	prev := s.lastLogins[sshConn.User()]
+	s.lastLogins[sshConn.User()] = &lastLogin{
+		Time:       time.Now(),
+		RemoteAddr: sshConn.RemoteAddr().String(),
+	}
+	return prev
+}
+
+// motd renders the message of the day displayed to the user after
+// the login. It returns an empty string if no motd is configured
+func (s *sshServer) motd(sshConn *ssh.ServerConn, prev *lastLogin) string {
+	text := s.motdText
+	if s.motdFile != "" {
+		data, err := os.ReadFile(s.motdFile)
+		if err != nil {
+			log.Errorf("failed to read motd_file: %s", err)
+			return ""
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return ""
+	}
+
+	tpl, err := template.New("motd").Parse(text)
+	if err != nil {
+		log.Printf("invalid motd template: %s", err)
+		return text
+	}
+	hostname, _ := os.Hostname()
+	data := motdData{
+		Hostname:   hostname,
+		User:       sshConn.User(),
+		RemoteAddr: sshConn.RemoteAddr().String(),
+		Time:       time.Now(),
+	}
+	if prev != nil {
+		data.LastLogin = prev.Time.Format(time.ANSIC)
+		data.LastLoginFrom = prev.RemoteAddr
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		log.Errorf("failed to render motd: %s", err)
+		return text
+	}
+	out := buf.String()
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	return out
+}
@@ -0,0 +1,194 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errCommandNotAllowed = errors.New("command not allowed")
+
+// policy holds the features a client connection is allowed to use
+type policy struct {
+	localForwarding  bool
+	remoteForwarding bool
+	session          bool
+	shell            bool
+	sftp             bool
+	sftpReadOnly     bool
+
+	// if not empty, the sftp clients are confined in these paths
+	sftpAllowedPaths []string
+
+	// if set, executed in place of the requested commands
+	forceCommand string
+	// if not empty, the exec requests must match one of these
+	allowedCommands []*regexp.Regexp
+	// if not empty, only these git and rsync invocations are allowed
+	restrictedCommands []string
+	// if set, overrides the shell the sessions run into
+	loginShell string
+	// additional session environment variables
+	env map[string]string
+}
+
+// compileCommandPatterns compiles the allowed_commands patterns. The
+// patterns are anchored, so they must match the whole command
+func compileCommandPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := []*regexp.Regexp{}
+	for _, p := range patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed_commands pattern '%s': %s", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// command returns the command to run for a shell (empty requested)
+// or exec request. It returns an error if the request is not allowed
+func (p *policy) command(requested string) (string, error) {
+	if p.forceCommand != "" {
+		return p.forceCommand, nil
+	}
+	if len(p.allowedCommands) == 0 {
+		return requested, nil
+	}
+	if requested == "" {
+		return "", errCommandNotAllowed
+	}
+	for _, re := range p.allowedCommands {
+		if re.MatchString(requested) {
+			return requested, nil
+		}
+	}
+	return "", errCommandNotAllowed
+}
+
+// matches returns true if the policy conf applies to the user
+// authenticated with the key identified by fingerprint
+func (p *PolicyConf) matches(user string, fingerprint string) bool {
+	if p.User != "" && p.User != user {
+		return false
+	}
+	if p.KeyFingerprint != "" && p.KeyFingerprint != fingerprint {
+		return false
+	}
+	return true
+}
+
+// getPolicy computes the policy for a connection authenticated through the
+// listener configured by lc. The server wide settings are applied first,
+// then the listener, the virtual user and every matching policy conf, in
+// order. The disable flags and sftp_read_only can only restrict the
+// previous settings. force_command, shell, allowed_commands,
+// restricted_commands and sftp_allowed_paths instead replace the previous
+// values when set, so they can loosen them too. The env variables are
+// merged, the last setting wins
+func (s *sshServer) getPolicy(sshConn *ssh.ServerConn, lc *ListenerConf) *policy {
+	p := &policy{
+		localForwarding:  !s.disableTunnelling,
+		remoteForwarding: !s.disableTunnelling,
+		session:          !s.disableSession,
+		shell:            !s.disableShell,
+		sftp:             !s.disableSftpSubsystem,
+		sftpReadOnly:     s.sftpReadOnly,
+		sftpAllowedPaths: s.sftpAllowedPaths,
+
+		forceCommand:       s.forceCommand,
+		allowedCommands:    s.allowedCommands,
+		restrictedCommands: s.restrictedCommands,
+		env:                map[string]string{},
+	}
+	for k, v := range s.env {
+		p.env[k] = v
+	}
+
+	if lc.DisableTunnelling {
+		p.localForwarding = false
+		p.remoteForwarding = false
+	}
+	if lc.DisableShell {
+		p.shell = false
+	}
+
+	if u, ok := s.users[sshConn.User()]; ok {
+		if u.DisableTunnelling {
+			p.localForwarding = false
+			p.remoteForwarding = false
+		}
+		if u.DisableShell {
+			p.shell = false
+		}
+		if u.DisableSftpSubsystem {
+			p.sftp = false
+		}
+		if u.SftpReadOnly {
+			p.sftpReadOnly = true
+		}
+		if len(u.SftpAllowedPaths) > 0 {
+			p.sftpAllowedPaths = u.SftpAllowedPaths
+		}
+		if u.ForceCommand != "" {
+			p.forceCommand = u.ForceCommand
+		}
+		if len(u.AllowedCommands) > 0 {
+			// validated on server start
+			p.allowedCommands, _ = compileCommandPatterns(u.AllowedCommands)
+		}
+		if len(u.RestrictedCommands) > 0 {
+			p.restrictedCommands = u.RestrictedCommands
+		}
+		if u.Shell != "" {
+			p.loginShell = u.Shell
+		}
+		for k, v := range u.Env {
+			p.env[k] = v
+		}
+	}
+
+	fingerprint := ""
+	if sshConn.Permissions != nil {
+		fingerprint = sshConn.Permissions.Extensions["pubkey-fp"]
+	}
+	for _, pc := range s.policies {
+		if !pc.matches(sshConn.User(), fingerprint) {
+			continue
+		}
+		if pc.DisableLocalForwarding {
+			p.localForwarding = false
+		}
+		if pc.DisableRemoteForwarding {
+			p.remoteForwarding = false
+		}
+		if pc.DisableSession {
+			p.session = false
+		}
+		if pc.SftpReadOnly {
+			p.sftpReadOnly = true
+		}
+		if len(pc.SftpAllowedPaths) > 0 {
+			p.sftpAllowedPaths = pc.SftpAllowedPaths
+		}
+		if pc.ForceCommand != "" {
+			p.forceCommand = pc.ForceCommand
+		}
+		if len(pc.AllowedCommands) > 0 {
+			// validated on server start
+			p.allowedCommands, _ = compileCommandPatterns(pc.AllowedCommands)
+		}
+		if len(pc.RestrictedCommands) > 0 {
+			p.restrictedCommands = pc.RestrictedCommands
+		}
+		if pc.Shell != "" {
+			p.loginShell = pc.Shell
+		}
+		for k, v := range pc.Env {
+			p.env[k] = v
+		}
+	}
+	return p
+}
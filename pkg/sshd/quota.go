@@ -0,0 +1,177 @@
+package sshd
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ferama/rospo/pkg/rio"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	errSessionQuotaExceeded = errors.New("session transfer quota exceeded")
+	errUserQuotaExceeded    = errors.New("user transfer quota exceeded")
+)
+
+// userUsage tracks the traffic of all the connections of a user
+type userUsage struct {
+	bytes        atomic.Int64
+	readLimiter  *rio.RateLimiter
+	writeLimiter *rio.RateLimiter
+}
+
+// hasTrafficLimits returns true if any rate limit or quota is configured
+func (s *sshServer) hasTrafficLimits() bool {
+	return s.sessionRateLimit > 0 || s.sessionQuota > 0 ||
+		s.userRateLimit > 0 || s.userQuota > 0
+}
+
+// getUserUsage returns the traffic usage of user. The usage is kept
+// for the whole server lifetime, so user quotas span across connections
+func (s *sshServer) getUserUsage(user string) *userUsage {
+	s.userUsagesMu.Lock()
+	defer s.userUsagesMu.Unlock()
+
+	u, ok := s.userUsages[user]
+	if !ok {
+		u = &userUsage{}
+		if s.userRateLimit > 0 {
+			u.readLimiter = rio.NewRateLimiter(s.userRateLimit)
+			u.writeLimiter = rio.NewRateLimiter(s.userRateLimit)
+		}
+		s.userUsages[user] = u
+	}
+	return u
+}
+
+// trafficMeter enforces the rate limits and the transfer quotas on the
+// channels of a client connection. The limits apply to each direction,
+// the quotas to the traffic of both. The ssh protocol overhead is not
+// accounted
+type trafficMeter struct {
+	server  *sshServer
+	sshConn *ssh.ServerConn
+	user    *userUsage
+
+	bytes        atomic.Int64
+	readLimiter  *rio.RateLimiter
+	writeLimiter *rio.RateLimiter
+
+	quotaErr error
+	errOnce  sync.Once
+}
+
+// newTrafficMeter returns the meter of the client connection sshConn. nil
+// if no limit is configured
+func (s *sshServer) newTrafficMeter(sshConn *ssh.ServerConn) *trafficMeter {
+	if !s.hasTrafficLimits() {
+		return nil
+	}
+	m := &trafficMeter{
+		server:  s,
+		sshConn: sshConn,
+		user:    s.getUserUsage(sshConn.User()),
+	}
+	if s.sessionRateLimit > 0 {
+		m.readLimiter = rio.NewRateLimiter(s.sessionRateLimit)
+		m.writeLimiter = rio.NewRateLimiter(s.sessionRateLimit)
+	}
+	return m
+}
+
+// channel returns ch metered. ch as is if the meter is nil
+func (m *trafficMeter) channel(ch ssh.Channel) ssh.Channel {
+	if m == nil {
+		return ch
+	}
+	return &meteredChannel{Channel: ch, meter: m}
+}
+
+// account adds n bytes to the connection and user counters, waiting
+// for the rate limiters. It returns an error if a quota is exceeded
+func (m *trafficMeter) account(n int, read bool) error {
+	if m.server.sessionQuota > 0 && m.bytes.Add(int64(n)) > m.server.sessionQuota {
+		return m.fail(errSessionQuotaExceeded)
+	}
+	if total := m.user.bytes.Add(int64(n)); m.server.userQuota > 0 && total > m.server.userQuota {
+		return m.fail(errUserQuotaExceeded)
+	}
+
+	if read {
+		if m.readLimiter != nil {
+			m.readLimiter.WaitN(n)
+		}
+		if m.user.readLimiter != nil {
+			m.user.readLimiter.WaitN(n)
+		}
+	} else {
+		if m.writeLimiter != nil {
+			m.writeLimiter.WaitN(n)
+		}
+		if m.user.writeLimiter != nil {
+			m.user.writeLimiter.WaitN(n)
+		}
+	}
+	return nil
+}
+
+// fail closes the connection because of the quota error err
+func (m *trafficMeter) fail(err error) error {
+	m.errOnce.Do(func() {
+		sessionLogger(m.sshConn).Printf("closing connection: %s", err)
+		m.quotaErr = err
+		m.sshConn.Close()
+	})
+	return m.quotaErr
+}
+
+// meteredChannel is an ssh.Channel accounted by a trafficMeter
+type meteredChannel struct {
+	ssh.Channel
+	meter *trafficMeter
+}
+
+func (c *meteredChannel) Read(b []byte) (int, error) {
+	n, err := c.Channel.Read(b)
+	if n > 0 {
+		if qerr := c.meter.account(n, true); qerr != nil {
+			return n, qerr
+		}
+	}
+	return n, err
+}
+
+func (c *meteredChannel) Write(b []byte) (int, error) {
+	if err := c.meter.account(len(b), false); err != nil {
+		return 0, err
+	}
+	return c.Channel.Write(b)
+}
+
+func (c *meteredChannel) Stderr() io.ReadWriter {
+	return &meteredStderr{c.Channel.Stderr(), c.meter}
+}
+
+type meteredStderr struct {
+	io.ReadWriter
+	meter *trafficMeter
+}
+
+func (c *meteredStderr) Read(b []byte) (int, error) {
+	n, err := c.ReadWriter.Read(b)
+	if n > 0 {
+		if qerr := c.meter.account(n, true); qerr != nil {
+			return n, qerr
+		}
+	}
+	return n, err
+}
+
+func (c *meteredStderr) Write(b []byte) (int, error) {
+	if err := c.meter.account(len(b), false); err != nil {
+		return 0, err
+	}
+	return c.ReadWriter.Write(b)
+}
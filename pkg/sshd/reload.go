@@ -0,0 +1,62 @@
+package sshd
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ReloadKeys applies the key settings of conf to the running server: the
+// host keys, the authorized_keys sources and the trusted user CA keys.
+// They are used by the new connections, the established ones are not
+// affected. The other settings need a restart
+func (s *sshServer) ReloadKeys(conf *SshDConf) error {
+	keyPaths := []string{}
+	if conf.Key != "" {
+		keyPaths = append(keyPaths, conf.Key)
+	}
+	keyPaths = append(keyPaths, conf.Keys...)
+	if len(keyPaths) == 0 {
+		return errors.New("server_key is not set")
+	}
+	hostKeys, err := loadHostKeys(keyPaths)
+	if err != nil {
+		return err
+	}
+	nextHostKeys, err := loadHostKeys(conf.NextKeys)
+	if err != nil {
+		return err
+	}
+
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	s.hostKeys = hostKeys
+	s.nextHostKeys = nextHostKeys
+	s.authorizedKeysURI = conf.AuthorizedKeysURI
+	s.trustedUserCAKeys = conf.TrustedUserCAKeys
+	s.authorizedPrincipalsFile = conf.AuthorizedPrincipalsFile
+	log.Printf("keys reloaded. authorized_keys: %s", conf.AuthorizedKeysURI)
+	return nil
+}
+
+// currentHostKeys returns the host keys and the next host keys
+func (s *sshServer) currentHostKeys() ([]ssh.Signer, []ssh.Signer) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	return s.hostKeys, s.nextHostKeys
+}
+
+// authorizedKeysSources returns the authorized_keys sources
+func (s *sshServer) authorizedKeysSources() []string {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	return s.authorizedKeysURI
+}
+
+// trustedCAKeys returns the trusted user CA keys sources and the
+// authorized principals file
+func (s *sshServer) trustedCAKeys() ([]string, string) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	return s.trustedUserCAKeys, s.authorizedPrincipalsFile
+}
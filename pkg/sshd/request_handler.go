@@ -1,35 +1,55 @@
 package sshd
 
 import (
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
+	"os/user"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/utils"
 	"golang.org/x/crypto/ssh"
 )
 
+var (
+	errUnknownForward     = errors.New("unknown forward")
+	errForwardingDisabled = errors.New("forwarding is disabled")
+	errSocketPathDenied   = errors.New("socket path not allowed")
+)
+
 type requestHandler struct {
 	server  *sshServer
 	sshConn *ssh.ServerConn
+	policy  *policy
 
 	reqs <-chan *ssh.Request
 
-	forwards   map[string]net.Listener
+	forwards map[string]net.Listener
+	// the forwards ids in the server forwards registry
+	forwardIDs map[string]int
 	forwardsMu sync.Mutex
 
 	forwardsKeepAliveInterval time.Duration
+	// nil if the traffic is not limited
+	meter *trafficMeter
+
+	log *logger.Logger
 }
 
-func newRequestHandler(server *sshServer, sshConn *ssh.ServerConn, reqs <-chan *ssh.Request) *requestHandler {
+func newRequestHandler(server *sshServer, sshConn *ssh.ServerConn, policy *policy, reqs <-chan *ssh.Request) *requestHandler {
 	return &requestHandler{
 		server:                    server,
 		sshConn:                   sshConn,
+		policy:                    policy,
 		reqs:                      reqs,
 		forwards:                  make(map[string]net.Listener),
+		forwardIDs:                make(map[string]int),
 		forwardsKeepAliveInterval: 5 * time.Second,
+		log:                       sessionLogger(sshConn),
 	}
 }
 
@@ -39,17 +59,33 @@ func (r *requestHandler) tcpipForwardHandler(req *ssh.Request) {
 		Port uint32
 	}{}
 	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
-		log.Printf("Unable to unmarshal payload")
+		r.log.Errorf("Unable to unmarshal payload")
 		req.Reply(false, []byte{})
 		return
 	}
 	laddr := payload.Addr
 	lport := payload.Port
 	addr := fmt.Sprintf("[%s]:%d", laddr, lport)
+	bindAddr := fmt.Sprintf("[%s]:%d", r.forwardBindHost(laddr), lport)
+
+	// a virtual host can be served by one forward only
+	if v := r.server.vhosts; v != nil {
+		if host := v.hostname(laddr); host != "" {
+			v.claimMu.Lock()
+			defer v.claimMu.Unlock()
+			if _, ok := v.forward(host); ok {
+				r.log.Warnf("tcpip-forward rejected for %s: %s", addr, errVhostInUse)
+				r.auditForward(req, addr, errVhostInUse)
+				req.Reply(false, []byte{})
+				return
+			}
+		}
+	}
 
-	listener, err := net.Listen("tcp", addr)
+	listener, err := net.Listen("tcp", bindAddr)
 	if err != nil {
-		log.Printf("listen failed for %s %s", addr, err)
+		r.log.Errorf("listen failed for %s %s", addr, err)
+		r.auditForward(req, addr, err)
 		req.Reply(false, []byte{})
 		return
 	}
@@ -58,34 +94,77 @@ func (r *requestHandler) tcpipForwardHandler(req *ssh.Request) {
 	// and use that as lport var. The lport value will be sent as reply
 	// to the client
 	if lport == 0 {
-		_, port, err := net.SplitHostPort(listener.Addr().String())
-		if err != nil {
-			panic(err)
-		}
-		u64, err := strconv.ParseUint(port, 10, 32)
-		if err != nil {
-			panic(err)
-		}
-		lport = uint32(u64)
+		lport = uint32(listener.Addr().(*net.TCPAddr).Port)
 		// fix the addr value too
 		addr = fmt.Sprintf("[%s]:%d", laddr, lport)
 	}
-	log.Printf("tcpip-forward listening for %s", addr)
+	r.log.Printf("tcpip-forward listening for %s on %s", addr, listener.Addr())
+	r.auditForward(req, addr, nil)
 	var replyPayload = struct{ Port uint32 }{lport}
 
+	// register the forward before replying, so that a cancel request
+	// following the reply always finds it
+	r.addForward(addr, listener, &ForwardInfo{
+		Name:     laddr,
+		Type:     req.Type,
+		BindAddr: listener.Addr().String(),
+		Port:     lport,
+	})
+
 	// Tell client everything is OK
 	req.Reply(true, ssh.Marshal(replyPayload))
 
 	// handle session
-	forwardSessionHandler := newSessionHandler(r.sshConn, listener, laddr, lport)
+	forwardSessionHandler := newSessionHandler(r.server, r.sshConn, listener, laddr, lport, "")
+	forwardSessionHandler.meter = r.meter
 	go forwardSessionHandler.handleSession()
 
 	// run checkAlive
 	go r.checkAlive(r.sshConn, listener, addr)
+}
 
-	r.forwardsMu.Lock()
-	r.forwards[addr] = listener
-	r.forwardsMu.Unlock()
+// addrInUseHandler tells the client if the tcpip-forward address in
+// the payload is busy, so that it can choose to use a fallback port
+func (r *requestHandler) addrInUseHandler(req *ssh.Request) {
+	var payload = struct {
+		Addr string
+		Port uint32
+	}{}
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Port == 0 {
+		req.Reply(false, nil)
+		return
+	}
+	bindAddr := fmt.Sprintf("[%s]:%d", r.forwardBindHost(payload.Addr), payload.Port)
+	inUse := false
+	listener, err := net.Listen("tcp", bindAddr)
+	if err == nil {
+		listener.Close()
+	} else {
+		inUse = utils.IsAddrInUse(err)
+	}
+	req.Reply(true, ssh.Marshal(struct{ InUse bool }{inUse}))
+}
+
+// forwardBindHost returns the host the tcpip-forward listener should be
+// bound to, given the address requested by the client and the server
+// gateway_ports policy
+func (r *requestHandler) forwardBindHost(requested string) string {
+	switch r.server.gatewayPorts {
+	case GATEWAY_PORTS_NO:
+		return "localhost"
+	case GATEWAY_PORTS_YES:
+		return ""
+	}
+	// clientspecified. The virtual host names are not bindable
+	// addresses: they are served by the http front-end only
+	if r.server.vhosts != nil && r.server.vhosts.hostname(requested) != "" {
+		return "localhost"
+	}
+	switch requested {
+	case "", "*", "0.0.0.0", "::":
+		return ""
+	}
+	return requested
 }
 
 func (r *requestHandler) cancelTcpIpForwardHandler(req *ssh.Request) {
@@ -94,62 +173,271 @@ func (r *requestHandler) cancelTcpIpForwardHandler(req *ssh.Request) {
 		Port uint32
 	}{}
 	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
-		log.Printf("Unable to unmarshal payload")
+		r.log.Errorf("Unable to unmarshal payload")
 		req.Reply(false, []byte{})
 		return
 	}
-	// TODO: what happens here if the original port was 0 (random port)?
+	// if a random port was requested, the client cancels the forward
+	// using the port allocated by the server, that is the one
+	// the forward is registered with
 	laddr := payload.Addr
 	lport := payload.Port
 	addr := fmt.Sprintf("[%s]:%d", laddr, lport)
+	ln, ok := r.removeForward(addr)
+	if ok {
+		r.log.Printf("tcpip-forward canceled for %s", addr)
+		ln.Close()
+		r.auditForward(req, addr, nil)
+	} else {
+		r.auditForward(req, addr, errUnknownForward)
+	}
+	req.Reply(ok, nil)
+}
+
+// auditForward records a forward request in the audit log. err is
+// nil if the request succeeded
+func (r *requestHandler) auditForward(req *ssh.Request, addr string, err error) {
+	r.server.audit(r.sshConn, &auditRecord{
+		Event:   auditForward,
+		Command: req.Type,
+		Address: addr,
+		Success: err == nil,
+		Error:   errString(err),
+	})
+}
+
+// addForward registers the forward listener ln with key, publishing
+// it in the server forwards registry
+func (r *requestHandler) addForward(key string, ln net.Listener, info *ForwardInfo) {
+	info.User = r.sshConn.User()
+	info.ClientAddr = r.sshConn.RemoteAddr().String()
+	if r.sshConn.Permissions != nil {
+		info.KeyFingerprint = r.sshConn.Permissions.Extensions["pubkey-fp"]
+	}
+	info.CreatedAt = time.Now()
+
 	r.forwardsMu.Lock()
-	ln, ok := r.forwards[addr]
-	r.forwardsMu.Unlock()
+	defer r.forwardsMu.Unlock()
+
+	r.forwards[key] = ln
+	r.forwardIDs[key] = r.server.forwardsRegistry.Add(info)
+}
+
+// removeForward unregisters the forward listener identified by key. It returns
+// the listener and true if it was registered
+func (r *requestHandler) removeForward(key string) (net.Listener, bool) {
+	r.forwardsMu.Lock()
+	defer r.forwardsMu.Unlock()
+
+	ln, ok := r.forwards[key]
 	if ok {
+		r.server.forwardsRegistry.Delete(r.forwardIDs[key])
+	}
+	delete(r.forwards, key)
+	delete(r.forwardIDs, key)
+	return ln, ok
+}
+
+// forwardsCount returns the number of active forwards
+func (r *requestHandler) forwardsCount() int {
+	r.forwardsMu.Lock()
+	defer r.forwardsMu.Unlock()
+
+	return len(r.forwards)
+}
+
+// hasForward returns true if the forward identified by key is still registered
+func (r *requestHandler) hasForward(key string) bool {
+	r.forwardsMu.Lock()
+	defer r.forwardsMu.Unlock()
+
+	_, ok := r.forwards[key]
+	return ok
+}
+
+// closeForwards closes all the active forward listeners. It is
+// called when the client connection terminates
+func (r *requestHandler) closeForwards() {
+	r.forwardsMu.Lock()
+	defer r.forwardsMu.Unlock()
+
+	for key, ln := range r.forwards {
+		r.log.Printf("closing forward listener %s", key)
 		ln.Close()
+		r.server.forwardsRegistry.Delete(r.forwardIDs[key])
+		delete(r.forwards, key)
+		delete(r.forwardIDs, key)
 	}
+}
+
+// streamLocalPath returns where the socket requested by a streamlocal
+// forward is created: inside the configured directory or the user home,
+// even through symlinks. Relative paths start from that directory
+func (r *requestHandler) streamLocalPath(path string) (string, error) {
+	dir := r.server.streamLocalForwardDir
+	if dir == "" {
+		if vu, ok := r.server.users[r.sshConn.User()]; ok && vu.Home != "" {
+			dir = vu.Home
+		} else if usr, err := user.Current(); err == nil {
+			dir = usr.HomeDir
+		}
+	}
+	if dir == "" {
+		return "", errSocketPathDenied
+	}
+	dir = filepath.Clean(dir)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	// the socket itself doesn't exist yet, its directory must
+	resolved := filepath.Join(resolvePath(filepath.Dir(path)), filepath.Base(path))
+	if path == dir || !isPathInside(path, []string{dir}) ||
+		!isPathInside(resolved, []string{resolvePath(dir)}) {
+		return "", errSocketPathDenied
+	}
+	return path, nil
+}
+
+func (r *requestHandler) streamLocalForwardHandler(req *ssh.Request) {
+	var payload = struct {
+		SocketPath string
+	}{}
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		r.log.Errorf("Unable to unmarshal payload")
+		req.Reply(false, []byte{})
+		return
+	}
+	// the forward is known to the client by the path it requested
+	socketPath := payload.SocketPath
+
+	// like the OpenSSH StreamLocalBindMask default, only the server
+	// user can connect to the socket
+	listenPath, err := r.streamLocalPath(socketPath)
+	var listener net.Listener
+	if err == nil {
+		listener, err = utils.ListenUnix(listenPath, 0600)
+	}
+	r.auditForward(req, socketPath, err)
+	if err != nil {
+		r.log.Errorf("listen failed for %s %s", socketPath, err)
+		req.Reply(false, []byte{})
+		return
+	}
+	r.log.Printf("streamlocal-forward listening for %s at %s", socketPath, listenPath)
+
+	r.addForward(socketPath, listener, &ForwardInfo{
+		Name:     socketPath,
+		Type:     req.Type,
+		BindAddr: listenPath,
+	})
+
+	// Tell client everything is OK
 	req.Reply(true, nil)
+
+	// handle session
+	forwardSessionHandler := newSessionHandler(r.server, r.sshConn, listener, "", 0, socketPath)
+	forwardSessionHandler.meter = r.meter
+	go forwardSessionHandler.handleSession()
+
+	// run checkAlive
+	go r.checkAlive(r.sshConn, listener, socketPath)
+}
+
+func (r *requestHandler) cancelStreamLocalForwardHandler(req *ssh.Request) {
+	var payload = struct {
+		SocketPath string
+	}{}
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		r.log.Errorf("Unable to unmarshal payload")
+		req.Reply(false, []byte{})
+		return
+	}
+	ln, ok := r.removeForward(payload.SocketPath)
+	if ok {
+		// closing a unix listener removes the socket file too
+		ln.Close()
+		r.auditForward(req, payload.SocketPath, nil)
+	} else {
+		r.auditForward(req, payload.SocketPath, errUnknownForward)
+	}
+	req.Reply(ok, nil)
 }
 
 func (r *requestHandler) handleRequests() {
 	for req := range r.reqs {
 		switch req.Type {
 		case "tcpip-forward":
-			if r.server.disableTunnelling {
+			if !r.policy.remoteForwarding {
+				r.auditForward(req, "", errForwardingDisabled)
 				req.Reply(false, nil)
 				continue
 			}
 			r.tcpipForwardHandler(req)
 
 		case "cancel-tcpip-forward":
-			if r.server.disableTunnelling {
+			if !r.policy.remoteForwarding {
+				r.auditForward(req, "", errForwardingDisabled)
 				req.Reply(false, nil)
 				continue
 			}
 			r.cancelTcpIpForwardHandler(req)
+
+		case "streamlocal-forward@openssh.com":
+			if !r.policy.remoteForwarding {
+				r.auditForward(req, "", errForwardingDisabled)
+				req.Reply(false, nil)
+				continue
+			}
+			r.streamLocalForwardHandler(req)
+
+		case "cancel-streamlocal-forward@openssh.com":
+			if !r.policy.remoteForwarding {
+				r.auditForward(req, "", errForwardingDisabled)
+				req.Reply(false, nil)
+				continue
+			}
+			r.cancelStreamLocalForwardHandler(req)
+
+		case "addr-in-use@rospo":
+			if !r.policy.remoteForwarding {
+				req.Reply(false, nil)
+				continue
+			}
+			r.addrInUseHandler(req)
+
+		case hostKeysProveRequestType:
+			r.hostKeysProveHandler(req)
+
 		default:
 			if strings.Contains(req.Type, "keepalive") {
 				req.Reply(true, nil)
 				continue
 			}
-			log.Printf("received out-of-band request: %+v", req)
+			r.log.Debugf("received out-of-band request: %+v", req)
 		}
 	}
+	// the requests channel is closed when the client connection
+	// terminates. Release all its forwards
+	r.closeForwards()
 }
 
 func (r *requestHandler) checkAlive(sshConn *ssh.ServerConn, ln net.Listener, addr string) {
 	ticker := time.NewTicker(r.forwardsKeepAliveInterval)
 
-	log.Println("starting check for forward availability")
+	r.log.Println("starting check for forward availability")
+	defer ticker.Stop()
 	for {
 		<-ticker.C
+		// the forward was canceled or the connection was closed
+		if !r.hasForward(addr) {
+			return
+		}
 		_, _, err := sshConn.SendRequest("checkalive@rospo", true, nil)
 		if err != nil {
-			log.Printf("forward endpoint not available anymore. Closing socket %s", ln.Addr())
+			r.log.Warnf("forward endpoint not available anymore. Closing socket %s", ln.Addr())
 			ln.Close()
-			r.forwardsMu.Lock()
-			delete(r.forwards, addr)
-			r.forwardsMu.Unlock()
+			r.removeForward(addr)
 			return
 		}
 	}
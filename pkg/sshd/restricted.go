@@ -0,0 +1,370 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// The restricted_commands allowed values. The matching exec requests
+// are run by the server directly, without a shell
+const (
+	// git-upload-pack, git-receive-pack and git-upload-archive
+	RESTRICTED_GIT = "git"
+	// git-upload-pack and git-upload-archive (fetch and clone only)
+	RESTRICTED_GIT_RO = "git-ro"
+	// rsync --server
+	RESTRICTED_RSYNC = "rsync"
+	// rsync --server --sender (download only)
+	RESTRICTED_RSYNC_RO = "rsync-ro"
+)
+
+var errUnterminatedQuote = errors.New("unterminated quoted string")
+
+// The kinds of the rsync options arguments
+const (
+	rsyncNoArg = iota
+	rsyncArg
+	// a path, confined in the root
+	rsyncPathArg
+)
+
+// the rsync server options allowed, like the rrsync ones. The options
+// not listed, like --log-file or --files-from, are denied, as well as
+// the ones following the symlinks, like --copy-unsafe-links. The options
+// with an argument must be given as --option=value
+var allowedRsyncOptions = map[string]int{
+	"--append":              rsyncNoArg,
+	"--backup-dir":          rsyncPathArg,
+	"--block-size":          rsyncArg,
+	"--bwlimit":             rsyncArg,
+	"--checksum-choice":     rsyncArg,
+	"--checksum-seed":       rsyncArg,
+	"--compare-dest":        rsyncPathArg,
+	"--compress-choice":     rsyncArg,
+	"--compress-level":      rsyncArg,
+	"--copy-dest":           rsyncPathArg,
+	"--debug":               rsyncArg,
+	"--delay-updates":       rsyncNoArg,
+	"--delete":              rsyncNoArg,
+	"--delete-after":        rsyncNoArg,
+	"--delete-before":       rsyncNoArg,
+	"--delete-delay":        rsyncNoArg,
+	"--delete-during":       rsyncNoArg,
+	"--delete-excluded":     rsyncNoArg,
+	"--delete-missing-args": rsyncNoArg,
+	"--existing":            rsyncNoArg,
+	"--fake-super":          rsyncNoArg,
+	"--force":               rsyncNoArg,
+	"--from0":               rsyncNoArg,
+	"--fsync":               rsyncNoArg,
+	"--fuzzy":               rsyncNoArg,
+	"--group":               rsyncNoArg,
+	"--groupmap":            rsyncArg,
+	"--hard-links":          rsyncNoArg,
+	"--iconv":               rsyncArg,
+	"--ignore-errors":       rsyncNoArg,
+	"--ignore-existing":     rsyncNoArg,
+	"--ignore-missing-args": rsyncNoArg,
+	"--ignore-times":        rsyncNoArg,
+	"--info":                rsyncArg,
+	"--inplace":             rsyncNoArg,
+	"--link-dest":           rsyncPathArg,
+	"--links":               rsyncNoArg,
+	"--list-only":           rsyncNoArg,
+	"--log-format":          rsyncArg,
+	"--max-alloc":           rsyncArg,
+	"--max-delete":          rsyncArg,
+	"--max-size":            rsyncArg,
+	"--min-size":            rsyncArg,
+	"--mkpath":              rsyncNoArg,
+	"--modify-window":       rsyncArg,
+	"--munge-links":         rsyncNoArg,
+	"--msgs2stderr":         rsyncNoArg,
+	"--new-compress":        rsyncNoArg,
+	"--no-W":                rsyncNoArg,
+	"--no-implied-dirs":     rsyncNoArg,
+	"--no-msgs2stderr":      rsyncNoArg,
+	"--no-r":                rsyncNoArg,
+	"--no-relative":         rsyncNoArg,
+	"--no-specials":         rsyncNoArg,
+	"--numeric-ids":         rsyncNoArg,
+	"--old-compress":        rsyncNoArg,
+	"--one-file-system":     rsyncNoArg,
+	"--open-noatime":        rsyncNoArg,
+	"--owner":               rsyncNoArg,
+	"--partial":             rsyncNoArg,
+	"--partial-dir":         rsyncPathArg,
+	"--perms":               rsyncNoArg,
+	"--preallocate":         rsyncNoArg,
+	"--recursive":           rsyncNoArg,
+	"--remove-sent-files":   rsyncNoArg,
+	"--remove-source-files": rsyncNoArg,
+	"--safe-links":          rsyncNoArg,
+	"--sender":              rsyncNoArg,
+	"--size-only":           rsyncNoArg,
+	"--skip-compress":       rsyncArg,
+	"--specials":            rsyncNoArg,
+	"--stats":               rsyncNoArg,
+	"--stderr":              rsyncArg,
+	"--suffix":              rsyncArg,
+	"--super":               rsyncNoArg,
+	"--temp-dir":            rsyncPathArg,
+	"--timeout":             rsyncArg,
+	"--times":               rsyncNoArg,
+	"--use-qsort":           rsyncNoArg,
+	"--usermap":             rsyncArg,
+	"--write-devices":       rsyncNoArg,
+}
+
+// the rsync short options allowed, none of them takes an argument. -s is
+// missing, as it sends the arguments on stdin where they can't be
+// checked. -L, -k and -K are missing too, as they follow the symlinks
+// that could point outside the root. The "e" option is handled apart:
+// in server mode, the rest of the argument holds the client capabilities
+const allowedRsyncShortOptions = "0vqcrRbulHpEAXogDtUNOJSnWxdmIyzCi8"
+
+// the rsync options that modify the source files
+var writeRsyncOptions = map[string]bool{
+	"--remove-source-files": true,
+	"--remove-sent-files":   true,
+}
+
+// validateRestrictedCommands checks the restricted_commands values
+func validateRestrictedCommands(kinds []string) error {
+	for _, k := range kinds {
+		switch k {
+		case RESTRICTED_GIT, RESTRICTED_GIT_RO, RESTRICTED_RSYNC, RESTRICTED_RSYNC_RO:
+		default:
+			return fmt.Errorf("invalid restricted_commands value '%s'", k)
+		}
+	}
+	return nil
+}
+
+// splitCommand splits a command line into words the way a POSIX shell
+// does, handling single quotes, double quotes and backslash escapes.
+// Any other shell syntax is kept literally
+func splitCommand(command string) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, errUnterminatedQuote
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(command) && command[i] != '"'; i++ {
+				if command[i] == '\\' && i+1 < len(command) && strings.IndexByte("\"\\$`", command[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(command[i])
+			}
+			if i >= len(command) {
+				return nil, errUnterminatedQuote
+			}
+			inWord = true
+		case c == '\\' && i+1 < len(command):
+			i++
+			word.WriteByte(command[i])
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// restrictPath maps a client requested path inside root. Absolute paths
+// are relative to root and ".." can't go above it. It returns false if
+// the path escapes root through its symlinks, like the sftp_allowed_paths
+func restrictPath(root string, path string) (string, bool) {
+	p := filepath.Join(root, filepath.Clean("/"+path))
+	if !isPathInside(resolvePath(p), []string{resolvePath(root)}) {
+		return "", false
+	}
+	return p, true
+}
+
+// restrictedCommand returns the argv to run for a client command, if
+// it is handled by one of the kinds restricted commands. Paths are
+// confined inside root
+func restrictedCommand(kinds []string, root string, command string) ([]string, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errCommandNotAllowed
+	}
+	for _, kind := range kinds {
+		var argv []string
+		switch kind {
+		case RESTRICTED_GIT, RESTRICTED_GIT_RO:
+			argv = gitCommand(args, root, kind == RESTRICTED_GIT_RO)
+		case RESTRICTED_RSYNC, RESTRICTED_RSYNC_RO:
+			argv = rsyncCommand(args, root, kind == RESTRICTED_RSYNC_RO)
+		}
+		if argv != nil {
+			return argv, nil
+		}
+	}
+	return nil, errCommandNotAllowed
+}
+
+// gitCommand handles the commands sent by git clients, like
+// git-upload-pack '/repo.git'. It returns nil if args is not allowed
+func gitCommand(args []string, root string, readOnly bool) []string {
+	// "git upload-pack" is accepted too
+	if len(args) == 3 && args[0] == "git" {
+		args = []string{"git-" + args[1], args[2]}
+	}
+	if len(args) != 2 {
+		return nil
+	}
+	switch args[0] {
+	case "git-upload-pack", "git-upload-archive":
+	case "git-receive-pack":
+		if readOnly {
+			return nil
+		}
+	default:
+		return nil
+	}
+	path, ok := restrictPath(root, args[1])
+	if !ok {
+		return nil
+	}
+	return []string{"git", strings.TrimPrefix(args[0], "git-"), path}
+}
+
+// rsyncCommand handles the commands sent by rsync clients, like
+// rsync --server -logDtpre.iLsfxC . /dest. It returns nil if args
+// is not allowed
+func rsyncCommand(args []string, root string, readOnly bool) []string {
+	if len(args) < 4 || args[0] != "rsync" || args[1] != "--server" {
+		return nil
+	}
+	// the options and the paths are separated by a "." argument
+	dot := -1
+	for i, a := range args[2:] {
+		if a == "." {
+			dot = i + 2
+			break
+		}
+	}
+	if dot < 0 || dot == len(args)-1 {
+		return nil
+	}
+
+	sender := false
+	munge := false
+	options := []string{}
+	for _, o := range args[2:dot] {
+		option, ok := rsyncOption(o, root)
+		if !ok {
+			return nil
+		}
+		name, _, _ := strings.Cut(option, "=")
+		if readOnly && writeRsyncOptions[name] {
+			return nil
+		}
+		if name == "--sender" {
+			sender = true
+		}
+		if name == "--munge-links" {
+			munge = true
+		}
+		options = append(options, option)
+	}
+	if readOnly && !sender {
+		return nil
+	}
+
+	// like rrsync, the symlinks are munged, so the ones the clients
+	// upload can't be followed
+	argv := []string{"rsync", "--server"}
+	if !munge {
+		argv = append(argv, "--munge-links")
+	}
+	argv = append(argv, options...)
+	argv = append(argv, ".")
+	for _, p := range args[dot+1:] {
+		path, ok := restrictPath(root, p)
+		if !ok {
+			return nil
+		}
+		argv = append(argv, path)
+	}
+	return argv
+}
+
+// rsyncOption checks the rsync server option o against the allowed ones.
+// It returns the option to run, with its path argument confined in root,
+// and false if o is not allowed
+func rsyncOption(o string, root string) (string, bool) {
+	if strings.HasPrefix(o, "--") {
+		name, value, hasValue := strings.Cut(o, "=")
+		kind, ok := allowedRsyncOptions[name]
+		if !ok || hasValue != (kind != rsyncNoArg) {
+			return "", false
+		}
+		if kind != rsyncPathArg {
+			return o, true
+		}
+		if filepath.IsAbs(value) {
+			path, ok := restrictPath(root, value)
+			if !ok {
+				return "", false
+			}
+			return name + "=" + path, true
+		}
+		// the relative paths are resolved by rsync from the destination,
+		// already confined
+		for _, part := range strings.Split(filepath.ToSlash(value), "/") {
+			if part == ".." {
+				return "", false
+			}
+		}
+		return o, true
+	}
+
+	if len(o) < 2 || o[0] != '-' {
+		return "", false
+	}
+	for i := 1; i < len(o); i++ {
+		if o[i] == 'e' {
+			// the client capabilities, like e.iLsfxC
+			for _, c := range o[i+1:] {
+				if c != '.' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+					return "", false
+				}
+			}
+			return o, true
+		}
+		if strings.IndexByte(allowedRsyncShortOptions, o[i]) < 0 {
+			return "", false
+		}
+	}
+	return o, true
+}
@@ -0,0 +1,99 @@
+package sshd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	words, err := splitCommand(`git-upload-pack '/my repo.git' "a \"b\"" c\ d`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"git-upload-pack", "/my repo.git", `a "b"`, "c d"}
+	if !reflect.DeepEqual(words, expected) {
+		t.Fatalf("expected %q, got %q", expected, words)
+	}
+	if _, err := splitCommand("echo 'unterminated"); err == nil {
+		t.Fatal("unterminated quotes should fail")
+	}
+}
+
+func TestRestrictedCommand(t *testing.T) {
+	cases := []struct {
+		kinds    []string
+		command  string
+		expected []string
+	}{
+		{[]string{RESTRICTED_GIT}, "git-receive-pack '../../etc'", []string{"git", "receive-pack", "/srv/etc"}},
+		{[]string{RESTRICTED_GIT}, "git upload-pack 'repo.git'", []string{"git", "upload-pack", "/srv/repo.git"}},
+		{[]string{RESTRICTED_GIT_RO}, "git-receive-pack 'repo.git'", nil},
+		{[]string{RESTRICTED_GIT}, "git-upload-pack 'repo.git'; ls", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server -logDtpre.iLsfxC . /data", []string{"rsync", "--server", "--munge-links", "-logDtpre.iLsfxC", ".", "/srv/data"}},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --log-file=/etc/x -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC_RO}, "rsync --server -logDtpre.iLsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC_RO}, "rsync --server --sender -logDtpre.iLsfxC . ../data", []string{"rsync", "--server", "--munge-links", "--sender", "-logDtpre.iLsfxC", ".", "/srv/data"}},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server -vlogDtprze.iLsfxCIvu --delete --temp-dir=/tmp --partial-dir=.partial . data", []string{"rsync", "--server", "--munge-links", "-vlogDtprze.iLsfxCIvu", "--delete", "--temp-dir=/srv/tmp", "--partial-dir=.partial", ".", "/srv/data"}},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --partial-dir=../../etc -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --files-from=/etc/passwd -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --exclude-from=/etc/passwd -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --no-such-option -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --delete=x -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --timeout -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server -slogDtpre.iLsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server -T/etc -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server -e.Ls;x . data", nil},
+		{[]string{RESTRICTED_RSYNC_RO}, "rsync --server --sender --remove-source-files -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server -logDtprLe.iLsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server -logDtprke.iLsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server -logDtprKe.iLsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --copy-unsafe-links -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --copy-links -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --copy-dirlinks -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --keep-dirlinks -e.LsfxC . data", nil},
+		{[]string{RESTRICTED_RSYNC}, "rsync --server --munge-links -logDtpre.iLsfxC . data", []string{"rsync", "--server", "--munge-links", "-logDtpre.iLsfxC", ".", "/srv/data"}},
+		{[]string{RESTRICTED_GIT, RESTRICTED_RSYNC}, "sh -c ls", nil},
+	}
+	for _, c := range cases {
+		argv, err := restrictedCommand(c.kinds, "/srv", c.command)
+		if c.expected == nil {
+			if err == nil {
+				t.Fatalf("'%s' should not be allowed, got %q", c.command, argv)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("'%s' should be allowed: %s", c.command, err)
+		}
+		if !reflect.DeepEqual(argv, c.expected) {
+			t.Fatalf("'%s': expected %q, got %q", c.command, c.expected, argv)
+		}
+	}
+}
+
+func TestRestrictedCommandSymlinks(t *testing.T) {
+	root := t.TempDir()
+	// a symlink uploaded by the client, pointing outside its root
+	if err := os.Symlink("/", filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "data"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	kinds := []string{RESTRICTED_GIT, RESTRICTED_RSYNC}
+	for _, command := range []string{
+		"rsync --server -logDtpre.iLsfxC . escape/etc",
+		"rsync --server --sender -logDtpre.iLsfxC . /escape/etc/passwd",
+		"rsync --server --temp-dir=/escape/tmp -e.LsfxC . data",
+		"git-receive-pack 'escape/tmp/repo.git'",
+	} {
+		if argv, err := restrictedCommand(kinds, root, command); err == nil {
+			t.Fatalf("'%s' should not be allowed, got %q", command, argv)
+		}
+	}
+	if _, err := restrictedCommand(kinds, root, "rsync --server -logDtpre.iLsfxC . data"); err != nil {
+		t.Fatalf("the paths inside the root should be allowed: %s", err)
+	}
+}
@@ -1,16 +1,26 @@
 package sshd
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/registry"
+
 	"github.com/ferama/rospo/pkg/utils"
 
 	"golang.org/x/crypto/ssh"
@@ -20,79 +30,287 @@ var log = logger.NewLogger("[SSHD] ", logger.Blue)
 
 // sshServer instance
 type sshServer struct {
-	hostPrivateKey    ssh.Signer
+	// the keys settings, updated by ReloadKeys. Guarded by keysMu
+	hostKeys          []ssh.Signer
+	nextHostKeys      []ssh.Signer
 	authorizedKeysURI []string
-	password          string
-	listenAddress     *string
-
-	disableShell         bool
-	disableAuth          bool
-	disableBanner        bool
-	disableSftpSubsystem bool
-	disableTunnelling    bool
-
-	shellExecutable string
-
-	listener   net.Listener
+	keysMu            sync.RWMutex
+
+	password      string
+	listenerConfs []*ListenerConf
+
+	disableShell           bool
+	disableSession         bool
+	disableAuth            bool
+	disableBanner          bool
+	disableSftpSubsystem   bool
+	sftpReadOnly           bool
+	disableTunnelling      bool
+	disableAgentForwarding bool
+	disableX11Forwarding   bool
+
+	shellExecutable    string
+	gatewayPorts       string
+	serverVersion      string
+	bannerText         string
+	bannerFile         string
+	motdText           string
+	motdFile           string
+	policies           []*PolicyConf
+	allowUsers         []*userPattern
+	denyUsers          []*userPattern
+	forceCommand       string
+	env                map[string]string
+	allowedCommands    []*regexp.Regexp
+	restrictedCommands []string
+	sftpAllowedPaths   []string
+	users              map[string]*UserConf
+	// where the streamlocal forward sockets can be created. Empty
+	// means the user home
+	streamLocalForwardDir string
+
+	// the CA keys sources, user certificates signed by them are accepted
+	trustedUserCAKeys        []string
+	authorizedPrincipalsFile string
+
+	maxConnections        int
+	maxConnectionsPerUser int
+	maxSessions           int
+	maxChannels           int
+
+	sessionRateLimit int64
+	sessionQuota     int64
+	userRateLimit    int64
+	userQuota        int64
+	userUsages       map[string]*userUsage
+	userUsagesMu     sync.Mutex
+
+	clientAliveInterval time.Duration
+	clientAliveCountMax int
+	// how long the clients have to log in. 0 means no limit
+	loginGraceTime time.Duration
+
+	listeners  []net.Listener
 	listenerMU sync.RWMutex
 
-	activeSessions  int
-	activeSessionMu sync.Mutex
+	sessions      map[int]*clientSession
+	lastSessionID int
+	sessionsMu    sync.Mutex
+	// the accepted connections, handshakes included, and the
+	// authenticated ones of each user. Guarded by sessionsMu
+	connections     int
+	userConnections map[string]int
+	// bounds the concurrent rejections of the connections over the limits
+	rejections chan struct{}
+
+	// keys added and removed at runtime through the control api. The
+	// runtime keys are indexed by their marshaled form, the revoked ones
+	// by fingerprint
+	runtimeKeys   map[string]*AuthorizedKey
+	revokedKeys   map[string]bool
+	runtimeKeysMu sync.Mutex
+
+	controlSocket   string
+	controlListener net.Listener
+
+	// nil if the http front-end is disabled
+	vhosts *vhosts
+
+	metrics *serverMetrics
+	// the active reverse forwards of all the clients
+	forwardsRegistry *registry.Registry
+
+	// nil if the audit log is disabled
+	auditLog *auditLogger
+	webhooks []*webhook
+
+	// the latest login of each user, used by the motd
+	lastLogins   map[string]*lastLogin
+	lastLoginsMu sync.Mutex
+
+	// tracks all the served connections, handshakes included
+	connectionsWG sync.WaitGroup
+	// true while the server is stopping or stopped
+	isStopped atomic.Bool
 }
 
 // NewSshServer builds an SshServer object
 func NewSshServer(conf *SshDConf) *sshServer {
-	keyPath, _ := utils.ExpandUserHome(conf.Key)
-	if keyPath == "" {
+	keyPaths := []string{}
+	if conf.Key != "" {
+		keyPaths = append(keyPaths, conf.Key)
+	}
+	keyPaths = append(keyPaths, conf.Keys...)
+	if len(keyPaths) == 0 {
 		log.Fatalln("server_key is not set")
 	}
-	log.Printf("loading server key at: '%s'", keyPath)
-	hostPrivateKey, err := os.ReadFile(keyPath)
+	hostKeys, err := loadHostKeys(keyPaths)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	nextHostKeys, err := loadHostKeys(conf.NextKeys)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	log.Printf("authorized_keys: %s", conf.AuthorizedKeysURI)
+
+	gatewayPorts := conf.GatewayPorts
+	switch gatewayPorts {
+	case "":
+		gatewayPorts = GATEWAY_PORTS_CLIENTSPECIFIED
+	case GATEWAY_PORTS_NO, GATEWAY_PORTS_YES, GATEWAY_PORTS_CLIENTSPECIFIED:
+	default:
+		log.Fatalf("invalid gateway_ports value '%s'", gatewayPorts)
+	}
+
+	clientAliveInterval := conf.ClientAliveInterval
+	if clientAliveInterval == 0 {
+		clientAliveInterval = defaultClientAliveInterval
+	}
+	clientAliveCountMax := conf.ClientAliveCountMax
+	if clientAliveCountMax <= 0 {
+		clientAliveCountMax = defaultClientAliveCountMax
+	}
+	loginGraceTime := conf.LoginGraceTime
+	if loginGraceTime == 0 {
+		loginGraceTime = defaultLoginGraceTime
+	} else if loginGraceTime < 0 {
+		loginGraceTime = 0
+	}
+
+	if conf.DisableSession && conf.DisableTunnelling {
+		log.Println("both sessions and tunnelling are disabled: clients can't do anything")
+	}
+
+	serverVersion, err := parseServerVersion(conf.ServerVersion)
 	if err != nil {
-		log.Println("server identity do not exists. Generating one...")
-		key, err := utils.GeneratePrivateKey()
-		if err != nil {
-			panic(err)
-		}
-		encoded := utils.EncodePrivateKeyToPEM(key)
-		if err := utils.WriteKeyToFile(encoded, keyPath); err != nil {
-			panic(err)
-		}
-		hostPrivateKey = encoded
+		log.Fatalln(err)
+	}
 
-		// this is the one to use in the known_hosts file
-		publicKey, err := utils.GeneratePublicKey(&key.PublicKey)
-		if err != nil {
-			panic(err)
-		}
-		utils.WriteKeyToFile(publicKey, keyPath+".pub")
+	allowUsers, err := parseUserPatterns(conf.AllowUsers)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	denyUsers, err := parseUserPatterns(conf.DenyUsers)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	hostPrivateKeySigner, err := ssh.ParsePrivateKey(hostPrivateKey)
+	users, err := validateUsers(conf.Users, len(conf.TrustedUserCAKeys) > 0)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	allowedCommands, err := compileCommandPatterns(conf.AllowedCommands)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, pc := range conf.Policies {
+		if _, err := compileCommandPatterns(pc.AllowedCommands); err != nil {
+			log.Fatalln(err)
+		}
+		if err := validateRestrictedCommands(pc.RestrictedCommands); err != nil {
+			log.Fatalln(err)
+		}
+		if err := validateSftpPaths(pc.SftpAllowedPaths); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := validateRestrictedCommands(conf.RestrictedCommands); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validateSftpPaths(conf.SftpAllowedPaths); err != nil {
+		log.Fatalln(err)
+	}
 
 	ss := &sshServer{
-		authorizedKeysURI:    conf.AuthorizedKeysURI,
-		password:             conf.AuthorizedPassword,
-		hostPrivateKey:       hostPrivateKeySigner,
-		shellExecutable:      conf.ShellExecutable,
-		disableShell:         conf.DisableShell,
-		disableBanner:        conf.DisableBanner,
-		disableSftpSubsystem: conf.DisableSftpSubsystem,
-		disableAuth:          conf.DisableAuth,
-		disableTunnelling:    conf.DisableTunnelling,
-
-		listenAddress:  &conf.ListenAddress,
-		activeSessions: 0,
+		authorizedKeysURI:      conf.AuthorizedKeysURI,
+		password:               conf.AuthorizedPassword,
+		hostKeys:               hostKeys,
+		nextHostKeys:           nextHostKeys,
+		maxConnections:         conf.MaxConnections,
+		maxConnectionsPerUser:  conf.MaxConnectionsPerUser,
+		maxSessions:            conf.MaxSessions,
+		maxChannels:            conf.MaxChannels,
+		sessionRateLimit:       conf.SessionRateLimit,
+		sessionQuota:           conf.SessionQuota,
+		userRateLimit:          conf.UserRateLimit,
+		userQuota:              conf.UserQuota,
+		clientAliveInterval:    time.Duration(clientAliveInterval) * time.Second,
+		clientAliveCountMax:    clientAliveCountMax,
+		loginGraceTime:         time.Duration(loginGraceTime) * time.Second,
+		shellExecutable:        conf.ShellExecutable,
+		disableShell:           conf.DisableShell,
+		disableSession:         conf.DisableSession,
+		disableBanner:          conf.DisableBanner,
+		disableSftpSubsystem:   conf.DisableSftpSubsystem,
+		sftpReadOnly:           conf.SftpReadOnly,
+		disableAuth:            conf.DisableAuth,
+		disableTunnelling:      conf.DisableTunnelling,
+		disableAgentForwarding: conf.DisableAgentForwarding,
+		disableX11Forwarding:   conf.DisableX11Forwarding,
+		gatewayPorts:           gatewayPorts,
+		serverVersion:          serverVersion,
+		bannerText:             conf.BannerText,
+		bannerFile:             conf.BannerFile,
+		motdText:               conf.Motd,
+		motdFile:               conf.MotdFile,
+		policies:               conf.Policies,
+		allowUsers:             allowUsers,
+		denyUsers:              denyUsers,
+		forceCommand:           conf.ForceCommand,
+		env:                    conf.Env,
+		allowedCommands:        allowedCommands,
+		restrictedCommands:     conf.RestrictedCommands,
+		sftpAllowedPaths:       conf.SftpAllowedPaths,
+		streamLocalForwardDir:  conf.StreamLocalForwardDir,
+		users:                  users,
+		controlSocket:          conf.ControlSocket,
+
+		sessions:        make(map[int]*clientSession),
+		userConnections: make(map[string]int),
+		rejections:      make(chan struct{}, maxRejections),
+		lastLogins:      make(map[string]*lastLogin),
+		userUsages:      make(map[string]*userUsage),
+		metrics:         newServerMetrics(),
+		runtimeKeys:     make(map[string]*AuthorizedKey),
+		revokedKeys:     make(map[string]bool),
+
+		forwardsRegistry: registry.NewRegistry(),
+
+		trustedUserCAKeys:        conf.TrustedUserCAKeys,
+		authorizedPrincipalsFile: conf.AuthorizedPrincipalsFile,
+	}
+	if conf.AuditLogFile != "" {
+		ss.auditLog, err = newAuditLogger(conf.AuditLogFile)
+		if err != nil {
+			log.Fatalf("failed to open audit_log_file: %s", err)
+		}
+	}
+	for _, wc := range conf.Webhooks {
+		wh, err := newWebhook(wc)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		ss.webhooks = append(ss.webhooks, wh)
+	}
+	if conf.HTTPVhosts != nil {
+		ss.vhosts, err = newVhosts(ss, conf.HTTPVhosts)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
+	if conf.ListenAddress != "" {
+		ss.listenerConfs = append(ss.listenerConfs, &ListenerConf{
+			Address: conf.ListenAddress,
+		})
+	}
+	ss.listenerConfs = append(ss.listenerConfs, conf.Listeners...)
+
 	// run here, to make sure I have a valid authorized keys
 	// file on start
-	if !conf.DisableAuth {
+	if !conf.DisableAuth && !ss.hasVirtualUsers() {
 		res := ss.loadAuthorizedKeys()
-		if len(res) == 0 && conf.AuthorizedPassword == "" {
+		if len(res) == 0 && conf.AuthorizedPassword == "" && len(conf.TrustedUserCAKeys) == 0 {
 			log.Fatalf(`failed to load authorized_keys, err: %v
 	
 	You need an authorized_keys source. You can create and 
@@ -124,6 +342,12 @@ func (s *sshServer) parseAuthorizedKeysBytes(bytes []byte) (map[string]bool, err
 }
 
 func (s *sshServer) loadAuthorizedKeys() map[string]bool {
+	return s.loadAuthorizedKeysFrom(s.authorizedKeysSources())
+}
+
+// loadAuthorizedKeysFrom loads the keys from the authorized_keys sources
+// keyURIs. Sources can be files or http urls
+func (s *sshServer) loadAuthorizedKeysFrom(keyURIs []string) map[string]bool {
 	res := map[string]bool{}
 	mergeMap := func(m map[string]bool) {
 		for k, v := range m {
@@ -131,7 +355,7 @@ func (s *sshServer) loadAuthorizedKeys() map[string]bool {
 		}
 	}
 
-	for _, keyURI := range s.authorizedKeysURI {
+	for _, keyURI := range keyURIs {
 		u, err := url.ParseRequestURI(keyURI)
 		if err != nil || u.Scheme == "" {
 			log.Println("loading keys from file", keyURI)
@@ -172,18 +396,61 @@ func (s *sshServer) loadAuthorizedKeys() map[string]bool {
 }
 
 func (s *sshServer) passwordAuth(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-	if s.password == string(password) {
+	rec := &auditRecord{Event: auditAuth, Method: "password"}
+	defer s.audit(conn, rec)
+
+	if err := s.checkUserAccess(conn); err != nil {
+		s.metrics.countAuth(false)
+		rec.Error = err.Error()
+		return nil, err
+	}
+
+	authorized := s.password == string(password)
+	if s.hasVirtualUsers() {
+		authorized = s.virtualUserPasswordAuth(conn.User(), string(password))
+	}
+	s.metrics.countAuth(authorized)
+	if authorized {
+		rec.Success = true
 		return &ssh.Permissions{}, nil
 	}
+	rec.Error = "wrong password"
 	return nil, fmt.Errorf("wrong password")
 }
 
 func (s *sshServer) keyAuth(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
 	log.Println(conn.RemoteAddr(), "authenticate with", pubKey.Type())
 
-	authorizedKeysMap := s.loadAuthorizedKeys()
+	rec := &auditRecord{
+		Event:          auditAuth,
+		Method:         "publickey",
+		KeyFingerprint: ssh.FingerprintSHA256(pubKey),
+	}
+	defer s.audit(conn, rec)
 
-	if authorizedKeysMap[string(pubKey.Marshal())] {
+	if err := s.checkUserAccess(conn); err != nil {
+		s.metrics.countAuth(false)
+		rec.Error = err.Error()
+		return nil, err
+	}
+
+	if cert, ok := pubKey.(*ssh.Certificate); ok {
+		rec.Method = "certificate"
+		rec.KeyFingerprint = ssh.FingerprintSHA256(cert.Key)
+		perms, err := s.certAuth(conn, cert)
+		s.metrics.countAuth(err == nil)
+		if err != nil {
+			rec.Error = err.Error()
+			return nil, err
+		}
+		rec.Success = true
+		return perms, nil
+	}
+
+	authorized := s.isKeyAuthorized(conn.User(), pubKey)
+	s.metrics.countAuth(authorized)
+	if authorized {
+		rec.Success = true
 		return &ssh.Permissions{
 			// Record the public key used for authentication.
 			Extensions: map[string]string{
@@ -191,81 +458,192 @@ func (s *sshServer) keyAuth(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.P
 			},
 		}, nil
 	}
+	rec.Error = "unknown public key"
 	return nil, fmt.Errorf("unknown public key for %q", conn.User())
 }
 
+// parseServerVersion validates the server_version value, adding
+// the protocol prefix if missing
+func parseServerVersion(version string) (string, error) {
+	if version == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(version, "SSH-2.0-") {
+		version = "SSH-2.0-" + version
+	}
+	// RFC 4253: the identification string is at most 255 chars, CR LF included
+	if len(version) > 253 {
+		return "", fmt.Errorf("server_version is too long")
+	}
+	if strings.ContainsAny(version, "\r\n") {
+		return "", fmt.Errorf("server_version can't contain line breaks")
+	}
+	return version, nil
+}
+
+// GetActiveSessionsCount returns the number of connected clients
 func (s *sshServer) GetActiveSessionsCount() int {
-	s.activeSessionMu.Lock()
-	defer s.activeSessionMu.Unlock()
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	return len(s.sessions)
+}
+
+func (s *sshServer) addSession(cs *clientSession) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	s.lastSessionID++
+	cs.id = s.lastSessionID
+	s.sessions[cs.id] = cs
+	log.Printf("active sessions: %d", len(s.sessions))
+}
+
+// listSessions returns the connected client sessions
+func (s *sshServer) listSessions() []*clientSession {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	res := make([]*clientSession, 0, len(s.sessions))
+	for _, cs := range s.sessions {
+		res = append(res, cs)
+	}
+	return res
+}
+
+func (s *sshServer) removeSession(cs *clientSession) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	delete(s.sessions, cs.id)
+	log.Printf("active sessions: %d", len(s.sessions))
+}
 
-	return s.activeSessions
+// isTemporaryAcceptError returns true if the accept error err
+// is transient and the listener is still usable
+func isTemporaryAcceptError(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// sessionLogger returns the logger of the client connection conn, with
+// its peer address, user and ssh session id fields
+func sessionLogger(conn *ssh.ServerConn) *logger.Logger {
+	if conn == nil {
+		return log
+	}
+	return log.With("peer", conn.RemoteAddr().String()).
+		With("user", conn.User()).
+		With("session", hex.EncodeToString(conn.SessionID()))
 }
 
 // serve sshd client connection
-func (s *sshServer) serveConnection(conn net.Conn, config ssh.ServerConfig) {
-	log.Printf("connection from %s", conn.RemoteAddr())
-	s.activeSessionMu.Lock()
-	s.activeSessions++
-	log.Printf("active sessions: %d", s.activeSessions)
-	s.activeSessionMu.Unlock()
+func (s *sshServer) serveConnection(conn net.Conn, config ssh.ServerConfig, lc *ListenerConf) {
+	defer s.connectionsWG.Done()
+	// a misbehaving client must not bring the whole server down
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("connection from %s crashed: %v", conn.RemoteAddr(), r)
+			conn.Close()
+		}
+	}()
+	clog := log.With("peer", conn.RemoteAddr().String())
+	clog.Printf("connection from %s", conn.RemoteAddr())
+
+	// the host keys may be reloaded, they are set per connection
+	hostKeys, _ := s.currentHostKeys()
+	for _, key := range hostKeys {
+		config.AddHostKey(key)
+	}
 
+	// a client not logging in in time must not hold its connection slot
+	if s.loginGraceTime > 0 {
+		conn.SetDeadline(time.Now().Add(s.loginGraceTime))
+	}
 	// From a standard TCP connection to an encrypted SSH connection
 	sshConn, chans, reqs, err := ssh.NewServerConn(conn, &config)
 	if err != nil {
-		log.Printf("client connection error %s", err)
+		clog.Errorf("client connection error %s", err)
 		return
 	}
+	conn.SetDeadline(time.Time{})
+	clog = sessionLogger(sshConn)
 	if !s.disableAuth {
-		log.Printf("logged in %s", sshConn.Permissions.Extensions["pubkey-fp"])
+		clog.Printf("logged in %s", sshConn.Permissions.Extensions["pubkey-fp"])
 	} else {
-		log.Println("logged in WITHOUT authentication")
-	}
-
-	requestHandler := newRequestHandler(s, sshConn, reqs)
-	go requestHandler.handleRequests()
-
-	channelHandler := newChannelHandler(
-		s,
-		sshConn,
-		chans,
-	)
-
-	// blocks until chans is closed (session terminates)
-	channelHandler.handleChannels()
-	// Accept all channels
-	log.Println("client session terminated")
-	s.activeSessionMu.Lock()
-	s.activeSessions--
-	log.Printf("active sessions: %d", s.activeSessions)
-	s.activeSessionMu.Unlock()
+		clog.Println("logged in WITHOUT authentication")
+	}
+
+	if err := s.reserveUserConnection(sshConn.User()); err != nil {
+		clog.Warnf("rejecting connection from %s: %s", conn.RemoteAddr(), err)
+		s.audit(sshConn, &auditRecord{Event: auditSessionOpen, Error: err.Error()})
+		sshConn.Close()
+		return
+	}
+	defer s.releaseUserConnection(sshConn.User())
+
+	s.audit(sshConn, &auditRecord{Event: auditSessionOpen, Success: true})
+
+	session := newClientSession(s, sshConn, lc, chans, reqs, s.newTrafficMeter(sshConn))
+	s.addSession(session)
+	defer func() {
+		clog.Println("client session terminated")
+		session.Close()
+		s.removeSession(session)
+		s.audit(sshConn, &auditRecord{
+			Event:           auditSessionClose,
+			Success:         true,
+			DurationSeconds: time.Since(session.startTime).Seconds(),
+		})
+	}()
+	if s.isStopped.Load() {
+		// the server was stopped while the client was handshaking
+		session.Close()
+	}
+
+	go session.announceHostKeys()
+
+	// blocks until the client disconnects
+	session.serve()
 }
 
 // Start the sshServer actually listening for incoming connections
-// and handling requests and ssh channels
-func (s *sshServer) Start() {
+// and handling requests and ssh channels. It blocks until the server
+// is stopped and returns an error if the server can't listen or
+// a listener fails
+func (s *sshServer) Start() error {
 	bannerCb := func(conn ssh.ConnMetadata) string {
-		return `
- .---------------.
- | 🐸 rospo sshd |
- .---------------.
-
-`
+		return s.banner()
 	}
-	if runtime.GOOS == "windows" || s.disableBanner {
+	if s.bannerText == "" && s.bannerFile == "" {
+		bannerCb = func(conn ssh.ConnMetadata) string {
+			return defaultBanner
+		}
+		if runtime.GOOS == "windows" {
+			bannerCb = nil
+		}
+	}
+	if s.disableBanner {
 		bannerCb = nil
 	}
 
 	config := ssh.ServerConfig{
 		BannerCallback: bannerCb,
+		ServerVersion:  s.serverVersion,
 	}
-	config.AddHostKey(s.hostPrivateKey)
-	if *s.listenAddress == "" {
-		log.Fatalf("listen port can't be empty")
+
+	if len(s.listenerConfs) == 0 {
+		return errors.New("listen port can't be empty")
 	}
 
 	if !s.disableAuth {
 		// if password auth is enabled, add the required config
-		if s.password != "" {
+		if s.hasPasswordAuth() {
 			config.PasswordCallback = s.passwordAuth
 			config.MaxAuthTries = 3
 		} else {
@@ -276,34 +654,225 @@ func (s *sshServer) Start() {
 		config.PublicKeyCallback = s.keyAuth
 	} else {
 		config.NoClientAuth = true
+		config.NoClientAuthCallback = func(conn ssh.ConnMetadata) (*ssh.Permissions, error) {
+			return nil, s.checkUserAccess(conn)
+		}
+	}
+
+	if s.auditLog != nil {
+		if err := s.auditLog.reopen(); err != nil {
+			return fmt.Errorf("failed to open audit_log_file: %s", err)
+		}
+	}
+
+	s.isStopped.Store(false)
+	listeners := []net.Listener{}
+	for _, lc := range s.listenerConfs {
+		listener, err := lc.listen()
+
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		log.Printf("listening on %s\n", listener.Addr())
+		listeners = append(listeners, listener)
+	}
+
+	var controlListener net.Listener
+	if s.controlSocket != "" {
+		var err error
+		controlListener, err = s.startControl()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
 	}
 
-	listener, err := net.Listen("tcp", *s.listenAddress)
+	if s.vhosts != nil {
+		if err := s.vhosts.start(); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			if controlListener != nil {
+				controlListener.Close()
+			}
+			return err
+		}
+	}
 
 	s.listenerMU.Lock()
-	s.listener = listener
+	s.listeners = listeners
+	s.controlListener = controlListener
 	s.listenerMU.Unlock()
 
-	if err != nil {
-		log.Fatal(err)
+	var wg sync.WaitGroup
+	var failOnce sync.Once
+	var acceptErr error
+	for idx, listener := range listeners {
+		wg.Add(1)
+		go func(listener net.Listener, lc *ListenerConf) {
+			defer wg.Done()
+			err := s.acceptLoop(listener, config, lc)
+			if err == nil {
+				return
+			}
+			// a broken listener brings down the others too, so
+			// the failure doesn't go unnoticed
+			failOnce.Do(func() {
+				log.Errorf("listener %s failed: %s", listener.Addr(), err)
+				acceptErr = err
+				for _, l := range listeners {
+					l.Close()
+				}
+			})
+		}(listener, s.listenerConfs[idx])
 	}
-	log.Printf("listening on %s\n", listener.Addr())
+	wg.Wait()
+	return acceptErr
+}
+
+// acceptLoop serves the connections accepted by listener. Temporary errors
+// (like the exhaustion of file descriptors) are retried with a backoff.
+// It returns nil when the server is stopped
+func (s *sshServer) acceptLoop(listener net.Listener, config ssh.ServerConfig, lc *ListenerConf) error {
+	var backoff time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			panic(err)
+			if s.isStopped.Load() {
+				log.Printf("listener %s closed", listener.Addr())
+				return nil
+			}
+			if !isTemporaryAcceptError(err) {
+				return err
+			}
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else {
+				backoff *= 2
+			}
+			if backoff > time.Second {
+				backoff = time.Second
+			}
+			log.Errorf("accept error: %s; retrying in %s", err, backoff)
+			time.Sleep(backoff)
+			continue
 		}
-		go s.serveConnection(conn, config)
+		backoff = 0
+		s.connectionsWG.Add(1)
+		if err := s.reserveConnection(); err != nil {
+			log.Warnf("rejecting connection from %s: %s", conn.RemoteAddr(), err)
+			go s.rejectConnection(conn, err.Error())
+			continue
+		}
+		go func() {
+			defer s.releaseConnection()
+			s.serveConnection(conn, config, lc)
+		}()
 	}
 }
 
-// GetListenerAddr returns the server listener network address
+// Stop gracefully stops the server. It stops accepting new connections,
+// notifies the connected clients and waits for their sessions and forwards
+// to drain. When ctx expires, the remaining sessions are forcibly closed
+// and the ctx error is returned. The server can be started again
+// after Stop returns
+func (s *sshServer) Stop(ctx context.Context) error {
+	if s.isStopped.Swap(true) {
+		return nil
+	}
+	log.Println("stopping server")
+
+	s.listenerMU.Lock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+	if s.controlListener != nil {
+		s.controlListener.Close()
+		s.controlListener = nil
+	}
+	if s.vhosts != nil {
+		s.vhosts.stop()
+	}
+	s.listenerMU.Unlock()
+
+	// the notifications are sent without holding sessionsMu: a client
+	// not reading its data would block them
+	for _, cs := range s.listSessions() {
+		go cs.notifyShutdown("rospo: the server is shutting down")
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.connectionsWG.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		if s.auditLog != nil {
+			s.auditLog.close()
+		}
+		log.Println("server stopped")
+		return nil
+	case <-ctx.Done():
+	}
+
+	sessions := s.listSessions()
+	log.Printf("closing %d sessions", len(sessions))
+	// the x/crypto ssh server can't send a disconnect message
+	// with a reason: tell the users before closing
+	notifySessions(sessions, func(cs *clientSession) {
+		cs.channelHandler.notify("rospo: the server is shutting down, closing the connection")
+	})
+	for _, cs := range sessions {
+		cs.Close()
+	}
+
+	if s.auditLog != nil {
+		// the closed sessions write their session_close records
+		select {
+		case <-drained:
+		case <-time.After(auditCloseTimeout):
+		}
+		s.auditLog.close()
+	}
+	return ctx.Err()
+}
+
+// GetListenerAddr returns the server (first) listener network address
 func (s *sshServer) GetListenerAddr() net.Addr {
 	s.listenerMU.RLock()
 	defer s.listenerMU.RUnlock()
 
-	if s.listener != nil {
-		return s.listener.Addr()
+	if len(s.listeners) != 0 {
+		return s.listeners[0].Addr()
 	}
 	return nil
 }
+
+// GetListenerAddrs returns the network addresses of all the server listeners
+func (s *sshServer) GetListenerAddrs() []net.Addr {
+	s.listenerMU.RLock()
+	defer s.listenerMU.RUnlock()
+
+	addrs := []net.Addr{}
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// GetVhostsAddrs returns the network addresses of the http front-end
+// listeners, http first. Empty if the front-end is disabled
+func (s *sshServer) GetVhostsAddrs() []net.Addr {
+	if s.vhosts == nil {
+		return []net.Addr{}
+	}
+	return s.vhosts.addrs()
+}
@@ -1,14 +1,37 @@
 package sshd
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/utils"
+	"github.com/pkg/sftp"
+
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 func getPort(addr net.Addr) string {
@@ -22,6 +45,10 @@ func startD(disableSftp bool) (*sshServer, string) {
 		ListenAddress:        "127.0.0.1:0",
 		DisableSftpSubsystem: disableSftp,
 	}
+	return startDWithConf(serverConf)
+}
+
+func startDWithConf(serverConf *SshDConf) (*sshServer, string) {
 	serverConf.AuthorizedKeysURI = []string{"../../testdata/authorized_keys"}
 	sd := NewSshServer(serverConf)
 	go sd.Start()
@@ -33,6 +60,9 @@ func startD(disableSftp bool) (*sshServer, string) {
 		}
 		time.Sleep(500 * time.Millisecond)
 	}
+	if addr.Network() == "unix" {
+		return sd, ""
+	}
 	sshdPort := getPort(addr)
 	return sd, sshdPort
 }
@@ -70,6 +100,13 @@ func TestActiveSessions(t *testing.T) {
 	if sd.GetActiveSessionsCount() != nClients {
 		t.Fatalf("has '%d' sessions, expected '%d", sd.GetActiveSessionsCount(), nClients)
 	}
+	sessions := sd.Sessions()
+	if len(sessions) != nClients || sessions[0].ID >= sessions[1].ID {
+		t.Fatalf("unexpected sessions list, %d items", len(sessions))
+	}
+	if sessions[0].RemoteAddr == "" || sessions[0].User == "" {
+		t.Fatalf("unexpected session %+v", sessions[0])
+	}
 
 	t.Logf("==== generated '%d' clients", nClients)
 	for _, c := range clients {
@@ -112,3 +149,2076 @@ func TestSftpDisabled(t *testing.T) {
 		t.Fatal("expected sftp subsystem to be disabled")
 	}
 }
+
+func TestStreamLocalForward(t *testing.T) {
+	dir := t.TempDir()
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:                   "../../testdata/server",
+		ListenAddress:         "127.0.0.1:0",
+		StreamLocalForwardDir: dir,
+	})
+	defer sd.Stop(context.Background())
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	// a stale socket left by a previous forward is replaced
+	socketPath := filepath.Join(dir, "rospo.sock")
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := conn.Client.ListenUnix(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket permissions %s", fi.Mode().Perm())
+	}
+
+	// the sockets are confined in the configured directory
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{
+		filepath.Join(outside, "rospo.sock"),
+		filepath.Join(dir, "escape", "rospo.sock"),
+		"../rospo.sock",
+	} {
+		if l, err := conn.Client.ListenUnix(p); err == nil {
+			l.Close()
+			t.Fatalf("'%s' should not be allowed", p)
+		}
+	}
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("test"))
+		c.Close()
+	}()
+
+	c, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "test" {
+		t.Fatalf("expected 'test', got '%s'", buf)
+	}
+}
+
+func TestGatewayPorts(t *testing.T) {
+	cases := []struct {
+		gatewayPorts string
+		requested    string
+		expected     string
+	}{
+		{GATEWAY_PORTS_NO, "0.0.0.0", "localhost"},
+		{GATEWAY_PORTS_NO, "192.168.0.1", "localhost"},
+		{GATEWAY_PORTS_YES, "127.0.0.1", ""},
+		{GATEWAY_PORTS_CLIENTSPECIFIED, "127.0.0.1", "127.0.0.1"},
+		{GATEWAY_PORTS_CLIENTSPECIFIED, "*", ""},
+		{GATEWAY_PORTS_CLIENTSPECIFIED, "", ""},
+	}
+	for _, c := range cases {
+		r := newRequestHandler(&sshServer{gatewayPorts: c.gatewayPorts}, nil, nil, nil)
+		if host := r.forwardBindHost(c.requested); host != c.expected {
+			t.Fatalf("%s: expected '%s' for '%s', got '%s'", c.gatewayPorts, c.expected, c.requested, host)
+		}
+	}
+}
+
+func TestAgentForwarding(t *testing.T) {
+	_, sshdPort := startD(false)
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	keyring := agent.NewKeyring()
+	if err := agent.ForwardToAgent(conn.Client, keyring); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := agent.RequestAgentForwarding(sess); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Run(`test -S "$SSH_AUTH_SOCK"`); err != nil {
+		t.Fatalf("expected agent socket: %s", err)
+	}
+}
+
+func TestX11Forwarding(t *testing.T) {
+	_, sshdPort := startD(false)
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	sess, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	var payload = struct {
+		SingleConnection bool
+		AuthProtocol     string
+		AuthCookie       string
+		ScreenNumber     uint32
+	}{
+		false, "MIT-MAGIC-COOKIE-1", "00112233445566778899aabbccddeeff", 0,
+	}
+	ok, err := sess.SendRequest("x11-req", true, ssh.Marshal(payload))
+	if err != nil || !ok {
+		t.Fatalf("x11-req should be accepted: %v", err)
+	}
+	if err := sess.Run(`test -n "$DISPLAY"`); err != nil {
+		t.Fatalf("expected DISPLAY to be set: %s", err)
+	}
+}
+
+func TestCancelTcpIpForward(t *testing.T) {
+	_, sshdPort := startD(false)
+	conn := getSSHConn(sshdPort)
+
+	ln, err := conn.Client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	if c, err := net.Dial("tcp", addr); err != nil {
+		t.Fatalf("forward should be listening: %s", err)
+	} else {
+		c.Close()
+	}
+
+	// closing the client listener sends the cancel-tcpip-forward request
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("forward should be canceled")
+	}
+
+	// forwards are released on client disconnect too
+	ln, err = conn.Client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = ln.Addr().String()
+	conn.Stop()
+	time.Sleep(500 * time.Millisecond)
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("forward should be closed on disconnect")
+	}
+}
+
+func TestDeadClientDetection(t *testing.T) {
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:                 "../../testdata/server",
+		ListenAddress:       "127.0.0.1:0",
+		ClientAliveInterval: 1,
+		ClientAliveCountMax: 2,
+	})
+
+	// a proxy between the client and the server that can stop
+	// delivering packets, simulating a crashed client
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frozen atomic.Bool
+	go func() {
+		c, err := proxyLn.Accept()
+		proxyLn.Close()
+		if err != nil {
+			return
+		}
+		s, err := net.Dial("tcp", "127.0.0.1:"+sshdPort)
+		if err != nil {
+			c.Close()
+			return
+		}
+		pipe := func(dst, src net.Conn) {
+			defer dst.Close()
+			defer src.Close()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := src.Read(buf)
+				if err != nil {
+					return
+				}
+				if !frozen.Load() {
+					dst.Write(buf[:n])
+				}
+			}
+		}
+		go pipe(s, c)
+		pipe(c, s)
+	}()
+
+	conn := getSSHConn(getPort(proxyLn.Addr()))
+	defer conn.Stop()
+
+	ln, err := conn.Client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	// an alive client is not disconnected
+	time.Sleep(3 * time.Second)
+	if sd.GetActiveSessionsCount() != 1 {
+		t.Fatalf("has '%d' sessions, expected '1'", sd.GetActiveSessionsCount())
+	}
+
+	frozen.Store(true)
+	time.Sleep(4 * time.Second)
+	if sd.GetActiveSessionsCount() != 0 {
+		t.Fatalf("has '%d' sessions, expected '0'", sd.GetActiveSessionsCount())
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("dead client forward should be closed")
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	_, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		Policies: []*PolicyConf{
+			{
+				KeyFingerprint: "SHA256:JNnK7lFLj0twcO3fn/RAzD7yfP5sI6sZde9Zm724nfU",
+				DisableSession: true,
+			},
+			{
+				User:                    "not-the-test-user",
+				DisableRemoteForwarding: true,
+			},
+		},
+	})
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	if _, err := conn.Client.NewSession(); err == nil {
+		t.Fatal("sessions should be disabled for this key")
+	}
+	ln, err := conn.Client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("remote forwarding should be allowed: %s", err)
+	}
+	ln.Close()
+}
+
+func TestMaxSessions(t *testing.T) {
+	_, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		MaxSessions:   1,
+	})
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	session, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Client.NewSession(); err == nil {
+		t.Fatal("the second session should exceed max_sessions")
+	}
+	session.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	session, err = conn.Client.NewSession()
+	if err != nil {
+		t.Fatalf("a closed session should release its slot: %s", err)
+	}
+	session.Close()
+}
+
+func TestMaxConnections(t *testing.T) {
+	_, sshdPort := startDWithConf(&SshDConf{
+		Key:            "../../testdata/server",
+		ListenAddress:  "127.0.0.1:0",
+		MaxConnections: 1,
+	})
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var banner string
+	config := &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
+	}
+
+	// a connection still handshaking takes the only slot
+	pending, err := net.Dial("tcp", "127.0.0.1:"+sshdPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, config); err == nil {
+		t.Fatal("the second connection should exceed max_connections")
+	}
+	if !strings.Contains(banner, "too many connections") {
+		t.Fatalf("expected the rejection reason, got '%s'", banner)
+	}
+
+	pending.Close()
+	time.Sleep(500 * time.Millisecond)
+	client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, config)
+	if err != nil {
+		t.Fatalf("a closed connection should release its slot: %s", err)
+	}
+	client.Close()
+}
+
+func TestLoginGraceTime(t *testing.T) {
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:            "../../testdata/server",
+		ListenAddress:  "127.0.0.1:0",
+		MaxConnections: 1,
+		LoginGraceTime: 1,
+	})
+	defer sd.Stop(context.Background())
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	// an idle client never sending its version takes the only slot
+	idle, err := net.Dial("tcp", "127.0.0.1:"+sshdPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, config); err == nil {
+		t.Fatal("the second connection should exceed max_connections")
+	}
+
+	// until the login grace time expires
+	time.Sleep(1500 * time.Millisecond)
+	client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, config)
+	if err != nil {
+		t.Fatalf("the idle connection should release its slot: %s", err)
+	}
+	client.Close()
+}
+
+func TestFailedHandshakeSessions(t *testing.T) {
+	sd, sshdPort := startD(false)
+
+	c, err := net.Dial("tcp", "127.0.0.1:"+sshdPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("not an ssh client\r\n"))
+	c.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	if sd.GetActiveSessionsCount() != 0 {
+		t.Fatalf("has '%d' sessions, expected '0'", sd.GetActiveSessionsCount())
+	}
+}
+
+func TestStop(t *testing.T) {
+	sd, sshdPort := startD(false)
+
+	// without clients the server stops immediately
+	conn := getSSHConn(sshdPort)
+	conn.Stop()
+	time.Sleep(500 * time.Millisecond)
+	if err := sd.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sd.GetListenerAddr() != nil {
+		t.Fatal("listener should be released")
+	}
+
+	// restart the server. The still connected client
+	// is disconnected when the timeout expires
+	go sd.Start()
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	conn = getSSHConn(getPort(sd.GetListenerAddr()))
+	defer conn.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := sd.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if sd.GetActiveSessionsCount() != 0 {
+		t.Fatalf("has '%d' sessions, expected '0'", sd.GetActiveSessionsCount())
+	}
+}
+
+func TestStopSlowClient(t *testing.T) {
+	// sh doesn't source the user rc files, the command starts at once
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:             "../../testdata/server",
+		ListenAddress:   "127.0.0.1:0",
+		ShellExecutable: "/bin/sh",
+	})
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not a rospo client, that would disconnect on the shutdown request
+	client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the client doesn't read the command output: the channel
+	// window fills up and the server writes block
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.StdoutPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.StderrPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start("head -c 16777216 /dev/zero"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+
+	stopped := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		stopped <- sd.Stop(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	counted := make(chan int)
+	go func() {
+		counted <- sd.GetActiveSessionsCount()
+	}()
+	select {
+	case <-counted:
+	case <-time.After(time.Second):
+		t.Fatal("the sessions should be accessible while stopping")
+	}
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Fatal("expected the context error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stop should not be blocked by the client")
+	}
+}
+
+func TestStopNotifiesSessions(t *testing.T) {
+	sd, sshdPort := startD(false)
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	sess, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := &lockedBuffer{}
+	sess.Stderr = stderr
+	if err := sess.Start("sleep 5"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	sd.Stop(ctx)
+	time.Sleep(200 * time.Millisecond)
+
+	if !strings.Contains(stderr.String(), "rospo: the server is shutting down") {
+		t.Fatalf("expected the shutdown notice, got '%s'", stderr.String())
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func TestMultipleListeners(t *testing.T) {
+	sd, _ := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		Listeners: []*ListenerConf{
+			{
+				Address:      "127.0.0.1:0",
+				DisableShell: true,
+			},
+		},
+	})
+	addrs := sd.GetListenerAddrs()
+	if len(addrs) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(addrs))
+	}
+
+	conn := getSSHConn(getPort(addrs[0]))
+	defer conn.Stop()
+	sess, _ := conn.Client.NewSession()
+	if err := sess.Run("true"); err != nil {
+		t.Fatalf("exec should be allowed on the first listener: %s", err)
+	}
+
+	restricted := getSSHConn(getPort(addrs[1]))
+	defer restricted.Stop()
+	sess, _ = restricted.Client.NewSession()
+	if err := sess.Run("true"); err == nil {
+		t.Fatal("exec should be disabled on the second listener")
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "sshd.sock")
+	sd, _ := startDWithConf(&SshDConf{
+		Key: "../../testdata/server",
+		Listeners: []*ListenerConf{
+			{
+				SocketPath:        socketPath,
+				SocketPermissions: "0660",
+			},
+			{
+				Address: "unix://" + socketPath + ".2",
+			},
+		},
+	})
+	defer sd.Stop(context.Background())
+
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Fatalf("expected 0660 permissions, got %o", fi.Mode().Perm())
+	}
+
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{socketPath, socketPath + ".2"} {
+		client, err := ssh.Dial("unix", path, &ssh.ClientConfig{
+			User:            "test",
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+	}
+}
+
+func TestHostKeyGeneration(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "server_key")
+	signer, err := loadHostKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		t.Fatalf("expected an ed25519 key, got %s", signer.PublicKey().Type())
+	}
+	fi, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected 0600 permissions, got %o", fi.Mode().Perm())
+	}
+	if _, err := os.Stat(keyPath + ".pub"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stored key is loaded on next start
+	loaded, err := loadHostKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.PublicKey().Marshal(), signer.PublicKey().Marshal()) {
+		t.Fatal("expected the stored key to be loaded")
+	}
+}
+
+func TestMultipleHostKeys(t *testing.T) {
+	dir := t.TempDir()
+	_, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		Keys:          []string{filepath.Join(dir, "ssh_host_ecdsa_key")},
+		ListenAddress: "127.0.0.1:0",
+	})
+
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, algo := range []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSASHA256} {
+		var hostKeyType string
+		client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+			User:              "test",
+			Auth:              []ssh.AuthMethod{auth},
+			HostKeyAlgorithms: []string{algo},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				hostKeyType = key.Type()
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", algo, err)
+		}
+		client.Close()
+		if hostKeyType == "" {
+			t.Fatalf("%s: host key not received", algo)
+		}
+	}
+
+	if _, err := loadHostKeys([]string{"../../testdata/server", "../../testdata/server"}); err == nil {
+		t.Fatal("keys with the same type should be rejected")
+	}
+}
+
+func TestHostKeysRotation(t *testing.T) {
+	nextKeyPath := filepath.Join(t.TempDir(), "next_server_key")
+	_, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		NextKeys:      []string{nextKeyPath},
+		ListenAddress: "127.0.0.1:0",
+	})
+
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpConn, err := net.Dial("tcp", "127.0.0.1:"+sshdPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, chans, reqs, err := ssh.NewClientConn(tcpConn, "127.0.0.1", &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "")
+		}
+	}()
+
+	var announced [][]byte
+	select {
+	case req := <-reqs:
+		if req.Type != hostKeysRequestType {
+			t.Fatalf("unexpected request %s", req.Type)
+		}
+		announced, err = parseStrings(req.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("host keys not announced")
+	}
+	if len(announced) != 2 {
+		t.Fatalf("expected 2 announced keys, got %d", len(announced))
+	}
+
+	nextKey := announced[1]
+	ok, reply, err := conn.SendRequest(hostKeysProveRequestType, true, marshalStrings([][]byte{nextKey}))
+	if err != nil || !ok {
+		t.Fatalf("prove request failed: %v", err)
+	}
+	sigs, err := parseStrings(reply)
+	if err != nil || len(sigs) != 1 {
+		t.Fatalf("invalid prove reply: %v", err)
+	}
+	sig := new(ssh.Signature)
+	if err := ssh.Unmarshal(sigs[0], sig); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.ParsePublicKey(nextKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ssh.Marshal(struct {
+		RequestType string
+		SessionID   []byte
+		HostKey     []byte
+	}{
+		hostKeysProveRequestType, conn.SessionID(), nextKey,
+	})
+	if err := pub.Verify(data, sig); err != nil {
+		t.Fatalf("invalid host key proof: %s", err)
+	}
+}
+
+func TestSignHostKeyProof(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := map[string]ssh.Signer{}
+	for name, key := range map[string]interface{}{"rsa": rsaKey, "ecdsa": ecdsaKey, "ed25519": ed25519Key} {
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[name] = signer
+	}
+	cert := &ssh.Certificate{
+		Key:         signers["rsa"].PublicKey(),
+		CertType:    ssh.HostCert,
+		ValidBefore: ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, signers["ed25519"]); err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signers["rsa"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers["rsa-cert"] = certSigner
+
+	expected := map[string]string{
+		"rsa":      ssh.KeyAlgoRSASHA512,
+		"rsa-cert": ssh.KeyAlgoRSASHA512,
+		"ecdsa":    ssh.KeyAlgoECDSA256,
+		"ed25519":  ssh.KeyAlgoED25519,
+	}
+	data := []byte("proof")
+	for name, signer := range signers {
+		sig, err := signHostKeyProof(signer, data)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if sig.Format != expected[name] {
+			t.Fatalf("%s: expected %s signature, got %s", name, expected[name], sig.Format)
+		}
+		if err := signer.PublicKey().Verify(data, sig); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+}
+
+func TestBannerAndMotd(t *testing.T) {
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:             "../../testdata/server",
+		ListenAddress:   "127.0.0.1:0",
+		BannerText:      "authorized access only\n",
+		Motd:            "welcome {{.User}}{{if .LastLogin}}, last login from {{.LastLoginFrom}}{{end}}",
+		ShellExecutable: "echo shell",
+	})
+	defer sd.Stop(context.Background())
+
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func() (string, string) {
+		banner := ""
+		client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+			User:            "test",
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			BannerCallback: func(message string) error {
+				banner = message
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		session.Stdout = &out
+		if err := session.Shell(); err != nil {
+			t.Fatal(err)
+		}
+		session.Wait()
+		return banner, out.String()
+	}
+
+	banner, out := login()
+	if banner != "authorized access only\n" {
+		t.Fatalf("unexpected banner %q", banner)
+	}
+	if !strings.HasPrefix(out, "welcome test\n") {
+		t.Fatalf("unexpected motd %q", out)
+	}
+	_, out = login()
+	if !strings.HasPrefix(out, "welcome test, last login from 127.0.0.1:") {
+		t.Fatalf("unexpected motd %q", out)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		AuditLogFile:  auditPath,
+	})
+	conn := getSSHConn(sshdPort)
+
+	session, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Run("true")
+	ln, err := conn.Client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	conn.Stop()
+	time.Sleep(500 * time.Millisecond)
+	sd.Stop(context.Background())
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := map[string]*auditRecord{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		rec := &auditRecord{}
+		if err := json.Unmarshal([]byte(line), rec); err != nil {
+			t.Fatalf("invalid audit record %q: %s", line, err)
+		}
+		events[rec.Event+":"+rec.Command] = rec
+	}
+	for _, key := range []string{
+		"auth:", "session_open:", "exec:true", "forward:tcpip-forward",
+		"forward:cancel-tcpip-forward", "session_close:",
+	} {
+		rec, ok := events[key]
+		if !ok {
+			t.Fatalf("missing audit record %s", key)
+		}
+		if !rec.Success || rec.KeyFingerprint == "" || rec.RemoteAddr == "" {
+			t.Fatalf("unexpected audit record %+v", rec)
+		}
+	}
+}
+
+func TestAuditLogStopTimeout(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		AuditLogFile:  auditPath,
+	})
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	// the connected client outlives the stop timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := sd.Stop(ctx); err == nil {
+		t.Fatal("expected the context error")
+	}
+	sd.auditLog.mu.Lock()
+	closed := sd.auditLog.file == nil
+	sd.auditLog.mu.Unlock()
+	if !closed {
+		t.Fatal("the audit log should be closed")
+	}
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"event":"session_close"`) {
+		t.Fatalf("missing the session_close record in %q", data)
+	}
+}
+
+func TestControlAuthorizedKeys(t *testing.T) {
+	controlSocket := filepath.Join(t.TempDir(), "control.sock")
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		ControlSocket: controlSocket,
+	})
+	defer sd.Stop(context.Background())
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", controlSocket)
+			},
+		},
+	}
+	keyPath := filepath.Join(t.TempDir(), "runtime_key")
+	signer, err := loadHostKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func() error {
+		client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+			User:            "test",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+	if err := dial(); err == nil {
+		t.Fatal("the key should not be authorized yet")
+	}
+
+	body := fmt.Sprintf(`{"key": %q}`, ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	res, err := httpClient.Post("http://control/authorized_keys", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	if err := dial(); err != nil {
+		t.Fatalf("the runtime key should be authorized: %s", err)
+	}
+
+	res, err = httpClient.Get("http://control/authorized_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []*AuthorizedKey{}
+	json.NewDecoder(res.Body).Decode(&keys)
+	res.Body.Close()
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+
+	fp := ssh.FingerprintSHA256(signer.PublicKey())
+	req, _ := http.NewRequest(http.MethodDelete, "http://control/authorized_keys?fingerprint="+url.QueryEscape(fp), nil)
+	res, err = httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	if err := dial(); err == nil {
+		t.Fatal("the removed key should not be authorized")
+	}
+
+	// keys from the authorized_keys sources can be revoked too
+	for _, key := range sd.ListAuthorizedKeys() {
+		if err := sd.RemoveAuthorizedKey(key.Fingerprint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sd.ListAuthorizedKeys()) != 0 {
+		t.Fatal("all the keys should be revoked")
+	}
+	if err := sd.RemoveAuthorizedKey(fp); err != ErrAuthorizedKeyNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestVirtualUsers(t *testing.T) {
+	home := filepath.Join(t.TempDir(), "alice")
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		Users: []*UserConf{
+			{
+				Name:              "alice",
+				AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+				Home:              home,
+				DisableTunnelling: true,
+			},
+			{
+				Name:     "bob",
+				Password: "bobpass",
+			},
+		},
+	})
+	defer sd.Stop(context.Background())
+
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(user string, auth ssh.AuthMethod) (*ssh.Client, error) {
+		return ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+
+	client, err := dial("alice", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// relative paths are resolved in the user home
+	if err := session.Run("echo $USER $HOME > env; pwd >> env"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(filepath.Join(home, "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("alice %s\n%s\n", home, home)
+	if string(out) != expected {
+		t.Fatalf("expected %q, got %q", expected, out)
+	}
+	if _, err := client.Listen("tcp", "127.0.0.1:0"); err == nil {
+		t.Fatal("tunnelling should be disabled for alice")
+	}
+
+	if _, err := dial("mallory", auth); err == nil {
+		t.Fatal("unknown users should not log in")
+	}
+	if _, err := dial("bob", auth); err == nil {
+		t.Fatal("alice key should not be valid for bob")
+	}
+	if _, err := dial("bob", ssh.Password("wrong")); err == nil {
+		t.Fatal("wrong password should not be valid")
+	}
+	client, err = dial("bob", ssh.Password("bobpass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	// the runtime keys changes apply to the virtual users too
+	for _, key := range sd.ListAuthorizedKeys() {
+		if err := sd.RemoveAuthorizedKey(key.Fingerprint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dial("alice", auth); err == nil {
+		t.Fatal("the revoked key should not be valid for alice")
+	}
+	pub, err := os.ReadFile("../../testdata/client.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sd.AddAuthorizedKey(string(pub)); err != nil {
+		t.Fatal(err)
+	}
+	client, err = dial("bob", auth)
+	if err != nil {
+		t.Fatalf("the runtime key should be valid for bob: %s", err)
+	}
+	client.Close()
+	if _, err := dial("mallory", auth); err == nil {
+		t.Fatal("unknown users should not log in with runtime keys")
+	}
+}
+
+func TestDisableSession(t *testing.T) {
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:            "../../testdata/server",
+		ListenAddress:  "127.0.0.1:0",
+		DisableSession: true,
+	})
+	defer sd.Stop(context.Background())
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	if _, err := conn.Client.NewSession(); err == nil {
+		t.Fatal("sessions should be rejected")
+	}
+	ln, err := conn.Client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("reverse tunnels should be allowed: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	// forward tunnel to the reverse tunnel listener
+	c, err := conn.Client.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("forward tunnels should be allowed: %s", err)
+	}
+	c.Close()
+}
+
+func TestServerVersion(t *testing.T) {
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		ServerVersion: "OpenSSH_9.3",
+	})
+	defer sd.Stop(context.Background())
+
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if string(client.ServerVersion()) != "SSH-2.0-OpenSSH_9.3" {
+		t.Fatalf("unexpected server version %s", client.ServerVersion())
+	}
+
+	if _, err := parseServerVersion("SSH-2.0-bad\r\nversion"); err == nil {
+		t.Fatal("line breaks should not be allowed")
+	}
+}
+
+func TestTrafficLimits(t *testing.T) {
+	// a tcp server sending 256KB to every client
+	payload := make([]byte, 256*1024)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				c.Write(payload)
+				c.Close()
+			}(c)
+		}
+	}()
+
+	download := func(sshdPort string) (int64, time.Duration) {
+		conn := getSSHConn(sshdPort)
+		defer conn.Stop()
+		start := time.Now()
+		c, err := conn.Client.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return 0, time.Since(start)
+		}
+		n, _ := io.Copy(io.Discard, c)
+		return n, time.Since(start)
+	}
+
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:              "../../testdata/server",
+		ListenAddress:    "127.0.0.1:0",
+		SessionRateLimit: 128 * 1024,
+	})
+	n, elapsed := download(sshdPort)
+	sd.Stop(context.Background())
+	if n != int64(len(payload)) {
+		t.Fatalf("expected %d bytes, got %d", len(payload), n)
+	}
+	if elapsed < time.Second {
+		t.Fatalf("the download should be rate limited, took %s", elapsed)
+	}
+
+	sd, sshdPort = startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		SessionQuota:  64 * 1024,
+	})
+	defer sd.Stop(context.Background())
+	n, _ = download(sshdPort)
+	if n >= int64(len(payload)) {
+		t.Fatal("the download should exceed the session quota")
+	}
+}
+
+func TestForceCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		ForceCommand:  "echo \"$SSH_ORIGINAL_COMMAND\" > " + out,
+	})
+	defer sd.Stop(context.Background())
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	session, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Run("rm -rf /"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "rm -rf /\n" {
+		t.Fatalf("unexpected SSH_ORIGINAL_COMMAND %q", data)
+	}
+}
+
+func TestForceCommandEnv(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skipf("bash not available: %s", err)
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	marker := filepath.Join(dir, "marker")
+	script := filepath.Join(dir, "script")
+	if err := os.WriteFile(script, []byte("touch "+marker+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:             "../../testdata/server",
+		ListenAddress:   "127.0.0.1:0",
+		ShellExecutable: bash,
+		ForceCommand:    "echo \"$FOO $LANG\" > " + out,
+	})
+	defer sd.Stop(context.Background())
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	session, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"BASH_ENV": script, "FOO": "foo", "LANG": "C"} {
+		if err := session.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := session.Run("true"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatal("BASH_ENV should not be set by the client")
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != " C\n" {
+		t.Fatalf("unexpected env %q", data)
+	}
+}
+
+func TestAllowedCommands(t *testing.T) {
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		Policies: []*PolicyConf{
+			{
+				AllowedCommands: []string{"true", "echo [a-z]+", "echo safe .*"},
+			},
+		},
+	})
+	defer sd.Stop(context.Background())
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	run := func(command string) error {
+		session, err := conn.Client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.Close()
+		if command == "" {
+			return session.Shell()
+		}
+		return session.Run(command)
+	}
+	if err := run("true"); err != nil {
+		t.Fatalf("true should be allowed: %s", err)
+	}
+	if err := run("echo hello"); err != nil {
+		t.Fatalf("echo hello should be allowed: %s", err)
+	}
+	if err := run("echo hello; rm -rf /tmp/x"); err == nil {
+		t.Fatal("the pattern should match the whole command")
+	}
+	if err := run(""); err == nil {
+		t.Fatal("shell should not be allowed")
+	}
+
+	// the allowed commands are not run by a shell
+	marker := filepath.Join(t.TempDir(), "marker")
+	for _, command := range []string{
+		"echo safe ; touch " + marker,
+		"echo safe $(touch " + marker + ")",
+		"echo safe `touch " + marker + "`",
+	} {
+		session, err := conn.Client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := session.Output(command)
+		session.Close()
+		if err != nil {
+			t.Fatalf("'%s' should be allowed: %s", command, err)
+		}
+		if string(out) != strings.TrimPrefix(command, "echo ")+"\n" {
+			t.Fatalf("unexpected output %q", out)
+		}
+		if _, err := os.Stat(marker); err == nil {
+			t.Fatalf("'%s' should not run a shell", command)
+		}
+	}
+}
+
+func TestStartError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	sd := NewSshServer(&SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     ln.Addr().String(),
+	})
+	if err := sd.Start(); err == nil {
+		t.Fatal("start should fail if the address is in use")
+	}
+
+	if !isTemporaryAcceptError(&net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}) {
+		t.Fatal("EMFILE should be a temporary accept error")
+	}
+	if isTemporaryAcceptError(net.ErrClosed) {
+		t.Fatal("a closed listener error is not temporary")
+	}
+}
+
+func TestStderr(t *testing.T) {
+	sd, sshdPort := startD(false)
+	defer sd.Stop(context.Background())
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	session, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run("echo out; echo err >&2"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(stdout.String(), "out\n") || strings.Contains(stdout.String(), "err") {
+		t.Fatalf("unexpected stdout %q", stdout.String())
+	}
+	// the user shell rc files may write to stderr too
+	if !strings.HasSuffix(stderr.String(), "err\n") || strings.Contains(stderr.String(), "out") {
+		t.Fatalf("unexpected stderr %q", stderr.String())
+	}
+}
+
+func TestSessionEnv(t *testing.T) {
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		Env:           map[string]string{"FOO": "server", "BAR": "server"},
+		Policies: []*PolicyConf{
+			{Env: map[string]string{"BAR": "policy"}},
+		},
+	})
+	defer sd.Stop(context.Background())
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	session, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := session.Output("echo $SSH_CONNECTION; echo $SSH_CLIENT; echo $FOO $BAR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(out), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("unexpected output %q", out)
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) != 4 || fields[0] != "127.0.0.1" || fields[3] != sshdPort {
+		t.Fatalf("unexpected SSH_CONNECTION %q", lines[0])
+	}
+	if lines[1] != fmt.Sprintf("127.0.0.1 %s %s", fields[1], sshdPort) {
+		t.Fatalf("unexpected SSH_CLIENT %q", lines[1])
+	}
+	if lines[2] != "server policy" {
+		t.Fatalf("unexpected configured env %q", lines[2])
+	}
+}
+
+func TestStats(t *testing.T) {
+	sd, sshdPort := startD(false)
+	defer sd.Stop(context.Background())
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	session, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Output("echo hello"); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := conn.Client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	stats := sd.Stats()
+	if stats.ActiveConnections != 1 {
+		t.Fatalf("expected 1 connection, got %d", stats.ActiveConnections)
+	}
+	if stats.OpenForwards != 1 {
+		t.Fatalf("expected 1 forward, got %d", stats.OpenForwards)
+	}
+	if stats.AuthSuccesses != 1 {
+		t.Fatalf("expected 1 auth success, got %d", stats.AuthSuccesses)
+	}
+	sessions := stats.Channels["session"]
+	if sessions.Total != 1 || sessions.Open != 0 || sessions.BytesOut < int64(len("hello\n")) {
+		t.Fatalf("unexpected session channels stats %+v", sessions)
+	}
+}
+
+func TestForwardsRegistry(t *testing.T) {
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		GatewayPorts:  GATEWAY_PORTS_NO,
+	})
+	defer sd.Stop(context.Background())
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	// with gateway_ports no, the requested host names the forward.
+	// Sending the raw request, the client Listen would resolve the name
+	payload := ssh.Marshal(&struct {
+		Addr string
+		Port uint32
+	}{"myapp", 0})
+	ok, reply, err := conn.Client.SendRequest("tcpip-forward", true, payload)
+	if err != nil || !ok {
+		t.Fatalf("forward request failed: %v", err)
+	}
+	var allocated struct{ Port uint32 }
+	if err := ssh.Unmarshal(reply, &allocated); err != nil {
+		t.Fatal(err)
+	}
+	forwards := sd.Forwards("myapp")
+	if len(forwards) != 1 {
+		t.Fatalf("expected 1 forward, got %d", len(forwards))
+	}
+	f := forwards[0]
+	if f.Port == 0 || f.User == "" || f.ClientAddr == "" {
+		t.Fatalf("unexpected forward %+v", f)
+	}
+	if allocated.Port != f.Port {
+		t.Fatalf("the allocated port %d was not reported, client got %d", f.Port, allocated.Port)
+	}
+	if len(sd.Forwards("other")) != 0 {
+		t.Fatal("no forwards expected for other name")
+	}
+
+	payload = ssh.Marshal(&struct {
+		Addr string
+		Port uint32
+	}{"myapp", f.Port})
+	if ok, _, _ := conn.Client.SendRequest("cancel-tcpip-forward", true, payload); !ok {
+		t.Fatal("cancel request failed")
+	}
+	if len(sd.Forwards("")) != 0 {
+		t.Fatal("the canceled forward should be removed")
+	}
+}
+
+func TestRestrictedCommands(t *testing.T) {
+	home := t.TempDir()
+	if err := exec.Command("git", "init", "--bare", filepath.Join(home, "repo.git")).Run(); err != nil {
+		t.Skipf("git not available: %s", err)
+	}
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		Users: []*UserConf{
+			{
+				Name:               "git",
+				AuthorizedKeysURI:  []string{"../../testdata/authorized_keys"},
+				Home:               home,
+				RestrictedCommands: []string{RESTRICTED_GIT_RO},
+			},
+			{
+				Name:              "echo",
+				AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+				Shell:             "/bin/echo",
+			},
+		},
+	})
+	defer sd.Stop(context.Background())
+
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(user string) *ssh.Client {
+		client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	client := dial("git")
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client env doesn't reach git
+	trace := filepath.Join(t.TempDir(), "trace")
+	if err := session.Setenv("GIT_TRACE", trace); err != nil {
+		t.Fatal(err)
+	}
+	// the path can't escape the user home. The flush packet ends
+	// the upload-pack negotiation
+	session.Stdin = strings.NewReader("0000")
+	out, err := session.Output("git-upload-pack '/../repo.git'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) < 4 || !strings.HasSuffix(string(out), "0000") {
+		t.Fatalf("unexpected upload-pack output %q", out)
+	}
+	if _, err := os.Stat(trace); err == nil {
+		t.Fatal("GIT_TRACE should not be set by the client")
+	}
+
+	for _, command := range []string{"git-receive-pack 'repo.git'", "ls", ""} {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if command == "" {
+			err = session.Shell()
+		} else {
+			err = session.Run(command)
+		}
+		session.Close()
+		if err == nil {
+			t.Fatalf("'%s' should not be allowed", command)
+		}
+	}
+
+	// the exec requests are run by the user login shell
+	client = dial("echo")
+	defer client.Close()
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = session.Output("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "-c hello\n" {
+		t.Fatalf("unexpected login shell output %q", out)
+	}
+}
+
+func TestSftpRestrictions(t *testing.T) {
+	dir := t.TempDir()
+	home := filepath.Join(dir, "home")
+	upload := filepath.Join(dir, "upload")
+	if err := os.MkdirAll(upload, 0700); err != nil {
+		t.Fatal(err)
+	}
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		Users: []*UserConf{
+			{
+				Name:              "uploader",
+				AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+				Home:              home,
+				SftpAllowedPaths:  []string{upload},
+			},
+			{
+				Name:              "reader",
+				AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+				Home:              home,
+				SftpReadOnly:      true,
+			},
+		},
+	})
+	defer sd.Stop(context.Background())
+	if err := os.WriteFile(filepath.Join(home, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// closed before stopping the server
+	clients := []*ssh.Client{}
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	dial := func(user string) *sftp.Client {
+		client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+		sc, err := sftp.NewClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sc
+	}
+
+	sc := dial("uploader")
+	defer sc.Close()
+	// the home is not allowed, relative paths start from the upload dir
+	f, err := sc.Create("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+	data, err := os.ReadFile(filepath.Join(upload, "file.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("the file should be uploaded in the upload dir: %s", err)
+	}
+	if _, err := sc.Open(filepath.Join(home, "secret")); err == nil {
+		t.Fatal("the home should not be accessible")
+	}
+	if _, err := sc.Create("../home/file.txt"); err == nil {
+		t.Fatal("the parent dir should not be accessible")
+	}
+	if err := sc.Symlink(home, "link"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.Open("link/secret"); err == nil {
+		t.Fatal("symlinks should not escape the allowed paths")
+	}
+	if err := sc.Remove("link"); err != nil {
+		t.Fatalf("the symlink should be removable: %s", err)
+	}
+
+	sc = dial("reader")
+	defer sc.Close()
+	if _, err := sc.Create("file.txt"); err == nil {
+		t.Fatal("read only users should not write")
+	}
+	if err := sc.Remove("secret"); err == nil {
+		t.Fatal("read only users should not remove files")
+	}
+	if _, err := sc.Open(filepath.Join(home, "secret")); err != nil {
+		t.Fatalf("read only users should read: %s", err)
+	}
+}
+
+func TestAllowDenyUsers(t *testing.T) {
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+		AllowUsers:        []string{"dev-*@127.0.0.0/8", "ops@10.*", "admin"},
+		DenyUsers:         []string{"dev-guest"},
+	})
+	defer sd.Stop(context.Background())
+
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(user string) error {
+		client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+	for user, allowed := range map[string]bool{
+		"dev-alice": true,
+		"admin":     true,
+		"dev-guest": false,
+		"ops":       false,
+		"other":     false,
+	} {
+		err := dial(user)
+		if allowed && err != nil {
+			t.Fatalf("%s should be allowed: %s", user, err)
+		}
+		if !allowed && err == nil {
+			t.Fatalf("%s should be denied", user)
+		}
+	}
+
+	if _, err := parseUserPatterns([]string{"alice@10.0.0.0/33"}); err == nil {
+		t.Fatal("invalid CIDR expected to fail")
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	received := make(chan *auditRecord, 16)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rec := &auditRecord{}
+		if err := json.NewDecoder(r.Body).Decode(rec); err != nil {
+			t.Errorf("invalid webhook payload: %s", err)
+		}
+		received <- rec
+	}))
+	defer hook.Close()
+
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		Webhooks: []*WebhookConf{
+			{
+				URL:     hook.URL,
+				Events:  []string{"auth", "session_open", "session_close"},
+				Headers: map[string]string{"Authorization": "Bearer token"},
+			},
+		},
+	})
+	defer sd.Stop(context.Background())
+	conn := getSSHConn(sshdPort)
+	session, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Run("true")
+	conn.Stop()
+
+	// the events are sent in order, exec is filtered out
+	for _, event := range []string{"auth", "session_open", "session_close"} {
+		select {
+		case rec := <-received:
+			if rec.Event != event || !rec.Success || rec.User == "" {
+				t.Fatalf("expected a successful %s event, got %+v", event, rec)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing %s event", event)
+		}
+	}
+
+	if _, err := newWebhook(&WebhookConf{URL: hook.URL, Events: []string{"login"}}); err == nil {
+		t.Fatal("unknown events should fail")
+	}
+}
+
+func TestAuthorizedPrincipals(t *testing.T) {
+	dir := t.TempDir()
+	_, caPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ca, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pub")
+	if err := os.WriteFile(caFile, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	principalsDir := filepath.Join(dir, "principals")
+	os.Mkdir(principalsDir, 0700)
+	if err := os.WriteFile(filepath.Join(principalsDir, "deploy"), []byte("# ci robots\nci-bot\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:                      "../../testdata/server",
+		ListenAddress:            "127.0.0.1:0",
+		TrustedUserCAKeys:        []string{caFile},
+		AuthorizedPrincipalsFile: filepath.Join(principalsDir, "%u"),
+	})
+	defer sd.Stop(context.Background())
+
+	certSigner := func(principals []string, validBefore time.Time) ssh.Signer {
+		_, priv, _ := ed25519.GenerateKey(rand.Reader)
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &ssh.Certificate{
+			Key:             signer.PublicKey(),
+			CertType:        ssh.UserCert,
+			ValidPrincipals: principals,
+			ValidBefore:     uint64(validBefore.Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		cs, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cs
+	}
+	dial := func(user string, signer ssh.Signer) error {
+		client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	valid := time.Now().Add(time.Hour)
+	if err := dial("deploy", certSigner([]string{"ci-bot"}, valid)); err != nil {
+		t.Fatalf("the principal listed in the user file should log in: %s", err)
+	}
+	if err := dial("deploy", certSigner([]string{"deploy"}, valid)); err == nil {
+		t.Fatal("the user file should replace the user name principal")
+	}
+	// no principals file for the user: the principal must be the user name
+	if err := dial("alice", certSigner([]string{"alice"}, valid)); err != nil {
+		t.Fatalf("the user name principal should log in: %s", err)
+	}
+	if err := dial("alice", certSigner([]string{"ci-bot"}, valid)); err == nil {
+		t.Fatal("other principals should not log in")
+	}
+	if err := dial("deploy", certSigner([]string{"ci-bot"}, time.Now().Add(-time.Hour))); err == nil {
+		t.Fatal("expired certificates should not log in")
+	}
+}
+
+func TestHTTPVhosts(t *testing.T) {
+	sd, sshdPort := startDWithConf(&SshDConf{
+		Key:           "../../testdata/server",
+		ListenAddress: "127.0.0.1:0",
+		HTTPVhosts: &HTTPVhostsConf{
+			Domain:        "relay.example.com",
+			ListenAddress: "127.0.0.1:0",
+		},
+	})
+	defer sd.Stop(context.Background())
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	// serve the forwarded connections as a tiny web app
+	chans := conn.Client.HandleChannelOpen("forwarded-tcpip")
+	go func() {
+		for nc := range chans {
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				defer ch.Close()
+				req, err := http.ReadRequest(bufio.NewReader(ch))
+				if err != nil {
+					return
+				}
+				body := "hello from " + req.Header.Get("X-Forwarded-Host")
+				fmt.Fprintf(ch, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+			}()
+		}
+	}()
+
+	forward := func(name string) bool {
+		payload := ssh.Marshal(&struct {
+			Addr string
+			Port uint32
+		}{name, 0})
+		ok, _, err := conn.Client.SendRequest("tcpip-forward", true, payload)
+		return err == nil && ok
+	}
+	if !forward("app1") {
+		t.Fatal("forward request failed")
+	}
+	if forward("app1.relay.example.com") {
+		t.Fatal("a virtual host can't be claimed twice")
+	}
+
+	addrs := sd.GetVhostsAddrs()
+	if len(addrs) != 1 {
+		t.Fatalf("expected 1 vhosts listener, got %d", len(addrs))
+	}
+	get := func(host string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addrs[0].String()+"/", nil)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	status, body := get("app1.relay.example.com")
+	if status != http.StatusOK || body != "hello from app1.relay.example.com" {
+		t.Fatalf("unexpected response %d %q", status, body)
+	}
+	if status, _ := get("app2.relay.example.com"); status != http.StatusNotFound {
+		t.Fatalf("expected not found for an unknown host, got %d", status)
+	}
+}
+
+func TestReloadKeys(t *testing.T) {
+	sd, sshdPort := startD(false)
+
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func() (string, error) {
+		var fingerprint string
+		client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+			User: "test",
+			Auth: []ssh.AuthMethod{auth},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				fingerprint = ssh.FingerprintSHA256(key)
+				return nil
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+		client.Close()
+		return fingerprint, nil
+	}
+	before, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	emptyKeys := filepath.Join(dir, "authorized_keys")
+	if err := os.WriteFile(emptyKeys, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := &SshDConf{
+		Key:               filepath.Join(dir, "server_key"),
+		AuthorizedKeysURI: []string{emptyKeys},
+	}
+	if err := sd.ReloadKeys(conf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial(); err == nil {
+		t.Fatal("the client key should not be authorized anymore")
+	}
+
+	conf.AuthorizedKeysURI = []string{"../../testdata/authorized_keys"}
+	if err := sd.ReloadKeys(conf); err != nil {
+		t.Fatal(err)
+	}
+	after, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after == before {
+		t.Fatal("the reloaded host key should be used")
+	}
+
+	if err := sd.ReloadKeys(&SshDConf{}); err == nil {
+		t.Fatal("a reload without host keys should fail")
+	}
+}
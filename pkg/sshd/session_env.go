@@ -0,0 +1,42 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/rpty"
+)
+
+// splitAddr returns the host and port of addr. Addresses without
+// a port (like unix sockets) get the OpenSSH UNKNOWN placeholders
+func splitAddr(addr net.Addr) (string, string) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "UNKNOWN", "65535"
+	}
+	return host, port
+}
+
+// sshEnv returns the standard ssh session environment variables
+// (SSH_CONNECTION, SSH_CLIENT and SSH_TTY)
+func (s *channelHandler) sshEnv(pty rpty.Pty) []string {
+	clientHost, clientPort := splitAddr(s.sshConn.RemoteAddr())
+	serverHost, serverPort := splitAddr(s.sshConn.LocalAddr())
+
+	env := []string{
+		fmt.Sprintf("SSH_CONNECTION=%s %s %s %s", clientHost, clientPort, serverHost, serverPort),
+		fmt.Sprintf("SSH_CLIENT=%s %s %s", clientHost, clientPort, serverPort),
+	}
+	if pty != nil && pty.Name() != "" {
+		env = append(env, fmt.Sprintf("SSH_TTY=%s", pty.Name()))
+	}
+	return env
+}
+
+// acceptRestrictedEnv returns true if the client variable name can be
+// set for the sessions under a command restriction. Only the locale
+// ones are accepted
+func acceptRestrictedEnv(name string) bool {
+	return name == "LANG" || strings.HasPrefix(name, "LC_")
+}
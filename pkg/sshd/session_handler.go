@@ -3,31 +3,70 @@ package sshd
 import (
 	"net"
 
+	"github.com/ferama/rospo/pkg/logger"
 	"github.com/ferama/rospo/pkg/rio"
 	"golang.org/x/crypto/ssh"
 )
 
 type sessionHandler struct {
+	server       *sshServer
 	sshConn      *ssh.ServerConn
 	listener     net.Listener
 	listenerAddr string
 	listenerPort uint32
+	// if not empty, the listener is a unix socket listening
+	// at this path (streamlocal-forward)
+	socketPath string
+	// nil if the traffic is not limited
+	meter *trafficMeter
+
+	log *logger.Logger
 }
 
-func newSessionHandler(sshConn *ssh.ServerConn,
+func newSessionHandler(server *sshServer,
+	sshConn *ssh.ServerConn,
 	ln net.Listener,
 	laddr string,
-	lport uint32) *sessionHandler {
+	lport uint32,
+	socketPath string) *sessionHandler {
 
 	return &sessionHandler{
+		server:       server,
 		sshConn:      sshConn,
 		listener:     ln,
 		listenerAddr: laddr,
 		listenerPort: lport,
+		socketPath:   socketPath,
+		log:          sessionLogger(sshConn),
 	}
 }
 
+func (s *sessionHandler) handleStreamLocalClient(client net.Conn) {
+	var payload = struct {
+		SocketPath string
+		Reserved   string
+	}{
+		s.socketPath, "",
+	}
+
+	c, requests, err := s.sshConn.OpenChannel("forwarded-streamlocal@openssh.com", ssh.Marshal(payload))
+	if err != nil {
+		s.log.Errorf("Unable to get channel: %s. Hanging up requesting party!", err)
+		client.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	c, closed := s.server.metrics.openChannel("forwarded-streamlocal@openssh.com", c)
+	rio.CopyConnWithOnClose(s.meter.channel(c), client, false, closed)
+	s.log.Printf("ended streamlocal forward session: %s", s.socketPath)
+}
+
 func (s *sessionHandler) handleClient(client net.Conn) {
+	if s.socketPath != "" {
+		s.handleStreamLocalClient(client)
+		return
+	}
+
 	remotetcpaddr := client.RemoteAddr().(*net.TCPAddr)
 	raddr := remotetcpaddr.IP.String()
 	rport := uint32(remotetcpaddr.Port)
@@ -45,27 +84,28 @@ func (s *sessionHandler) handleClient(client net.Conn) {
 
 	c, requests, err := s.sshConn.OpenChannel("forwarded-tcpip", mpayload)
 	if err != nil {
-		log.Printf("Unable to get channel: %s. Hanging up requesting party!", err)
+		s.log.Errorf("Unable to get channel: %s. Hanging up requesting party!", err)
 		client.Close()
 		return
 	}
 	go ssh.DiscardRequests(requests)
-	rio.CopyConn(c, client)
-	log.Printf("ended forward session: %s", client.LocalAddr())
+	c, closed := s.server.metrics.openChannel("forwarded-tcpip", c)
+	rio.CopyConnWithOnClose(s.meter.channel(c), client, false, closed)
+	s.log.Printf("ended forward session: %s", client.LocalAddr())
 }
 
 func (s *sessionHandler) handleSession() {
 	for {
 		client, err := s.listener.Accept()
 		if err != nil {
-			neterr := err.(net.Error)
-			if neterr.Timeout() {
-				log.Printf("Accept failed with timeout: %s", err)
+			neterr, ok := err.(net.Error)
+			if ok && neterr.Timeout() {
+				s.log.Errorf("Accept failed with timeout: %s", err)
 				continue
 			}
 			break
 		}
-		log.Printf("started forward session: %s", client.LocalAddr())
+		s.log.Printf("started forward session: %s", client.LocalAddr())
 
 		go s.handleClient(client)
 	}
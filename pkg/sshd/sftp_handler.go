@@ -0,0 +1,283 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// validateSftpPaths checks the sftp_allowed_paths values
+func validateSftpPaths(paths []string) error {
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("sftp allowed path '%s' must be absolute", p)
+		}
+	}
+	return nil
+}
+
+// sftpHandler serves the sftp requests on the local filesystem, confining
+// them inside the allowed paths
+type sftpHandler struct {
+	readOnly bool
+	allowed  []string
+	// the allowed paths with symlinks resolved
+	resolved []string
+}
+
+func newSftpHandler(allowed []string, readOnly bool) *sftpHandler {
+	h := &sftpHandler{
+		readOnly: readOnly,
+	}
+	for _, p := range allowed {
+		h.allowed = append(h.allowed, filepath.Clean(p))
+		h.resolved = append(h.resolved, resolvePath(filepath.Clean(p)))
+	}
+	return h
+}
+
+// handlers returns the sftp request server handlers
+func (h *sftpHandler) handlers() sftp.Handlers {
+	return sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}
+}
+
+// startDirectory returns the directory relative paths are resolved
+// against: dir if allowed, the first allowed path otherwise
+func (h *sftpHandler) startDirectory(dir string) string {
+	if dir != "" && h.check(dir) == nil {
+		return dir
+	}
+	return h.allowed[0]
+}
+
+// resolvePath resolves the symlinks of the longest existing
+// ancestor of p
+func resolvePath(p string) string {
+	if r, err := filepath.EvalSymlinks(p); err == nil {
+		return r
+	}
+	parent := filepath.Dir(p)
+	if parent == p {
+		return p
+	}
+	return filepath.Join(resolvePath(parent), filepath.Base(p))
+}
+
+func isPathInside(p string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns a permission error if p is outside the allowed
+// paths, even through symlinks
+func (h *sftpHandler) check(p string) error {
+	if !isPathInside(p, h.allowed) || !isPathInside(resolvePath(p), h.resolved) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// checkNoFollow is like check, but p itself can be a symlink pointing
+// outside the allowed paths. For the operations not following it
+func (h *sftpHandler) checkNoFollow(p string) error {
+	resolved := filepath.Join(resolvePath(filepath.Dir(p)), filepath.Base(p))
+	if !isPathInside(p, h.allowed) || !isPathInside(resolved, h.resolved) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	if err := h.check(r.Filepath); err != nil {
+		return nil, err
+	}
+	return os.Open(r.Filepath)
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.OpenFile(r)
+}
+
+func (h *sftpHandler) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	if h.readOnly {
+		return nil, os.ErrPermission
+	}
+	if err := h.check(r.Filepath); err != nil {
+		return nil, err
+	}
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Append {
+		flags |= os.O_APPEND
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return os.OpenFile(r.Filepath, flags, 0644)
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	if h.readOnly {
+		return os.ErrPermission
+	}
+	switch r.Method {
+	case "Setstat":
+		if err := h.check(r.Filepath); err != nil {
+			return err
+		}
+		return h.setstat(r)
+	case "Rename", "Link":
+		if err := h.checkNoFollow(r.Filepath); err != nil {
+			return err
+		}
+		if err := h.checkNoFollow(r.Target); err != nil {
+			return err
+		}
+		if r.Method == "Link" {
+			return os.Link(r.Filepath, r.Target)
+		}
+		return os.Rename(r.Filepath, r.Target)
+	case "Rmdir", "Remove", "Mkdir":
+		if err := h.checkNoFollow(r.Filepath); err != nil {
+			return err
+		}
+		if r.Method == "Mkdir" {
+			return os.Mkdir(r.Filepath, 0755)
+		}
+		return os.Remove(r.Filepath)
+	case "Symlink":
+		// r.Filepath is the target and r.Target the link. The
+		// target is checked when the link is followed
+		if err := h.checkNoFollow(r.Target); err != nil {
+			return err
+		}
+		return os.Symlink(r.Filepath, r.Target)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) setstat(r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		if err := os.Truncate(r.Filepath, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(r.Filepath, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		atime := time.Unix(int64(attrs.Atime), 0)
+		mtime := time.Unix(int64(attrs.Mtime), 0)
+		if err := os.Chtimes(r.Filepath, atime, mtime); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := os.Chown(r.Filepath, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	check := h.check
+	if r.Method == "Readlink" {
+		check = h.checkNoFollow
+	}
+	if err := check(r.Filepath); err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			infos = append(infos, info)
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		info, err := os.Stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	case "Readlink":
+		target, err := os.Readlink(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{linkInfo(target)}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	if err := h.checkNoFollow(r.Filepath); err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+// listerAt implements sftp.ListerAt over a slice
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// linkInfo is the file info returned for Readlink requests: only
+// the name, holding the link target, is used
+type linkInfo string
+
+func (l linkInfo) Name() string       { return string(l) }
+func (l linkInfo) Size() int64        { return 0 }
+func (l linkInfo) Mode() os.FileMode  { return os.ModeSymlink }
+func (l linkInfo) ModTime() time.Time { return time.Time{} }
+func (l linkInfo) IsDir() bool        { return false }
+func (l linkInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,105 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// userPattern is an allow_users or deny_users entry: a user name
+// pattern, optionally followed by @ and a client host pattern or CIDR
+type userPattern struct {
+	user string
+	host string
+	// set if host is a CIDR
+	network *net.IPNet
+}
+
+// parseUserPatterns parses allow_users and deny_users entries
+func parseUserPatterns(patterns []string) ([]*userPattern, error) {
+	res := []*userPattern{}
+	for _, p := range patterns {
+		user, host, hasHost := strings.Cut(p, "@")
+		if user == "" || (hasHost && host == "") {
+			return nil, fmt.Errorf("invalid user pattern '%s'", p)
+		}
+		up := &userPattern{user: user, host: host}
+		if strings.Contains(host, "/") {
+			_, network, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid user pattern '%s': %s", p, err)
+			}
+			up.network = network
+		}
+		res = append(res, up)
+	}
+	return res, nil
+}
+
+// matchWildcard matches s against pattern, where * matches any
+// sequence of characters and ? any single character
+func matchWildcard(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// matches returns true if the pattern matches the user connecting
+// from addr
+func (p *userPattern) matches(user string, addr net.Addr) bool {
+	if !matchWildcard(p.user, user) {
+		return false
+	}
+	if p.host == "" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	if p.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && p.network.Contains(ip)
+	}
+	return matchWildcard(p.host, host)
+}
+
+// checkUserAccess returns an error if the connection user is denied
+// by the deny_users patterns or not matched by the allow_users ones
+func (s *sshServer) checkUserAccess(conn ssh.ConnMetadata) error {
+	for _, p := range s.denyUsers {
+		if p.matches(conn.User(), conn.RemoteAddr()) {
+			return fmt.Errorf("user %s denied", conn.User())
+		}
+	}
+	if len(s.allowUsers) == 0 {
+		return nil
+	}
+	for _, p := range s.allowUsers {
+		if p.matches(conn.User(), conn.RemoteAddr()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("user %s not allowed", conn.User())
+}
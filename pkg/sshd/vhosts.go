@@ -0,0 +1,232 @@
+package sshd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var errVhostInUse = errors.New("virtual host already in use")
+
+// the http servers timeouts. No read or write timeout: the proxied
+// requests and responses can be long lived streams
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// newHTTPServer returns an http server for handler, closing the clients
+// slow to send the request headers and the idle keep alive connections
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+}
+
+// vhosts is the http front-end of the server. It routes the requests to
+// the reverse forwards by host name: a forward named "app1" (ssh -R
+// app1:0:localhost:3000) is served at app1.<domain>
+type vhosts struct {
+	server *sshServer
+	conf   *HTTPVhostsConf
+	domain string
+
+	proxy *httputil.ReverseProxy
+	// nil if the https listener uses a static certificate
+	certManager *autocert.Manager
+
+	listeners   []net.Listener
+	listenersMu sync.Mutex
+	// serializes the check and the registration of the forward
+	// names, so that a host is never claimed twice
+	claimMu sync.Mutex
+}
+
+func newVhosts(server *sshServer, conf *HTTPVhostsConf) (*vhosts, error) {
+	domain := strings.Trim(strings.ToLower(conf.Domain), ".")
+	if domain == "" {
+		return nil, errors.New("http_vhosts domain is not set")
+	}
+	if conf.ListenAddress == "" && conf.TLSListenAddress == "" {
+		return nil, errors.New("http_vhosts needs a listen_address or a tls_listen_address")
+	}
+	if (conf.TLSCert == "") != (conf.TLSKey == "") {
+		return nil, errors.New("http_vhosts tls_cert and tls_key must be set together")
+	}
+	v := &vhosts{
+		server: server,
+		conf:   conf,
+		domain: domain,
+	}
+	v.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			proto := "http"
+			if req.TLS != nil {
+				proto = "https"
+			}
+			req.Header.Set("X-Forwarded-Host", req.Host)
+			req.Header.Set("X-Forwarded-Proto", proto)
+			req.URL.Scheme = "http"
+			req.URL.Host = req.Host
+		},
+		Transport: &http.Transport{
+			DialContext:         v.dialForward,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("vhost %s: %s", req.Host, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	if conf.TLSListenAddress != "" && conf.TLSCert == "" {
+		v.certManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Email:      conf.AutocertEmail,
+			HostPolicy: v.hostPolicy,
+		}
+		if conf.AutocertCacheDir != "" {
+			v.certManager.Cache = autocert.DirCache(conf.AutocertCacheDir)
+		}
+	}
+	return v, nil
+}
+
+// hostname returns the virtual host served by a forward named name, or
+// an empty string if the name doesn't identify a virtual host. Names are
+// either a single label, like "app1", or a host under the vhosts domain
+func (v *vhosts) hostname(name string) string {
+	name = strings.Trim(strings.ToLower(name), ".")
+	if strings.HasSuffix(name, "."+v.domain) {
+		name = strings.TrimSuffix(name, "."+v.domain)
+	}
+	if name == "" || name == "localhost" || strings.ContainsAny(name, ".:*[]") {
+		return ""
+	}
+	return name + "." + v.domain
+}
+
+// forward returns the forward serving host, if any
+func (v *vhosts) forward(host string) (ForwardInfo, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(strings.ToLower(host), ".")
+	for _, info := range v.server.Forwards("") {
+		if info.Type == "tcpip-forward" && v.hostname(info.Name) == host {
+			return info, true
+		}
+	}
+	return ForwardInfo{}, false
+}
+
+// hostPolicy allows the automatic certificates for the registered hosts only
+func (v *vhosts) hostPolicy(ctx context.Context, host string) error {
+	if _, ok := v.forward(host); !ok {
+		return fmt.Errorf("unknown virtual host %s", host)
+	}
+	return nil
+}
+
+// dialForward connects to the listener of the forward serving the
+// request host. addr is the host:port the transport is dialing
+func (v *vhosts) dialForward(ctx context.Context, network, addr string) (net.Conn, error) {
+	info, ok := v.forward(addr)
+	if !ok {
+		return nil, fmt.Errorf("unknown virtual host %s", addr)
+	}
+	host, port, err := net.SplitHostPort(info.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+}
+
+func (v *vhosts) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if _, ok := v.forward(req.Host); !ok {
+		http.Error(w, "unknown virtual host", http.StatusNotFound)
+		return
+	}
+	v.proxy.ServeHTTP(w, req)
+}
+
+// start starts the http and https listeners
+func (v *vhosts) start() error {
+	if v.conf.ListenAddress != "" {
+		listener, err := net.Listen("tcp", v.conf.ListenAddress)
+		if err != nil {
+			return err
+		}
+		var handler http.Handler = v
+		if v.certManager != nil {
+			// serves the http-01 challenges
+			handler = v.certManager.HTTPHandler(v)
+		}
+		v.addListener(listener)
+		log.Printf("http vhosts listening on %s", listener.Addr())
+		go newHTTPServer(handler).Serve(listener)
+	}
+	if v.conf.TLSListenAddress != "" {
+		var tlsConf *tls.Config
+		if v.certManager != nil {
+			tlsConf = v.certManager.TLSConfig()
+		} else {
+			cert, err := tls.LoadX509KeyPair(v.conf.TLSCert, v.conf.TLSKey)
+			if err != nil {
+				v.stop()
+				return err
+			}
+			tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		listener, err := tls.Listen("tcp", v.conf.TLSListenAddress, tlsConf)
+		if err != nil {
+			v.stop()
+			return err
+		}
+		v.addListener(listener)
+		log.Printf("https vhosts listening on %s", listener.Addr())
+		go newHTTPServer(v).Serve(listener)
+	}
+	return nil
+}
+
+func (v *vhosts) addListener(l net.Listener) {
+	v.listenersMu.Lock()
+	defer v.listenersMu.Unlock()
+	v.listeners = append(v.listeners, l)
+}
+
+func (v *vhosts) stop() {
+	v.listenersMu.Lock()
+	defer v.listenersMu.Unlock()
+	for _, l := range v.listeners {
+		l.Close()
+	}
+	v.listeners = nil
+}
+
+// addrs returns the addresses of the vhosts listeners, http first
+func (v *vhosts) addrs() []net.Addr {
+	v.listenersMu.Lock()
+	defer v.listenersMu.Unlock()
+	res := []net.Addr{}
+	for _, l := range v.listeners {
+		res = append(res, l.Addr())
+	}
+	return res
+}
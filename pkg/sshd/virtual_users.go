@@ -0,0 +1,78 @@
+package sshd
+
+import (
+	"fmt"
+	"os"
+)
+
+// validateUsers checks the virtual users configuration and creates
+// their home directories. If certAuth is true, users can log in with
+// certificates only
+func validateUsers(users []*UserConf, certAuth bool) (map[string]*UserConf, error) {
+	res := make(map[string]*UserConf)
+	for _, u := range users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("virtual user name can't be empty")
+		}
+		if _, ok := res[u.Name]; ok {
+			return nil, fmt.Errorf("duplicated virtual user '%s'", u.Name)
+		}
+		if len(u.AuthorizedKeysURI) == 0 && u.Password == "" && !certAuth {
+			return nil, fmt.Errorf("virtual user '%s' has neither authorized_keys nor password", u.Name)
+		}
+		if _, err := compileCommandPatterns(u.AllowedCommands); err != nil {
+			return nil, fmt.Errorf("virtual user '%s': %s", u.Name, err)
+		}
+		if err := validateRestrictedCommands(u.RestrictedCommands); err != nil {
+			return nil, fmt.Errorf("virtual user '%s': %s", u.Name, err)
+		}
+		if err := validateSftpPaths(u.SftpAllowedPaths); err != nil {
+			return nil, fmt.Errorf("virtual user '%s': %s", u.Name, err)
+		}
+		if u.Home != "" {
+			if err := os.MkdirAll(u.Home, 0700); err != nil {
+				return nil, fmt.Errorf("can't create home for virtual user '%s': %s", u.Name, err)
+			}
+		}
+		res[u.Name] = u
+	}
+	return res, nil
+}
+
+// hasVirtualUsers returns true if the server runs in virtual users mode
+func (s *sshServer) hasVirtualUsers() bool {
+	return len(s.users) > 0
+}
+
+// hasPasswordAuth returns true if any password authentication is configured
+func (s *sshServer) hasPasswordAuth() bool {
+	if s.password != "" {
+		return true
+	}
+	for _, u := range s.users {
+		if u.Password != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// virtualUserKeys returns the keys of the virtual user name authorized
+// keys sources. Empty if the user is unknown
+func (s *sshServer) virtualUserKeys(name string) map[string]bool {
+	u, ok := s.users[name]
+	if !ok {
+		return map[string]bool{}
+	}
+	return s.loadAuthorizedKeysFrom(u.AuthorizedKeysURI)
+}
+
+// virtualUserPasswordAuth returns true if password is the one of
+// the virtual user name
+func (s *sshServer) virtualUserPasswordAuth(name string, password string) bool {
+	u, ok := s.users[name]
+	if !ok || u.Password == "" {
+		return false
+	}
+	return u.Password == password
+}
@@ -0,0 +1,111 @@
+package sshd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// the max number of events waiting to be sent to a webhook. When
+	// the queue is full, new events are dropped
+	webhookQueueSize = 256
+	webhookTimeout   = 10 * time.Second
+)
+
+// the events a webhook can be notified of
+var webhookEvents = map[string]bool{
+	auditAuth:         true,
+	auditSessionOpen:  true,
+	auditSessionClose: true,
+	auditShell:        true,
+	auditExec:         true,
+	auditSubsystem:    true,
+	auditForward:      true,
+}
+
+// webhook POSTs the audit records of the configured events to
+// an http endpoint
+type webhook struct {
+	conf   *WebhookConf
+	events map[string]bool
+	client *http.Client
+
+	queue chan *auditRecord
+	once  sync.Once
+}
+
+func newWebhook(conf *WebhookConf) (*webhook, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid webhook url '%s'", conf.URL)
+	}
+	w := &webhook{
+		conf:   conf,
+		events: make(map[string]bool),
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan *auditRecord, webhookQueueSize),
+	}
+	for _, e := range conf.Events {
+		if !webhookEvents[e] {
+			return nil, fmt.Errorf("invalid webhook event '%s'", e)
+		}
+		w.events[e] = true
+	}
+	return w, nil
+}
+
+// notify queues rec to be sent, if the webhook is interested in it.
+// It never blocks
+func (w *webhook) notify(rec *auditRecord) {
+	if len(w.events) > 0 && !w.events[rec.Event] {
+		return
+	}
+	w.once.Do(func() {
+		go w.run()
+	})
+	// the record could be modified by the caller after notify returns
+	r := *rec
+	select {
+	case w.queue <- &r:
+	default:
+		log.Warnf("webhook %s queue is full, dropping %s event", w.conf.URL, rec.Event)
+	}
+}
+
+// run sends the queued records, in order
+func (w *webhook) run() {
+	for rec := range w.queue {
+		if err := w.post(rec); err != nil {
+			log.Errorf("webhook %s failed: %s", w.conf.URL, err)
+		}
+	}
+}
+
+func (w *webhook) post(rec *auditRecord) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+
+	"github.com/ferama/rospo/pkg/rio"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// the first display number tried for the forwarded X11 displays
+	x11DisplayOffset = 10
+	// how many displays to try before giving up
+	x11MaxDisplays = 1000
+)
+
+// x11Forward listens on a local X11 display and carries back every
+// connection to the client through x11 channels
+type x11Forward struct {
+	sshConn  *ssh.ServerConn
+	meter    *trafficMeter
+	listener net.Listener
+
+	display          int
+	screen           uint32
+	singleConnection bool
+	authProtocol     string
+	authCookie       string
+}
+
+func newX11Forward(sshConn *ssh.ServerConn, meter *trafficMeter, payload []byte) (*x11Forward, error) {
+	var req = struct {
+		SingleConnection bool
+		AuthProtocol     string
+		AuthCookie       string
+		ScreenNumber     uint32
+	}{}
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	x := &x11Forward{
+		sshConn:          sshConn,
+		meter:            meter,
+		screen:           req.ScreenNumber,
+		singleConnection: req.SingleConnection,
+		authProtocol:     req.AuthProtocol,
+		authCookie:       req.AuthCookie,
+	}
+
+	for d := x11DisplayOffset; d < x11DisplayOffset+x11MaxDisplays; d++ {
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", 6000+d))
+		if err != nil {
+			continue
+		}
+		x.listener = listener
+		x.display = d
+		break
+	}
+	if x.listener == nil {
+		return nil, fmt.Errorf("no free X11 display available")
+	}
+
+	if err := x.xauth("add", x.xauthDisplay(), x.authProtocol, x.authCookie); err != nil {
+		sessionLogger(sshConn).Errorf("unable to set X11 auth cookie: %s", err)
+	}
+
+	go x.serve()
+	return x, nil
+}
+
+// Display returns the value to be exported as DISPLAY
+func (x *x11Forward) Display() string {
+	return fmt.Sprintf("localhost:%d.%d", x.display, x.screen)
+}
+
+func (x *x11Forward) xauthDisplay() string {
+	return "unix:" + strconv.Itoa(x.display)
+}
+
+func (x *x11Forward) xauth(args ...string) error {
+	out, err := exec.Command("xauth", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	return nil
+}
+
+func (x *x11Forward) serve() {
+	for {
+		conn, err := x.listener.Accept()
+		if err != nil {
+			return
+		}
+		origin := conn.RemoteAddr().(*net.TCPAddr)
+		var payload = struct {
+			OriginAddr string
+			OriginPort uint32
+		}{
+			origin.IP.String(), uint32(origin.Port),
+		}
+		channel, reqs, err := x.sshConn.OpenChannel("x11", ssh.Marshal(payload))
+		if err != nil {
+			sessionLogger(x.sshConn).Errorf("unable to open x11 channel: %s", err)
+			conn.Close()
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+		go rio.CopyConn(x.meter.channel(channel), conn)
+
+		if x.singleConnection {
+			x.listener.Close()
+			return
+		}
+	}
+}
+
+// Close stops the display listener and removes the auth cookie
+func (x *x11Forward) Close() {
+	x.listener.Close()
+	x.xauth("remove", x.xauthDisplay())
+}
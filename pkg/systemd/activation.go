@@ -0,0 +1,133 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// activatedSocket is a listening socket passed by systemd
+type activatedSocket struct {
+	file *os.File
+	// the FileDescriptorName of the socket unit
+	name string
+	addr net.Addr
+	// identifies the listener that took the socket. Empty if free
+	owner string
+}
+
+var (
+	sockets     []*activatedSocket
+	socketsOnce sync.Once
+	socketsMU   sync.Mutex
+)
+
+// loadSockets reads the sockets passed by systemd. The LISTEN_
+// variables are unset, so that they don't leak to the child processes
+func loadSockets() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		closeOnExec(fd)
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		// FileListener works on a dup, the file stays open
+		l, err := net.FileListener(file)
+		if err != nil {
+			log.Printf("ignoring the activated socket %s: %s", name, err)
+			continue
+		}
+		sockets = append(sockets, &activatedSocket{file: file, name: name, addr: l.Addr()})
+		l.Close()
+	}
+	if len(sockets) > 0 {
+		log.Printf("%d activated sockets received", len(sockets))
+	}
+}
+
+// Listener returns a listener on the socket passed by systemd whose
+// FileDescriptorName is name or that listens on addr, a host:port
+// address or a unix socket path. nil if there is none. A socket is
+// given to one name and addr pair only, so that many listeners with the
+// same name get different sockets. The listener is built on a copy of
+// the socket: it can be closed and asked again, like on a restart
+func Listener(name string, addr string) (net.Listener, error) {
+	socketsOnce.Do(loadSockets)
+
+	socketsMU.Lock()
+	defer socketsMU.Unlock()
+	owner := name + "\x00" + addr
+	var found *activatedSocket
+	for _, s := range sockets {
+		if s.owner == owner {
+			found = s
+		}
+	}
+	for _, s := range sockets {
+		if found == nil && s.owner == "" && name != "" && s.name == name {
+			found = s
+		}
+	}
+	for _, s := range sockets {
+		if found == nil && s.owner == "" && addrMatches(s.addr, addr) {
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	if found.owner == "" {
+		found.owner = owner
+		log.Printf("using the activated socket %s for %s", found.name, found.addr)
+	}
+	return net.FileListener(found.file)
+}
+
+// addrMatches returns true if the socket address got is the listen
+// address want. An empty or unspecified host matches the unspecified
+// addresses on the same port
+func addrMatches(got net.Addr, want string) bool {
+	if want == "" {
+		return false
+	}
+	if got.Network() == "unix" {
+		return got.String() == strings.TrimPrefix(want, "unix:")
+	}
+	tcp, ok := got.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(want)
+	if err != nil || port != strconv.Itoa(tcp.Port) {
+		return false
+	}
+	if host == "" {
+		return tcp.IP.IsUnspecified()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// a host name
+		return false
+	}
+	return ip.Equal(tcp.IP) || (ip.IsUnspecified() && tcp.IP.IsUnspecified())
+}
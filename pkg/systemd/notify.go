@@ -0,0 +1,86 @@
+// Package systemd implements the systemd service protocols without
+// linking libsystemd: the sd_notify state notifications, the watchdog
+// keep alive and the socket activation listeners
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ferama/rospo/pkg/logger"
+)
+
+var log = logger.NewLogger("[SYSD] ", logger.Blue)
+
+// Notify sends state to the service manager, like sd_notify. It does
+// nothing if the process is not run by systemd as a notify service
+func Notify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	// abstract namespace sockets start with @
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Ready tells systemd the service startup completed
+func Ready() {
+	notify("READY=1")
+}
+
+// Reloading tells systemd the service is reloading its config. Ready
+// must follow once done
+func Reloading() {
+	notify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", monotonicUsec()))
+}
+
+// Stopping tells systemd the service is shutting down
+func Stopping() {
+	notify("STOPPING=1")
+}
+
+func notify(state string) {
+	if err := Notify(state); err != nil {
+		log.Errorf("notify failed: %s", err)
+	}
+}
+
+// WatchdogInterval returns the watchdog timeout systemd expects the keep
+// alive notifications within. Zero if the watchdog is disabled
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// StartWatchdog sends the watchdog keep alive notifications in the
+// background, at half the watchdog timeout. It does nothing if the
+// watchdog is disabled
+func StartWatchdog() {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval / 2) {
+			notify("WATCHDOG=1")
+		}
+	}()
+}
@@ -0,0 +1,81 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	Ready()
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Fatalf("unexpected state %q", buf[:n])
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Notify("READY=1"); err != nil {
+		t.Fatalf("notify without systemd should do nothing: %s", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if WatchdogInterval() != 0 {
+		t.Fatal("the watchdog should be disabled")
+	}
+	t.Setenv("WATCHDOG_USEC", "3000000")
+	if WatchdogInterval() != 3*time.Second {
+		t.Fatalf("unexpected interval %s", WatchdogInterval())
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if WatchdogInterval() != 0 {
+		t.Fatal("the watchdog of another process should be ignored")
+	}
+}
+
+func TestAddrMatches(t *testing.T) {
+	any4 := &net.TCPAddr{IP: net.IPv4zero, Port: 2222}
+	any6 := &net.TCPAddr{IP: net.IPv6unspecified, Port: 2222}
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222}
+	unix := &net.UnixAddr{Name: "/run/rospo.sock", Net: "unix"}
+
+	cases := []struct {
+		got  net.Addr
+		want string
+		res  bool
+	}{
+		{any4, ":2222", true},
+		{any6, ":2222", true},
+		{any6, "0.0.0.0:2222", true},
+		{any4, ":2223", false},
+		{local, "127.0.0.1:2222", true},
+		{local, ":2222", false},
+		{local, "localhost:2222", false},
+		{unix, "/run/rospo.sock", true},
+		{unix, "unix:/run/rospo.sock", true},
+		{unix, "/run/other.sock", false},
+		{local, "", false},
+	}
+	for _, c := range cases {
+		if addrMatches(c.got, c.want) != c.res {
+			t.Errorf("addrMatches(%s, %s) should be %t", c.got, c.want, c.res)
+		}
+	}
+}
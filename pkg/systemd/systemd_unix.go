@@ -0,0 +1,26 @@
+//go:build !windows
+
+package systemd
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// monotonicUsec returns the CLOCK_MONOTONIC time in microseconds, the
+// clock systemd uses to match the reload notifications
+func monotonicUsec() int64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return ts.Nano() / int64(time.Microsecond)
+}
+
+// closeOnExec keeps the activated sockets out of the processes spawned
+// by the sshd sessions
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
@@ -0,0 +1,7 @@
+package systemd
+
+func monotonicUsec() int64 {
+	return 0
+}
+
+func closeOnExec(fd int) {}
@@ -0,0 +1,21 @@
+package tun
+
+import (
+	"net"
+
+	"github.com/ferama/rospo/pkg/systemd"
+)
+
+// activatedListener returns a listener on the socket passed by systemd
+// for the tunnel local endpoint: the one named like the tunnel or
+// listening on the same address. nil if there is none
+func (t *Tunnel) activatedListener() (net.Listener, error) {
+	addr := t.localEndpoint.String()
+	if !t.localEndpoint.IsUnix() {
+		var err error
+		if addr, err = t.localListenAddress(); err != nil {
+			return nil, err
+		}
+	}
+	return systemd.Listener(t.name, addr)
+}
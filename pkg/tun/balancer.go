@@ -0,0 +1,227 @@
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// The load balancing policies of the forward tunnels with
+// multiple remote endpoints. With the failover policy the endpoints are
+// always tried in order: the first is the primary, the others backups
+const (
+	BALANCE_ROUND_ROBIN       = "round_robin"
+	BALANCE_LEAST_CONNECTIONS = "least_connections"
+	BALANCE_FAILOVER          = "failover"
+)
+
+// how long a backend is skipped after a dial failure. Once expired the
+// backend is probed again by the next connection, so a failover tunnel
+// fails back to its primary
+const backendDownTimeout = 30 * time.Second
+
+// BackendStats holds the state of a load balanced remote endpoint
+type BackendStats struct {
+	Endpoint          string `json:"endpoint"`
+	ActiveConnections int64  `json:"active_connections"`
+	Healthy           bool   `json:"healthy"`
+}
+
+// backend is a load balanced remote endpoint
+type backend struct {
+	endpoint *utils.Endpoint
+	active   atomic.Int64
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func (b *backend) healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().After(b.downUntil)
+}
+
+// markDown marks the backend as unhealthy after a failure. It is
+// tried again after backendDownTimeout
+func (b *backend) markDown() {
+	b.mu.Lock()
+	b.downUntil = time.Now().Add(backendDownTimeout)
+	b.mu.Unlock()
+}
+
+// balancer distributes the tunnel connections across the backends.
+// The health is passive: the backends failing to dial are skipped
+// for a while
+type balancer struct {
+	policy   string
+	backends []*backend
+
+	mu   sync.Mutex
+	next int
+	// the last backend dialed
+	current *backend
+
+	log *logger.Logger
+}
+
+func newBalancer(policy string, endpoints []*utils.Endpoint, log *logger.Logger) *balancer {
+	if policy == "" {
+		policy = BALANCE_ROUND_ROBIN
+	}
+	b := &balancer{policy: policy, log: log}
+	for _, e := range endpoints {
+		b.backends = append(b.backends, &backend{endpoint: e})
+	}
+	return b
+}
+
+// candidates returns the backends in the order they should be tried:
+// the healthy ones by policy, then the unhealthy ones
+func (b *balancer) candidates() []*backend {
+	start := 0
+	if b.policy != BALANCE_FAILOVER {
+		b.mu.Lock()
+		start = b.next
+		b.next = (b.next + 1) % len(b.backends)
+		b.mu.Unlock()
+	}
+
+	healthy := []*backend{}
+	down := []*backend{}
+	for i := range b.backends {
+		be := b.backends[(start+i)%len(b.backends)]
+		if be.healthy() {
+			healthy = append(healthy, be)
+		} else {
+			down = append(down, be)
+		}
+	}
+	if b.policy == BALANCE_LEAST_CONNECTIONS {
+		// stable, so ties are broken round robin
+		for i := 1; i < len(healthy); i++ {
+			for j := i; j > 0 && healthy[j].active.Load() < healthy[j-1].active.Load(); j-- {
+				healthy[j], healthy[j-1] = healthy[j-1], healthy[j]
+			}
+		}
+	}
+	return append(healthy, down...)
+}
+
+// use records be as the last dialed backend, logging the failovers
+func (b *balancer) use(be *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.policy == BALANCE_FAILOVER && b.current != be && (b.current != nil || be != b.backends[0]) {
+		if be == b.backends[0] {
+			b.log.Printf("failing back to the primary endpoint %s", be.endpoint.String())
+		} else {
+			b.log.Printf("failing over to the backup endpoint %s", be.endpoint.String())
+		}
+	}
+	b.current = be
+}
+
+func (b *balancer) stats() []BackendStats {
+	res := []BackendStats{}
+	for _, be := range b.backends {
+		res = append(res, BackendStats{
+			Endpoint:          be.endpoint.String(),
+			ActiveConnections: be.active.Load(),
+			Healthy:           be.healthy(),
+		})
+	}
+	return res
+}
+
+// backendConn is a connection to a backend, accounted as active
+// until closed
+type backendConn struct {
+	net.Conn
+	backend   *backend
+	closeOnce sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.backend.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// buildBalancer builds the balancer of the tunnel destinations. nil if
+// the tunnel has a single destination
+func (t *Tunnel) buildBalancer() (*balancer, error) {
+	if len(t.remotes) == 0 && len(t.backups) == 0 {
+		return nil, nil
+	}
+	if len(t.remotes) > 0 && len(t.backups) > 0 {
+		return nil, errors.New("remotes and backups can't be used together")
+	}
+	if t.dynamic || t.udp {
+		return nil, errors.New("multiple destinations are not supported by dynamic and udp tunnels")
+	}
+
+	if len(t.backups) > 0 {
+		// the destination is the remote endpoint of forward tunnels
+		// and the local one of reverse tunnels
+		endpoints := []*utils.Endpoint{t.localEndpoint}
+		if t.forward {
+			endpoints = []*utils.Endpoint{t.remoteEndpoint}
+		}
+		for _, b := range t.backups {
+			endpoints = append(endpoints, utils.NewEndpoint(b))
+		}
+		return newBalancer(BALANCE_FAILOVER, endpoints, t.log), nil
+	}
+
+	if !t.forward {
+		return nil, errors.New("multiple remote endpoints are supported by forward tunnels only")
+	}
+	switch t.balance {
+	case "", BALANCE_ROUND_ROBIN, BALANCE_LEAST_CONNECTIONS:
+	default:
+		return nil, fmt.Errorf("invalid balance policy '%s'", t.balance)
+	}
+	endpoints := []*utils.Endpoint{t.remoteEndpoint}
+	for _, r := range t.remotes {
+		endpoints = append(endpoints, utils.NewEndpoint(r))
+	}
+	return newBalancer(t.balance, endpoints, t.log), nil
+}
+
+// dialTarget dials the tunnel destination: the remote endpoint, through
+// the ssh server, for forward tunnels and the local one for reverse
+// tunnels. With multiple endpoints, the balancer chooses the backend
+func (t *Tunnel) dialTarget() (net.Conn, error) {
+	dial := t.dialLocal
+	target := t.localEndpoint
+	if t.forward {
+		dial = t.dialRemote
+		target = t.remoteEndpoint
+	}
+	b := t.balancer.Load()
+	if b == nil {
+		return dial(target.Network(), target.String())
+	}
+	var lastErr error
+	for _, be := range b.candidates() {
+		conn, err := dial(be.endpoint.Network(), be.endpoint.String())
+		if err != nil {
+			t.log.Errorf("backend %s failed: %s", be.endpoint.String(), err)
+			be.markDown()
+			lastErr = err
+			continue
+		}
+		be.active.Add(1)
+		b.use(be)
+		return &backendConn{Conn: conn, backend: be}, nil
+	}
+	return nil, lastErr
+}
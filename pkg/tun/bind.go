@@ -0,0 +1,72 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// resolveBindAddress returns the ip of the bind address. It can be an
+// ip, a host name or a local network interface name
+func resolveBindAddress(bind string) (string, error) {
+	iface, err := net.InterfaceByName(bind)
+	if err != nil {
+		// not an interface
+		return bind, nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	var found net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		// prefer the ipv4 addresses
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+		if found == nil {
+			found = ipnet.IP
+		}
+	}
+	if found == nil {
+		return "", fmt.Errorf("no address found for interface %s", bind)
+	}
+	return found.String(), nil
+}
+
+// localListenAddress returns the address of the local tcp and udp
+// listeners: the local endpoint, bound to the bind address if set
+func (t *Tunnel) localListenAddress() (string, error) {
+	if t.bindAddress == "" {
+		return t.localEndpoint.String(), nil
+	}
+	host, err := resolveBindAddress(t.bindAddress)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(t.localEndpoint.Port)), nil
+}
+
+// remoteListenAddress returns the address of the listeners on the ssh
+// server. The bind address is sent as is: the server gateway ports
+// policy decides if it is honored
+func (t *Tunnel) remoteListenAddress() string {
+	if t.bindAddress == "" || t.remoteEndpoint.IsUnix() {
+		return t.remoteEndpoint.String()
+	}
+	return net.JoinHostPort(t.bindAddress, strconv.Itoa(t.remoteEndpoint.Port))
+}
+
+// remoteListenAddressWithPort returns the remote listeners address
+// with a different port
+func (t *Tunnel) remoteListenAddressWithPort(port int) string {
+	host := t.bindAddress
+	if host == "" {
+		host = t.remoteEndpoint.Host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
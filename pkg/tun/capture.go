@@ -0,0 +1,309 @@
+package tun
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The capture formats
+const (
+	CAPTURE_PCAP = "pcap"
+	CAPTURE_RAW  = "raw"
+)
+
+const (
+	defaultCaptureMaxSize = 64 * 1024 * 1024
+
+	pcapLinkTypeRaw = 101
+	pcapSnapLen     = 262144
+	// the max payload of a synthesized tcp segment
+	pcapMaxSegment = 65000
+
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpPsh = 0x08
+	tcpAck = 0x10
+)
+
+// CaptureConf enables the traffic capture of a tunnel, for debugging.
+// The data of the tcp clients is written to a pcap file, readable by
+// wireshark, or to a raw dump. The capture stops at the first limit hit
+type CaptureConf struct {
+	// the file the traffic is written to. It is truncated on start
+	Path string `yaml:"path" json:"path"`
+	// pcap (the default) or raw. The pcap packets are synthesized from
+	// the streams: one tcp connection per client, between the client
+	// and the listener addresses. The raw dump is the plain data of each
+	// read and write, preceded by a header line
+	Format string `yaml:"format" json:"format"`
+	// the max capture size, in bytes. Defaults to 64MB
+	MaxSize int64 `yaml:"max_size" json:"max_size"`
+	// the max capture duration, in seconds. 0 means unlimited
+	MaxDuration int `yaml:"max_duration" json:"max_duration"`
+}
+
+// captureStream is the state of a client connection in the capture
+type captureStream struct {
+	clientIP, serverIP     net.IP
+	clientPort, serverPort uint16
+	clientSeq, serverSeq   uint32
+}
+
+// capture writes the traffic of a tunnel to a file
+type capture struct {
+	format   string
+	maxSize  int64
+	deadline time.Time
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	stopped bool
+	ipID    uint16
+	streams map[uint64]*captureStream
+
+	log func(format string, v ...any)
+}
+
+func newCapture(conf *CaptureConf, logf func(format string, v ...any)) (*capture, error) {
+	format := conf.Format
+	if format == "" {
+		format = CAPTURE_PCAP
+	}
+	if format != CAPTURE_PCAP && format != CAPTURE_RAW {
+		return nil, fmt.Errorf("invalid capture format '%s'", conf.Format)
+	}
+	if conf.Path == "" {
+		return nil, fmt.Errorf("the capture path is not set")
+	}
+	f, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &capture{
+		format:  format,
+		maxSize: conf.MaxSize,
+		f:       f,
+		w:       bufio.NewWriter(f),
+		streams: make(map[uint64]*captureStream),
+		log:     logf,
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = defaultCaptureMaxSize
+	}
+	if conf.MaxDuration > 0 {
+		c.deadline = time.Now().Add(time.Duration(conf.MaxDuration) * time.Second)
+	}
+	if format == CAPTURE_PCAP {
+		hdr := make([]byte, 24)
+		binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+		binary.LittleEndian.PutUint16(hdr[4:], 2)
+		binary.LittleEndian.PutUint16(hdr[6:], 4)
+		binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+		binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+		c.write(hdr)
+	}
+	logf("capturing the traffic to %s (%s)", conf.Path, format)
+	return c, nil
+}
+
+// write appends data to the capture file, stopping the capture if a
+// limit is hit. Called with the lock held
+func (c *capture) write(data []byte) bool {
+	if c.stopped {
+		return false
+	}
+	if !c.deadline.IsZero() && time.Now().After(c.deadline) {
+		c.stop("max duration reached")
+		return false
+	}
+	if c.size+int64(len(data)) > c.maxSize {
+		c.stop("max size reached")
+		return false
+	}
+	if _, err := c.w.Write(data); err != nil {
+		c.stop(err.Error())
+		return false
+	}
+	c.size += int64(len(data))
+	return true
+}
+
+// stop ends the capture. Called with the lock held
+func (c *capture) stop(reason string) {
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+	c.w.Flush()
+	c.f.Close()
+	c.log("capture stopped: %s", reason)
+}
+
+// close ends the capture, flushing the file
+func (c *capture) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stop("tunnel stopped")
+}
+
+// captureAddr returns the ipv4 address and the port of addr. The other
+// addresses, like the unix sockets ones, are replaced by fallback
+func captureAddr(addr net.Addr, fallback net.IP, port uint16) (net.IP, uint16) {
+	if a, ok := addr.(*net.TCPAddr); ok && a.IP.To4() != nil {
+		return a.IP.To4(), uint16(a.Port)
+	}
+	return fallback, port
+}
+
+// open records a new client connection
+func (c *capture) open(conn *statsConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.format == CAPTURE_RAW {
+		c.write([]byte(fmt.Sprintf("# %s conn #%d opened from %s\n",
+			time.Now().Format(time.RFC3339Nano), conn.id, conn.RemoteAddr())))
+		return
+	}
+	s := &captureStream{clientSeq: 1000, serverSeq: 2000}
+	s.clientIP, s.clientPort = captureAddr(conn.RemoteAddr(), net.IPv4(10, 0, 0, 1).To4(), uint16(1024+conn.id%60000))
+	s.serverIP, s.serverPort = captureAddr(conn.LocalAddr(), net.IPv4(10, 0, 0, 2).To4(), 80)
+	c.streams[conn.id] = s
+	c.packet(s, true, tcpSyn, nil)
+	s.clientSeq++
+	c.packet(s, false, tcpSyn|tcpAck, nil)
+	s.serverSeq++
+	c.packet(s, true, tcpAck, nil)
+}
+
+// data records the data sent by the client, or received by it
+func (c *capture) data(conn *statsConn, fromClient bool, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.format == CAPTURE_RAW {
+		dir := "<"
+		if fromClient {
+			dir = ">"
+		}
+		hdr := fmt.Sprintf("# %s conn #%d %s %d bytes\n",
+			time.Now().Format(time.RFC3339Nano), conn.id, dir, len(data))
+		if c.write([]byte(hdr)) {
+			c.write(append(append([]byte{}, data...), '\n'))
+		}
+		return
+	}
+	s, ok := c.streams[conn.id]
+	if !ok {
+		return
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > pcapMaxSegment {
+			n = pcapMaxSegment
+		}
+		c.packet(s, fromClient, tcpPsh|tcpAck, data[:n])
+		if fromClient {
+			s.clientSeq += uint32(n)
+		} else {
+			s.serverSeq += uint32(n)
+		}
+		data = data[n:]
+	}
+}
+
+// end records the closing of a client connection
+func (c *capture) end(conn *statsConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.format == CAPTURE_RAW {
+		c.write([]byte(fmt.Sprintf("# %s conn #%d closed\n",
+			time.Now().Format(time.RFC3339Nano), conn.id)))
+		return
+	}
+	s, ok := c.streams[conn.id]
+	if !ok {
+		return
+	}
+	delete(c.streams, conn.id)
+	c.packet(s, true, tcpFin|tcpAck, nil)
+	s.clientSeq++
+	c.packet(s, false, tcpFin|tcpAck, nil)
+	s.serverSeq++
+	c.packet(s, true, tcpAck, nil)
+}
+
+// packet writes an ipv4 tcp packet of the stream. Called with the lock held
+func (c *capture) packet(s *captureStream, fromClient bool, flags byte, payload []byte) {
+	srcIP, dstIP := s.clientIP, s.serverIP
+	srcPort, dstPort := s.clientPort, s.serverPort
+	seq, ack := s.clientSeq, s.serverSeq
+	if !fromClient {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = ack, seq
+	}
+	if flags&tcpAck == 0 {
+		ack = 0
+	}
+	pkt := make([]byte, 40+len(payload))
+	// ipv4 header
+	ip := pkt[:20]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)))
+	c.ipID++
+	binary.BigEndian.PutUint16(ip[4:], c.ipID)
+	binary.BigEndian.PutUint16(ip[6:], 0x4000)
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], srcIP)
+	copy(ip[16:20], dstIP)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+	// tcp header
+	tcp := pkt[20:]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	// the pseudo header sum
+	pseudo := uint32(6) + uint32(len(tcp))
+	for i := 0; i < 4; i += 2 {
+		pseudo += uint32(binary.BigEndian.Uint16(srcIP[i:]))
+		pseudo += uint32(binary.BigEndian.Uint16(dstIP[i:]))
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+
+	now := time.Now()
+	rec := make([]byte, 16, 16+len(pkt))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	c.write(append(rec, pkt...))
+}
+
+// checksum computes the internet checksum of data, starting from sum
+func checksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
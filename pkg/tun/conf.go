@@ -1,6 +1,8 @@
 package tun
 
 import (
+	"errors"
+
 	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/utils"
 )
@@ -8,12 +10,135 @@ import (
 // TunnelConf is a struct that holds the tunnel configuration
 type TunnelConf struct {
 	//// Tunnel conf
+	// the tunnel name and labels. They identify the tunnel in the
+	// status output, in the stats and in the logs
+	Name   string            `yaml:"name" json:"name"`
+	Labels map[string]string `yaml:"labels" json:"labels"`
+	// the endpoints are host:port addresses or unix socket paths.
+	// Socket paths are absolute or prefixed by unix:
 	Remote string `yaml:"remote" json:"remote"`
 	Local  string `yaml:"local" json:"local"`
+	// additional remote endpoints of forward tunnels. The connections are
+	// distributed across Remote and these ones, by the Balance policy:
+	// round_robin (the default) or least_connections. The endpoints
+	// failing to dial are skipped for a while
+	Remotes []string `yaml:"remotes" json:"remotes"`
+	Balance string   `yaml:"balance" json:"balance"`
+	// the backup destinations: remote endpoints for forward tunnels,
+	// local endpoints for reverse ones. When the destination fails to
+	// dial, the backups are tried in order. The failed destinations are
+	// probed again after a while, so the tunnel fails back to the primary
+	Backups []string `yaml:"backups" json:"backups"`
 	// indicates if it is a forward or reverse tunnel
 	Forward bool `yaml:"forward" json:"forward"`
+	// if true, a SOCKS5 proxy listens on the Local endpoint and every
+	// connection is forwarded to the requested destination through the
+	// ssh server, like ssh -D. Remote and Forward are ignored
+	Dynamic bool `yaml:"dynamic" json:"dynamic"`
+	// if true, a SOCKS5 proxy listens on the Remote endpoint of the ssh
+	// server and the destinations are dialed from the local machine, like
+	// ssh -R with no destination. Local and Forward are ignored
+	RemoteDynamic bool `yaml:"remote_dynamic" json:"remote_dynamic"`
+	// if true, the endpoints are udp. The datagrams received on the Local
+	// endpoint are sent to the Remote one by the ssh server, and the
+	// replies carried back. Supported by forward tunnels only, and it
+	// requires a rospo sshd server
+	Udp bool `yaml:"udp" json:"udp"`
+	// the permissions, in octal notation, of the local unix socket when
+	// Local is a socket path and the listener is local. Defaults to 0600
+	SocketPermissions string `yaml:"socket_permissions" json:"socket_permissions"`
+	// the maximum throughput of the tunnel, all clients included, in bytes
+	// per second. It applies to each direction. 0 means unlimited
+	RateLimit int64 `yaml:"rate_limit" json:"rate_limit"`
+	// if true, a json line with the listener address and port is printed
+	// on stdout once listening. Useful with port 0 listeners
+	PrintPort bool `yaml:"print_port" json:"print_port"`
+	// if set, the listener port is written to this file once listening.
+	// The file is removed when the tunnel is stopped
+	PortFile string `yaml:"port_file" json:"port_file"`
+	// the address the tunnel listener is bound to: an ip, a host name or,
+	// for local listeners, a network interface name. It overrides the host
+	// of the listener endpoint, that defaults to 127.0.0.1 when empty.
+	// Use 0.0.0.0 to listen on all the interfaces
+	BindAddress string `yaml:"bind_address" json:"bind_address"`
+	// the CIDRs or ips of the clients allowed to connect to the tunnel
+	// listener. The other connections are closed once accepted. Empty
+	// allows any client
+	AllowedSources []string `yaml:"allowed_sources" json:"allowed_sources"`
+	// the maximum tcp connections forwarded at once. 0 means unlimited
+	MaxConnections int `yaml:"max_connections" json:"max_connections"`
+	// how many connections exceeding max_connections can wait for a free
+	// slot. The others are closed once accepted. Defaults to 0
+	ConnectionsQueue int `yaml:"connections_queue" json:"connections_queue"`
+	// if set, the tunnel listener clients must complete a mutual tls
+	// handshake, presenting a certificate signed by the client CA. Meant
+	// for reverse tunnels exposed on public servers
+	MTLS *MTLSConf `yaml:"mtls" json:"mtls"`
+	// if set to v1 or v2, a PROXY protocol header carrying the client
+	// address is sent to the target service before the client data.
+	// Not supported by dynamic and udp tunnels
+	ProxyProtocol string `yaml:"proxy_protocol" json:"proxy_protocol"`
+	// the remote ports, as a "first-last" range, tried in order when the
+	// remote endpoint port is busy, e.g. after an unclean disconnection.
+	// The listener is reported like the port 0 ones
+	FallbackPorts string `yaml:"fallback_ports" json:"fallback_ports"`
+	// what forward tcp tunnels do with the clients while the ssh
+	// connection is down. With "close" (the default) the listener is
+	// closed until the connection is reestablished. With "hold" the
+	// listener stays open and the new clients wait for the connection up
+	// to reconnect_hold_timeout seconds (default 10). With "reject" the
+	// listener stays open and the new clients are disconnected at once
+	ReconnectPolicy      string `yaml:"reconnect_policy" json:"reconnect_policy"`
+	ReconnectHoldTimeout int    `yaml:"reconnect_hold_timeout" json:"reconnect_hold_timeout"`
+	// how many seconds the active connections can take to complete when
+	// the tunnel is stopped. The remaining ones are closed. Defaults to 0
+	DrainTimeout int `yaml:"drain_timeout" json:"drain_timeout"`
+	// the tunnel stops once it accepted max_accepted tcp clients and
+	// they disconnected, after lifetime seconds or after idle_timeout
+	// seconds without clients and traffic. 0 disables the limit
+	MaxAccepted int `yaml:"max_accepted" json:"max_accepted"`
+	Lifetime    int `yaml:"lifetime" json:"lifetime"`
+	IdleTimeout int `yaml:"idle_timeout" json:"idle_timeout"`
+	// the tcp options of the local sockets: the listener, its clients
+	// and the destinations of reverse tunnels
+	SocketOptions *SocketOptionsConf `yaml:"socket_options" json:"socket_options"`
+	// if true, the ssh connection is established when the first client
+	// connects, and closed after lazy_idle_timeout seconds (default 60)
+	// without clients. Meanwhile the local listener stays open, and the
+	// clients wait for the connection up to reconnect_hold_timeout
+	// seconds. Supported by forward tcp tunnels only
+	Lazy            bool `yaml:"lazy" json:"lazy"`
+	LazyIdleTimeout int  `yaml:"lazy_idle_timeout" json:"lazy_idle_timeout"`
+	// make the entry a template, expanded into one tunnel for each
+	// foreach item and range number. The {{var}} placeholders of the
+	// name, the labels, the endpoints and the addresses are replaced by
+	// the item values and the range number. {{var+N}} and {{var-N}} add
+	// an offset to the numeric values
+	Foreach []map[string]string `yaml:"foreach" json:"foreach"`
+	Range   *TemplateRange      `yaml:"range" json:"range"`
+	// the priority class of the tunnel traffic: high, normal (the
+	// default) or low. When the tunnels sharing an ssh connection are
+	// busy, the data they send over it is scheduled by weight (8, 4 and
+	// 1), so interactive tunnels aren't starved by the bulk ones
+	Priority string `yaml:"priority" json:"priority"`
+	// if set, the traffic of the tcp clients is written to a file, for
+	// debugging
+	Capture *CaptureConf `yaml:"capture" json:"capture"`
 	// use a dedicated ssh client. if nil use the global one
 	SshClientConf *sshc.SshClientConf `yaml:"sshclient" json:"sshclient"`
+	// use one of the named ssh clients of the config file
+	SshClientName string `yaml:"sshclient_name" json:"sshclient_name"`
+}
+
+// IsUdp returns true if the tunnel carries udp datagrams: udp is set,
+// or an endpoint has the udp:// scheme
+func (c *TunnelConf) IsUdp() bool {
+	if c.Udp {
+		return true
+	}
+	local, _ := utils.SplitScheme(c.Local)
+	remote, _ := utils.SplitScheme(c.Remote)
+	return local == utils.SCHEME_UDP || remote == utils.SCHEME_UDP
 }
 
 // GetRemotEndpoint Builds a remote endpoint object from the Remote string
@@ -25,3 +150,29 @@ func (c *TunnelConf) GetRemotEndpoint() *utils.Endpoint {
 func (c *TunnelConf) GetLocalEndpoint() *utils.Endpoint {
 	return utils.NewEndpoint(c.Local)
 }
+
+// Validate checks the tunnel options without connecting, like Start
+// does before activating the tunnel
+func (c *TunnelConf) Validate() error {
+	if c.Dynamic && c.RemoteDynamic {
+		return errors.New("dynamic and remote_dynamic can't be both set")
+	}
+	// dynamic tunnels have the SOCKS listener endpoint only, and the
+	// tunnels with many remotes don't need the remote one
+	if c.Local == "" && !c.RemoteDynamic {
+		return errors.New("the local endpoint is not set")
+	}
+	if c.Remote == "" && !c.Dynamic && len(c.Remotes) == 0 {
+		return errors.New("the remote endpoint is not set")
+	}
+	endpoints := append([]string{c.Local, c.Remote}, c.Remotes...)
+	for _, e := range append(endpoints, c.Backups...) {
+		if e == "" {
+			continue
+		}
+		if err := utils.ValidateEndpoint(e); err != nil {
+			return err
+		}
+	}
+	return NewTunnel(nil, c, false).prepare()
+}
@@ -0,0 +1,25 @@
+package tun
+
+import "time"
+
+// how often the active connections are checked while draining
+const drainPollInterval = 100 * time.Millisecond
+
+// drain waits up to the drain timeout for the active connections to
+// complete, then closes the remaining ones. It returns how many of
+// them were closed
+func (t *Tunnel) drain() int {
+	deadline := time.Now().Add(t.drainTimeout)
+	for t.GetActiveClientsCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+
+	t.clientsMapMU.Lock()
+	defer t.clientsMapMU.Unlock()
+	cut := len(t.clientsMap)
+	for k, v := range t.clientsMap {
+		v.Close()
+		delete(t.clientsMap, k)
+	}
+	return cut
+}
@@ -0,0 +1,90 @@
+package tun
+
+import (
+	"context"
+	"net"
+
+	"github.com/ferama/go-socks"
+)
+
+// dialerResolver skips the name resolution in the SOCKS server: host
+// names are resolved by the side dialing the destination
+type dialerResolver struct{}
+
+func (r dialerResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// listenDynamic starts a SOCKS5 listener. In forward mode, like ssh -D,
+// the listener is local and every CONNECT request is dialed by the ssh
+// server. In reverse mode, like ssh -R with no destination, the listener
+// is on the ssh server and the requests are dialed from the local machine
+func (t *Tunnel) listenDynamic() error {
+	var listener net.Listener
+	var err error
+	var dial func(network, addr string) (net.Conn, error)
+	if t.forward {
+		listener, err = t.listenLocalEndpoint()
+		dial = t.dialRemote
+	} else {
+		listener, err = t.listenRemoteEndpoint()
+		dial = t.dialLocal
+	}
+	if err != nil {
+		t.log.Errorf("dynamic listener error. %s\n", err)
+		t.setError(err)
+		return err
+	}
+	listener = t.tlsListener(t.limitListener(listener))
+	defer listener.Close()
+
+	t.listenerMU.Lock()
+	t.listener = listener
+	t.listenerMU.Unlock()
+	t.setListening(true)
+	t.reportListener()
+
+	server, err := socks.New(&socks.Config{
+		Logger:   t.log.StdLogger(),
+		Resolver: dialerResolver{},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(network, addr)
+			if err != nil {
+				t.setError(err)
+			}
+			return conn, err
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if t.forward {
+		t.log.Printf("dynamic forward connected. Local SOCKS5: %s\n", listener.Addr())
+	} else {
+		t.log.Printf("dynamic reverse connected. Remote SOCKS5: %s\n", listener.Addr())
+	}
+	// stop accepting clients when the ssh connection is lost. The
+	// tunnel restarts the listener when it is reestablished
+	go func() {
+		t.sshConn.Client.Wait()
+		listener.Close()
+	}()
+	for {
+		client, err := t.accept(listener)
+		if err != nil {
+			t.log.Println("disconnected")
+			t.setError(err)
+			return err
+		}
+		client = t.addClient(client)
+
+		go func() {
+			if err := server.ServeConn(client); err != nil {
+				t.log.Errorf("socks request failed: %s", err)
+			}
+			client.Close()
+			t.removeClient(client)
+		}()
+	}
+}
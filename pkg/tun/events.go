@@ -0,0 +1,97 @@
+package tun
+
+import (
+	"sync"
+	"time"
+)
+
+// the tunnel event types
+const (
+	// the tunnel listener is up, or down again
+	EVENT_TUNNEL_UP   = "tunnel_up"
+	EVENT_TUNNEL_DOWN = "tunnel_down"
+	// the tunnel listener address is known. Sent after tunnel_up
+	EVENT_LISTENER_BOUND = "listener_bound"
+	// the tunnel has been stopped and won't restart
+	EVENT_TUNNEL_STOPPED = "tunnel_stopped"
+	// a client connected and disconnected
+	EVENT_CONNECTION_OPENED = "connection_opened"
+	EVENT_CONNECTION_CLOSED = "connection_closed"
+)
+
+// Event describes a change in the state of a tunnel
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	TunnelID   int       `json:"tunnel_id"`
+	TunnelName string    `json:"tunnel_name,omitempty"`
+	// the listener address, for listener_bound
+	Listener string `json:"listener,omitempty"`
+	// the last tunnel error, for tunnel_down
+	Error string `json:"error,omitempty"`
+	// the connection id and client address, for the connection events
+	ConnID uint64 `json:"conn_id,omitempty"`
+	Peer   string `json:"peer,omitempty"`
+	// the connection stats, for connection_closed
+	BytesIn  int64         `json:"bytes_in,omitempty"`
+	BytesOut int64         `json:"bytes_out,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// EventBus dispatches the tunnel events to its subscribers. The events
+// are never blocking the tunnels: a subscriber that doesn't keep up
+// misses them
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+var (
+	eventsOnce sync.Once
+	events     *EventBus
+)
+
+// Events returns the bus the tunnel events are published to
+func Events() *EventBus {
+	eventsOnce.Do(func() {
+		events = &EventBus{subscribers: make(map[chan Event]struct{})}
+	})
+	return events
+}
+
+// Subscribe returns a channel receiving the events, buffering up to
+// size of them, and the function to call to unsubscribe
+func (b *EventBus) Subscribe(size int) (<-chan Event, func()) {
+	ch := make(chan Event, size)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (b *EventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// emit publishes an event of the tunnel
+func (t *Tunnel) emit(e Event) {
+	e.Time = time.Now()
+	e.TunnelID = t.registryID
+	e.TunnelName = t.name
+	Events().publish(e)
+}
@@ -0,0 +1,63 @@
+package tun
+
+import "time"
+
+// how often the expiry conditions are checked
+const expiryCheckInterval = 500 * time.Millisecond
+
+// expires returns true if the tunnel stops by itself, after some
+// connections, a duration or a period of inactivity
+func (t *Tunnel) expires() bool {
+	return t.maxAccepted > 0 || t.lifetime > 0 || t.idleTimeout > 0
+}
+
+// acceptsMore returns false once the tunnel accepted max_accepted clients
+func (t *Tunnel) acceptsMore() bool {
+	return t.maxAccepted <= 0 || t.stats.accepted.Load() < int64(t.maxAccepted)
+}
+
+// expiryReason returns why the tunnel should stop, or an empty string.
+// idleSince is when the tunnel last had an active connection or traffic
+func (t *Tunnel) expiryReason(started, idleSince time.Time) string {
+	if t.lifetime > 0 && time.Since(started) >= t.lifetime {
+		return "lifetime expired"
+	}
+	if t.maxAccepted > 0 && !t.acceptsMore() && t.GetActiveClientsCount() == 0 {
+		return "all the accepted connections completed"
+	}
+	if t.idleTimeout > 0 && time.Since(idleSince) >= t.idleTimeout {
+		return "idle timeout expired"
+	}
+	return ""
+}
+
+// watchExpiry shuts the tunnel down once it expires
+func (t *Tunnel) watchExpiry() {
+	started := time.Now()
+	idleSince := started
+	lastBytes := t.stats.bytesIn.Load() + t.stats.bytesOut.Load()
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.terminate:
+			return
+		case <-ticker.C:
+		}
+		bytes := t.stats.bytesIn.Load() + t.stats.bytesOut.Load()
+		if bytes != lastBytes || t.GetActiveClientsCount() > 0 {
+			idleSince = time.Now()
+			lastBytes = bytes
+		}
+		if reason := t.expiryReason(started, idleSince); reason != "" {
+			t.log.Printf("stopping the tunnel: %s", reason)
+			t.Shutdown()
+			return
+		}
+	}
+}
+
+// Done returns a channel closed once the tunnel is stopped
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
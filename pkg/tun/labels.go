@@ -0,0 +1,24 @@
+package tun
+
+import (
+	"github.com/ferama/rospo/pkg/logger"
+)
+
+// newTunnelLogger returns the logger of a tunnel: the package one, with
+// the tunnel name added to the prefix and to the fields
+func newTunnelLogger(name string) *logger.Logger {
+	if name == "" {
+		return log
+	}
+	return log.WithPrefix("["+name+"] ").With("tunnel", name)
+}
+
+// GetName returns the tunnel name. Empty if not set
+func (t *Tunnel) GetName() string {
+	return t.name
+}
+
+// GetLabels returns the tunnel labels
+func (t *Tunnel) GetLabels() map[string]string {
+	return t.labels
+}
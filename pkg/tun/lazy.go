@@ -0,0 +1,32 @@
+package tun
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultLazyIdleTimeout = 60 * time.Second
+
+// GetLazyIdleTimeout returns how long the on demand ssh connection of
+// a lazy tunnel stays open without clients
+func (c *TunnelConf) GetLazyIdleTimeout() time.Duration {
+	if c.LazyIdleTimeout > 0 {
+		return time.Duration(c.LazyIdleTimeout) * time.Second
+	}
+	return defaultLazyIdleTimeout
+}
+
+// lazyConn is a tunnel target connection holding the on demand ssh
+// connection. It is released on close
+type lazyConn struct {
+	net.Conn
+	tunnel *Tunnel
+	once   sync.Once
+}
+
+func (c *lazyConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.tunnel.sshConn.Release)
+	return err
+}
@@ -0,0 +1,133 @@
+package tun
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ferama/rospo/pkg/logger"
+)
+
+// limitedListener caps the clients served at once. The clients exceeding
+// the limit wait for a free slot in a queue, and are disconnected when
+// the queue is full too
+type limitedListener struct {
+	net.Listener
+
+	// the clients denied by the sources allowlist are closed before
+	// taking a slot or a queue place
+	allowed func(net.Addr) bool
+
+	slots     chan struct{}
+	queueSize int32
+	queued    atomic.Int32
+
+	conns  chan net.Conn
+	failed chan struct{}
+	err    error
+
+	log *logger.Logger
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// limitListener applies the tunnel connections limit to l
+func (t *Tunnel) limitListener(l net.Listener) net.Listener {
+	if t.maxConnections <= 0 {
+		return l
+	}
+	ll := &limitedListener{
+		Listener:  l,
+		allowed:   t.isSourceAllowed,
+		slots:     make(chan struct{}, t.maxConnections),
+		queueSize: int32(t.connectionsQueue),
+		conns:     make(chan net.Conn),
+		log:       t.log,
+		failed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go ll.run()
+	return ll
+}
+
+func (l *limitedListener) run() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.failed)
+			return
+		}
+		if !l.allowed(c.RemoteAddr()) {
+			l.log.Warnf("connection from %s denied", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+		select {
+		case l.slots <- struct{}{}:
+			go l.deliver(c)
+		default:
+			if l.queued.Add(1) <= l.queueSize {
+				go l.wait(c)
+			} else {
+				l.queued.Add(-1)
+				l.log.Warnf("connection from %s refused: too many connections", c.RemoteAddr())
+				c.Close()
+			}
+		}
+	}
+}
+
+// wait queues c until a slot is free
+func (l *limitedListener) wait(c net.Conn) {
+	defer l.queued.Add(-1)
+	select {
+	case l.slots <- struct{}{}:
+		l.deliver(c)
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// deliver hands c, holding a slot, to Accept
+func (l *limitedListener) deliver(c net.Conn) {
+	sc := &slotConn{Conn: c, listener: l}
+	select {
+	case l.conns <- sc:
+	case <-l.done:
+		sc.Close()
+	}
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.failed:
+		return nil, l.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *limitedListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// slotConn frees its listener slot when closed
+type slotConn struct {
+	net.Conn
+	listener  *limitedListener
+	closeOnce sync.Once
+}
+
+func (c *slotConn) Close() error {
+	c.closeOnce.Do(func() {
+		<-c.listener.slots
+	})
+	return c.Conn.Close()
+}
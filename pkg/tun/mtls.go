@@ -0,0 +1,110 @@
+package tun
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MTLSConf holds the mutual tls configuration of a tunnel listener
+type MTLSConf struct {
+	// the server certificate and key, pem encoded
+	Cert string `yaml:"cert" json:"cert"`
+	Key  string `yaml:"key" json:"key"`
+	// the pem encoded CAs the client certificates must be signed by
+	ClientCA string `yaml:"client_ca" json:"client_ca"`
+}
+
+// tlsConfig builds the tls server configuration. The clients must
+// present a certificate signed by the client CA
+func (c *MTLSConf) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the mtls certificate: %s", err)
+	}
+	data, err := os.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the mtls client CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", c.ClientCA)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// how long a client has to complete the mtls handshake
+const mtlsHandshakeTimeout = 10 * time.Second
+
+// tlsListener requires the mtls handshake to the clients of l, if
+// configured. The handshake happens on the first read or write, so a
+// client without a valid certificate never reaches the tunnel endpoint
+func (t *Tunnel) tlsListener(l net.Listener) net.Listener {
+	if t.tlsConfig == nil {
+		return l
+	}
+	return &mtlsListener{
+		Listener: l,
+		config:   t.tlsConfig,
+		timeout:  mtlsHandshakeTimeout,
+	}
+}
+
+// mtlsListener wraps the accepted connections in tls server connections
+// whose handshake must complete within timeout
+type mtlsListener struct {
+	net.Listener
+	config  *tls.Config
+	timeout time.Duration
+}
+
+func (l *mtlsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &mtlsConn{Conn: tls.Server(c, l.config), timeout: l.timeout}, nil
+}
+
+// mtlsConn runs the handshake, bounded by timeout, before the
+// first read or write. Not done in Accept, so that a slow client
+// doesn't block the others
+type mtlsConn struct {
+	*tls.Conn
+	timeout time.Duration
+
+	once sync.Once
+	err  error
+}
+
+func (c *mtlsConn) handshake() error {
+	c.once.Do(func() {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+		c.err = c.Conn.Handshake()
+		c.Conn.SetDeadline(time.Time{})
+	})
+	return c.err
+}
+
+func (c *mtlsConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *mtlsConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
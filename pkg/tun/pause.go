@@ -0,0 +1,21 @@
+package tun
+
+// Pause makes the tunnel refuse the new clients. The listener stays up
+// and the active connections are not cut
+func (t *Tunnel) Pause() {
+	if !t.paused.Swap(true) {
+		t.log.Println("paused")
+	}
+}
+
+// Resume makes a paused tunnel accept the new clients again
+func (t *Tunnel) Resume() {
+	if t.paused.Swap(false) {
+		t.log.Println("resumed")
+	}
+}
+
+// IsPaused returns true if the tunnel refuses the new clients
+func (t *Tunnel) IsPaused() bool {
+	return t.paused.Load()
+}
@@ -0,0 +1,102 @@
+package tun
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the max number of tunnels a port range or list can expand to
+const maxExpandedPorts = 1024
+
+// splitPorts splits an endpoint into its host and its port
+// specification. ok is false for unix socket endpoints and for
+// endpoints without a port
+func splitPorts(endpoint string) (host string, ports string, ok bool) {
+	if strings.HasPrefix(endpoint, "/") || strings.HasPrefix(endpoint, "unix:") {
+		return "", "", false
+	}
+	idx := strings.LastIndex(endpoint, ":")
+	if idx < 0 || strings.HasSuffix(endpoint[idx:], "]") {
+		return "", "", false
+	}
+	return endpoint[:idx], endpoint[idx+1:], true
+}
+
+// parsePorts parses a port specification: a comma separated list of
+// ports or "first-last" ranges, like "8000-8010,9000"
+func parsePorts(spec string) ([]int, error) {
+	res := []int{}
+	for _, item := range strings.Split(spec, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		from, err := strconv.Atoi(first)
+		if err != nil || from < 0 || from > 65535 {
+			return nil, fmt.Errorf("invalid port '%s'", item)
+		}
+		to := from
+		if isRange {
+			to, err = strconv.Atoi(last)
+			if err != nil || to < from || to > 65535 {
+				return nil, fmt.Errorf("invalid port range '%s'", item)
+			}
+		}
+		if len(res)+to-from+1 > maxExpandedPorts {
+			return nil, fmt.Errorf("too many ports in '%s', max %d", spec, maxExpandedPorts)
+		}
+		for p := from; p <= to; p++ {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+// endpointPorts returns the host and the ports of endpoint. The ports are
+// nil if the endpoint is a single address
+func endpointPorts(endpoint string) (string, []int, error) {
+	host, spec, ok := splitPorts(endpoint)
+	if !ok || !strings.ContainsAny(spec, ",-") {
+		return endpoint, nil, nil
+	}
+	ports, err := parsePorts(spec)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid endpoint '%s': %s", endpoint, err)
+	}
+	return host, ports, nil
+}
+
+// ExpandPorts returns one tunnel configuration for each port when the
+// endpoints carry a port range or list, like local ":8000-8010" and
+// remote ":8000-8010". The ports are paired in order, so both endpoints
+// must have the same number of them. A plain configuration is returned
+// as is
+func (c *TunnelConf) ExpandPorts() ([]*TunnelConf, error) {
+	localHost, localPorts, err := endpointPorts(c.Local)
+	if err != nil {
+		return nil, err
+	}
+	remoteHost, remotePorts, err := endpointPorts(c.Remote)
+	if err != nil {
+		return nil, err
+	}
+	if localPorts == nil && remotePorts == nil {
+		return []*TunnelConf{c}, nil
+	}
+	if len(localPorts) != len(remotePorts) {
+		return nil, fmt.Errorf("the local '%s' and remote '%s' ports don't match", c.Local, c.Remote)
+	}
+	if c.Dynamic || c.RemoteDynamic {
+		return nil, fmt.Errorf("port ranges are not supported by dynamic tunnels")
+	}
+	if c.PortFile != "" {
+		return nil, fmt.Errorf("port_file is not supported with port ranges, use print_port")
+	}
+
+	res := []*TunnelConf{}
+	for i := range localPorts {
+		expanded := *c
+		expanded.Local = fmt.Sprintf("%s:%d", localHost, localPorts[i])
+		expanded.Remote = fmt.Sprintf("%s:%d", remoteHost, remotePorts[i])
+		res = append(res, &expanded)
+	}
+	return res, nil
+}
@@ -0,0 +1,48 @@
+package tun
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/ferama/rospo/pkg/rio"
+)
+
+// validatePriority checks the tunnel priority class
+func (t *Tunnel) validatePriority() error {
+	if !rio.IsValidPriority(t.priority) {
+		return fmt.Errorf("invalid priority '%s'", t.priority)
+	}
+	return nil
+}
+
+// prioConn is an ssh channel whose writes are scheduled with the
+// tunnel priority, among the other channels of the ssh connection
+type prioConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *prioConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// prioritize schedules the writes to the ssh channel c
+func (t *Tunnel) prioritize(c net.Conn) net.Conn {
+	if t.sshConn == nil {
+		return c
+	}
+	return &prioConn{
+		Conn: c,
+		w:    rio.NewScheduledWriter(c, t.sshConn.WriteScheduler(), t.priority),
+	}
+}
+
+// dialRemote dials a destination through the ssh server
+func (t *Tunnel) dialRemote(network, addr string) (net.Conn, error) {
+	conn, err := t.sshConn.Client.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.prioritize(conn), nil
+}
@@ -0,0 +1,84 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// The supported PROXY protocol versions
+const (
+	PROXY_PROTOCOL_V1 = "v1"
+	PROXY_PROTOCOL_V2 = "v2"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// tcpAddr returns addr as a tcp address. nil if it is not one
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a
+	}
+	a, err := net.ResolveTCPAddr("tcp", addr.String())
+	if err != nil || a.IP == nil {
+		return nil
+	}
+	return a
+}
+
+// proxyHeader builds the PROXY protocol header of a connection from src
+// to dst. Connections not over tcp, like the unix sockets ones, are
+// described as unknown
+func proxyHeader(version string, src net.Addr, dst net.Addr) []byte {
+	s, d := tcpAddr(src), tcpAddr(dst)
+	ipv4 := s != nil && d != nil && s.IP.To4() != nil && d.IP.To4() != nil
+	ipv6 := s != nil && d != nil && !ipv4 && s.IP.To4() == nil && d.IP.To4() == nil
+
+	if version == PROXY_PROTOCOL_V1 {
+		switch {
+		case ipv4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port))
+		case ipv6:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port))
+		default:
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	switch {
+	case ipv4:
+		// version 2, PROXY command. TCP over ipv4
+		buf.Write([]byte{0x21, 0x11})
+		binary.Write(&buf, binary.BigEndian, uint16(12))
+		buf.Write(s.IP.To4())
+		buf.Write(d.IP.To4())
+	case ipv6:
+		// version 2, PROXY command. TCP over ipv6
+		buf.Write([]byte{0x21, 0x21})
+		binary.Write(&buf, binary.BigEndian, uint16(36))
+		buf.Write(s.IP.To16())
+		buf.Write(d.IP.To16())
+	default:
+		// version 2, LOCAL command: the receiver uses the real
+		// connection addresses
+		buf.Write([]byte{0x20, 0x00})
+		binary.Write(&buf, binary.BigEndian, uint16(0))
+		return buf.Bytes()
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(s.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(d.Port))
+	return buf.Bytes()
+}
+
+// sendProxyHeader writes the PROXY protocol header of client to the
+// target connection, if enabled
+func (t *Tunnel) sendProxyHeader(target net.Conn, client net.Conn) error {
+	if t.proxyProtocol == "" {
+		return nil
+	}
+	_, err := target.Write(proxyHeader(t.proxyProtocol, client.RemoteAddr(), client.LocalAddr()))
+	return err
+}
@@ -0,0 +1,90 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the maximum delay between two listen attempts
+const maxRetryDelay = time.Minute
+
+// parsePortRange parses a "first-last" port range, or a single port
+func parsePortRange(s string) (int, int, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+	f, err1 := strconv.Atoi(strings.TrimSpace(first))
+	l, err2 := strconv.Atoi(strings.TrimSpace(last))
+	if err1 != nil || err2 != nil || f <= 0 || l > 65535 || f > l {
+		return 0, 0, fmt.Errorf("invalid port range '%s'", s)
+	}
+	return f, l, nil
+}
+
+// listenRemoteEndpoint listens on the remote endpoint of the ssh server.
+// If the server reports the port as busy, the fallback ports are tried
+// in order. The other failures, like a denied forward, are returned
+func (t *Tunnel) listenRemoteEndpoint() (net.Listener, error) {
+	listener, err := t.listenRemoteAllocated()
+	if err == nil || t.remoteEndpoint.IsUnix() || t.fallbackFirst == 0 {
+		return listener, err
+	}
+	if !t.sshConn.RemoteAddrInUse(t.remoteListenAddress()) {
+		return nil, err
+	}
+	for port := t.fallbackFirst; port <= t.fallbackLast; port++ {
+		addr := t.remoteListenAddressWithPort(port)
+		l, ferr := t.sshConn.Client.Listen("tcp", addr)
+		if ferr == nil {
+			t.log.Warnf("remote endpoint %s is busy, bound to the fallback %s", t.remoteListenAddress(), addr)
+			return l, nil
+		}
+		if !t.sshConn.RemoteAddrInUse(addr) {
+			return nil, ferr
+		}
+	}
+	return nil, err
+}
+
+// listenRemoteAllocated listens on the remote endpoint. When the port 0
+// is requested, the server allocates a free one: it is requested again
+// on reconnection, so the tunnel keeps its port if still available
+func (t *Tunnel) listenRemoteAllocated() (net.Listener, error) {
+	if t.remoteEndpoint.IsUnix() || t.remoteEndpoint.Port != 0 {
+		return t.sshConn.Client.Listen(t.remoteEndpoint.Network(), t.remoteListenAddress())
+	}
+	if t.allocatedPort != 0 {
+		l, err := t.sshConn.Client.Listen("tcp", t.remoteListenAddressWithPort(t.allocatedPort))
+		if err == nil {
+			return l, nil
+		}
+		t.log.Warnf("the previously allocated remote port %d is not available", t.allocatedPort)
+	}
+	l, err := t.sshConn.Client.Listen("tcp", t.remoteListenAddress())
+	if err != nil {
+		return nil, err
+	}
+	t.allocatedPort = listenerPort(l.Addr())
+	t.log.Printf("remote port %d allocated by the server", t.allocatedPort)
+	return l, nil
+}
+
+// retryDelay returns the delay before the next listen attempt, after
+// failures consecutive failed ones. It grows exponentially
+func (t *Tunnel) retryDelay(failures int) time.Duration {
+	delay := t.reconnectionInterval
+	for i := 1; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,123 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// The ReconnectPolicy allowed values
+const (
+	RECONNECT_CLOSE  = "close"
+	RECONNECT_HOLD   = "hold"
+	RECONNECT_REJECT = "reject"
+)
+
+const defaultReconnectHoldTimeout = 10 * time.Second
+
+// validateReconnectPolicy checks the reconnect policy against the
+// tunnel type
+func (t *Tunnel) validateReconnectPolicy() error {
+	if t.lazy {
+		if !t.forward || t.dynamic || t.udp {
+			return fmt.Errorf("lazy tunnels must be forward tcp tunnels")
+		}
+		if t.reconnectPolicy == RECONNECT_REJECT {
+			return fmt.Errorf("lazy tunnels don't support the %s reconnect policy", t.reconnectPolicy)
+		}
+	}
+	switch t.reconnectPolicy {
+	case "", RECONNECT_CLOSE:
+		return nil
+	case RECONNECT_HOLD, RECONNECT_REJECT:
+	default:
+		return fmt.Errorf("invalid reconnect policy '%s'", t.reconnectPolicy)
+	}
+	if !t.forward || t.dynamic || t.udp {
+		return fmt.Errorf("the %s reconnect policy is supported by forward tcp tunnels only", t.reconnectPolicy)
+	}
+	return nil
+}
+
+// keepsListener returns true if the listener stays open while
+// the ssh connection is down
+func (t *Tunnel) keepsListener() bool {
+	return t.lazy || t.reconnectPolicy == RECONNECT_HOLD || t.reconnectPolicy == RECONNECT_REJECT
+}
+
+// listenLocalPersistent is like listenLocal, but the listener stays open
+// across the ssh reconnections. The clients accepted while the connection
+// is down are held or rejected, as configured
+func (t *Tunnel) listenLocalPersistent() error {
+	listener, err := t.listenLocalEndpoint()
+	if err != nil {
+		t.log.Errorf("local listener error. %s\n", err)
+		t.setError(err)
+		return err
+	}
+	listener = t.tlsListener(t.limitListener(listener))
+	defer listener.Close()
+
+	t.listenerMU.Lock()
+	t.listener = listener
+	t.listenerMU.Unlock()
+	t.setListening(true)
+	t.reportListener()
+
+	if t.lazy {
+		t.log.Printf("lazy forward listening. Local: %s <- Remote: %s\n",
+			listener.Addr(), t.remoteEndpoint.String())
+	} else {
+		t.log.Printf("forward listening. Local: %s <- Remote: %s (reconnect policy %s)\n",
+			listener.Addr(), t.remoteEndpoint.String(), t.reconnectPolicy)
+	}
+	for {
+		client, err := t.accept(listener)
+		if err != nil {
+			t.log.Println("listener closed")
+			t.setError(err)
+			return err
+		}
+		client = t.addClient(client)
+		go t.forwardClient(client)
+	}
+}
+
+// forwardClient dials the target for client, waiting for the ssh
+// connection if the policy allows it. Lazy tunnels acquire the ssh
+// connection for the client lifetime
+func (t *Tunnel) forwardClient(client net.Conn) {
+	if t.lazy {
+		t.sshConn.Acquire()
+	}
+	fail := func(err error) {
+		if t.lazy {
+			t.sshConn.Release()
+		}
+		t.setError(err)
+		client.Close()
+		t.removeClient(client)
+	}
+	if !t.sshConn.IsConnected() {
+		if t.reconnectPolicy == RECONNECT_REJECT {
+			t.log.Warnf("rejecting %s: the ssh connection is down", client.RemoteAddr())
+			fail(fmt.Errorf("ssh connection down"))
+			return
+		}
+		if !t.sshConn.ReadyWaitTimeout(t.reconnectHoldTimeout) {
+			t.log.Warnf("dropping %s: the ssh connection is still down after %s", client.RemoteAddr(), t.reconnectHoldTimeout)
+			fail(fmt.Errorf("ssh connection down"))
+			return
+		}
+	}
+	remote, err := t.dialTarget()
+	if err != nil {
+		t.log.Errorf("dial INTO remote service error. %s\n", err)
+		fail(err)
+		return
+	}
+	if t.lazy {
+		remote = &lazyConn{Conn: remote, tunnel: t}
+	}
+	t.copyConn(client, remote)
+}
@@ -0,0 +1,95 @@
+package tun
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// listenerReport is the machine readable line printed on stdout
+// once the tunnel listener is up
+type listenerReport struct {
+	ID       int    `json:"id"`
+	Forward  bool   `json:"forward"`
+	Listener string `json:"listener"`
+	// zero for unix socket listeners
+	Port int `json:"port"`
+}
+
+// listenerPort returns the port of addr. Zero if it has none
+func listenerPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// GetListenerPort returns the tunnel listener port. Zero if the
+// tunnel is not listening or the listener is a unix socket
+func (t *Tunnel) GetListenerPort() int {
+	addr := t.GetListenerAddr()
+	if addr == nil {
+		return 0
+	}
+	return listenerPort(addr)
+}
+
+// reportListener publishes the listener address, useful when the
+// tunnel listens on port 0 and the actual port is chosen by the system
+func (t *Tunnel) reportListener() {
+	addr := t.GetListenerAddr()
+	if addr == nil {
+		return
+	}
+	t.emit(Event{Type: EVENT_LISTENER_BOUND, Listener: addr.String()})
+	port := listenerPort(addr)
+	if t.printPort {
+		data, _ := json.Marshal(&listenerReport{
+			ID:       t.registryID,
+			Forward:  t.forward,
+			Listener: addr.String(),
+			Port:     port,
+		})
+		fmt.Println(string(data))
+	}
+	if t.portFile != "" && port != 0 {
+		if err := writePortFile(t.portFile, port); err != nil {
+			t.log.Errorf("failed to write the port file: %s", err)
+		}
+	}
+}
+
+// removePortFile removes the port file, if any
+func (t *Tunnel) removePortFile() {
+	if t.portFile != "" {
+		os.Remove(t.portFile)
+	}
+}
+
+// writePortFile atomically replaces path with the port number
+func writePortFile(path string, port int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".port")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := fmt.Fprintf(tmp, "%d\n", port); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,85 @@
+package tun
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// SocketOptionsConf tunes the tcp sockets of a tunnel: its local
+// listener, the clients accepted on it and the destinations dialed from
+// the local machine. The sockets opened by the ssh server can't be tuned
+type SocketOptionsConf struct {
+	// disables the Nagle algorithm. Defaults to true
+	NoDelay *bool `yaml:"no_delay" json:"no_delay"`
+	// the tcp keepalive interval in seconds. 0 keeps the default, 15
+	// seconds, while a negative value disables the keepalives
+	KeepAlive int `yaml:"keep_alive" json:"keep_alive"`
+	// set SO_REUSEADDR and SO_REUSEPORT on the listener. SO_REUSEPORT
+	// lets many processes share a port, and is not supported on windows
+	ReuseAddr bool `yaml:"reuse_addr" json:"reuse_addr"`
+	ReusePort bool `yaml:"reuse_port" json:"reuse_port"`
+	// the socket receive and send buffer sizes, in bytes. 0 keeps the
+	// system defaults
+	ReadBuffer  int `yaml:"read_buffer" json:"read_buffer"`
+	WriteBuffer int `yaml:"write_buffer" json:"write_buffer"`
+}
+
+// apply sets the options on c. Only tcp connections are tuned
+func (c *SocketOptionsConf) apply(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if c == nil || !ok {
+		return nil
+	}
+	if c.NoDelay != nil {
+		if err := tcp.SetNoDelay(*c.NoDelay); err != nil {
+			return err
+		}
+	}
+	if c.KeepAlive < 0 {
+		if err := tcp.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if c.KeepAlive > 0 {
+		if err := tcp.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcp.SetKeepAlivePeriod(time.Duration(c.KeepAlive) * time.Second); err != nil {
+			return err
+		}
+	}
+	if c.ReadBuffer > 0 {
+		if err := tcp.SetReadBuffer(c.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if c.WriteBuffer > 0 {
+		if err := tcp.SetWriteBuffer(c.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen listens on the tcp address addr, with the listener options
+func (c *SocketOptionsConf) listen(addr string) (net.Listener, error) {
+	if c == nil || (!c.ReuseAddr && !c.ReusePort) {
+		return net.Listen("tcp", addr)
+	}
+	lc := net.ListenConfig{Control: c.control}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// dialLocal dials a destination from the local machine, applying the
+// socket options to the connection
+func (t *Tunnel) dialLocal(network, addr string) (net.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.socketOptions.apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+package tun
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// validate checks the options are supported by the platform
+func (c *SocketOptionsConf) validate() error {
+	return nil
+}
+
+// control sets the reuse options on the listener socket, before binding it
+func (c *SocketOptionsConf) control(network, address string, raw syscall.RawConn) error {
+	var opErr error
+	err := raw.Control(func(fd uintptr) {
+		if c.ReuseAddr {
+			opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		}
+		if opErr == nil && c.ReusePort {
+			opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,28 @@
+package tun
+
+import (
+	"errors"
+	"syscall"
+)
+
+// validate checks the options are supported by the platform
+func (c *SocketOptionsConf) validate() error {
+	if c != nil && c.ReusePort {
+		return errors.New("reuse_port is not supported on windows")
+	}
+	return nil
+}
+
+// control sets the reuse options on the listener socket, before binding it
+func (c *SocketOptionsConf) control(network, address string, raw syscall.RawConn) error {
+	var opErr error
+	err := raw.Control(func(fd uintptr) {
+		if c.ReuseAddr {
+			opErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,91 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseSources parses a list of CIDRs or single ips
+func parseSources(sources []string) ([]*net.IPNet, error) {
+	res := []*net.IPNet{}
+	for _, s := range sources {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source address '%s'", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source address '%s': %s", s, err)
+		}
+		res = append(res, network)
+	}
+	return res, nil
+}
+
+// isSourceAllowed returns true if a client connecting from addr can use
+// the tunnel. Clients with no ip, like the unix socket ones, are denied
+// when an allowlist is set
+func (t *Tunnel) isSourceAllowed(addr net.Addr) bool {
+	if len(t.allowedSources) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range t.allowedSources {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept waits for a client allowed by the sources allowlist and the
+// max accepted connections. The other clients are disconnected, the
+// socket options applied to the accepted ones
+func (t *Tunnel) accept(listener net.Listener) (net.Conn, error) {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !t.isSourceAllowed(client.RemoteAddr()) {
+			t.log.Warnf("connection from %s denied", client.RemoteAddr())
+			client.Close()
+			continue
+		}
+		if t.IsPaused() {
+			t.log.Warnf("connection from %s denied, the tunnel is paused", client.RemoteAddr())
+			client.Close()
+			continue
+		}
+		if !t.acceptsMore() {
+			t.log.Warnf("connection from %s denied, max accepted connections reached", client.RemoteAddr())
+			client.Close()
+			continue
+		}
+		if err := t.socketOptions.apply(client); err != nil {
+			t.log.Errorf("failed to set the socket options of %s: %s", client.RemoteAddr(), err)
+		}
+		if !t.forward {
+			// the clients of the remote listeners are ssh channels
+			client = t.prioritize(client)
+		}
+		return client, nil
+	}
+}
@@ -0,0 +1,253 @@
+package tun
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ferama/rospo/pkg/logger"
+)
+
+// Stats is a snapshot of the tunnel runtime metrics
+type Stats struct {
+	// client connections (udp sessions for udp tunnels) accepted
+	// since the tunnel start
+	AcceptedConnections int64 `json:"accepted_connections"`
+	ActiveConnections   int   `json:"active_connections"`
+	// BytesIn is the data received from the tunnel clients,
+	// BytesOut the data sent to them
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// the last listener or dial error
+	LastError     string    `json:"last_error"`
+	LastErrorTime time.Time `json:"last_error_time"`
+	// how long the tunnel listener has been up. Zero if it is down
+	Uptime time.Duration `json:"uptime"`
+	// the remote endpoints state, for forward tunnels with many
+	Backends []BackendStats `json:"backends,omitempty"`
+}
+
+// ConnStats describes an active client connection. The udp sessions
+// have no id and no counters
+type ConnStats struct {
+	ID   uint64 `json:"id,omitempty"`
+	Peer string `json:"peer"`
+	// the bytes received from the client and sent to it
+	BytesIn  int64         `json:"bytes_in"`
+	BytesOut int64         `json:"bytes_out"`
+	Duration time.Duration `json:"duration"`
+}
+
+// tunnelStats collects the tunnel counters
+type tunnelStats struct {
+	accepted atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	mu            sync.Mutex
+	lastError     string
+	lastErrorTime time.Time
+	upSince       time.Time
+}
+
+// the last connection id assigned. The ids are unique across the
+// tunnels, so a session can be found in the logs by its id alone
+var lastConnID atomic.Uint64
+
+// statsConn is a tunnel client connection counting the
+// transferred bytes and enforcing the tunnel rate limit
+type statsConn struct {
+	net.Conn
+	tunnel *Tunnel
+
+	// identifies the connection in the logs
+	id     uint64
+	opened time.Time
+	// the bytes received from the client and sent to it
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+func newStatsConn(c net.Conn, t *Tunnel) *statsConn {
+	return &statsConn{
+		Conn:   c,
+		tunnel: t,
+		id:     lastConnID.Add(1),
+		opened: time.Now(),
+	}
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.bytesIn.Add(int64(n))
+		if c.tunnel.capture != nil {
+			c.tunnel.capture.data(c, true, b[:n])
+		}
+	}
+	c.tunnel.countIn(n)
+	return n, err
+}
+
+func (c *statsConn) Write(b []byte) (int, error) {
+	c.tunnel.waitOut(len(b))
+	n, err := c.Conn.Write(b)
+	c.bytesOut.Add(int64(n))
+	if n > 0 && c.tunnel.capture != nil {
+		c.tunnel.capture.data(c, false, b[:n])
+	}
+	c.tunnel.countOut(n)
+	return n, err
+}
+
+// connLogger returns the tunnel logger with the connection fields
+func (c *statsConn) connLogger() *logger.Logger {
+	return c.tunnel.log.With("conn_id", c.id).With("peer", c.RemoteAddr().String())
+}
+
+// logOpen logs the connection opening and publishes its event
+func (c *statsConn) logOpen() {
+	c.connLogger().Printf("conn #%d opened from %s", c.id, c.RemoteAddr())
+	c.tunnel.emit(Event{
+		Type:   EVENT_CONNECTION_OPENED,
+		ConnID: c.id,
+		Peer:   c.RemoteAddr().String(),
+	})
+}
+
+// logClose logs the connection closing, with the transferred bytes
+// and the connection duration, and publishes its event
+func (c *statsConn) logClose() {
+	duration := time.Since(c.opened)
+	c.connLogger().
+		With("bytes_in", c.bytesIn.Load()).
+		With("bytes_out", c.bytesOut.Load()).
+		With("duration", duration.Round(time.Millisecond).String()).
+		Printf("conn #%d closed from %s. in: %d bytes, out: %d bytes, duration: %s",
+			c.id, c.RemoteAddr(), c.bytesIn.Load(), c.bytesOut.Load(),
+			duration.Round(time.Millisecond))
+	c.tunnel.emit(Event{
+		Type:     EVENT_CONNECTION_CLOSED,
+		ConnID:   c.id,
+		Peer:     c.RemoteAddr().String(),
+		BytesIn:  c.bytesIn.Load(),
+		BytesOut: c.bytesOut.Load(),
+		Duration: duration,
+	})
+}
+
+// countIn accounts n bytes received from a client, waiting
+// for the rate limiter
+func (t *Tunnel) countIn(n int) {
+	if n <= 0 {
+		return
+	}
+	t.stats.bytesIn.Add(int64(n))
+	t.addBytes(int64(n))
+	if t.readLimiter != nil {
+		t.readLimiter.WaitN(n)
+	}
+}
+
+// waitOut waits for the rate limiter before sending n bytes to a client
+func (t *Tunnel) waitOut(n int) {
+	if t.writeLimiter != nil {
+		t.writeLimiter.WaitN(n)
+	}
+}
+
+func (t *Tunnel) countOut(n int) {
+	t.stats.bytesOut.Add(int64(n))
+	t.addBytes(int64(n))
+}
+
+func (t *Tunnel) addBytes(n int64) {
+	t.metricsMU.Lock()
+	t.currentBytes += n
+	t.metricsMU.Unlock()
+}
+
+// setError records the last tunnel error
+func (t *Tunnel) setError(err error) {
+	t.stats.mu.Lock()
+	t.stats.lastError = err.Error()
+	t.stats.lastErrorTime = time.Now()
+	t.stats.mu.Unlock()
+}
+
+// setListening marks the tunnel listener as up or down
+func (t *Tunnel) setListening(up bool) {
+	t.stats.mu.Lock()
+	wasUp := !t.stats.upSince.IsZero()
+	if up {
+		t.stats.upSince = time.Now()
+	} else {
+		t.stats.upSince = time.Time{}
+	}
+	lastError := t.stats.lastError
+	t.stats.mu.Unlock()
+	if up && !wasUp {
+		t.emit(Event{Type: EVENT_TUNNEL_UP})
+	} else if !up && wasUp {
+		// the reported port is no longer bound
+		t.removePortFile()
+		t.emit(Event{Type: EVENT_TUNNEL_DOWN, Error: lastError})
+	}
+}
+
+// isListening returns true if the tunnel listener is up
+func (t *Tunnel) isListening() bool {
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+	return !t.stats.upSince.IsZero()
+}
+
+// Stats returns a snapshot of the tunnel runtime metrics
+func (t *Tunnel) Stats() Stats {
+	stats := Stats{
+		AcceptedConnections: t.stats.accepted.Load(),
+		ActiveConnections:   t.GetActiveClientsCount(),
+		BytesIn:             t.stats.bytesIn.Load(),
+		BytesOut:            t.stats.bytesOut.Load(),
+	}
+	t.stats.mu.Lock()
+	stats.LastError = t.stats.lastError
+	stats.LastErrorTime = t.stats.lastErrorTime
+	if !t.stats.upSince.IsZero() {
+		stats.Uptime = time.Since(t.stats.upSince)
+	}
+	t.stats.mu.Unlock()
+	if b := t.balancer.Load(); b != nil {
+		stats.Backends = b.stats()
+	}
+	return stats
+}
+
+// Connections returns the active client connections, the oldest first
+func (t *Tunnel) Connections() []ConnStats {
+	res := []ConnStats{}
+	t.clientsMapMU.Lock()
+	for _, c := range t.clientsMap {
+		sc, ok := c.(*statsConn)
+		if !ok {
+			continue
+		}
+		res = append(res, ConnStats{
+			ID:       sc.id,
+			Peer:     sc.RemoteAddr().String(),
+			BytesIn:  sc.bytesIn.Load(),
+			BytesOut: sc.bytesOut.Load(),
+			Duration: time.Since(sc.opened),
+		})
+	}
+	for addr := range t.udpSessions {
+		res = append(res, ConnStats{Peer: addr})
+	}
+	t.clientsMapMU.Unlock()
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Duration > res[j].Duration
+	})
+	return res
+}
@@ -0,0 +1,132 @@
+package tun
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// the max number of tunnels a template can expand to
+const maxTemplateTunnels = 1024
+
+// the template placeholders: {{name}}, or {{name+N}} and {{name-N}} for
+// the numeric values
+var placeholderRe = regexp.MustCompile(`\{\{\s*(\w+)\s*(?:([+-])\s*(\d+)\s*)?\}\}`)
+
+// TemplateRange binds a variable to the numbers from From to To
+type TemplateRange struct {
+	Var  string `yaml:"var" json:"var"`
+	From int    `yaml:"from" json:"from"`
+	To   int    `yaml:"to" json:"to"`
+}
+
+// templateItems returns the variables of each tunnel of the template:
+// the foreach items, combined with the range numbers if both are set
+func (c *TunnelConf) templateItems() ([]map[string]string, error) {
+	items := c.Foreach
+	if len(items) == 0 {
+		items = []map[string]string{{}}
+	}
+	if c.Range == nil {
+		return items, nil
+	}
+	if c.Range.Var == "" || c.Range.To < c.Range.From {
+		return nil, fmt.Errorf("invalid template range %d-%d of '%s'", c.Range.From, c.Range.To, c.Range.Var)
+	}
+	if len(items)*(c.Range.To-c.Range.From+1) > maxTemplateTunnels {
+		return nil, fmt.Errorf("the template expands to more than %d tunnels", maxTemplateTunnels)
+	}
+	res := []map[string]string{}
+	for _, item := range items {
+		for n := c.Range.From; n <= c.Range.To; n++ {
+			vars := map[string]string{c.Range.Var: strconv.Itoa(n)}
+			for k, v := range item {
+				vars[k] = v
+			}
+			res = append(res, vars)
+		}
+	}
+	return res, nil
+}
+
+// expandPlaceholders replaces the placeholders of s with the vars values
+func expandPlaceholders(s string, vars map[string]string) (string, error) {
+	var err error
+	res := placeholderRe.ReplaceAllStringFunc(s, func(p string) string {
+		m := placeholderRe.FindStringSubmatch(p)
+		value, ok := vars[m[1]]
+		if !ok {
+			err = fmt.Errorf("unknown template variable '%s' in '%s'", m[1], s)
+			return p
+		}
+		if m[2] == "" {
+			return value
+		}
+		n, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			err = fmt.Errorf("the template variable '%s' is not a number: '%s'", m[1], value)
+			return p
+		}
+		offset, _ := strconv.Atoi(m[3])
+		if m[2] == "-" {
+			offset = -offset
+		}
+		return strconv.Itoa(n + offset)
+	})
+	return res, err
+}
+
+// ExpandTemplate returns one tunnel configuration for each foreach item
+// and range number, with the placeholders of the name, the labels, the
+// endpoints, the addresses and the ssh client name replaced. A configuration without foreach
+// and range is returned as is
+func (c *TunnelConf) ExpandTemplate() ([]*TunnelConf, error) {
+	if len(c.Foreach) == 0 && c.Range == nil {
+		return []*TunnelConf{c}, nil
+	}
+	items, err := c.templateItems()
+	if err != nil {
+		return nil, err
+	}
+	if len(items) > maxTemplateTunnels {
+		return nil, fmt.Errorf("the template expands to more than %d tunnels", maxTemplateTunnels)
+	}
+
+	res := []*TunnelConf{}
+	for _, vars := range items {
+		expanded := *c
+		expanded.Foreach = nil
+		expanded.Range = nil
+		fields := []*string{
+			&expanded.Name,
+			&expanded.Local,
+			&expanded.Remote,
+			&expanded.BindAddress,
+			&expanded.PortFile,
+			&expanded.SshClientName,
+		}
+		expanded.Remotes = append([]string{}, c.Remotes...)
+		for i := range expanded.Remotes {
+			fields = append(fields, &expanded.Remotes[i])
+		}
+		expanded.Backups = append([]string{}, c.Backups...)
+		for i := range expanded.Backups {
+			fields = append(fields, &expanded.Backups[i])
+		}
+		for _, f := range fields {
+			if *f, err = expandPlaceholders(*f, vars); err != nil {
+				return nil, err
+			}
+		}
+		if c.Labels != nil {
+			expanded.Labels = make(map[string]string, len(c.Labels))
+			for k, v := range c.Labels {
+				if expanded.Labels[k], err = expandPlaceholders(v, vars); err != nil {
+					return nil, err
+				}
+			}
+		}
+		res = append(res, &expanded)
+	}
+	return res, nil
+}
@@ -1,10 +1,15 @@
 package tun
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ferama/rospo/pkg/failfast"
 	"github.com/ferama/rospo/pkg/logger"
 	"github.com/ferama/rospo/pkg/rio"
 	"github.com/ferama/rospo/pkg/sshc"
@@ -15,8 +20,63 @@ var log = logger.NewLogger("[TUN]  ", logger.Magenta)
 
 // Tunnel object
 type Tunnel struct {
+	// identify the tunnel in the status output and in the logs
+	name   string
+	labels map[string]string
+	log    *logger.Logger
+
 	// indicates if it is a forward or reverse tunnel
 	forward bool
+	// indicates if it is a dynamic (SOCKS5) tunnel
+	dynamic bool
+	// indicates if the endpoints are udp
+	udp bool
+	// the permissions of the local unix socket listener
+	socketPermissions string
+	// overrides the host of the listener endpoint if set
+	bindAddress string
+	// the clients allowed to connect to the listener. Empty means any
+	sources        []string
+	allowedSources []*net.IPNet
+	// the maximum clients served at once and how many more can wait
+	// for a free slot. No limit if zero
+	maxConnections   int
+	connectionsQueue int
+	// the mtls configuration of the listener, if any
+	mtls      *MTLSConf
+	tlsConfig *tls.Config
+	// the PROXY protocol version sent to the target. Disabled if empty
+	proxyProtocol string
+	// the remote ports tried when the remote endpoint is busy
+	fallbackPorts string
+	fallbackFirst int
+	fallbackLast  int
+	// the remote port allocated by the server when the port 0 is requested
+	allocatedPort int
+	// the additional destinations and the policy to choose among them
+	remotes []string
+	backups []string
+	balance string
+	// distributes the connections across the destinations, when there
+	// are many. nil if there is only one. Set by Start, while Stats
+	// can be running
+	balancer atomic.Pointer[balancer]
+	// the tcp options of the local sockets. nil keeps the defaults
+	socketOptions *SocketOptionsConf
+	// the traffic capture configuration and writer. nil if disabled
+	captureConf *CaptureConf
+	capture     *capture
+	// the priority class of the data sent over the ssh connection
+	priority string
+	// if true, the ssh connection is acquired by the clients, so that
+	// an on demand connection is up only while they need it
+	lazy bool
+	// what to do with the clients while the ssh connection is down
+	reconnectPolicy      string
+	reconnectHoldTimeout time.Duration
+	// the listener address reporting options
+	printPort bool
+	portFile  string
 
 	remoteEndpoint *utils.Endpoint
 	localEndpoint  *utils.Endpoint
@@ -26,14 +86,28 @@ type Tunnel struct {
 
 	// the tunnel connection listener
 	listener net.Listener
+	// the udp tunnels listener
+	packetConn net.PacketConn
 
 	// indicate if the tunnel should be terminated
 	terminate chan bool
 	stoppable bool
+	// if set the new clients are refused
+	paused       atomic.Bool
+	shutdownOnce sync.Once
+	// how long the active connections can take to complete on shutdown
+	drainTimeout time.Duration
+	// closed once the tunnel is stopped
+	done chan struct{}
+	// the limits stopping the tunnel by itself. Disabled if zero
+	maxAccepted int
+	lifetime    time.Duration
+	idleTimeout time.Duration
 
 	registryID int
 
 	clientsMap   map[string]net.Conn
+	udpSessions  map[string]*udpSession
 	clientsMapMU sync.Mutex
 
 	listenerMU sync.RWMutex
@@ -43,27 +117,75 @@ type Tunnel struct {
 	currentBytesPerSecond int64
 	metricsMU             sync.RWMutex
 	metricsSamplerCloser  chan bool
+
+	stats tunnelStats
+
+	// the rate limiters of the data received from the clients and
+	// sent to them. nil if unlimited
+	readLimiter  *rio.RateLimiter
+	writeLimiter *rio.RateLimiter
 }
 
 // NewTunnel builds a Tunnel object
 func NewTunnel(sshConn *sshc.SshConnection, conf *TunnelConf, stoppable bool) *Tunnel {
 
 	tunnel := &Tunnel{
-		forward:        conf.Forward,
-		remoteEndpoint: conf.GetRemotEndpoint(),
-		localEndpoint:  conf.GetLocalEndpoint(),
+		name:   conf.Name,
+		labels: conf.Labels,
+		log:    newTunnelLogger(conf.Name),
+
+		// the dynamic tunnels listen on the local endpoint, the
+		// remote dynamic ones on the remote endpoint
+		forward: (conf.Forward || conf.Dynamic) && !conf.RemoteDynamic,
+		dynamic: conf.Dynamic || conf.RemoteDynamic,
+		udp:     conf.IsUdp(),
+
+		socketPermissions: conf.SocketPermissions,
+		bindAddress:       conf.BindAddress,
+		sources:           conf.AllowedSources,
+		maxConnections:    conf.MaxConnections,
+		connectionsQueue:  conf.ConnectionsQueue,
+		mtls:              conf.MTLS,
+		proxyProtocol:     conf.ProxyProtocol,
+		fallbackPorts:     conf.FallbackPorts,
+		remotes:           conf.Remotes,
+		backups:           conf.Backups,
+		balance:           conf.Balance,
+		reconnectPolicy:   conf.ReconnectPolicy,
+		lazy:              conf.Lazy,
+		priority:          conf.Priority,
+		captureConf:       conf.Capture,
+		socketOptions:     conf.SocketOptions,
+		printPort:         conf.PrintPort,
+		portFile:          conf.PortFile,
+		remoteEndpoint:    conf.GetRemotEndpoint(),
+		localEndpoint:     conf.GetLocalEndpoint(),
 
 		sshConn:              sshConn,
 		reconnectionInterval: 5 * time.Second,
 		terminate:            make(chan bool, 1),
+		done:                 make(chan struct{}),
 		stoppable:            stoppable,
 
-		clientsMap: make(map[string]net.Conn),
+		clientsMap:  make(map[string]net.Conn),
+		udpSessions: make(map[string]*udpSession),
 
 		currentBytes:          0,
 		currentBytesPerSecond: 0,
 		metricsSamplerCloser:  make(chan bool),
 	}
+	tunnel.drainTimeout = time.Duration(conf.DrainTimeout) * time.Second
+	tunnel.maxAccepted = conf.MaxAccepted
+	tunnel.lifetime = time.Duration(conf.Lifetime) * time.Second
+	tunnel.idleTimeout = time.Duration(conf.IdleTimeout) * time.Second
+	tunnel.reconnectHoldTimeout = defaultReconnectHoldTimeout
+	if conf.ReconnectHoldTimeout > 0 {
+		tunnel.reconnectHoldTimeout = time.Duration(conf.ReconnectHoldTimeout) * time.Second
+	}
+	if conf.RateLimit > 0 {
+		tunnel.readLimiter = rio.NewRateLimiter(conf.RateLimit)
+		tunnel.writeLimiter = rio.NewRateLimiter(conf.RateLimit)
+	}
 
 	return tunnel
 }
@@ -88,101 +210,245 @@ func (t *Tunnel) waitForSshClient() bool {
 	}
 }
 
+// prepare validates the tunnel options and builds the balancer, the
+// sources allowlist and the tls config
+func (t *Tunnel) prepare() error {
+	if t.udp && (!t.forward || t.dynamic) {
+		return errors.New("udp is supported by forward tunnels only")
+	}
+	if t.udp {
+		for _, e := range []*utils.Endpoint{t.localEndpoint, t.remoteEndpoint} {
+			if e.IsUnix() || e.Network() != utils.SCHEME_UDP && e.Scheme != "" {
+				return fmt.Errorf("the udp tunnels can't have the %s endpoint %s", e.Network(), e)
+			}
+		}
+	} else if t.localEndpoint.Network() == utils.SCHEME_UDP || t.remoteEndpoint.Network() == utils.SCHEME_UDP {
+		return errors.New("the udp endpoints need an udp tunnel")
+	}
+	switch t.proxyProtocol {
+	case "", PROXY_PROTOCOL_V1, PROXY_PROTOCOL_V2:
+	default:
+		return fmt.Errorf("invalid proxy protocol version '%s'", t.proxyProtocol)
+	}
+	if t.proxyProtocol != "" && (t.dynamic || t.udp) {
+		return errors.New("the proxy protocol is not supported by dynamic and udp tunnels")
+	}
+	balancer, err := t.buildBalancer()
+	if err != nil {
+		return err
+	}
+	t.balancer.Store(balancer)
+	allowedSources, err := parseSources(t.sources)
+	if err != nil {
+		return err
+	}
+	t.allowedSources = allowedSources
+	t.fallbackFirst, t.fallbackLast, err = parsePortRange(t.fallbackPorts)
+	if err != nil {
+		return err
+	}
+	if t.mtls != nil {
+		if t.udp {
+			return errors.New("mtls is not supported by udp tunnels")
+		}
+		tlsConfig, err := t.mtls.tlsConfig()
+		if err != nil {
+			return err
+		}
+		t.tlsConfig = tlsConfig
+	}
+	if err := t.validatePriority(); err != nil {
+		return err
+	}
+	if err := t.socketOptions.validate(); err != nil {
+		return err
+	}
+	return t.validateReconnectPolicy()
+}
+
 // Start activates the tunnel connections
 func (t *Tunnel) Start() {
+	if err := t.prepare(); err != nil {
+		t.log.Println(err)
+		return
+	}
+	if t.captureConf != nil {
+		capture, err := newCapture(t.captureConf, t.log.Printf)
+		if err != nil {
+			t.log.Errorf("failed to start the capture: %s", err)
+			return
+		}
+		t.capture = capture
+	}
 	t.registryID = TunRegistry().Add(t)
 
 	go t.metricsSampler()
+	if t.expires() {
+		go t.watchExpiry()
+	}
+	// the consecutive failed listen attempts
+	failures := 0
 	for {
+		if t.keepsListener() {
+			// the listener doesn't depend on the ssh connection
+			t.listenLocalPersistent()
+			if t.isListening() {
+				failures = 0
+			} else {
+				failures++
+				t.failFast(failures)
+			}
+			t.setListening(false)
+			select {
+			case <-t.terminate:
+				t.log.Println("terminated")
+				return
+			case <-time.After(t.retryDelay(failures)):
+			}
+			continue
+		}
 		// waits for the ssh client to be connected to the server or for
 		// a terminate request
 		for {
 			if t.waitForSshClient() {
 				break
 			} else {
-				log.Println("terminated")
+				t.log.Println("terminated")
 				return
 			}
 		}
 
-		if t.forward {
+		if t.dynamic {
+			t.listenDynamic()
+		} else if t.udp {
+			t.listenLocalUdp()
+		} else if t.forward {
 			t.listenLocal()
 		} else {
 			t.listenRemote()
 		}
+		if t.isListening() {
+			failures = 0
+		} else {
+			failures++
+			t.failFast(failures)
+		}
+		t.setListening(false)
 
-		time.Sleep(t.reconnectionInterval)
+		time.Sleep(t.retryDelay(failures))
 	}
 }
 
+// failFast exits with the bind failure code if the failed listen
+// attempts exceed the fail fast max retries
+func (t *Tunnel) failFast(failures int) {
+	t.stats.mu.Lock()
+	lastError := t.stats.lastError
+	t.stats.mu.Unlock()
+	failfast.Check(failures, failfast.ExitBindFailure, errors.New(lastError))
+}
+
 // IsStoppable return true if the tunnel can be stopped calling the Stop
 // method. False if not
 func (t *Tunnel) IsStoppable() bool {
 	return t.stoppable
 }
 
-// Stop ends the tunnel
-func (t *Tunnel) Stop() {
+// Stop ends the tunnel, if stoppable. See Shutdown
+func (t *Tunnel) Stop() int {
 	if !t.stoppable {
-		return
+		return 0
 	}
-	close(t.metricsSamplerCloser)
-	TunRegistry().Delete(t.registryID)
-	close(t.terminate)
-	go func() {
+	return t.Shutdown()
+}
+
+// Shutdown ends the tunnel, even if not stoppable. It stops accepting new
+// clients and gives the active connections the drain timeout to complete,
+// then closes them. It returns the number of connections cut
+func (t *Tunnel) Shutdown() int {
+	cut := 0
+	t.shutdownOnce.Do(func() {
+		close(t.metricsSamplerCloser)
+		TunRegistry().Delete(t.registryID)
+		close(t.terminate)
+		t.removePortFile()
 		t.listenerMU.RLock()
 		if t.listener != nil {
 			t.listener.Close()
 		}
+		if t.packetConn != nil {
+			t.packetConn.Close()
+		}
 		t.listenerMU.RUnlock()
 
-		// close all clients connections
-		t.clientsMapMU.Lock()
-		for k, v := range t.clientsMap {
-			v.Close()
-			delete(t.clientsMap, k)
+		cut = t.drain()
+		if t.capture != nil {
+			t.capture.close()
 		}
-		t.clientsMapMU.Unlock()
-	}()
+		if cut > 0 {
+			t.log.Printf("tunnel stopped, %d connections cut", cut)
+		} else {
+			t.log.Println("tunnel stopped")
+		}
+		t.emit(Event{Type: EVENT_TUNNEL_STOPPED})
+		close(t.done)
+	})
+	return cut
 }
 
 func (t *Tunnel) listenLocal() error {
 	// Listen on remote server port
-	listener, err := net.Listen("tcp", t.localEndpoint.String())
+	listener, err := t.listenLocalEndpoint()
 	if err != nil {
-		log.Printf("dial INTO remote service error. %s\n", err)
+		t.log.Errorf("dial INTO remote service error. %s\n", err)
+		t.setError(err)
 		return err
 	}
+	listener = t.tlsListener(t.limitListener(listener))
 	defer listener.Close()
 
 	t.listenerMU.Lock()
 	t.listener = listener
 	t.listenerMU.Unlock()
+	t.setListening(true)
+	t.reportListener()
 
-	log.Printf("forward connected. Local: %s <- Remote: %s\n", t.listener.Addr(), t.remoteEndpoint.String())
+	t.log.Printf("forward connected. Local: %s <- Remote: %s\n", t.listener.Addr(), t.remoteEndpoint.String())
 	if t.sshConn != nil && listener != nil {
+		// stop accepting clients when the ssh connection is lost. The
+		// tunnel restarts the listener when it is reestablished
+		go func() {
+			t.sshConn.Client.Wait()
+			listener.Close()
+		}()
 		for {
-			remote, err := t.sshConn.Client.Dial("tcp", t.remoteEndpoint.String())
-			// Open a (local) connection to localEndpoint whose content will be forwarded so serverEndpoint
+			client, err := t.accept(listener)
 			if err != nil {
-				log.Printf("listen open port ON local server error. %s\n", err)
-				break
-			}
-			client, err := listener.Accept()
-			if err != nil {
-				log.Println("disconnected")
+				t.log.Println("disconnected")
+				t.setError(err)
 				return err
 			}
-			t.clientsMapMU.Lock()
-			t.clientsMap[client.RemoteAddr().String()] = client
-			t.clientsMapMU.Unlock()
-
-			t.copyConn(client, remote)
+			client = t.addClient(client)
+			go t.serveClient(client)
 		}
 	}
 	return nil
 }
 
+// serveClient dials the tunnel target for client and copies the data
+// between them. The client is dropped if no target can be dialed
+func (t *Tunnel) serveClient(client net.Conn) {
+	target, err := t.dialTarget()
+	if err != nil {
+		t.log.Errorf("dial INTO target error. %s\n", err)
+		t.setError(err)
+		client.Close()
+		t.removeClient(client)
+		return
+	}
+	t.copyConn(client, target)
+}
+
 func (t *Tunnel) metricsSampler() {
 	samplingPeriod := 5 // in secs
 	for {
@@ -199,21 +465,76 @@ func (t *Tunnel) metricsSampler() {
 	}
 }
 
+// clientKey identifies a client connection. Not using the remote
+// address: it is the same for all the unix sockets clients
+func clientKey(c net.Conn) string {
+	return fmt.Sprintf("%p", c)
+}
+
+// addClient accounts a new client connection. The returned connection
+// must be used in place of c, to count the transferred bytes
+func (t *Tunnel) addClient(c net.Conn) net.Conn {
+	t.stats.accepted.Add(1)
+	sc := newStatsConn(c, t)
+	t.clientsMapMU.Lock()
+	t.clientsMap[clientKey(sc)] = sc
+	t.clientsMapMU.Unlock()
+	sc.logOpen()
+	if t.capture != nil {
+		t.capture.open(sc)
+	}
+	return sc
+}
+
+// removeClient forgets a client connection. The closing is logged once
+func (t *Tunnel) removeClient(c net.Conn) {
+	t.clientsMapMU.Lock()
+	_, ok := t.clientsMap[clientKey(c)]
+	delete(t.clientsMap, clientKey(c))
+	t.clientsMapMU.Unlock()
+	if sc, isStats := c.(*statsConn); ok && isStats {
+		sc.logClose()
+		if t.capture != nil {
+			t.capture.end(sc)
+		}
+	}
+}
+
+// listenLocalEndpoint listens on the tunnel local endpoint, a tcp
+// address or a unix socket path
+func (t *Tunnel) listenLocalEndpoint() (net.Listener, error) {
+	if l, err := t.activatedListener(); l != nil || err != nil {
+		return l, err
+	}
+	if !t.localEndpoint.IsUnix() {
+		addr, err := t.localListenAddress()
+		if err != nil {
+			return nil, err
+		}
+		return t.socketOptions.listen(addr)
+	}
+	perm, err := utils.ParseSocketPermissions(t.socketPermissions)
+	if err != nil {
+		return nil, err
+	}
+	return t.localEndpoint.Listen(perm)
+}
+
+// copyConn copies the data between the client c1 and the tunnel
+// target c2
 func (t *Tunnel) copyConn(c1, c2 net.Conn) {
-	byteswrittench := rio.CopyConnWithOnClose(c1, c2, true,
+	if err := t.sendProxyHeader(c2, c1); err != nil {
+		t.log.Errorf("failed to send the proxy protocol header: %s", err)
+		c1.Close()
+		c2.Close()
+		t.removeClient(c1)
+		return
+	}
+	// the bytes are counted by the client statsConn
+	rio.CopyConnWithOnClose(c1, c2, false,
 		func() {
-			t.clientsMapMU.Lock()
-			delete(t.clientsMap, c1.RemoteAddr().String())
-			t.clientsMapMU.Unlock()
+			t.removeClient(c1)
 		})
-
-	go func() {
-		for w := range byteswrittench {
-			t.metricsMU.Lock()
-			t.currentBytes += w
-			t.metricsMU.Unlock()
-		}
-	}()
 }
 
 // GetsCurrentBytesPerSecond return the current tunnel throughput
@@ -231,6 +552,9 @@ func (t *Tunnel) GetListenerAddr() net.Addr {
 	if t.listener != nil {
 		return t.listener.Addr()
 	}
+	if t.packetConn != nil {
+		return t.packetConn.LocalAddr()
+	}
 	return nil
 }
 
@@ -239,7 +563,7 @@ func (t *Tunnel) GetActiveClientsCount() int {
 	t.clientsMapMU.Lock()
 	defer t.clientsMapMU.Unlock()
 
-	return len(t.clientsMap)
+	return len(t.clientsMap) + len(t.udpSessions)
 }
 
 // GetIsListenerLocal return true if it is a forward tunnel. In a forward tunnel
@@ -251,8 +575,21 @@ func (t *Tunnel) GetIsListenerLocal() bool {
 	return t.forward
 }
 
+// GetIsDynamic returns true if it is a dynamic (SOCKS5) tunnel
+func (t *Tunnel) GetIsDynamic() bool {
+	return t.dynamic
+}
+
 // GetEndpoint returns the tunnel endpoint
 func (t *Tunnel) GetEndpoint() utils.Endpoint {
+	// dynamic tunnels have no fixed destination: the listener
+	// endpoint is returned
+	if t.dynamic {
+		if t.forward {
+			return *t.localEndpoint
+		}
+		return *t.remoteEndpoint
+	}
 	if t.forward {
 		return *t.remoteEndpoint
 	}
@@ -264,39 +601,33 @@ func (t *Tunnel) listenRemote() error {
 	// you can use port :0 to get a random available tcp port
 	// Example:
 	//	listener, err := t.sshConn.Client.Listen("tcp", "127.0.0.1:0")
-	log.Println("starting remote listener")
-	listener, err := t.sshConn.Client.Listen("tcp", t.remoteEndpoint.String())
+	t.log.Println("starting remote listener")
+	listener, err := t.listenRemoteEndpoint()
 	if err != nil {
-		log.Printf("listen open port ON remote server error. %s\n", err)
+		t.log.Errorf("listen open port ON remote server error. %s\n", err)
+		t.setError(err)
 		return err
 	}
+	listener = t.tlsListener(t.limitListener(listener))
 	defer listener.Close()
 
 	t.listenerMU.Lock()
 	t.listener = listener
 	t.listenerMU.Unlock()
+	t.setListening(true)
+	t.reportListener()
 
-	log.Printf("reverse connected. Local: %s -> Remote: %s\n", t.localEndpoint.String(), t.listener.Addr())
+	t.log.Printf("reverse connected. Local: %s -> Remote: %s\n", t.localEndpoint.String(), t.listener.Addr())
 	if t.sshConn != nil && listener != nil {
 		for {
-			// Open a (local) connection to localEndpoint whose content will be forwarded so serverEndpoint
-			local, err := net.Dial("tcp", t.localEndpoint.String())
+			client, err := t.accept(listener)
 			if err != nil {
-				log.Printf("dial INTO local service error. %s\n", err)
-				break
-			}
-
-			client, err := listener.Accept()
-			if err != nil {
-				log.Println("disconnected")
+				t.log.Println("disconnected")
+				t.setError(err)
 				return err
 			}
-
-			t.clientsMapMU.Lock()
-			t.clientsMap[client.RemoteAddr().String()] = client
-			t.clientsMapMU.Unlock()
-
-			t.copyConn(client, local)
+			client = t.addClient(client)
+			go t.serveClient(client)
 		}
 	}
 	return nil
@@ -2,14 +2,30 @@ package tun
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/ferama/rospo/pkg/logger"
 	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/utils"
 )
 
 func startEchoService(l net.Listener) {
@@ -75,10 +91,12 @@ func TestTunnelReverse(t *testing.T) {
 	go startEchoService(echoListener)
 
 	echoPort := getPort(echoListener.Addr())
+	portFile := filepath.Join(t.TempDir(), "port")
 	tunnelConf := &TunnelConf{
-		Remote:  "127.0.0.1:0",
-		Local:   "127.0.0.1:" + echoPort,
-		Forward: false,
+		Remote:   "127.0.0.1:0",
+		Local:    "127.0.0.1:" + echoPort,
+		Forward:  false,
+		PortFile: portFile,
 	}
 	tunnel := NewTunnel(client, tunnelConf, true)
 	go tunnel.Start()
@@ -124,7 +142,16 @@ func TestTunnelReverse(t *testing.T) {
 	tunnel.GetIsListenerLocal()
 	tunnel.GetEndpoint()
 
+	// the port chosen by the server is reported
+	data, err := os.ReadFile(portFile)
+	if err != nil || strings.TrimSpace(string(data)) != getPort(tunaddr) {
+		t.Fatalf("unexpected port file content %q: %v", data, err)
+	}
+
 	tunnel.Stop()
+	if _, err := os.Stat(portFile); !os.IsNotExist(err) {
+		t.Fatal("the port file should be removed on stop")
+	}
 	// be sure to catch the full stop event
 	time.Sleep(tunnel.reconnectionInterval + 2*time.Second)
 }
@@ -217,5 +244,1811 @@ func TestTunnelForward(t *testing.T) {
 	tunnel.GetIsListenerLocal()
 	tunnel.GetEndpoint()
 
+	stats := tunnel.Stats()
+	if stats.AcceptedConnections != 1 || stats.ActiveConnections != 1 {
+		t.Fatalf("unexpected connections stats %+v", stats)
+	}
+	if stats.BytesIn != 5 || stats.BytesOut != 5 || stats.Uptime <= 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	conns := tunnel.Connections()
+	if len(conns) != 1 || conns[0].BytesIn != 5 || conns[0].Peer != conn.LocalAddr().String() {
+		t.Fatalf("unexpected connections %+v", conns)
+	}
+
+	tunnel.Stop()
+
+	// a forward refused by the server records the channel error
+	refusing := sshd.NewSshServer(&sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+		DisableTunnelling: true,
+	})
+	go refusing.Start()
+	for refusing.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	refusingClient := sshc.NewSshConnection(&sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true,
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: refusing.GetListenerAddr().String(),
+	})
+	go refusingClient.Start()
+	dead := NewTunnel(refusingClient, &TunnelConf{
+		Remote:  "127.0.0.1:" + echoPort,
+		Local:   "127.0.0.1:0",
+		Forward: true,
+	}, true)
+	go dead.Start()
+	for dead.Stats().LastError == "" {
+		if addr := dead.GetListenerAddr(); addr != nil {
+			if c, err := net.Dial("tcp", addr.String()); err == nil {
+				c.Read(make([]byte, 1))
+				c.Close()
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if dead.Stats().LastErrorTime.IsZero() {
+		t.Fail()
+	}
+	dead.Stop()
+}
+
+// socksConnect opens a SOCKS5 connection through the proxy at addr
+// to host:port, without authentication
+func socksConnect(t *testing.T, addr string, host string, port string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{5, 1, 0})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("unexpected greeting reply %v: %v", reply, err)
+	}
+	p, _ := strconv.Atoi(port)
+	req := []byte{5, 1, 0, 3, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(p>>8), byte(p))
+	conn.Write(req)
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("unexpected connect reply %v: %v", reply, err)
+	}
+	return conn
+}
+
+func testTunnelDynamic(t *testing.T, remote bool) {
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	clientConf := &sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}
+	client := sshc.NewSshConnection(clientConf)
+	go client.Start()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fail()
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	c := &TunnelConf{Local: "127.0.0.1:0", Dynamic: true}
+	if remote {
+		c = &TunnelConf{Remote: "127.0.0.1:0", RemoteDynamic: true}
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tunnel := NewTunnel(client, c, true)
+	go tunnel.Start()
+
+	var tunaddr net.Addr
+	for {
+		tunaddr = tunnel.GetListenerAddr()
+		if tunaddr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// the host name is resolved by the dialing side
+	conn := socksConnect(t, tunaddr.String(), "localhost", getPort(echoListener.Addr()))
+	defer conn.Close()
+	conn.Write([]byte("test\n"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "test" {
+		t.Fatalf("assert data written is equal to data read: %q %v", buf, err)
+	}
+	if !tunnel.GetIsDynamic() || tunnel.GetIsListenerLocal() == remote {
+		t.Fail()
+	}
+	if tunnel.GetActiveClientsCount() != 1 {
+		t.Fail()
+	}
+	tunnel.Stop()
+}
+
+func TestTunnelDynamic(t *testing.T) {
+	testTunnelDynamic(t, false)
+}
+
+func TestTunnelRemoteDynamic(t *testing.T) {
+	testTunnelDynamic(t, true)
+
+	c := &TunnelConf{Local: "127.0.0.1:0", Remote: "127.0.0.1:0", Dynamic: true, RemoteDynamic: true}
+	if err := c.Validate(); err == nil {
+		t.Fatal("dynamic and remote_dynamic should be exclusive")
+	}
+}
+
+func TestTunnelUdp(t *testing.T) {
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	clientConf := &sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}
+	client := sshc.NewSshConnection(clientConf)
+	go client.Start()
+
+	// udp echo service
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// the udp flag and the udp:// scheme are equivalent
+	for _, tc := range []*TunnelConf{
+		{Remote: echo.LocalAddr().String(), Local: "127.0.0.1:0", Forward: true, Udp: true},
+		{Remote: "udp://" + echo.LocalAddr().String(), Local: "udp://127.0.0.1:0", Forward: true},
+	} {
+		tunnel := NewTunnel(client, tc, true)
+		go tunnel.Start()
+
+		var tunaddr net.Addr
+		for {
+			tunaddr = tunnel.GetListenerAddr()
+			if tunaddr != nil {
+				break
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+
+		conn, err := net.Dial("udp", tunaddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1024)
+		for _, msg := range []string{"first", "second"} {
+			conn.Write([]byte(msg))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := conn.Read(buf)
+			if err != nil || string(buf[:n]) != msg {
+				t.Fatalf("expected %q, got %q: %v", msg, buf[:n], err)
+			}
+		}
+		if tunnel.GetActiveClientsCount() != 1 {
+			t.Fatalf("expected 1 udp session, got %d", tunnel.GetActiveClientsCount())
+		}
+		conn.Close()
+		tunnel.Stop()
+	}
+
+	// a client whose ssh channel can't be opened is dropped, the
+	// listener keeps serving the others
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:  "udp://127.0.0.1:70000",
+		Local:   "udp://127.0.0.1:0",
+		Forward: true,
+	}, true)
+	go tunnel.Start()
+	var tunaddr net.Addr
+	for tunaddr == nil {
+		time.Sleep(100 * time.Millisecond)
+		tunaddr = tunnel.GetListenerAddr()
+	}
+	conn, err := net.Dial("udp", tunaddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("dropped"))
+	time.Sleep(500 * time.Millisecond)
+	conn.Close()
+	if tunnel.Stats().LastError == "" {
+		t.Fatal("the channel error should be reported")
+	}
+	if tunnel.GetActiveClientsCount() != 0 {
+		t.Fatalf("expected no udp sessions, got %d", tunnel.GetActiveClientsCount())
+	}
+	if a := tunnel.GetListenerAddr(); a == nil || a.String() != tunaddr.String() {
+		t.Fatalf("the listener should not be restarted, got %v", a)
+	}
 	tunnel.Stop()
+
+	// the udp endpoints can't be mixed with tcp or unix ones
+	for _, tc := range []*TunnelConf{
+		{Remote: "tcp://" + echo.LocalAddr().String(), Local: "udp://127.0.0.1:0", Forward: true},
+		{Remote: "udp://" + echo.LocalAddr().String(), Local: "/tmp/rospo-udp.sock", Forward: true},
+		{Remote: "udp://" + echo.LocalAddr().String(), Local: "127.0.0.1:0"},
+	} {
+		if err := NewTunnel(client, tc, true).prepare(); err == nil {
+			t.Fatalf("the tunnel %s -> %s should be invalid", tc.Local, tc.Remote)
+		}
+	}
+}
+
+func TestTunnelUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:                   "../../testdata/server",
+		AuthorizedKeysURI:     []string{"../../testdata/authorized_keys"},
+		ListenAddress:         "127.0.0.1:0",
+		StreamLocalForwardDir: dir,
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	clientConf := &sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}
+	client := sshc.NewSshConnection(clientConf)
+	go client.Start()
+
+	echoPath := filepath.Join(dir, "echo.sock")
+	echoListener, err := net.Listen("unix", echoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	check := func(tunnel *Tunnel, network string) {
+		go tunnel.Start()
+		var tunaddr net.Addr
+		for {
+			tunaddr = tunnel.GetListenerAddr()
+			if tunaddr != nil {
+				break
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		// two clients at once: unix clients have no distinct addresses
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial(network, tunaddr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("test\n"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "test" {
+				t.Fatalf("assert data written is equal to data read: %q %v", buf, err)
+			}
+		}
+		if tunnel.GetActiveClientsCount() != 2 {
+			t.Fatalf("expected 2 clients, got %d", tunnel.GetActiveClientsCount())
+		}
+	}
+
+	// local unix socket forwarded to the remote unix socket
+	localPath := filepath.Join(dir, "local.sock")
+	forward := NewTunnel(client, &TunnelConf{
+		Remote:            "unix:" + echoPath,
+		Local:             localPath,
+		Forward:           true,
+		SocketPermissions: "0660",
+	}, true)
+	check(forward, "unix")
+	fi, err := os.Stat(localPath)
+	if err != nil || fi.Mode().Perm() != 0660 {
+		t.Fatalf("unexpected local socket permissions: %v", err)
+	}
+	forward.Stop()
+
+	// remote unix socket exposing the local one
+	remotePath := filepath.Join(dir, "remote.sock")
+	reverse := NewTunnel(client, &TunnelConf{
+		Remote:  remotePath,
+		Local:   echoPath,
+		Forward: false,
+	}, true)
+	check(reverse, "unix")
+	reverse.Stop()
+
+	time.Sleep(500 * time.Millisecond)
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Fatal("the local socket should be removed on stop")
+	}
+}
+
+func TestTunnelRateLimit(t *testing.T) {
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	clientConf := &sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}
+	client := sshc.NewSshConnection(clientConf)
+	go client.Start()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:    echoListener.Addr().String(),
+		Local:     "127.0.0.1:0",
+		Forward:   true,
+		RateLimit: 50 * 1024,
+	}, true)
+	go tunnel.Start()
+	defer tunnel.Stop()
+
+	var tunaddr net.Addr
+	for {
+		tunaddr = tunnel.GetListenerAddr()
+		if tunaddr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	conn, err := net.Dial("tcp", tunaddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the limiter allows a burst of one second of traffic, then
+	// 100KB more take two seconds
+	data := append(bytes.Repeat([]byte("a"), 150*1024), '\n')
+	start := time.Now()
+	go conn.Write(data)
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("assert data written is equal to data read: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Fatalf("the rate limit is not enforced, transfer took %s", elapsed)
+	}
+}
+
+func TestTunnelBindAddress(t *testing.T) {
+	tunnel := NewTunnel(nil, &TunnelConf{
+		Local:   ":8000",
+		Remote:  ":9000",
+		Forward: true,
+	}, true)
+	// the listeners default to the loopback
+	if addr, _ := tunnel.localListenAddress(); addr != "127.0.0.1:8000" {
+		t.Fatalf("unexpected default local address %s", addr)
+	}
+
+	for bind, expected := range map[string]string{
+		"0.0.0.0":  "0.0.0.0:8000",
+		"10.0.0.1": "10.0.0.1:8000",
+		"lo":       "127.0.0.1:8000",
+	} {
+		tunnel.bindAddress = bind
+		addr, err := tunnel.localListenAddress()
+		if err != nil || addr != expected {
+			t.Fatalf("unexpected local address %s for %s: %v", addr, bind, err)
+		}
+	}
+
+	// interface names are not resolved for remote listeners
+	tunnel.bindAddress = "0.0.0.0"
+	if addr := tunnel.remoteListenAddress(); addr != "0.0.0.0:9000" {
+		t.Fatalf("unexpected remote address %s", addr)
+	}
+}
+
+func TestTunnelAllowedSources(t *testing.T) {
+	if _, err := parseSources([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("invalid CIDRs should be refused")
+	}
+
+	check := func(sources []string, allowed bool) {
+		tunnel := NewTunnel(nil, &TunnelConf{Local: "127.0.0.1:0", Forward: true}, true)
+		tunnel.allowedSources, _ = parseSources(sources)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			if c, err := tunnel.accept(listener); err == nil {
+				c.Write([]byte("x"))
+				c.Close()
+			}
+		}()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// denied connections are closed without data
+		_, err = conn.Read(make([]byte, 1))
+		if allowed != (err == nil) {
+			t.Fatalf("unexpected result for %v: %v", sources, err)
+		}
+	}
+	check([]string{"10.0.0.0/8", "::1"}, false)
+	check([]string{"10.0.0.0/8", "127.0.0.1"}, true)
+	check([]string{}, true)
+}
+
+func TestTunnelSocketOptions(t *testing.T) {
+	noDelay := false
+	opts := &SocketOptionsConf{
+		NoDelay:     &noDelay,
+		KeepAlive:   30,
+		ReuseAddr:   true,
+		ReusePort:   true,
+		ReadBuffer:  64 * 1024,
+		WriteBuffer: 64 * 1024,
+	}
+	tunnel := NewTunnel(nil, &TunnelConf{
+		Local:         "127.0.0.1:0",
+		Forward:       true,
+		SocketOptions: opts,
+	}, true)
+	listener, err := tunnel.listenLocalEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// with reuse_port a second listener can share the port
+	tunnel.localEndpoint = utils.NewEndpoint(listener.Addr().String())
+	shared, err := tunnel.listenLocalEndpoint()
+	if err != nil {
+		t.Fatalf("reuse_port should allow a shared listener: %s", err)
+	}
+	shared.Close()
+
+	go func() {
+		if c, err := tunnel.accept(listener); err == nil {
+			c.Write([]byte("x"))
+			c.Close()
+		}
+	}()
+	conn, err := tunnel.dialLocal("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the options only apply to tcp connections
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := opts.apply(c1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTunnelMaxConnections(t *testing.T) {
+	tunnel := NewTunnel(nil, &TunnelConf{
+		Local:            "127.0.0.1:0",
+		Forward:          true,
+		MaxConnections:   1,
+		ConnectionsQueue: 1,
+	}, true)
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := tunnel.limitListener(raw)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	accept := func() net.Conn {
+		select {
+		case c := <-accepted:
+			return c
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	a := dial()
+	defer a.Close()
+	served := accept()
+	if served == nil {
+		t.Fatal("the first connection should be accepted")
+	}
+	// the second one is queued
+	b := dial()
+	defer b.Close()
+	// the third one exceeds the queue and is closed
+	c := dial()
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the connection should be closed, got %v", err)
+	}
+	queued := accept()
+	if queued != nil {
+		t.Fatal("the queued connection should wait for a free slot")
+	}
+
+	// the queued connection is served once a slot is free
+	served.Close()
+	queued = accept()
+	if queued == nil {
+		t.Fatal("the queued connection should be accepted")
+	}
+	queued.Close()
+}
+
+func TestTunnelMaxConnectionsDeniedSources(t *testing.T) {
+	tunnel := NewTunnel(nil, &TunnelConf{
+		Local:          "127.0.0.1:0",
+		Forward:        true,
+		MaxConnections: 1,
+		AllowedSources: []string{"10.0.0.1"},
+	}, true)
+	if err := tunnel.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := tunnel.limitListener(raw)
+	defer listener.Close()
+
+	// the denied clients are closed without taking the slots
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("the connection should be closed, got %v", err)
+		}
+		c.Close()
+	}
+	if n := len(listener.(*limitedListener).slots); n != 0 {
+		t.Fatalf("the denied connections took %d slots", n)
+	}
+}
+
+// writeCert generates a certificate signed by parent (self signed if nil)
+// and writes it and its key in dir. Returns the certificate and key
+func writeCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+func TestTunnelMTLS(t *testing.T) {
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	clientConf := &sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}
+	client := sshc.NewSshConnection(clientConf)
+	go client.Start()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+	// a client certificate signed by another CA
+	otherCA, otherKey := writeCert(t, dir, "other-ca", nil, nil)
+	writeCert(t, dir, "other", otherCA, otherKey)
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:  "127.0.0.1:0",
+		Local:   echoListener.Addr().String(),
+		Forward: false,
+		MTLS: &MTLSConf{
+			Cert:     filepath.Join(dir, "server.crt"),
+			Key:      filepath.Join(dir, "server.key"),
+			ClientCA: filepath.Join(dir, "ca.crt"),
+		},
+	}, true)
+	go tunnel.Start()
+	defer tunnel.Stop()
+
+	var tunaddr net.Addr
+	for {
+		tunaddr = tunnel.GetListenerAddr()
+		if tunaddr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	echo := func(name string) error {
+		conf := &tls.Config{RootCAs: roots}
+		if name != "" {
+			cert, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conf.Certificates = []tls.Certificate{cert}
+		}
+		conn, err := tls.Dial("tcp", tunaddr.String(), conf)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.Write([]byte("test\n"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if string(buf) != "test" {
+			return fmt.Errorf("unexpected data %q", buf)
+		}
+		return nil
+	}
+
+	if err := echo("client"); err != nil {
+		t.Fatalf("a client with a valid certificate should be served: %s", err)
+	}
+	if err := echo(""); err == nil {
+		t.Fatal("a client without certificate should be refused")
+	}
+	if err := echo("other"); err == nil {
+		t.Fatal("a client with an unknown certificate should be refused")
+	}
+}
+
+func TestMTLSHandshakeTimeout(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &mtlsListener{Listener: raw, config: &tls.Config{}, timeout: 100 * time.Millisecond}
+	defer listener.Close()
+
+	// the client never starts the handshake
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the handshake should fail")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("the handshake should time out")
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080}
+
+	h := string(proxyHeader(PROXY_PROTOCOL_V1, src, dst))
+	if h != "PROXY TCP4 192.168.1.10 10.0.0.1 40000 8080\r\n" {
+		t.Fatalf("unexpected v1 header %q", h)
+	}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8080}
+	h = string(proxyHeader(PROXY_PROTOCOL_V1, src6, dst6))
+	if h != "PROXY TCP6 2001:db8::1 2001:db8::2 40000 8080\r\n" {
+		t.Fatalf("unexpected v1 header %q", h)
+	}
+	unix := &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}
+	if h := string(proxyHeader(PROXY_PROTOCOL_V1, unix, unix)); h != "PROXY UNKNOWN\r\n" {
+		t.Fatalf("unexpected v1 header %q", h)
+	}
+
+	expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 12,
+		192, 168, 1, 10, 10, 0, 0, 1, 0x9c, 0x40, 0x1f, 0x90)
+	if h := proxyHeader(PROXY_PROTOCOL_V2, src, dst); !bytes.Equal(h, expected) {
+		t.Fatalf("unexpected v2 header %v", h)
+	}
+	if h := proxyHeader(PROXY_PROTOCOL_V2, src6, dst6); len(h) != 16+36 || h[13] != 0x21 {
+		t.Fatalf("unexpected v2 header %v", h)
+	}
+	if h := proxyHeader(PROXY_PROTOCOL_V2, unix, unix); len(h) != 16 || h[12] != 0x20 {
+		t.Fatalf("unexpected v2 header %v", h)
+	}
+
+	// the header carries the tunnel client addresses
+	tunnel := NewTunnel(nil, &TunnelConf{ProxyProtocol: PROXY_PROTOCOL_V1}, true)
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+	target, err := net.Dial("tcp", echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := tunnel.sendProxyHeader(target, client); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(target).ReadString('\n')
+	expectedLine := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %s %s\r\n", getPort(conn.LocalAddr()), getPort(listener.Addr()))
+	if err != nil || line != expectedLine {
+		t.Fatalf("unexpected header %q: %v", line, err)
+	}
+}
+
+func TestTunnelFallbackPorts(t *testing.T) {
+	if _, _, err := parsePortRange("9010-9000"); err == nil {
+		t.Fatal("invalid ranges should be refused")
+	}
+	if f, l, err := parsePortRange("9000-9010"); err != nil || f != 9000 || l != 9010 {
+		t.Fatalf("unexpected range %d-%d: %v", f, l, err)
+	}
+	tunnel := NewTunnel(nil, &TunnelConf{}, true)
+	if tunnel.retryDelay(0) != tunnel.reconnectionInterval ||
+		tunnel.retryDelay(2) != 2*tunnel.reconnectionInterval ||
+		tunnel.retryDelay(100) != maxRetryDelay {
+		t.Fatal("unexpected retry delays")
+	}
+
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	clientConf := &sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}
+	client := sshc.NewSshConnection(clientConf)
+	go client.Start()
+
+	// the remote endpoint port is busy
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freePort := getPort(free.Addr())
+	free.Close()
+
+	tunnel = NewTunnel(client, &TunnelConf{
+		Remote:        busy.Addr().String(),
+		Local:         "127.0.0.1:8000",
+		Forward:       false,
+		FallbackPorts: freePort,
+	}, true)
+	go tunnel.Start()
+	defer tunnel.Stop()
+
+	var tunaddr net.Addr
+	for {
+		tunaddr = tunnel.GetListenerAddr()
+		if tunaddr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if strconv.Itoa(tunnel.GetListenerPort()) != freePort {
+		t.Fatalf("expected the fallback port %s, got %s", freePort, tunaddr)
+	}
+
+	// the server reports the busy ports only
+	if !client.RemoteAddrInUse(busy.Addr().String()) {
+		t.Fatal("the remote endpoint should be reported as busy")
+	}
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+	if client.RemoteAddrInUse(other.Addr().String()) {
+		t.Fatal("a free port should not be reported as busy")
+	}
+}
+
+func TestTunnelRemotePortAllocation(t *testing.T) {
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	clientConf := &sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}
+	client := sshc.NewSshConnection(clientConf)
+	go client.Start()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:  "127.0.0.1:0",
+		Local:   echoListener.Addr().String(),
+		Forward: false,
+	}, true)
+	tunnel.reconnectionInterval = 100 * time.Millisecond
+	go tunnel.Start()
+	defer tunnel.Stop()
+
+	for tunnel.GetListenerPort() == 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	port := tunnel.GetListenerPort()
+	listener := tunnel.GetListenerAddr()
+
+	// the same port is requested again on reconnection
+	client.Client.Close()
+	for tunnel.GetListenerAddr() == listener || !tunnel.isListening() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if tunnel.GetListenerPort() != port {
+		t.Fatalf("expected the allocated port %d, got %d", port, tunnel.GetListenerPort())
+	}
+}
+
+func TestTunnelLoadBalancing(t *testing.T) {
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	clientConf := &sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}
+	client := sshc.NewSshConnection(clientConf)
+	go client.Start()
+
+	// the backends greet the clients with their name
+	backend := func(name string) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(name + "\n"))
+			}
+		}()
+		return l
+	}
+	a := backend("a")
+	defer a.Close()
+	b := backend("b")
+	defer b.Close()
+	// the rospo server accepts the channel before dialing: an invalid
+	// port fails the dial on the client side
+	broken := "127.0.0.1:70000"
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:  a.Addr().String(),
+		Remotes: []string{broken, b.Addr().String()},
+		Local:   "127.0.0.1:0",
+		Forward: true,
+	}, true)
+	go tunnel.Start()
+	defer tunnel.Stop()
+
+	var tunaddr net.Addr
+	for {
+		tunaddr = tunnel.GetListenerAddr()
+		if tunaddr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 6; i++ {
+		conn, err := net.Dial("tcp", tunaddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[strings.TrimSpace(line)]++
+	}
+	if counts["a"] == 0 || counts["b"] == 0 || counts["a"]+counts["b"] != 6 {
+		t.Fatalf("the connections are not balanced: %v", counts)
+	}
+
+	stats := tunnel.Stats()
+	if len(stats.Backends) != 3 || stats.Backends[1].Healthy || !stats.Backends[0].Healthy {
+		t.Fatalf("unexpected backends stats %+v", stats.Backends)
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b := newBalancer(BALANCE_LEAST_CONNECTIONS, []*utils.Endpoint{
+		utils.NewEndpoint("127.0.0.1:1"),
+		utils.NewEndpoint("127.0.0.1:2"),
+		utils.NewEndpoint("127.0.0.1:3"),
+	}, log)
+	b.backends[0].active.Store(2)
+	b.backends[1].active.Store(1)
+	b.backends[2].active.Store(3)
+	if c := b.candidates(); c[0] != b.backends[1] || c[1] != b.backends[0] {
+		t.Fatal("the backend with less connections should be preferred")
+	}
+	b.backends[1].markDown()
+	if c := b.candidates(); c[0] != b.backends[0] || c[2] != b.backends[1] {
+		t.Fatal("the unhealthy backends should be tried last")
+	}
+}
+
+func TestTunnelFailover(t *testing.T) {
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	clientConf := &sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}
+	client := sshc.NewSshConnection(clientConf)
+	go client.Start()
+
+	// the destinations greet the clients with their name
+	greeter := func(l net.Listener, name string) {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(name + "\n"))
+		}
+	}
+	backup, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	go greeter(backup, "backup")
+	// the primary destination is down
+	primary, _ := net.Listen("tcp", "127.0.0.1:0")
+	primaryAddr := primary.Addr().String()
+	primary.Close()
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:  "127.0.0.1:0",
+		Local:   primaryAddr,
+		Backups: []string{backup.Addr().String()},
+		Forward: false,
+	}, true)
+	go tunnel.Start()
+	defer tunnel.Stop()
+
+	var tunaddr net.Addr
+	for {
+		tunaddr = tunnel.GetListenerAddr()
+		if tunaddr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	greeting := func() string {
+		conn, err := net.Dial("tcp", tunaddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(line)
+	}
+
+	if g := greeting(); g != "backup" {
+		t.Fatalf("expected the backup destination, got %s", g)
+	}
+	// the primary is back: it is used once probed again
+	primary, err = net.Listen("tcp", primaryAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	go greeter(primary, "primary")
+	tunnel.balancer.Load().backends[0].mu.Lock()
+	tunnel.balancer.Load().backends[0].downUntil = time.Time{}
+	tunnel.balancer.Load().backends[0].mu.Unlock()
+	if g := greeting(); g != "primary" {
+		t.Fatalf("expected the primary destination, got %s", g)
+	}
+	if tunnel.GetListenerAddr() != tunaddr {
+		t.Fatal("the listener should be stable")
+	}
+}
+
+func TestExpandPorts(t *testing.T) {
+	conf := &TunnelConf{
+		Local:   "127.0.0.1:8000-8002,9000",
+		Remote:  "db:5000,6000-6002",
+		Forward: true,
+	}
+	tunnels, err := conf.ExpandPorts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][2]string{
+		{"127.0.0.1:8000", "db:5000"},
+		{"127.0.0.1:8001", "db:6000"},
+		{"127.0.0.1:8002", "db:6001"},
+		{"127.0.0.1:9000", "db:6002"},
+	}
+	if len(tunnels) != len(expected) {
+		t.Fatalf("expected %d tunnels, got %d", len(expected), len(tunnels))
+	}
+	for i, c := range tunnels {
+		if c.Local != expected[i][0] || c.Remote != expected[i][1] || !c.Forward {
+			t.Fatalf("unexpected tunnel %d: %s -> %s", i, c.Local, c.Remote)
+		}
+	}
+
+	plain := &TunnelConf{Local: "[::1]:8000", Remote: "/var/run/app.sock"}
+	tunnels, err = plain.ExpandPorts()
+	if err != nil || len(tunnels) != 1 || tunnels[0] != plain {
+		t.Fatalf("a plain tunnel should not be expanded: %v", err)
+	}
+
+	for _, c := range []*TunnelConf{
+		{Local: ":8000-8002", Remote: ":8000"},
+		{Local: ":8000-8002", Remote: ":9000-9001"},
+		{Local: ":8002-8000", Remote: ":8000-8002"},
+		{Local: ":1-2000", Remote: ":1-2000"},
+	} {
+		if _, err := c.ExpandPorts(); err == nil {
+			t.Fatalf("expected an error for %s -> %s", c.Local, c.Remote)
+		}
+	}
+}
+
+func TestTunnelName(t *testing.T) {
+	tunnel := NewTunnel(nil, &TunnelConf{
+		Name:   "grafana",
+		Labels: map[string]string{"team": "monitoring"},
+		Local:  ":3000",
+		Remote: ":3000",
+	}, false)
+	if tunnel.GetName() != "grafana" || tunnel.GetLabels()["team"] != "monitoring" {
+		t.Fatalf("unexpected name %q and labels %v", tunnel.GetName(), tunnel.GetLabels())
+	}
+	if !strings.HasSuffix(tunnel.log.Prefix(), "[grafana] ") {
+		t.Fatalf("the name should prefix the logs, got %q", tunnel.log.Prefix())
+	}
+
+	unnamed := NewTunnel(nil, &TunnelConf{Local: ":3000", Remote: ":3000"}, false)
+	if unnamed.log != log {
+		t.Fatal("unnamed tunnels should use the package logger")
+	}
+}
+
+func TestTunnelConnectionLogs(t *testing.T) {
+	var buf bytes.Buffer
+	tunnel := NewTunnel(nil, &TunnelConf{Local: ":3000", Remote: ":3000"}, false)
+	tunnel.log = logger.New(&buf, "")
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	client := tunnel.addClient(c1)
+	id := client.(*statsConn).id
+	go func() {
+		c2.Write([]byte("ping"))
+		io.ReadFull(c2, make([]byte, 2))
+	}()
+	io.ReadFull(client, make([]byte, 4))
+	client.Write([]byte("ok"))
+	client.Close()
+	tunnel.removeClient(client)
+	// the closing is logged once
+	tunnel.removeClient(client)
+
+	logs := buf.String()
+	if !strings.Contains(logs, fmt.Sprintf("conn #%d opened from pipe", id)) {
+		t.Fatalf("missing open log line: %q", logs)
+	}
+	closed := fmt.Sprintf("conn #%d closed from pipe. in: 4 bytes, out: 2 bytes", id)
+	if strings.Count(logs, closed) != 1 {
+		t.Fatalf("expected one close log line: %q", logs)
+	}
+
+	other := tunnel.addClient(c2).(*statsConn)
+	if other.id <= id {
+		t.Fatalf("the connection ids should increase, got %d after %d", other.id, id)
+	}
+}
+
+func TestPortFileRemovedWhenDown(t *testing.T) {
+	portFile := filepath.Join(t.TempDir(), "port")
+	tunnel := NewTunnel(nil, &TunnelConf{Local: ":3000", Remote: ":3000", PortFile: portFile}, false)
+	tunnel.setListening(true)
+	if err := writePortFile(portFile, 3000); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.setListening(false)
+	if _, err := os.Stat(portFile); !os.IsNotExist(err) {
+		t.Fatal("the port file should be removed when the listener closes")
+	}
+}
+
+func TestTunnelEvents(t *testing.T) {
+	events, unsubscribe := Events().Subscribe(16)
+	defer unsubscribe()
+
+	tunnel := NewTunnel(nil, &TunnelConf{Name: "events", Local: ":3000", Remote: ":3000"}, false)
+	tunnel.registryID = 42
+	tunnel.setListening(true)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	client := tunnel.addClient(c1)
+	go c2.Write([]byte("ping"))
+	io.ReadFull(client, make([]byte, 4))
+	client.Close()
+	tunnel.removeClient(client)
+	tunnel.setListening(false)
+	// no event if the state doesn't change
+	tunnel.setListening(false)
+
+	expected := []string{
+		EVENT_TUNNEL_UP,
+		EVENT_CONNECTION_OPENED,
+		EVENT_CONNECTION_CLOSED,
+		EVENT_TUNNEL_DOWN,
+	}
+	for _, typ := range expected {
+		var e Event
+		select {
+		case e = <-events:
+		case <-time.After(time.Second):
+			t.Fatalf("missing %s event", typ)
+		}
+		if e.Type != typ || e.TunnelID != 42 || e.TunnelName != "events" {
+			t.Fatalf("unexpected event %+v, expected %s", e, typ)
+		}
+		if e.Type == EVENT_CONNECTION_CLOSED && (e.BytesIn != 4 || e.ConnID == 0) {
+			t.Fatalf("unexpected connection stats %+v", e)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestTunnelExpiry(t *testing.T) {
+	tunnel := NewTunnel(nil, &TunnelConf{
+		Local:       "127.0.0.1:0",
+		Forward:     true,
+		MaxAccepted: 1,
+	}, true)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := tunnel.accept(listener)
+			if err != nil {
+				return
+			}
+			accepted <- tunnel.addClient(c)
+		}
+	}()
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	client := <-accepted
+	go tunnel.watchExpiry()
+
+	// the clients exceeding max_accepted are disconnected
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the second client should be disconnected, got %v", err)
+	}
+
+	// the tunnel stops once the accepted connection completes
+	select {
+	case <-tunnel.Done():
+		t.Fatal("the tunnel should wait for the active connection")
+	case <-time.After(time.Second):
+	}
+	client.Close()
+	tunnel.removeClient(client)
+	select {
+	case <-tunnel.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("the tunnel should stop after max_accepted connections")
+	}
+
+	idle := NewTunnel(nil, &TunnelConf{Local: "127.0.0.1:0", Forward: true, IdleTimeout: 1}, true)
+	go idle.watchExpiry()
+	select {
+	case <-idle.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("the tunnel should stop after the idle timeout")
+	}
+}
+
+func TestTunnelCapture(t *testing.T) {
+	run := func(conf *CaptureConf) []byte {
+		tunnel := NewTunnel(nil, &TunnelConf{Local: ":3000", Remote: ":3000"}, false)
+		capture, err := newCapture(conf, tunnel.log.Printf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnel.capture = capture
+
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		client := tunnel.addClient(c1)
+		go func() {
+			c2.Write([]byte("ping"))
+			io.ReadFull(c2, make([]byte, 4))
+		}()
+		io.ReadFull(client, make([]byte, 4))
+		client.Write([]byte("pong"))
+		client.Close()
+		tunnel.removeClient(client)
+		capture.close()
+
+		data, err := os.ReadFile(conf.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	dir := t.TempDir()
+	data := run(&CaptureConf{Path: filepath.Join(dir, "tunnel.pcap")})
+	if binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 {
+		t.Fatal("missing pcap header")
+	}
+	// the handshake, the two segments and the closing
+	packets := 0
+	payload := []byte{}
+	for off := 24; off < len(data); packets++ {
+		size := int(binary.LittleEndian.Uint32(data[off+8:]))
+		pkt := data[off+16 : off+16+size]
+		if checksum(pkt[:20], 0) != 0 {
+			t.Fatal("invalid ip checksum")
+		}
+		payload = append(payload, pkt[40:]...)
+		off += 16 + size
+	}
+	if packets != 8 || string(payload) != "pingpong" {
+		t.Fatalf("unexpected capture: %d packets, payload %q", packets, payload)
+	}
+
+	data = run(&CaptureConf{Path: filepath.Join(dir, "tunnel.raw"), Format: CAPTURE_RAW})
+	if !strings.Contains(string(data), "> 4 bytes\nping\n") || !strings.Contains(string(data), "< 4 bytes\npong\n") {
+		t.Fatalf("unexpected raw capture %q", data)
+	}
+
+	// the capture stops at the size limit
+	data = run(&CaptureConf{Path: filepath.Join(dir, "small.pcap"), MaxSize: 100})
+	if len(data) > 100 {
+		t.Fatalf("the capture exceeds its max size: %d bytes", len(data))
+	}
+}
+
+func TestTunnelReconnectPolicy(t *testing.T) {
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	startTunnel := func(policy string) (*sshc.SshConnection, *Tunnel) {
+		// the ssh client is not started: the connection is down
+		client := sshc.NewSshConnection(&sshc.SshClientConf{
+			Identity:  "../../testdata/client",
+			Insecure:  true, // disable known_hosts check
+			JumpHosts: make([]*sshc.JumpHostConf, 0),
+			ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		})
+		tunnel := NewTunnel(client, &TunnelConf{
+			Local:           "127.0.0.1:0",
+			Remote:          echoListener.Addr().String(),
+			Forward:         true,
+			ReconnectPolicy: policy,
+		}, true)
+		go tunnel.Start()
+		for tunnel.GetListenerAddr() == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return client, tunnel
+	}
+
+	// rejected at once while the connection is down
+	client, tunnel := startTunnel(RECONNECT_REJECT)
+	conn, err := net.Dial("tcp", tunnel.GetListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected a fast disconnection, got %v", err)
+	}
+	conn.Close()
+	tunnel.Stop()
+
+	// held until the connection is up
+	client, tunnel = startTunnel(RECONNECT_HOLD)
+	defer tunnel.Stop()
+	conn, err = net.Dial("tcp", tunnel.GetListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go client.Start()
+	defer client.Stop()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("held\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "held\n" {
+		t.Fatalf("unexpected echo %q: %v", line, err)
+	}
+
+	if err := NewTunnel(nil, &TunnelConf{Forward: false, ReconnectPolicy: RECONNECT_HOLD}, true).validateReconnectPolicy(); err == nil {
+		t.Fatal("reverse tunnels should not support the hold policy")
+	}
+}
+
+func TestTunnelLazy(t *testing.T) {
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	tunnelConf := &TunnelConf{
+		Local:           "127.0.0.1:0",
+		Remote:          echoListener.Addr().String(),
+		Forward:         true,
+		Lazy:            true,
+		LazyIdleTimeout: 1,
+	}
+	client := sshc.NewSshConnection(&sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	})
+	client.SetOnDemand(tunnelConf.GetLazyIdleTimeout())
+	go client.Start()
+	defer client.Stop()
+
+	tunnel := NewTunnel(client, tunnelConf, true)
+	go tunnel.Start()
+	defer tunnel.Stop()
+	for tunnel.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if client.IsConnected() {
+		t.Fatal("the connection should wait for the first client")
+	}
+
+	conn, err := net.Dial("tcp", tunnel.GetListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("lazy\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "lazy\n" {
+		t.Fatalf("unexpected echo %q: %v", line, err)
+	}
+	if !client.IsConnected() {
+		t.Fatal("the connection should be up while the client is")
+	}
+	conn.Close()
+
+	// closed once idle, checked at each keepalive
+	deadline := time.Now().Add(10 * time.Second)
+	for client.IsConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("the idle connection should be closed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := NewTunnel(nil, &TunnelConf{Forward: false, Lazy: true}, true).validateReconnectPolicy(); err == nil {
+		t.Fatal("reverse tunnels should not be lazy")
+	}
+}
+
+func TestTunnelDrain(t *testing.T) {
+	// start a local sshd
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd := sshd.NewSshServer(serverConf)
+	go sd.Start()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	sshdPort := getPort(addr)
+
+	clientConf := &sshc.SshClientConf{
+		Identity:  "../../testdata/client",
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}
+	client := sshc.NewSshConnection(clientConf)
+	go client.Start()
+	defer client.Stop()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	startTunnel := func() (*Tunnel, net.Conn) {
+		tunnel := NewTunnel(client, &TunnelConf{
+			Local:        "127.0.0.1:0",
+			Remote:       echoListener.Addr().String(),
+			Forward:      true,
+			DrainTimeout: 1,
+		}, true)
+		go tunnel.Start()
+		for tunnel.GetListenerAddr() == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+		conn, err := net.Dial("tcp", tunnel.GetListenerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("hello\n"))
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		return tunnel, conn
+	}
+
+	// the connection outlives the drain timeout and is cut
+	tunnel, conn := startTunnel()
+	defer conn.Close()
+	start := time.Now()
+	if cut := tunnel.Stop(); cut != 1 {
+		t.Fatalf("expected 1 connection cut, got %d", cut)
+	}
+	if time.Since(start) < time.Second {
+		t.Fatal("the connection should be given the drain timeout")
+	}
+	if _, err := net.Dial("tcp", tunnel.GetListenerAddr().String()); err == nil {
+		t.Fatal("the listener should be closed")
+	}
+
+	// the connection completes while draining
+	tunnel, conn = startTunnel()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		conn.Close()
+	}()
+	if cut := tunnel.Stop(); cut != 0 {
+		t.Fatalf("expected no connections cut, got %d", cut)
+	}
 }
@@ -0,0 +1,242 @@
+package tun
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ferama/rospo/pkg/rio"
+	"github.com/ferama/rospo/pkg/sshc"
+)
+
+// how long a udp session is kept open without any datagram
+// in either direction
+const udpSessionTimeout = 2 * time.Minute
+
+// how many datagrams of a client can wait to be sent through its ssh
+// channel. The datagrams exceeding it are dropped
+const udpSessionQueueSize = 64
+
+// udpSession carries the datagrams of a single local udp client
+// through a dedicated ssh channel
+type udpSession struct {
+	// the datagrams received from the client, waiting to be sent
+	queue chan []byte
+	// closed when the session is closed
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex
+	// nil until the ssh channel is open
+	conn         *sshc.UdpConn
+	lastActivity time.Time
+}
+
+func newUdpSession() *udpSession {
+	return &udpSession{
+		queue:        make(chan []byte, udpSessionQueueSize),
+		done:         make(chan struct{}),
+		lastActivity: time.Now(),
+	}
+}
+
+func (s *udpSession) touch() {
+	s.mu.Lock()
+	s.lastActivity = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *udpSession) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastActivity) > udpSessionTimeout
+}
+
+// setConn sets the ssh channel of the session. It returns false, and
+// closes conn, if the session was closed in the meantime
+func (s *udpSession) setConn(conn *sshc.UdpConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		conn.Close()
+		return false
+	default:
+	}
+	s.conn = conn
+	return true
+}
+
+// close closes the session and its ssh channel
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		close(s.done)
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	})
+}
+
+// listenLocalUdp starts a local udp listener. The datagrams of each
+// client address are sent through an ssh channel to the remote endpoint,
+// where the server emits them from a udp socket. Replies are carried back
+func (t *Tunnel) listenLocalUdp() error {
+	addr, err := t.localListenAddress()
+	if err != nil {
+		t.log.Errorf("udp listener error. %s\n", err)
+		t.setError(err)
+		return err
+	}
+	pconn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.log.Errorf("udp listener error. %s\n", err)
+		t.setError(err)
+		return err
+	}
+	defer pconn.Close()
+
+	t.listenerMU.Lock()
+	t.packetConn = pconn
+	t.listenerMU.Unlock()
+	t.setListening(true)
+	t.reportListener()
+
+	done := make(chan struct{})
+	defer close(done)
+	go t.expireUdpSessions(done)
+
+	// stop reading datagrams when the ssh connection is lost. The
+	// tunnel restarts the listener when it is reestablished
+	go func() {
+		t.sshConn.Client.Wait()
+		pconn.Close()
+	}()
+
+	t.log.Printf("udp forward connected. Local: %s <- Remote: %s\n", pconn.LocalAddr(), t.remoteEndpoint.String())
+	buf := make([]byte, rio.MaxDatagramSize)
+	for {
+		n, addr, err := pconn.ReadFrom(buf)
+		if err != nil {
+			t.log.Println("disconnected")
+			t.setError(err)
+			return err
+		}
+		if !t.isSourceAllowed(addr) {
+			continue
+		}
+		t.clientsMapMU.Lock()
+		session, ok := t.udpSessions[addr.String()]
+		if !ok && !t.IsPaused() {
+			session = newUdpSession()
+			t.udpSessions[addr.String()] = session
+			t.stats.accepted.Add(1)
+			go t.serveUdpSession(pconn, addr, session)
+		}
+		t.clientsMapMU.Unlock()
+		if session == nil {
+			continue
+		}
+		session.touch()
+		// the ssh channel writes can block: they are done by the
+		// session, so that a slow client doesn't stall the others
+		select {
+		case session.queue <- append([]byte(nil), buf[:n]...):
+		default:
+			t.log.Debugf("udp queue of %s full, dropping datagram", addr)
+		}
+	}
+}
+
+// serveUdpSession opens the ssh channel of the local client at addr and
+// sends its datagrams. A failure drops the client only
+func (t *Tunnel) serveUdpSession(pconn net.PacketConn, addr net.Addr, session *udpSession) {
+	conn, err := t.sshConn.DialUDP(t.remoteEndpoint.String())
+	if err != nil {
+		t.log.Errorf("udp forward error for %s. %s\n", addr, err)
+		t.setError(err)
+		t.removeUdpSession(addr, session)
+		return
+	}
+	if !session.setConn(conn) {
+		return
+	}
+	go t.udpReplies(pconn, addr, session)
+
+	for {
+		select {
+		case <-session.done:
+			return
+		case datagram := <-session.queue:
+			if _, err := conn.Write(datagram); err != nil {
+				t.log.Errorf("udp forward write error. %s\n", err)
+				continue
+			}
+			t.countIn(len(datagram))
+		}
+	}
+}
+
+// removeUdpSession closes session and removes it from the tunnel sessions
+func (t *Tunnel) removeUdpSession(addr net.Addr, session *udpSession) {
+	session.close()
+	t.clientsMapMU.Lock()
+	if t.udpSessions[addr.String()] == session {
+		delete(t.udpSessions, addr.String())
+	}
+	t.clientsMapMU.Unlock()
+}
+
+// udpReplies sends the datagrams coming from the remote endpoint
+// back to the local client at addr
+func (t *Tunnel) udpReplies(pconn net.PacketConn, addr net.Addr, session *udpSession) {
+	defer t.removeUdpSession(addr, session)
+
+	pooled := rio.GetBuffer(rio.MaxDatagramSize)
+	defer rio.PutBuffer(pooled)
+	buf := *pooled
+	for {
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		session.touch()
+		t.waitOut(n)
+		if _, err := pconn.WriteTo(buf[:n], addr); err != nil {
+			return
+		}
+		t.countOut(n)
+	}
+}
+
+// expireUdpSessions closes the idle udp sessions until done is closed
+func (t *Tunnel) expireUdpSessions(done chan struct{}) {
+	ticker := time.NewTicker(udpSessionTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			t.closeUdpSessions()
+			return
+		case <-ticker.C:
+			t.clientsMapMU.Lock()
+			for _, s := range t.udpSessions {
+				if s.idle() {
+					// udpReplies removes it from the sessions
+					s.close()
+				}
+			}
+			t.clientsMapMU.Unlock()
+		}
+	}
+}
+
+func (t *Tunnel) closeUdpSessions() {
+	t.clientsMapMU.Lock()
+	defer t.clientsMapMU.Unlock()
+	for k, s := range t.udpSessions {
+		s.close()
+		delete(t.udpSessions, k)
+	}
+}
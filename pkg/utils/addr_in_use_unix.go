@@ -0,0 +1,14 @@
+//go:build !windows
+
+package utils
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IsAddrInUse returns true if err is a listen failure caused by an
+// address already in use
+func IsAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
@@ -0,0 +1,13 @@
+package utils
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// IsAddrInUse returns true if err is a listen failure caused by an
+// address already in use
+func IsAddrInUse(err error) bool {
+	return errors.Is(err, windows.WSAEADDRINUSE)
+}
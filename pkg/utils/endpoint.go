@@ -2,25 +2,178 @@ package utils
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 )
 
+// The endpoint schemes, like "udp://host:port". They are the endpoint
+// networks, as used by net.Dial
+const (
+	SCHEME_TCP  = "tcp"
+	SCHEME_UDP  = "udp"
+	SCHEME_UNIX = "unix"
+)
+
+// unixPrefix explicitly marks an endpoint as a unix socket path, like
+// the unix:// scheme
+const unixPrefix = "unix:"
+
 // Endpoint holds the tunnel endpoint details
 type Endpoint struct {
-	Host string
-	Port int
+	// the scheme the endpoint was given with, if any. See Network
+	Scheme string `json:",omitempty"`
+	Host   string
+	Port   int
+	// the unix socket path. If set, Host and Port are unused
+	Path string `json:",omitempty"`
+}
+
+// SplitScheme splits the scheme, like tcp, udp or unix, from the address
+// of an endpoint. The scheme is empty if not given. The legacy "unix:"
+// prefix is the unix scheme too. The ssh:// urls are not split
+func SplitScheme(s string) (scheme string, address string) {
+	if scheme, address, ok := strings.Cut(s, "://"); ok && scheme+"://" != SSHScheme {
+		return strings.ToLower(scheme), address
+	}
+	if strings.HasPrefix(s, unixPrefix) {
+		return SCHEME_UNIX, strings.TrimPrefix(s, unixPrefix)
+	}
+	return "", s
 }
 
-// NewEndpoint builds an Endpoint object
+// NewEndpoint builds an Endpoint object. An endpoint can be prefixed by
+// its scheme, like "udp://host:port" or "unix:///run/app.sock". Without
+// the scheme, absolute paths and strings prefixed by "unix:" describe
+// unix socket endpoints, the others tcp ones
 func NewEndpoint(s string) *Endpoint {
-	parsed := ParseSSHUrl(s)
+	scheme, address := SplitScheme(s)
+	if scheme == SCHEME_UNIX || (scheme == "" && strings.HasPrefix(address, "/")) {
+		return &Endpoint{Scheme: scheme, Path: address}
+	}
+	parsed := ParseSSHUrl(address)
 	e := &Endpoint{
-		Host: parsed.Host,
-		Port: parsed.Port,
+		Scheme: scheme,
+		Host:   parsed.Host,
+		Port:   parsed.Port,
 	}
 	return e
 }
 
+// IsUnix returns true if the endpoint is a unix socket
+func (endpoint *Endpoint) IsUnix() bool {
+	return endpoint.Path != ""
+}
+
+// Network returns the endpoint network, as used by net.Dial: the scheme
+// if given, unix for the socket paths and tcp otherwise
+func (endpoint *Endpoint) Network() string {
+	if endpoint.Scheme != "" {
+		return endpoint.Scheme
+	}
+	if endpoint.IsUnix() {
+		return SCHEME_UNIX
+	}
+	return SCHEME_TCP
+}
+
+// URL returns the endpoint with its scheme, like "udp://127.0.0.1:53"
+func (endpoint *Endpoint) URL() string {
+	return endpoint.Network() + "://" + endpoint.String()
+}
+
+// Dial connects to the endpoint from the local machine
+func (endpoint *Endpoint) Dial() (net.Conn, error) {
+	return net.Dial(endpoint.Network(), endpoint.String())
+}
+
+// Listen listens on a tcp endpoint, or on a unix socket one with the perm
+// permissions, see ListenUnix. The udp endpoints use ListenPacket
+func (endpoint *Endpoint) Listen(perm os.FileMode) (net.Listener, error) {
+	switch endpoint.Network() {
+	case SCHEME_TCP:
+		return net.Listen(SCHEME_TCP, endpoint.String())
+	case SCHEME_UNIX:
+		return ListenUnix(endpoint.Path, perm)
+	}
+	return nil, fmt.Errorf("can't listen for connections on the %s endpoint %s", endpoint.Network(), endpoint)
+}
+
+// ListenPacket listens on a udp endpoint
+func (endpoint *Endpoint) ListenPacket() (net.PacketConn, error) {
+	if endpoint.Network() != SCHEME_UDP {
+		return nil, fmt.Errorf("can't listen for datagrams on the %s endpoint %s", endpoint.Network(), endpoint)
+	}
+	return net.ListenPacket(SCHEME_UDP, endpoint.String())
+}
+
 // String returns the string representation of the endpoint
 func (endpoint *Endpoint) String() string {
-	return fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
+	if endpoint.IsUnix() {
+		return endpoint.Path
+	}
+	return net.JoinHostPort(endpoint.Host, strconv.Itoa(endpoint.Port))
+}
+
+// ValidateEndpoint returns an error if s is not a valid endpoint, like
+// "host:port", ":port", "user@host:port", "[ipv6]:port", an ssh:// url
+// or a unix socket path, optionally prefixed by the tcp://, udp:// or
+// unix:// scheme
+func ValidateEndpoint(s string) error {
+	scheme, address := SplitScheme(s)
+	switch scheme {
+	case "", SCHEME_TCP, SCHEME_UDP:
+	case SCHEME_UNIX:
+		if address == "" {
+			return fmt.Errorf("invalid endpoint '%s': empty socket path", s)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid endpoint '%s': unknown scheme '%s', use tcp, udp or unix", s, scheme)
+	}
+	if address == "" {
+		return fmt.Errorf("empty endpoint")
+	}
+	if strings.HasPrefix(address, "/") {
+		if scheme != "" {
+			return fmt.Errorf("invalid endpoint '%s': a %s endpoint is a host:port address", s, scheme)
+		}
+		return nil
+	}
+	host := address
+	if strings.HasPrefix(address, SSHScheme) {
+		u, err := parseSchemeUrl(address)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint '%s': %s", s, err)
+		}
+		host = u.Host
+	} else if idx := strings.LastIndex(address, "@"); idx >= 0 {
+		host = address[idx+1:]
+	}
+	_, portString, hasPort, err := splitHostPort(host)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint '%s': %s", s, err)
+	}
+	if hasPort {
+		port, err := strconv.Atoi(portString)
+		if err != nil || port < 0 || port > 65535 {
+			return fmt.Errorf("invalid endpoint '%s': bad port '%s'", s, portString)
+		}
+	}
+	return nil
+}
+
+// IsLoopback returns true if the listen address is bound to the loopback
+// interface
+func IsLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
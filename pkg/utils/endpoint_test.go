@@ -1,6 +1,9 @@
 package utils
 
-import "testing"
+import (
+	"path/filepath"
+	"testing"
+)
 
 func TestEndpoint(t *testing.T) {
 	val := "localhost:2222"
@@ -13,3 +16,119 @@ func TestEndpoint(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestIPv6Endpoint(t *testing.T) {
+	for val, expected := range map[string]string{
+		"[2001:db8::1]:2222": "[2001:db8::1]:2222",
+		"user@[::1]:22":      "[::1]:22",
+		"[::1]":              "[::1]:22",
+		"2001:db8::1":        "[2001:db8::1]:22",
+	} {
+		e := NewEndpoint(val)
+		if e.String() != expected {
+			t.Fatalf("unexpected endpoint %s for %s", e, val)
+		}
+	}
+}
+
+func TestUnixEndpoint(t *testing.T) {
+	for _, val := range []string{"/var/run/app.sock", "unix:/var/run/app.sock"} {
+		e := NewEndpoint(val)
+		if !e.IsUnix() || e.Network() != "unix" || e.String() != "/var/run/app.sock" {
+			t.Fatalf("unexpected endpoint %+v for %s", e, val)
+		}
+	}
+	if NewEndpoint("localhost:2222").Network() != "tcp" {
+		t.Fail()
+	}
+}
+
+func TestSchemeEndpoint(t *testing.T) {
+	for val, expected := range map[string]string{
+		"tcp://localhost:2222":    "tcp://localhost:2222",
+		"udp://[::1]:53":          "udp://[::1]:53",
+		"UDP://127.0.0.1:53":      "udp://127.0.0.1:53",
+		"unix:///run/app.sock":    "unix:///run/app.sock",
+		"unix:/run/app.sock":      "unix:///run/app.sock",
+		"/run/app.sock":           "unix:///run/app.sock",
+		"localhost:2222":          "tcp://localhost:2222",
+		"ssh://user@host:2222":    "tcp://host:2222",
+		"udp://user@10.0.0.1:161": "udp://10.0.0.1:161",
+	} {
+		if e := NewEndpoint(val); e.URL() != expected {
+			t.Fatalf("unexpected url %s for %s", e.URL(), val)
+		}
+	}
+	if e := NewEndpoint("localhost:2222"); e.Scheme != "" {
+		t.Fatalf("unexpected scheme %s", e.Scheme)
+	}
+}
+
+func TestEndpointListen(t *testing.T) {
+	e := NewEndpoint("tcp://127.0.0.1:0")
+	l, err := e.Listen(0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := NewEndpoint(l.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	sock := NewEndpoint("unix://" + filepath.Join(t.TempDir(), "app.sock"))
+	ul, err := sock.Listen(0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+	if conn, err = sock.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	u := NewEndpoint("udp://127.0.0.1:0")
+	if _, err := u.Listen(0600); err == nil {
+		t.Fatal("the udp endpoints can't accept connections")
+	}
+	pconn, err := u.ListenPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	if _, err := e.ListenPacket(); err == nil {
+		t.Fatal("the tcp endpoints can't listen for datagrams")
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	for _, val := range []string{"localhost:2222", ":8080", "user@host:22", "host", "/var/run/app.sock", "unix:/tmp/a.sock",
+		"[::1]:22", "user@[2001:db8::1]:2222", "[::1]", "2001:db8::1",
+		"tcp://host:22", "udp://:53", "UDP://[::1]:53", "unix:///tmp/a.sock"} {
+		if err := ValidateEndpoint(val); err != nil {
+			t.Fatalf("%s should be valid: %s", val, err)
+		}
+	}
+	for _, val := range []string{"", "host:port", "host:70000", "a:b:c", "unix:", "[::1", "[::1]22", "[::1]:port", "2001:db8::1:port",
+		"http://host:80", "udp:///tmp/a.sock", "tcp://", "unix://", "udp://host:port"} {
+		if err := ValidateEndpoint(val); err == nil {
+			t.Fatalf("%s should be invalid", val)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"127.0.0.1:8090": true,
+		"localhost:8090": true,
+		"[::1]:8090":     true,
+		":8090":          false,
+		"0.0.0.0:8090":   false,
+		"10.0.0.1:8090":  false,
+	} {
+		if IsLoopback(addr) != expected {
+			t.Fatalf("unexpected result for %s", addr)
+		}
+	}
+}
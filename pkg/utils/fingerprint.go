@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The fingerprint hash algorithms, like the ssh-keygen -E ones
+const (
+	FINGERPRINT_SHA256 = "sha256"
+	FINGERPRINT_MD5    = "md5"
+)
+
+// the randomart field size, like the OpenSSH one
+const (
+	randomArtWidth  = 17
+	randomArtHeight = 9
+)
+
+// the randomart symbols, from the least to the most visited cell. The last
+// two mark the start and the end of the walk
+const randomArtSymbols = " .o+=*BOX@%&#/^SE"
+
+// fingerprintDigest returns the hash of the key and the algorithm name, as
+// shown by OpenSSH
+func fingerprintDigest(key ssh.PublicKey, hash string) ([]byte, string, error) {
+	switch strings.ToLower(hash) {
+	case FINGERPRINT_SHA256:
+		sum := sha256.Sum256(key.Marshal())
+		return sum[:], "SHA256", nil
+	case FINGERPRINT_MD5:
+		sum := md5.Sum(key.Marshal())
+		return sum[:], "MD5", nil
+	}
+	return nil, "", fmt.Errorf("unknown fingerprint hash '%s', use sha256 or md5", hash)
+}
+
+// Fingerprint returns the fingerprint of key like OpenSSH does, as
+// "SHA256:base64" or "MD5:hex:pairs"
+func Fingerprint(key ssh.PublicKey, hash string) (string, error) {
+	digest, name, err := fingerprintDigest(key, hash)
+	if err != nil {
+		return "", err
+	}
+	if name == "SHA256" {
+		return ssh.FingerprintSHA256(key), nil
+	}
+	pairs := []string{}
+	for _, b := range digest {
+		pairs = append(pairs, hex.EncodeToString([]byte{b}))
+	}
+	return "MD5:" + strings.Join(pairs, ":"), nil
+}
+
+// keyTypeAndSize returns the key type and size as shown by OpenSSH, like
+// "ED25519" and 256. The size is 0 if unknown
+func keyTypeAndSize(key ssh.PublicKey) (string, int) {
+	suffix := ""
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+		suffix = "-CERT"
+	}
+	name := ""
+	switch t := key.Type(); {
+	case t == ssh.KeyAlgoRSA:
+		name = "RSA"
+	case t == ssh.KeyAlgoDSA:
+		name = "DSA"
+	case t == ssh.KeyAlgoED25519:
+		name = "ED25519"
+	case t == ssh.KeyAlgoSKED25519:
+		name = "ED25519-SK"
+	case t == ssh.KeyAlgoSKECDSA256:
+		name = "ECDSA-SK"
+	case strings.HasPrefix(t, "ecdsa-"):
+		name = "ECDSA"
+	default:
+		name = strings.ToUpper(t)
+	}
+	size := 0
+	switch name {
+	case "ED25519", "ED25519-SK", "ECDSA-SK":
+		size = 256
+	default:
+		if ck, ok := key.(ssh.CryptoPublicKey); ok {
+			switch pub := ck.CryptoPublicKey().(type) {
+			case *dsa.PublicKey:
+				size = pub.P.BitLen()
+			case *rsa.PublicKey:
+				size = pub.N.BitLen()
+			case *ecdsa.PublicKey:
+				size = pub.Curve.Params().BitSize
+			}
+		}
+	}
+	return name + suffix, size
+}
+
+// clamp limits v to the [0, max] range
+func clamp(v int, max int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// randomArtBorder returns a border line with label centered in it
+func randomArtBorder(label string) string {
+	if len(label) > randomArtWidth {
+		label = ""
+	}
+	left := (randomArtWidth - len(label)) / 2
+	return "+" + strings.Repeat("-", left) + label + strings.Repeat("-", randomArtWidth-left-len(label)) + "+"
+}
+
+// RandomArt returns the OpenSSH randomart image of key, as printed by
+// ssh-keygen -lv, computed on its hash fingerprint. The image is the walk
+// of a bishop, moved by the fingerprint bits, so that the different keys
+// are easy to tell apart at a glance
+func RandomArt(key ssh.PublicKey, hash string) (string, error) {
+	digest, name, err := fingerprintDigest(key, hash)
+	if err != nil {
+		return "", err
+	}
+	var field [randomArtWidth][randomArtHeight]int
+	start := len(randomArtSymbols) - 2
+	end := len(randomArtSymbols) - 1
+	x, y := randomArtWidth/2, randomArtHeight/2
+	for _, b := range digest {
+		for i := 0; i < 4; i++ {
+			if b&0x1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if b&0x2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			x = clamp(x, randomArtWidth-1)
+			y = clamp(y, randomArtHeight-1)
+			if field[x][y] < start-1 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[randomArtWidth/2][randomArtHeight/2] = start
+	field[x][y] = end
+
+	keyType, size := keyTypeAndSize(key)
+	title := fmt.Sprintf("[%s %d]", keyType, size)
+	if size == 0 || len(title) > randomArtWidth {
+		title = "[" + keyType + "]"
+	}
+	lines := []string{randomArtBorder(title)}
+	for row := 0; row < randomArtHeight; row++ {
+		var sb strings.Builder
+		sb.WriteString("|")
+		for col := 0; col < randomArtWidth; col++ {
+			sb.WriteByte(randomArtSymbols[field[col][row]])
+		}
+		sb.WriteString("|")
+		lines = append(lines, sb.String())
+	}
+	lines = append(lines, randomArtBorder("["+name+"]"))
+	return strings.Join(lines, "\n"), nil
+}
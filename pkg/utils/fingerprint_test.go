@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestFingerprint(t *testing.T) {
+	data, err := os.ReadFile("testdata/identity.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the expected values are the ssh-keygen -lv ones
+	for hash, expected := range map[string]string{
+		FINGERPRINT_SHA256: "SHA256:AzGNSPB+oSsqLoScO5iwQU8GpWECp4cwZAaGwXliPSU",
+		FINGERPRINT_MD5:    "MD5:64:6a:85:9b:f3:c3:27:5f:83:4f:1d:ef:72:cf:7a:ee",
+	} {
+		if fp, err := Fingerprint(key, hash); err != nil || fp != expected {
+			t.Fatalf("unexpected %s fingerprint %s: %v", hash, fp, err)
+		}
+	}
+	if _, err := Fingerprint(key, "sha1"); err == nil {
+		t.Fatal("sha1 should be rejected")
+	}
+
+	for hash, expected := range map[string]string{
+		FINGERPRINT_SHA256: `+---[RSA 4096]----+
+|&O*Eoooo         |
+|O@o=o .o.        |
+|+.= o o          |
+| o + . o         |
+|+ = o . S        |
+|++ . o   .       |
+|++o .            |
+|*+ .             |
+|=..              |
++----[SHA256]-----+`,
+		FINGERPRINT_MD5: `+---[RSA 4096]----+
+|                 |
+|       .         |
+|      . +        |
+|       B         |
+|      * S     .  |
+|     . +   . . o |
+|        = o + . .|
+|         = + ..oo|
+|          . . .BE|
++------[MD5]------+`,
+	} {
+		if art, err := RandomArt(key, hash); err != nil || art != expected {
+			t.Fatalf("unexpected %s randomart:\n%s\n%v", hash, art, err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The supported private key formats
+const (
+	// the OpenSSH new format, the ssh-keygen default
+	KEY_FORMAT_OPENSSH = "openssh"
+	// PKCS#1 for rsa keys, SEC 1 for ecdsa keys
+	KEY_FORMAT_PEM   = "pem"
+	KEY_FORMAT_PKCS8 = "pkcs8"
+)
+
+// The supported public key formats
+const (
+	PUBKEY_FORMAT_AUTHORIZED_KEYS = "authorized_keys"
+	PUBKEY_FORMAT_RFC4716         = "rfc4716"
+)
+
+// the bcrypt_pbkdf rounds of the encrypted OpenSSH keys, like ssh-keygen
+const opensshKdfRounds = 16
+
+// IsEncryptedKey tells if the private key data is protected by a passphrase
+func IsEncryptedKey(data []byte) bool {
+	_, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	return errors.As(err, &missing)
+}
+
+// ParsePrivateKey parses a private key in any of the supported formats,
+// decrypting it with passphrase if not empty
+func ParsePrivateKey(data []byte, passphrase []byte) (crypto.Signer, error) {
+	var key any
+	var err error
+	if len(passphrase) == 0 {
+		key, err = ssh.ParseRawPrivateKey(data)
+	} else {
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	case *ed25519.PrivateKey:
+		return *k, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// EncodePrivateKey encodes a private key (rsa, ecdsa or ed25519) in the
+// format, encrypted with passphrase if not empty. The comment is stored by
+// the openssh format only
+func EncodePrivateKey(key crypto.Signer, format string, comment string, passphrase []byte) ([]byte, error) {
+	switch format {
+	case KEY_FORMAT_OPENSSH:
+		return encodeOpenSSHPrivateKey(key, comment, passphrase)
+	case KEY_FORMAT_PKCS8:
+		if len(passphrase) != 0 {
+			return nil, fmt.Errorf("the pkcs8 keys can't be encrypted, use the openssh or the pem format")
+		}
+		return EncodePrivateKeyToPKCS8PEM(key)
+	case KEY_FORMAT_PEM:
+		var block *pem.Block
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		case *ecdsa.PrivateKey:
+			der, err := x509.MarshalECPrivateKey(k)
+			if err != nil {
+				return nil, err
+			}
+			block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+		default:
+			return nil, fmt.Errorf("only the rsa and ecdsa keys can be encoded as pem, use the openssh or the pkcs8 format")
+		}
+		if len(passphrase) != 0 {
+			var err error
+			// the legacy OpenSSL encryption, the only one of the pem keys
+			block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, passphrase, x509.PEMCipherAES256)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return pem.EncodeToMemory(block), nil
+	}
+	return nil, fmt.Errorf("unsupported key format '%s'", format)
+}
+
+// encodeOpenSSHPrivateKey encodes a private key in the OpenSSH new format,
+// encrypted with aes256-ctr if passphrase is not empty. See
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+func encodeOpenSSHPrivateKey(key crypto.Signer, comment string, passphrase []byte) ([]byte, error) {
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	var keyFields []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return nil, fmt.Errorf("the multi prime rsa keys are not supported")
+		}
+		p, q := k.Primes[0], k.Primes[1]
+		keyFields = ssh.Marshal(struct {
+			N    *big.Int
+			E    *big.Int
+			D    *big.Int
+			Iqmp *big.Int
+			P    *big.Int
+			Q    *big.Int
+		}{k.N, big.NewInt(int64(k.E)), k.D, new(big.Int).ModInverse(q, p), p, q})
+	case *ecdsa.PrivateKey:
+		keyFields = ssh.Marshal(struct {
+			Curve string
+			Pub   []byte
+			D     *big.Int
+		}{
+			fmt.Sprintf("nistp%d", k.Curve.Params().BitSize),
+			elliptic.Marshal(k.Curve, k.X, k.Y),
+			k.D,
+		})
+	case ed25519.PrivateKey:
+		keyFields = ssh.Marshal(struct {
+			Pub  []byte
+			Priv []byte
+		}{k.Public().(ed25519.PublicKey), k})
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	cipherName, kdfName, kdfOpts, blockSize := "none", "none", "", 8
+	var salt []byte
+	if len(passphrase) != 0 {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		cipherName, kdfName, blockSize = "aes256-ctr", "bcrypt", aes.BlockSize
+		kdfOpts = string(ssh.Marshal(struct {
+			Salt   []byte
+			Rounds uint32
+		}{salt, opensshKdfRounds}))
+	}
+
+	// the check ints, to verify the passphrase on decryption
+	check := make([]byte, 4)
+	if _, err := rand.Read(check); err != nil {
+		return nil, err
+	}
+	checkInt := binary.BigEndian.Uint32(check)
+	block := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Rest    []byte `ssh:"rest"`
+	}{checkInt, checkInt, pub.Type(), keyFields})
+	block = append(block, ssh.Marshal(struct{ Comment string }{comment})...)
+	for i := 1; len(block)%blockSize != 0; i++ {
+		block = append(block, byte(i))
+	}
+
+	if len(passphrase) != 0 {
+		k, err := bcryptPbkdfKey(passphrase, salt, opensshKdfRounds, 32+aes.BlockSize)
+		if err != nil {
+			return nil, err
+		}
+		c, err := aes.NewCipher(k[:32])
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCTR(c, k[32:]).XORKeyStream(block, block)
+	}
+
+	data := []byte("openssh-key-v1\x00")
+	data = append(data, ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{cipherName, kdfName, kdfOpts, 1, pub.Marshal(), block})...)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: data}), nil
+}
+
+// EncodePublicKey encodes a public key in the format, with the comment if
+// not empty
+func EncodePublicKey(key ssh.PublicKey, format string, comment string) ([]byte, error) {
+	switch format {
+	case PUBKEY_FORMAT_AUTHORIZED_KEYS:
+		line := SerializePublicKey(key)
+		if comment != "" {
+			line += " " + comment
+		}
+		return []byte(line + "\n"), nil
+	case PUBKEY_FORMAT_RFC4716:
+		var buf bytes.Buffer
+		buf.WriteString("---- BEGIN SSH2 PUBLIC KEY ----\n")
+		if comment != "" {
+			fmt.Fprintf(&buf, "Comment: \"%s\"\n", strings.ReplaceAll(comment, `"`, `\"`))
+		}
+		// the lines are at most 72 bytes long
+		encoded := base64.StdEncoding.EncodeToString(key.Marshal())
+		for len(encoded) > 70 {
+			buf.WriteString(encoded[:70] + "\n")
+			encoded = encoded[70:]
+		}
+		buf.WriteString(encoded + "\n")
+		buf.WriteString("---- END SSH2 PUBLIC KEY ----\n")
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported public key format '%s'", format)
+}
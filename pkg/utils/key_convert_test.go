@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConvertKeys(t *testing.T) {
+	for _, keyType := range []string{KEY_TYPE_RSA, KEY_TYPE_ECDSA, KEY_TYPE_ED25519} {
+		key, err := GenerateKeyOfType(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, _ := ssh.NewPublicKey(key.Public())
+
+		for _, format := range []string{KEY_FORMAT_OPENSSH, KEY_FORMAT_PEM, KEY_FORMAT_PKCS8} {
+			for _, passphrase := range []string{"", "secret"} {
+				data, err := EncodePrivateKey(key, format, "comment", []byte(passphrase))
+				if keyType == KEY_TYPE_ED25519 && format == KEY_FORMAT_PEM ||
+					format == KEY_FORMAT_PKCS8 && passphrase != "" {
+					if err == nil {
+						t.Fatalf("%s %s with passphrase %q should not be supported", keyType, format, passphrase)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s %s: %s", keyType, format, err)
+				}
+				if IsEncryptedKey(data) != (passphrase != "") {
+					t.Fatalf("%s %s: wrong encrypted state", keyType, format)
+				}
+				parsed, err := ParsePrivateKey(data, []byte(passphrase))
+				if err != nil {
+					t.Fatalf("%s %s: %s", keyType, format, err)
+				}
+				parsedPub, _ := ssh.NewPublicKey(parsed.Public())
+				if !bytes.Equal(parsedPub.Marshal(), pub.Marshal()) {
+					t.Fatalf("%s %s: the key changed", keyType, format)
+				}
+				// the key must be usable by the ssh client
+				if passphrase == "" {
+					if _, err := ssh.ParsePrivateKey(data); err != nil {
+						t.Fatalf("%s %s: %s", keyType, format, err)
+					}
+				} else if _, err := ParsePrivateKey(data, []byte("wrong")); err == nil {
+					t.Fatalf("%s %s: decrypted with the wrong passphrase", keyType, format)
+				}
+			}
+		}
+
+		line, err := EncodePublicKey(pub, PUBKEY_FORMAT_AUTHORIZED_KEYS, "me@host")
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, comment, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil || comment != "me@host" || !bytes.Equal(parsed.Marshal(), pub.Marshal()) {
+			t.Fatalf("%s: bad authorized_keys line %q", keyType, line)
+		}
+
+		rfc, err := EncodePublicKey(pub, PUBKEY_FORMAT_RFC4716, "me@host")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(rfc)), "\n")
+		if lines[0] != "---- BEGIN SSH2 PUBLIC KEY ----" || lines[1] != `Comment: "me@host"` ||
+			lines[len(lines)-1] != "---- END SSH2 PUBLIC KEY ----" {
+			t.Fatalf("%s: bad rfc4716 key\n%s", keyType, rfc)
+		}
+		for _, l := range lines {
+			if len(l) > 72 {
+				t.Fatalf("%s: rfc4716 line longer than 72 bytes: %s", keyType, l)
+			}
+		}
+	}
+}
+
+func TestConvertIdentity(t *testing.T) {
+	data, err := os.ReadFile("testdata/identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParsePrivateKey(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EncodePrivateKey(key, KEY_FORMAT_OPENSSH, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EncodePrivateKey(key, "ppk", "", nil); err == nil {
+		t.Fatal("unsupported format accepted")
+	}
+}
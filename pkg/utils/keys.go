@@ -1,6 +1,10 @@
 package utils
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -12,8 +16,8 @@ import (
 	"os/user"
 	"path/filepath"
 
+	"github.com/ferama/rospo/pkg/knownhosts"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // GeneratePrivateKey generate an rsa key (actually used from the sshd server)
@@ -55,6 +59,56 @@ func GeneratePublicKey(key *rsa.PublicKey) ([]byte, error) {
 	return pubKeyBytes, nil
 }
 
+// GenerateEd25519PrivateKey generates an ed25519 key (used for the sshd host key)
+func GenerateEd25519PrivateKey() (ed25519.PrivateKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	return privateKey, err
+}
+
+// The supported private key types
+const (
+	KEY_TYPE_RSA     = "rsa"
+	KEY_TYPE_ECDSA   = "ecdsa"
+	KEY_TYPE_ED25519 = "ed25519"
+)
+
+// GenerateKeyOfType generates a private key of the given type
+func GenerateKeyOfType(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KEY_TYPE_RSA:
+		return GeneratePrivateKey()
+	case KEY_TYPE_ECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KEY_TYPE_ED25519:
+		return GenerateEd25519PrivateKey()
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", keyType)
+}
+
+// EncodePrivateKeyToPKCS8PEM converts a private key object (rsa, ecdsa or ed25519)
+// to a PKCS#8 PEM block
+func EncodePrivateKeyToPKCS8PEM(privateKey crypto.PrivateKey) ([]byte, error) {
+	privDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	privBlock := pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privDER,
+	}
+	return pem.EncodeToMemory(&privBlock), nil
+}
+
+// MarshalPublicKey converts a public key object (rsa, ecdsa or ed25519)
+// to the authorized_keys format
+func MarshalPublicKey(key crypto.PublicKey) ([]byte, error) {
+	publicKey, err := ssh.NewPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.MarshalAuthorizedKey(publicKey), nil
+}
+
 // WriteKeyToFile stores a key to the specified path
 func WriteKeyToFile(keyBytes []byte, keyPath string) error {
 	path, _ := ExpandUserHome(keyPath)
@@ -91,20 +145,10 @@ func LoadIdentityFile(file string) (ssh.AuthMethod, error) {
 }
 
 // AddHostKeyToKnownHosts updates user known_hosts file adding the host key
+//
+// Deprecated: use knownhosts.Add
 func AddHostKeyToKnownHosts(host string, key ssh.PublicKey, knownHostsPath string) error {
-	// add host key if host is not found in known_hosts, error object is return, if nil then connection proceeds,
-	// if not nil then connection stops.
-
-	f, fErr := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_WRONLY, 0600)
-	if fErr != nil {
-		return fErr
-	}
-	defer f.Close()
-
-	knownHosts := knownhosts.Normalize(host)
-	out := fmt.Sprintf("%s\n", knownhosts.Line([]string{knownHosts}, key))
-	_, fileErr := f.WriteString(out)
-	return fileErr
+	return knownhosts.Add(knownHostsPath, host, key, false)
 }
 
 // SerializePublicKey converts an ssh.PublicKey to printable bas64 string
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// DefaultSocketPermissions are the permissions of the unix sockets
+// created by ListenUnix if not specified
+const DefaultSocketPermissions = 0600
+
+// ParseSocketPermissions parses unix socket permissions in octal
+// notation. Empty means DefaultSocketPermissions
+func ParseSocketPermissions(s string) (os.FileMode, error) {
+	if s == "" {
+		return DefaultSocketPermissions, nil
+	}
+	p, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid socket permissions '%s': %s", s, err)
+	}
+	return os.FileMode(p), nil
+}
+
+// ListenUnix listens on a unix socket at path, with the perm permissions.
+// A stale socket left by a previous unclean shutdown is removed. The
+// socket file is removed when the listener is closed
+func ListenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket %s is already in use", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,53 @@
+package eventsapi
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/ferama/rospo/pkg/tun"
+	"github.com/gin-gonic/gin"
+)
+
+// the events buffered for each client. The events exceeding it while
+// the client is slow are lost
+const eventsBufferSize = 256
+
+// Routes setup the events api routes
+func Routes(router *gin.RouterGroup) {
+	router.GET("", get)
+}
+
+// get streams the tunnel events as server-sent events, named by the
+// event type. The tunnel query parameter filters the events of a
+// tunnel id
+//
+// Example curl:
+// curl -N http://localhost:8090/api/events?tunnel=1
+func get(c *gin.Context) {
+	tunnelID := -1
+	if param := c.Query("tunnel"); param != "" {
+		id, err := strconv.Atoi(param)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		tunnelID = id
+	}
+
+	events, unsubscribe := tun.Events().Subscribe(eventsBufferSize)
+	defer unsubscribe()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-events:
+			if tunnelID < 0 || e.TunnelID == tunnelID {
+				c.SSEvent(e.Type, e)
+			}
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
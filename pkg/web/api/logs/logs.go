@@ -0,0 +1,36 @@
+package logsapi
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ferama/rospo/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// Routes setup the logs api routes
+func Routes(router *gin.RouterGroup) {
+	router.GET("", get)
+}
+
+// get returns the last log lines, the oldest first. The lines query
+// parameter limits how many
+//
+// Example curl:
+// curl http://localhost:8090/api/logs?lines=50
+func get(c *gin.Context) {
+	lines := logger.Recent()
+	if param := c.Query("lines"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid lines parameter",
+			})
+			return
+		}
+		if n < len(lines) {
+			lines = lines[len(lines)-n:]
+		}
+	}
+	c.JSON(http.StatusOK, lines)
+}
@@ -2,7 +2,9 @@ package tunapi
 
 import (
 	"net"
+	"time"
 
+	"github.com/ferama/rospo/pkg/tun"
 	"github.com/ferama/rospo/pkg/utils"
 )
 
@@ -10,9 +12,47 @@ type tunResponseItem struct {
 	ID               int            `json:"Id"`
 	Listener         net.Addr       `json:"Listener"`
 	IsListenerLocal  bool           `json:"IsListenerLocal"`
+	IsDynamic        bool           `json:"IsDynamic"`
 	Endpoint         utils.Endpoint `json:"Endpoint"`
 	ClientsCount     int            `json:"ClientsCount"`
 	IsStoppable      bool           `json:"IsStoppable"`
 	Throughput       int64          `json:"Throughput"`
 	ThroughputString string         `json:"ThroughputString"`
+
+	Name         string            `json:"Name"`
+	Labels       map[string]string `json:"Labels"`
+	ListenerPort int               `json:"ListenerPort"`
+
+	AcceptedConnections int64         `json:"AcceptedConnections"`
+	BytesIn             int64         `json:"BytesIn"`
+	BytesOut            int64         `json:"BytesOut"`
+	LastError           string        `json:"LastError"`
+	LastErrorTime       time.Time     `json:"LastErrorTime"`
+	Uptime              time.Duration `json:"Uptime"`
+	// the remote endpoints state, for forward tunnels with many
+	Backends []backendResponseItem `json:"Backends,omitempty"`
+}
+
+// backendResponseItem is the state of a load balanced remote endpoint
+type backendResponseItem struct {
+	Endpoint          string `json:"Endpoint"`
+	ActiveConnections int64  `json:"ActiveConnections"`
+	Healthy           bool   `json:"Healthy"`
+}
+
+// setStats fills the item with the tunnel statistics
+func (i *tunResponseItem) setStats(stats tun.Stats) {
+	i.AcceptedConnections = stats.AcceptedConnections
+	i.BytesIn = stats.BytesIn
+	i.BytesOut = stats.BytesOut
+	i.LastError = stats.LastError
+	i.LastErrorTime = stats.LastErrorTime
+	i.Uptime = stats.Uptime
+	for _, b := range stats.Backends {
+		i.Backends = append(i.Backends, backendResponseItem{
+			Endpoint:          b.Endpoint,
+			ActiveConnections: b.ActiveConnections,
+			Healthy:           b.Healthy,
+		})
+	}
 }
@@ -32,16 +32,23 @@ func (r *tunRoutes) get(c *gin.Context) {
 		for id, val := range data {
 			tunnel := val.(*tun.Tunnel)
 			addr := tunnel.GetListenerAddr()
-			res = append(res, tunResponseItem{
+			item := tunResponseItem{
 				ID:               id,
 				Listener:         addr,
 				IsListenerLocal:  tunnel.GetIsListenerLocal(),
+				IsDynamic:        tunnel.GetIsDynamic(),
 				IsStoppable:      tunnel.IsStoppable(),
 				Endpoint:         tunnel.GetEndpoint(),
 				ClientsCount:     tunnel.GetActiveClientsCount(),
 				Throughput:       tunnel.GetCurrentBytesPerSecond(),
 				ThroughputString: utils.ByteCountSI(tunnel.GetCurrentBytesPerSecond()) + "/s",
-			})
+
+				Name:         tunnel.GetName(),
+				Labels:       tunnel.GetLabels(),
+				ListenerPort: tunnel.GetListenerPort(),
+			}
+			item.setStats(tunnel.Stats())
+			res = append(res, item)
 		}
 		c.JSON(http.StatusOK, res)
 
@@ -62,16 +69,23 @@ func (r *tunRoutes) get(c *gin.Context) {
 		}
 		tunnel := val.(*tun.Tunnel)
 		addr := tunnel.GetListenerAddr()
-		c.JSON(http.StatusOK, tunResponseItem{
+		item := tunResponseItem{
 			ID:               tunId,
 			Listener:         addr,
 			IsListenerLocal:  tunnel.GetIsListenerLocal(),
+			IsDynamic:        tunnel.GetIsDynamic(),
 			IsStoppable:      tunnel.IsStoppable(),
 			Endpoint:         tunnel.GetEndpoint(),
 			ClientsCount:     tunnel.GetActiveClientsCount(),
 			Throughput:       tunnel.GetCurrentBytesPerSecond(),
 			ThroughputString: utils.ByteCountSI(tunnel.GetCurrentBytesPerSecond()) + "/s",
-		})
+
+			Name:         tunnel.GetName(),
+			Labels:       tunnel.GetLabels(),
+			ListenerPort: tunnel.GetListenerPort(),
+		}
+		item.setStats(tunnel.Stats())
+		c.JSON(http.StatusOK, item)
 	}
 }
 
@@ -94,8 +108,17 @@ func (r *tunRoutes) delete(c *gin.Context) {
 		return
 	}
 	tunnel := data.(*tun.Tunnel)
-	tunnel.Stop()
-	c.JSON(http.StatusOK, gin.H{})
+	if !tunnel.IsStoppable() {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "the tunnel can't be stopped",
+		})
+		return
+	}
+	// blocks while the connections are drained
+	cut := tunnel.Stop()
+	c.JSON(http.StatusOK, gin.H{
+		"CutConnections": cut,
+	})
 }
 
 // Example curl:
@@ -108,7 +131,27 @@ func (r *tunRoutes) post(c *gin.Context) {
 		})
 		return
 	}
-	tunnel := tun.NewTunnel(r.sshConn, &conf, true)
-	go tunnel.Start()
+	templated, err := conf.ExpandTemplate()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	tunnels := []*tun.TunnelConf{}
+	for _, tc := range templated {
+		expanded, err := tc.ExpandPorts()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		tunnels = append(tunnels, expanded...)
+	}
+	for _, tc := range tunnels {
+		tunnel := tun.NewTunnel(r.sshConn, tc, true)
+		go tunnel.Start()
+	}
 	c.JSON(http.StatusOK, gin.H{})
 }
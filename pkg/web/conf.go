@@ -1,6 +1,28 @@
 package web
 
+// DefaultListenAddress is the web server address when none is set, bound
+// to the loopback interface
+const DefaultListenAddress = "127.0.0.1:8090"
+
 // WebConf holds the rest api server configuration
 type WebConf struct {
 	ListenAddress string `yaml:"listen_address"`
+	// if the password is set, the apis and the ui require the http basic
+	// authentication
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// if the token is set, the apis accept the
+	// "Authorization: Bearer <token>" header too
+	Token string `yaml:"token"`
+	// serves the apis only, without the dashboard
+	DisableUI bool `yaml:"disable_ui"`
+}
+
+// GetListenAddress returns the listen address, DefaultListenAddress
+// if not set
+func (c *WebConf) GetListenAddress() string {
+	if c.ListenAddress == "" {
+		return DefaultListenAddress
+	}
+	return c.ListenAddress
 }
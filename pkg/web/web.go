@@ -1,38 +1,150 @@
 package web
 
 import (
+	"crypto/subtle"
+	_ "embed"
+	"net/http"
+	"strings"
 	"time"
 
+	"github.com/ferama/rospo/pkg/control"
+	"github.com/ferama/rospo/pkg/logger"
 	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/utils"
+	eventsapi "github.com/ferama/rospo/pkg/web/api/events"
+	logsapi "github.com/ferama/rospo/pkg/web/api/logs"
 	rootapi "github.com/ferama/rospo/pkg/web/api/root"
 	tunapi "github.com/ferama/rospo/pkg/web/api/tun"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
+var log = logger.NewLogger("[WEB]  ", logger.Yellow)
+
+// the single page dashboard
+//
+//go:embed ui/index.html
+var indexHTML []byte
+
+// logRequests logs the requests through the package logger, in place
+// of the gin one, so that they follow the logs format
+func logRequests(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	log.With("method", c.Request.Method).
+		With("path", c.Request.URL.Path).
+		With("status", c.Writer.Status()).
+		With("peer", c.ClientIP()).
+		With("duration", time.Since(start).String()).
+		Debugf("%s %s %d %s", c.Request.Method, c.Request.URL.Path, c.Writer.Status(), time.Since(start))
+}
+
+// the context key set on the requests authenticated by the token
+const bearerKey = "bearer"
+
+// authenticate requires the configured token or http basic
+// authentication
+func authenticate(conf *WebConf) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if conf.Token != "" {
+			token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if ok && subtle.ConstantTimeCompare([]byte(token), []byte(conf.Token)) == 1 {
+				c.Set(bearerKey, true)
+				c.Next()
+				return
+			}
+		}
+		if conf.Password != "" {
+			user, pass, ok := c.Request.BasicAuth()
+			if ok &&
+				subtle.ConstantTimeCompare([]byte(user), []byte(conf.Username)) == 1 &&
+				subtle.ConstantTimeCompare([]byte(pass), []byte(conf.Password)) == 1 {
+				c.Next()
+				return
+			}
+			c.Header("WWW-Authenticate", `Basic realm="rospo"`)
+		}
+		c.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+// jsonOnly refuses the POST requests without a json body. The browsers
+// send the other ones cross site, with the cached credentials, without
+// asking first. The token is never sent that way
+func jsonOnly(c *gin.Context) {
+	if c.GetBool(bearerKey) {
+		c.Next()
+		return
+	}
+	if c.Request.Method == http.MethodPost && c.ContentType() != gin.MIMEJSON {
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{
+			"error": "the request body must be json",
+		})
+		return
+	}
+	c.Next()
+}
+
 // StartServer start the rospo web server. The webserver
-// exposes rospo apis and a nice ui at the /
+// exposes rospo apis and a nice ui at the /. The management api of
+// ctrl is served under /api/v1
 func StartServer(isDev bool,
 	sshConn *sshc.SshConnection,
+	ctrl *control.Server,
 	conf *WebConf,
 	info *rootapi.Info) {
 
 	if !isDev {
 		gin.SetMode(gin.ReleaseMode)
 	}
-	r := gin.Default()
+	r := newRouter(sshConn, ctrl, conf, info)
 
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"*"},
-		AllowHeaders:     []string{"Content-Type, Origin"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+	log.Printf("listening on %s", conf.GetListenAddress())
+	if err := r.Run(conf.GetListenAddress()); err != nil {
+		log.Errorf("web server error: %s", err)
+	}
+}
 
-	rootapi.Routes(info, sshConn, r.Group("/api"))
-	tunapi.Routes(sshConn, r.Group("/api/tuns"))
+// newRouter sets up the apis and the ui routes
+func newRouter(sshConn *sshc.SshConnection, ctrl *control.Server, conf *WebConf, info *rootapi.Info) *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Recovery(), logRequests)
 
-	r.Run(conf.ListenAddress)
+	// with the token only, the ui page is public and asks for the token
+	// to query the apis
+	api := r.Group("/api")
+	ui := r.Group("/")
+	if conf.Password != "" || conf.Token != "" {
+		api.Use(authenticate(conf), jsonOnly)
+		if conf.Password != "" {
+			ui.Use(authenticate(conf))
+		}
+	} else {
+		if !utils.IsLoopback(conf.GetListenAddress()) {
+			log.Warnf("the web server listens on %s without authentication", conf.GetListenAddress())
+		}
+		r.Use(cors.New(cors.Config{
+			AllowOrigins:     []string{"*"},
+			AllowMethods:     []string{"*"},
+			AllowHeaders:     []string{"Content-Type, Origin"},
+			ExposeHeaders:    []string{"Content-Length"},
+			AllowCredentials: true,
+			MaxAge:           12 * time.Hour,
+		}))
+	}
+
+	rootapi.Routes(info, sshConn, api)
+	tunapi.Routes(sshConn, api.Group("/tuns"))
+	eventsapi.Routes(api.Group("/events"))
+	logsapi.Routes(api.Group("/logs"))
+	if ctrl != nil {
+		api.Any("/v1/*path", gin.WrapH(http.StripPrefix("/api/v1", ctrl.Handler())))
+	}
+
+	if !conf.DisableUI {
+		ui.GET("/", func(c *gin.Context) {
+			c.Data(http.StatusOK, "text/html; charset=utf-8", indexHTML)
+		})
+	}
+	return r
 }
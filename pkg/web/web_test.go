@@ -0,0 +1,89 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ferama/rospo/pkg/control"
+	rootapi "github.com/ferama/rospo/pkg/web/api/root"
+)
+
+func TestWebAuth(t *testing.T) {
+	conf := &WebConf{Username: "admin", Password: "secret"}
+	r := newRouter(nil, nil, conf, &rootapi.Info{})
+
+	do := func(method, path, contentType string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if auth {
+			req.SetBasicAuth("admin", "secret")
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("GET", "/", "", false); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	w := do("GET", "/", "", true)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<title>rospo</title>") {
+		t.Fatalf("unexpected ui response %d", w.Code)
+	}
+	log.Println("web test line")
+	w = do("GET", "/api/logs?lines=1", "", true)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "web test line") {
+		t.Fatalf("unexpected logs response %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/api/tuns", "text/plain", true); w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+
+	conf.DisableUI = true
+	r = newRouter(nil, nil, conf, &rootapi.Info{})
+	if w := do("GET", "/", "", true); w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+}
+
+func TestWebToken(t *testing.T) {
+	conf := &WebConf{Token: "secret"}
+	r := newRouter(nil, control.NewServer("test", nil, nil), conf, &rootapi.Info{})
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// the ui page is public, the apis are not
+	if w := do("GET", "/", ""); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if w := do("GET", "/api/v1/status", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if w := do("GET", "/api/v1/status", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	w := do("GET", "/api/v1/status", "secret")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"version":"test"`) {
+		t.Fatalf("unexpected status response %d %s", w.Code, w.Body.String())
+	}
+	w = do("GET", "/api/v1/sessions", "secret")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("unexpected sessions response %d %s", w.Code, w.Body.String())
+	}
+	// the tunnels can't be added without a tunnel manager
+	if w := do("POST", "/api/v1/tunnels", "secret"); w.Code != http.StatusNotImplemented {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+}